@@ -0,0 +1,80 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// csvWriter writes the semicolon-separated, decimal-comma CSV that Excel
+// opens correctly in pt-BR, with a UTF-8 BOM.
+type csvWriter struct {
+	w      *csv.Writer
+	cols   []Column
+	sheets int
+}
+
+func newCSV(w io.Writer) (*csvWriter, error) {
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return nil, err
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = ';'
+	return &csvWriter{w: cw}, nil
+}
+
+func (c *csvWriter) Sheet(name string, cols []Column) error {
+	if c.sheets > 0 {
+		if err := c.w.Write([]string{}); err != nil {
+			return err
+		}
+		if err := c.w.Write([]string{name}); err != nil {
+			return err
+		}
+	}
+	c.sheets++
+	c.cols = cols
+	header := make([]string, len(cols))
+	for i, col := range cols {
+		header[i] = col.Header
+	}
+	return c.w.Write(header)
+}
+
+func (c *csvWriter) Row(values ...interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		kind := Text
+		if i < len(c.cols) {
+			kind = c.cols[i].Kind
+		}
+		record[i] = csvValue(kind, v)
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func csvValue(kind Kind, v interface{}) string {
+	switch kind {
+	case Integer, Number, Money, Percent:
+		f, ok := number(v)
+		if !ok {
+			return text(v)
+		}
+		prec := 2
+		if kind == Integer {
+			prec = 0
+		}
+		return strings.Replace(strconv.FormatFloat(f, 'f', prec, 64), ".", ",", 1)
+	case Date:
+		if t, ok := date(v); ok {
+			return t.Format("02/01/2006")
+		}
+	}
+	return text(v)
+}
@@ -0,0 +1,153 @@
+// Package export streams tabular data as XLSX or CSV. Rows are written as
+// they are produced, so a handler can export a whole table straight from
+// sql.Rows without holding it in memory.
+package export
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Supported formats, as accepted in ?format=.
+const (
+	FormatXLSX = "xlsx"
+	FormatCSV  = "csv"
+)
+
+// Kind is the type of a column; it decides how cells are stored and formatted.
+type Kind int
+
+const (
+	Text    Kind = iota
+	Integer      // #.##0
+	Number       // #.##0,00
+	Money        // R$ #.##0,00
+	Percent      // value in percent units: 12.5 is shown as 12,50%
+	Date         // time.Time or a "DD/MM/YYYY" string
+)
+
+// Column describes one column of a sheet. Width is in characters; zero picks
+// a default for the kind.
+type Column struct {
+	Header string
+	Kind   Kind
+	Width  float64
+}
+
+// Writer writes one or more sheets. CSV has no sheets: sections follow each
+// other separated by a blank line, each after the first introduced by its name.
+type Writer interface {
+	// Sheet starts a new sheet with a header row.
+	Sheet(name string, cols []Column) error
+	// Row appends a row to the current sheet. Values are matched to columns
+	// by position: string, int/int64, float64, *float64 (nil is an empty
+	// cell), time.Time or "DD/MM/YYYY" for dates.
+	Row(values ...interface{}) error
+	// Close finishes the file. Nothing is complete before Close.
+	Close() error
+}
+
+// ParseFormat validates a ?format= value.
+func ParseFormat(s string) (string, bool) {
+	switch strings.ToLower(s) {
+	case FormatXLSX:
+		return FormatXLSX, true
+	case FormatCSV:
+		return FormatCSV, true
+	}
+	return "", false
+}
+
+// ContentType returns the MIME type of format.
+func ContentType(format string) string {
+	if format == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+}
+
+// New returns a Writer for format that writes to w.
+func New(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case FormatXLSX:
+		return newXLSX(w), nil
+	case FormatCSV:
+		return newCSV(w)
+	}
+	return nil, fmt.Errorf("formato de exportação não suportado: %q", format)
+}
+
+// number converts a numeric cell value; ok is false for empty cells.
+func number(v interface{}) (f float64, ok bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case *float64:
+		if n == nil {
+			return 0, false
+		}
+		return *n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case *int64:
+		if n == nil {
+			return 0, false
+		}
+		return float64(*n), true
+	}
+	return 0, false
+}
+
+// date converts a date cell value; ok is false for empty or unparseable cells.
+func date(v interface{}) (t time.Time, ok bool) {
+	switch d := v.(type) {
+	case time.Time:
+		return d, !d.IsZero()
+	case *time.Time:
+		if d == nil {
+			return time.Time{}, false
+		}
+		return *d, !d.IsZero()
+	case string:
+		t, err := time.Parse("02/01/2006", d)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// text renders any value as a string (for Text columns and fallbacks).
+func text(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case *string:
+		if s == nil {
+			return ""
+		}
+		return *s
+	case *time.Time:
+		if s == nil {
+			return ""
+		}
+		return s.Format("02/01/2006")
+	case time.Time:
+		return s.Format("02/01/2006")
+	case *float64, *int64:
+		if f, ok := number(v); ok {
+			return fmt.Sprint(f)
+		}
+		return ""
+	}
+	if f, ok := number(v); ok {
+		return fmt.Sprint(f)
+	}
+	return fmt.Sprint(v)
+}
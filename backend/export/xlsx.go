@@ -0,0 +1,303 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cell styles, indexes into cellXfs of styles.xml.
+const (
+	styleDefault = iota
+	styleHeader
+	styleMoney
+	styleNumber
+	styleInteger
+	stylePercent
+	styleDate
+)
+
+const stylesXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="2"><numFmt numFmtId="164" formatCode="&quot;R$&quot;\ #,##0.00;[Red]\-&quot;R$&quot;\ #,##0.00"/><numFmt numFmtId="165" formatCode="dd/mm/yyyy"/></numFmts>
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><color rgb="FFFFFFFF"/><name val="Calibri"/></font></fonts>
+<fills count="3"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill><fill><patternFill patternType="solid"><fgColor rgb="FF4A5568"/><bgColor indexed="64"/></patternFill></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="7">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="2" borderId="0" xfId="0" applyFont="1" applyFill="1"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="4" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="3" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="10" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+</cellXfs>
+<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>
+</styleSheet>`
+
+// xlsxWriter streams an Office Open XML workbook. Sheets are written to the
+// zip as they are filled; the workbook parts that list them go in at Close.
+// Strings are stored inline so nothing has to be collected up front.
+type xlsxWriter struct {
+	zw     *zip.Writer
+	sheet  *bufio.Writer
+	cols   []Column
+	row    int
+	names  []string
+	closed bool
+}
+
+func newXLSX(w io.Writer) *xlsxWriter {
+	return &xlsxWriter{zw: zip.NewWriter(w)}
+}
+
+func (x *xlsxWriter) Sheet(name string, cols []Column) error {
+	if err := x.endSheet(); err != nil {
+		return err
+	}
+	x.names = append(x.names, x.uniqueName(name))
+	f, err := x.zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", len(x.names)))
+	if err != nil {
+		return err
+	}
+	x.sheet = bufio.NewWriter(f)
+	x.cols = cols
+	x.row = 0
+
+	b := x.sheet
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	b.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	if len(cols) > 0 {
+		b.WriteString("<cols>")
+		for i, col := range cols {
+			fmt.Fprintf(b, `<col min="%d" max="%d" width="%.1f" customWidth="1"/>`, i+1, i+1, columnWidth(col))
+		}
+		b.WriteString("</cols>")
+	}
+	b.WriteString("<sheetData>")
+
+	header := make([]interface{}, len(cols))
+	for i, col := range cols {
+		header[i] = col.Header
+	}
+	return x.writeRow(header, true)
+}
+
+func (x *xlsxWriter) Row(values ...interface{}) error {
+	if x.sheet == nil {
+		return fmt.Errorf("export: Row called before Sheet")
+	}
+	return x.writeRow(values, false)
+}
+
+func (x *xlsxWriter) writeRow(values []interface{}, header bool) error {
+	x.row++
+	b := x.sheet
+	fmt.Fprintf(b, `<row r="%d">`, x.row)
+	for i, v := range values {
+		ref := cellRef(i, x.row)
+		kind := Text
+		if !header && i < len(x.cols) {
+			kind = x.cols[i].Kind
+		}
+		switch kind {
+		case Integer, Number, Money, Percent:
+			f, ok := number(v)
+			if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+				if s := text(v); s != "" {
+					writeInlineString(b, ref, s, styleDefault)
+				}
+				continue
+			}
+			style := map[Kind]int{Integer: styleInteger, Number: styleNumber, Money: styleMoney, Percent: stylePercent}[kind]
+			if kind == Percent {
+				f /= 100
+			}
+			fmt.Fprintf(b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style, strconv.FormatFloat(f, 'f', -1, 64))
+		case Date:
+			t, ok := date(v)
+			if !ok {
+				if s := text(v); s != "" {
+					writeInlineString(b, ref, s, styleDefault)
+				}
+				continue
+			}
+			fmt.Fprintf(b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, styleDate, strconv.FormatFloat(excelSerial(t), 'f', -1, 64))
+		default:
+			style := styleDefault
+			if header {
+				style = styleHeader
+			}
+			if s := text(v); s != "" || header {
+				writeInlineString(b, ref, s, style)
+			}
+		}
+	}
+	_, err := b.WriteString("</row>")
+	return err
+}
+
+// endSheet closes the current sheet, adding an autofilter over its data.
+func (x *xlsxWriter) endSheet() error {
+	if x.sheet == nil {
+		return nil
+	}
+	b := x.sheet
+	b.WriteString("</sheetData>")
+	if len(x.cols) > 0 {
+		fmt.Fprintf(b, `<autoFilter ref="A1:%s"/>`, cellRef(len(x.cols)-1, x.row))
+	}
+	b.WriteString("</worksheet>")
+	x.sheet = nil
+	return b.Flush()
+}
+
+func (x *xlsxWriter) Close() error {
+	if x.closed {
+		return nil
+	}
+	x.closed = true
+	if err := x.endSheet(); err != nil {
+		return err
+	}
+	if len(x.names) == 0 {
+		// A workbook needs at least one sheet
+		if err := x.Sheet("Dados", nil); err != nil {
+			return err
+		}
+		if err := x.endSheet(); err != nil {
+			return err
+		}
+	}
+
+	var types, sheets, rels strings.Builder
+	for i, name := range x.names {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&sheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, escapeXML(name), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+	stylesID := len(x.names) + 1
+
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` + types.String() + `</Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>` + sheets.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` + rels.String() +
+			fmt.Sprintf(`<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, stylesID) + `</Relationships>`},
+		{"xl/styles.xml", stylesXML},
+	}
+	for _, p := range parts {
+		f, err := x.zw.Create(p.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, p.body); err != nil {
+			return err
+		}
+	}
+	return x.zw.Close()
+}
+
+// uniqueName makes name a valid sheet name: at most 31 characters, none of
+// []:*?/\ and not repeated within the workbook.
+func (x *xlsxWriter) uniqueName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" {
+		name = fmt.Sprintf("Planilha%d", len(x.names)+1)
+	}
+	base := []rune(name)
+	if len(base) > 31 {
+		base = base[:31]
+	}
+	candidate := string(base)
+	for n := 2; x.hasName(candidate); n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		cut := base
+		if len(cut)+len(suffix) > 31 {
+			cut = cut[:31-len(suffix)]
+		}
+		candidate = string(cut) + suffix
+	}
+	return candidate
+}
+
+func (x *xlsxWriter) hasName(name string) bool {
+	for _, n := range x.names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeInlineString(b *bufio.Writer, ref, s string, style int) {
+	fmt.Fprintf(b, `<c r="%s" t="inlineStr"`, ref)
+	if style != styleDefault {
+		fmt.Fprintf(b, ` s="%d"`, style)
+	}
+	b.WriteString(`><is><t xml:space="preserve">`)
+	b.WriteString(escapeXML(s))
+	b.WriteString(`</t></is></c>`)
+}
+
+func escapeXML(s string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
+
+// cellRef returns the A1 reference of a zero-based column and one-based row.
+func cellRef(col, row int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name + strconv.Itoa(row)
+}
+
+// excelSerial converts t to the 1900 date system used by Excel.
+func excelSerial(t time.Time) float64 {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	y, m, d := t.Date()
+	days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Sub(epoch).Hours() / 24
+	h, min, sec := t.Clock()
+	return days + float64(h*3600+min*60+sec)/86400
+}
+
+func columnWidth(col Column) float64 {
+	if col.Width > 0 {
+		return col.Width
+	}
+	switch col.Kind {
+	case Money:
+		return 16
+	case Number, Percent:
+		return 12
+	case Integer:
+		return 10
+	case Date:
+		return 12
+	}
+	if w := float64(len([]rune(col.Header))) + 4; w > 14 {
+		return w
+	}
+	return 14
+}
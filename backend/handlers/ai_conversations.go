@@ -0,0 +1,524 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"fb_apu01/services"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// aiHistoryTurns is how many earlier successful turns are replayed to the
+// model with a follow-up question.
+const aiHistoryTurns = 6
+
+// aiChartHint tells the frontend how the result can be plotted.
+type aiChartHint struct {
+	Type     string   `json:"type"` // "line", "bar", "kpi" or "table"
+	Category string   `json:"category,omitempty"`
+	Series   []string `json:"series,omitempty"`
+}
+
+var numericDBTypes = map[string]bool{
+	"INT2": true, "INT4": true, "INT8": true, "NUMERIC": true, "FLOAT4": true, "FLOAT8": true, "MONEY": true,
+}
+
+// buildChartHint picks the first non-numeric column as category and the
+// numeric ones as series. Period-like categories suggest a line chart.
+func buildChartHint(res *sandboxResult) *aiChartHint {
+	hint := &aiChartHint{Type: "table"}
+	for i, col := range res.Columns {
+		lower := strings.ToLower(col)
+		isPeriod := lower == "ano" || lower == "mes" || strings.Contains(lower, "mes_ano") ||
+			strings.Contains(lower, "periodo") || strings.Contains(lower, "data")
+		numeric := i < len(res.Types) && numericDBTypes[res.Types[i]]
+		switch {
+		case numeric && !isPeriod:
+			hint.Series = append(hint.Series, col)
+		case hint.Category == "":
+			hint.Category = col
+			if isPeriod {
+				hint.Type = "line"
+			}
+		}
+	}
+	switch {
+	case len(hint.Series) == 0:
+		hint.Type = "table"
+		hint.Category = ""
+	case hint.Category == "" && len(res.Rows) == 1:
+		hint.Type = "kpi"
+	case hint.Category == "":
+		hint.Type = "table"
+	case hint.Type != "line":
+		hint.Type = "bar"
+	}
+	return hint
+}
+
+// summarizeResult describes a result in one line for the model's context:
+// row count, columns and the first row.
+func summarizeResult(res *sandboxResult) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d linha(s); colunas: %s", len(res.Rows), strings.Join(res.Columns, ", "))
+	if len(res.Rows) > 0 {
+		first, _ := json.Marshal(res.Rows[0])
+		fmt.Fprintf(&sb, "; primeira linha: %s", first)
+	}
+	summary := sb.String()
+	if len(summary) > 500 {
+		summary = summary[:500] + "…"
+	}
+	return summary
+}
+
+// loadConversationHistory returns the last successful turns of a conversation
+// owned by userID in companyID. sql.ErrNoRows means the conversation does not
+// exist for this user.
+func loadConversationHistory(ctx context.Context, db *sql.DB, companyID, userID, conversationID string) ([]services.SQLTurn, error) {
+	tx, err := BeginTenantTx(ctx, db, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM ai_conversations WHERE id = $1 AND company_id = $2 AND user_id = $3)
+	`, conversationID, companyID, userID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := tx.Query(`
+		SELECT pergunta, sql_gerado, COALESCE(resumo_resultado, '')
+		FROM (
+			SELECT pergunta, sql_gerado, resumo_resultado, created_at
+			FROM ai_conversation_turns
+			WHERE conversation_id = $1 AND erro IS NULL AND sql_gerado IS NOT NULL
+			ORDER BY created_at DESC
+			LIMIT $2
+		) t
+		ORDER BY created_at ASC
+	`, conversationID, aiHistoryTurns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []services.SQLTurn
+	for rows.Next() {
+		var t services.SQLTurn
+		if err := rows.Scan(&t.Pergunta, &t.SQL, &t.Resumo); err != nil {
+			return nil, err
+		}
+		history = append(history, t)
+	}
+	return history, rows.Err()
+}
+
+// recordConversationTurn stores a turn, creating the conversation when
+// conversationID is empty. A failed turn has erro set and no result; it is
+// shown in the conversation but not replayed to the model. Returns the
+// conversation and turn ids.
+func recordConversationTurn(ctx context.Context, db *sql.DB, companyID, userID, conversationID, pergunta, generatedSQL string, res *sandboxResult, chart *aiChartHint, model, erro string) (string, string, error) {
+	tx, err := BeginTenantTx(ctx, db, companyID)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	if conversationID == "" {
+		titulo := pergunta
+		if r := []rune(titulo); len(r) > 80 {
+			titulo = string(r[:80]) + "…"
+		}
+		err = tx.QueryRow(`
+			INSERT INTO ai_conversations (company_id, user_id, titulo) VALUES ($1, $2, $3) RETURNING id
+		`, companyID, userID, titulo).Scan(&conversationID)
+	} else {
+		_, err = tx.Exec(`UPDATE ai_conversations SET updated_at = NOW() WHERE id = $1`, conversationID)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var resumo, chartJSON interface{}
+	rowCount := 0
+	if res != nil {
+		resumo, rowCount = summarizeResult(res), len(res.Rows)
+		chartJSON, _ = json.Marshal(chart)
+	}
+	var turnID string
+	err = tx.QueryRow(`
+		INSERT INTO ai_conversation_turns
+			(conversation_id, company_id, pergunta, sql_gerado, resumo_resultado, row_count, chart, model, erro)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''))
+		RETURNING id
+	`, conversationID, companyID, pergunta, generatedSQL, resumo, rowCount, chartJSON, model, erro).Scan(&turnID)
+	if err != nil {
+		return "", "", err
+	}
+	return conversationID, turnID, tx.Commit()
+}
+
+// ─── Conversations API ───────────────────────────────────────────────────────
+
+type aiConversation struct {
+	ID        string    `json:"id"`
+	Titulo    string    `json:"titulo"`
+	Turnos    int       `json:"turnos"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type aiConversationTurn struct {
+	ID        string          `json:"id"`
+	Pergunta  string          `json:"pergunta"`
+	SQL       string          `json:"sql"`
+	Resumo    string          `json:"resumo"`
+	RowCount  int             `json:"row_count"`
+	Chart     json.RawMessage `json:"chart,omitempty"`
+	Model     string          `json:"model"`
+	Erro      string          `json:"erro,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// aiRequestScope resolves user and company for the AI endpoints.
+func aiRequestScope(db *sql.DB, w http.ResponseWriter, r *http.Request) (userID, companyID string, ok bool) {
+	claims, ok := r.Context().Value(ClaimsKey).(jwt.MapClaims)
+	if !ok {
+		jsonErr(w, http.StatusUnauthorized, "unauthorized")
+		return "", "", false
+	}
+	userID, _ = claims["user_id"].(string)
+
+	companyID, err := GetEffectiveCompanyID(db, userID, r.Header.Get("X-Company-ID"))
+	if err != nil {
+		jsonErr(w, http.StatusInternalServerError, "erro ao obter empresa: "+err.Error())
+		return "", "", false
+	}
+	return userID, companyID, true
+}
+
+// AIConversationsHandler lists the user's conversations (GET /api/ai/conversations).
+func AIConversationsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		userID, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`
+			SELECT c.id, c.titulo, c.updated_at,
+			       (SELECT COUNT(*) FROM ai_conversation_turns t WHERE t.conversation_id = c.id)
+			FROM ai_conversations c
+			WHERE c.company_id = $1 AND c.user_id = $2
+			ORDER BY c.updated_at DESC
+			LIMIT 50
+		`, companyID, userID)
+		if err != nil {
+			log.Printf("AIConversations list error: %v", err)
+			jsonErr(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		defer rows.Close()
+
+		list := []aiConversation{}
+		for rows.Next() {
+			var c aiConversation
+			if err := rows.Scan(&c.ID, &c.Titulo, &c.UpdatedAt, &c.Turnos); err != nil {
+				log.Printf("AIConversations scan error: %v", err)
+				continue
+			}
+			list = append(list, c)
+		}
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// AIConversationHandler returns (GET) or deletes (DELETE) one conversation:
+// /api/ai/conversations/{id}
+func AIConversationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		userID, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+		conversationID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/ai/conversations/"), "/")
+		if conversationID == "" {
+			jsonErr(w, http.StatusBadRequest, "conversa não informada")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			var titulo string
+			err := tx.QueryRow(`
+				SELECT titulo FROM ai_conversations WHERE id = $1 AND company_id = $2 AND user_id = $3
+			`, conversationID, companyID, userID).Scan(&titulo)
+			if err == sql.ErrNoRows {
+				jsonErr(w, http.StatusNotFound, "conversa não encontrada")
+				return
+			} else if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+
+			rows, err := tx.Query(`
+				SELECT id, pergunta, COALESCE(sql_gerado, ''), COALESCE(resumo_resultado, ''),
+				       row_count, chart, COALESCE(model, ''), COALESCE(erro, ''), created_at
+				FROM ai_conversation_turns
+				WHERE conversation_id = $1
+				ORDER BY created_at ASC
+			`, conversationID)
+			if err != nil {
+				log.Printf("AIConversation turns error: %v", err)
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			defer rows.Close()
+
+			turns := []aiConversationTurn{}
+			for rows.Next() {
+				var t aiConversationTurn
+				var chart []byte
+				if err := rows.Scan(&t.ID, &t.Pergunta, &t.SQL, &t.Resumo, &t.RowCount, &chart, &t.Model, &t.Erro, &t.CreatedAt); err != nil {
+					log.Printf("AIConversation turn scan error: %v", err)
+					continue
+				}
+				if len(chart) > 0 {
+					t.Chart = chart
+				}
+				turns = append(turns, t)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":     conversationID,
+				"titulo": titulo,
+				"turnos": turns,
+			})
+
+		case http.MethodDelete:
+			res, err := tx.Exec(`
+				DELETE FROM ai_conversations WHERE id = $1 AND company_id = $2 AND user_id = $3
+			`, conversationID, companyID, userID)
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				jsonErr(w, http.StatusNotFound, "conversa não encontrada")
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"message": "Conversa removida"})
+
+		default:
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// ─── Saved queries API ───────────────────────────────────────────────────────
+
+type aiSavedQuery struct {
+	ID        string          `json:"id"`
+	Nome      string          `json:"nome"`
+	Pergunta  string          `json:"pergunta"`
+	SQL       string          `json:"sql"`
+	Chart     json.RawMessage `json:"chart,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AISavedQueriesHandler lists (GET) or creates (POST {nome, turn_id}) named
+// reports from a conversation turn: /api/ai/saved-queries. Only SQL that the
+// assistant generated and ran can be saved — clients never send raw SQL.
+func AISavedQueriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		userID, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := tx.Query(`
+				SELECT id, nome, pergunta, sql_gerado, chart, created_at
+				FROM ai_saved_queries
+				WHERE company_id = $1
+				ORDER BY nome
+			`, companyID)
+			if err != nil {
+				log.Printf("AISavedQueries list error: %v", err)
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			defer rows.Close()
+
+			list := []aiSavedQuery{}
+			for rows.Next() {
+				var q aiSavedQuery
+				var chart []byte
+				if err := rows.Scan(&q.ID, &q.Nome, &q.Pergunta, &q.SQL, &chart, &q.CreatedAt); err != nil {
+					log.Printf("AISavedQueries scan error: %v", err)
+					continue
+				}
+				if len(chart) > 0 {
+					q.Chart = chart
+				}
+				list = append(list, q)
+			}
+			json.NewEncoder(w).Encode(list)
+
+		case http.MethodPost:
+			var req struct {
+				Nome   string `json:"nome"`
+				TurnID string `json:"turn_id"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+				strings.TrimSpace(req.Nome) == "" || req.TurnID == "" {
+				jsonErr(w, http.StatusBadRequest, "nome e turn_id são obrigatórios")
+				return
+			}
+
+			var id string
+			err := tx.QueryRow(`
+				INSERT INTO ai_saved_queries (company_id, user_id, nome, pergunta, sql_gerado, chart)
+				SELECT t.company_id, $3, $4, t.pergunta, t.sql_gerado, t.chart
+				FROM ai_conversation_turns t
+				WHERE t.id = $1 AND t.company_id = $2 AND t.erro IS NULL AND t.sql_gerado IS NOT NULL
+				ON CONFLICT (company_id, nome) DO UPDATE
+				SET pergunta = EXCLUDED.pergunta, sql_gerado = EXCLUDED.sql_gerado, chart = EXCLUDED.chart
+				WHERE ai_saved_queries.user_id = EXCLUDED.user_id
+				RETURNING id
+			`, req.TurnID, companyID, userID, strings.TrimSpace(req.Nome)).Scan(&id)
+			if err == sql.ErrNoRows {
+				// Either the turn does not exist or the name belongs to another user's query
+				var taken bool
+				if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ai_saved_queries WHERE company_id = $1 AND nome = $2)`,
+					companyID, strings.TrimSpace(req.Nome)).Scan(&taken); err == nil && taken {
+					jsonErr(w, http.StatusConflict, "já existe uma consulta salva com este nome")
+					return
+				}
+				jsonErr(w, http.StatusNotFound, "consulta não encontrada")
+				return
+			} else if err != nil {
+				log.Printf("AISavedQueries insert error: %v", err)
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"id": id})
+
+		default:
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// AISavedQueryHandler deletes one of the user's saved queries (DELETE
+// /api/ai/saved-queries/{id}) or re-runs any saved query of the company in the
+// sandbox without the model (POST .../{id}/run).
+func AISavedQueryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		userID, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/ai/saved-queries/"), "/")
+		id, action, _ := strings.Cut(path, "/")
+		if id == "" {
+			jsonErr(w, http.StatusBadRequest, "consulta não informada")
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodDelete && action == "":
+			res, err := tx.Exec("DELETE FROM ai_saved_queries WHERE id = $1 AND company_id = $2 AND user_id = $3",
+				id, companyID, userID)
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				// Same rule as saving: another user's query is not touched
+				var exists bool
+				if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ai_saved_queries WHERE id = $1 AND company_id = $2)`,
+					id, companyID).Scan(&exists); err == nil && exists {
+					jsonErr(w, http.StatusForbidden, "consulta salva por outro usuário")
+					return
+				}
+				jsonErr(w, http.StatusNotFound, "consulta não encontrada")
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"message": "Consulta removida"})
+
+		case r.Method == http.MethodPost && action == "run":
+			var pergunta, generatedSQL string
+			err := tx.QueryRow(`
+				SELECT pergunta, sql_gerado FROM ai_saved_queries WHERE id = $1 AND company_id = $2
+			`, id, companyID).Scan(&pergunta, &generatedSQL)
+			if err == sql.ErrNoRows {
+				jsonErr(w, http.StatusNotFound, "consulta não encontrada")
+				return
+			} else if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			tx.Rollback()
+
+			finalSQL := reCompanyPlaceholder.ReplaceAllString(generatedSQL, "$$1::uuid")
+			result, err := runSandboxedQuery(r.Context(), db, companyID, finalSQL)
+			if err != nil {
+				fmt.Printf("[AI Query] Saved query %s failed: %v\n", id, err)
+				jsonErr(w, http.StatusBadRequest, "Erro ao executar a consulta salva.")
+				return
+			}
+			json.NewEncoder(w).Encode(aiQueryResult{
+				Pergunta:  pergunta,
+				SQL:       finalSQL,
+				Columns:   result.Columns,
+				Rows:      result.Rows,
+				RowCount:  len(result.Rows),
+				Truncated: result.Truncated,
+				Chart:     buildChartHint(result),
+				Model:     "saved",
+			})
+
+		default:
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
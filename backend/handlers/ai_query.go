@@ -13,7 +13,10 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// sqlDenyPatterns rejects SQL statements that mutate data or schema.
+// sqlDenyPatterns rejects SQL statements that mutate data or schema. It is
+// not a security boundary (quoted identifiers such as U&"..." get past any
+// regex): it only turns an obviously wrong answer into a quick repair round.
+// Isolation comes from runSandboxedQuery.
 var sqlDenyPatterns = []*regexp.Regexp{
 	regexp.MustCompile(`(?i)\bINSERT\b`),
 	regexp.MustCompile(`(?i)\bUPDATE\b`),
@@ -24,6 +27,10 @@ var sqlDenyPatterns = []*regexp.Regexp{
 	regexp.MustCompile(`(?i)\bTRUNCATE\b`),
 	regexp.MustCompile(`(?i)\bGRANT\b`),
 	regexp.MustCompile(`(?i)\bREVOKE\b`),
+	regexp.MustCompile(`(?i)\bCOPY\b`),
+	regexp.MustCompile(`(?i)\bRESET\b`),
+	regexp.MustCompile(`(?i)\bSET_CONFIG\b`),
+	regexp.MustCompile(`(?i)\bSET\s+(LOCAL\s+|SESSION\s+)?(ROLE|SESSION|SEARCH_PATH)\b`),
 }
 
 func validateReadOnlySQL(sqlStr string) error {
@@ -40,16 +47,23 @@ func validateReadOnlySQL(sqlStr string) error {
 var reCompanyPlaceholder = regexp.MustCompile(`'?__COMPANY(?:_ID(?:__)?)?'?`)
 
 type aiQueryRequest struct {
-	Pergunta string `json:"pergunta"`
+	Pergunta       string `json:"pergunta"`
+	ConversationID string `json:"conversation_id"` // optional — continues an earlier conversation
 }
 
 type aiQueryResult struct {
-	Pergunta string                   `json:"pergunta"`
-	SQL      string                   `json:"sql"`
-	Columns  []string                 `json:"columns"`
-	Rows     []map[string]interface{} `json:"rows"`
-	RowCount int                      `json:"row_count"`
-	Model    string                   `json:"model"`
+	Pergunta  string                   `json:"pergunta"`
+	SQL       string                   `json:"sql"`
+	Columns   []string                 `json:"columns"`
+	Rows      []map[string]interface{} `json:"rows"`
+	RowCount  int                      `json:"row_count"`
+	Truncated bool                     `json:"truncated"`
+	Chart     *aiChartHint             `json:"chart"`
+	Model     string                   `json:"model"`
+	Attempts  int                      `json:"attempts,omitempty"` // >1 when the SQL was auto-repaired
+
+	ConversationID string `json:"conversation_id,omitempty"`
+	TurnID         string `json:"turn_id,omitempty"`
 }
 
 func jsonErr(w http.ResponseWriter, status int, msg string, extra ...map[string]string) {
@@ -64,7 +78,7 @@ func jsonErr(w http.ResponseWriter, status int, msg string, extra ...map[string]
 	json.NewEncoder(w).Encode(out)
 }
 
-// AIQueryHandler receives a natural language question, generates SQL via GLM,
+// AIQueryHandler receives a natural language question, generates SQL via the LLM,
 // executes it against the database, and returns the results as JSON.
 func AIQueryHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -96,98 +110,61 @@ func AIQueryHandler(db *sql.DB) http.HandlerFunc {
 
 		aiClient := services.NewAIClient()
 		if !aiClient.IsAvailable() {
-			jsonErr(w, http.StatusServiceUnavailable, "IA não configurada (ZAI_API_KEY ausente)")
+			jsonErr(w, http.StatusServiceUnavailable, "IA não configurada (nenhum provedor LLM disponível — veja LLM_PROVIDERS)")
 			return
 		}
 
-		// Generate SQL via AI
-		userPrompt := services.BuildTextToSQLPrompt(req.Pergunta)
-		aiResp, err := aiClient.GenerateFastRaw(services.SystemPromptTextToSQL, userPrompt, "", 2048)
-		if err != nil {
-			jsonErr(w, http.StatusInternalServerError, fmt.Sprintf("Erro na IA: %v", err))
-			return
-		}
-
-		// Extract and validate SQL from AI response
-		generatedSQL, err := services.ExtractSQL(aiResp.Text)
-		if err != nil {
-			fmt.Printf("[AI Query] ExtractSQL failed: %v\nRaw AI text (first 500): %.500s\n", err, aiResp.Text)
-			jsonErr(w, http.StatusUnprocessableEntity,
-				"IA não retornou SQL válido. Tente reformular a pergunta.",
-			)
-			return
-		}
-
-		// Validate that the AI-generated SQL only contains read operations
-		if err := validateReadOnlySQL(generatedSQL); err != nil {
-			fmt.Printf("[AI Query] SQL denied by whitelist: %v\nSQL: %.500s\n", err, generatedSQL)
-			jsonErr(w, http.StatusUnprocessableEntity, "SQL gerado contém operação não permitida. Tente reformular a pergunta.")
-			return
+		// Follow-up questions carry the recent turns of the conversation
+		var history []services.SQLTurn
+		if req.ConversationID != "" {
+			history, err = loadConversationHistory(r.Context(), db, companyID, userID, req.ConversationID)
+			if err == sql.ErrNoRows {
+				jsonErr(w, http.StatusNotFound, "conversa não encontrada")
+				return
+			} else if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "erro ao carregar conversa: "+err.Error())
+				return
+			}
 		}
 
-		// Inject company_id — substitui __COMPANY_ID__ e qualquer variação truncada pela IA
-		// (ex: '__COMPANY_ID', '__COMPANY', com ou sem aspas simples ao redor)
-		finalSQL := reCompanyPlaceholder.ReplaceAllString(generatedSQL, "'"+companyID+"'")
-
-		// Verificação de segurança: se ainda sobrou algum placeholder não resolvido, rejeitar
-		if strings.Contains(finalSQL, "__COMPANY") {
-			jsonErr(w, http.StatusUnprocessableEntity,
-				"SQL gerado contém placeholder não resolvido — tente reformular a pergunta",
-				map[string]string{"sql": finalSQL},
-			)
+		// Generate SQL via AI — execution errors go back to the model for repair
+		messages := services.BuildTextToSQLMessages(history, req.Pergunta)
+		run, qerr := generateAndRunSQL(r.Context(), db, aiClient, companyID, req.Pergunta, messages)
+		if qerr != nil {
+			// The failed question stays in the conversation, with what went wrong
+			conversationID, _, err := recordConversationTurn(r.Context(), db, companyID, userID, req.ConversationID,
+				req.Pergunta, qerr.sql, nil, nil, qerr.model, qerr.cause)
+			if err != nil {
+				fmt.Printf("[AI Query] Failed to record failed conversation turn: %v\n", err)
+			} else {
+				qerr.extra = append(qerr.extra, map[string]string{"conversation_id": conversationID})
+			}
+			jsonErr(w, qerr.status, qerr.msg, qerr.extra...)
 			return
 		}
+		aiResp, generatedSQL, finalSQL, result := run.aiResp, run.generatedSQL, run.finalSQL, run.result
 
-		// Ensure there's a LIMIT
-		if !strings.Contains(strings.ToUpper(finalSQL), "LIMIT") {
-			finalSQL += "\nLIMIT 100"
-		}
-
-		// Execute the query
-		rows, err := db.Query(finalSQL)
+		chart := buildChartHint(result)
+		conversationID, turnID, err := recordConversationTurn(r.Context(), db, companyID, userID, req.ConversationID,
+			req.Pergunta, generatedSQL, result, chart, aiResp.Model, "")
 		if err != nil {
-			fmt.Printf("[AI Query] Query execution failed: %v\nSQL: %.500s\n", err, finalSQL)
-			jsonErr(w, http.StatusBadRequest, "Erro ao executar a consulta. Tente reformular a pergunta.")
-			return
-		}
-		defer rows.Close()
-
-		// Read results
-		cols, _ := rows.Columns()
-		var resultRows []map[string]interface{}
-		for rows.Next() {
-			vals := make([]interface{}, len(cols))
-			ptrs := make([]interface{}, len(cols))
-			for i := range vals {
-				ptrs[i] = &vals[i]
-			}
-			if err := rows.Scan(ptrs...); err != nil {
-				continue
-			}
-			row := make(map[string]interface{})
-			for i, col := range cols {
-				// PostgreSQL DECIMAL/NUMERIC scans as []byte; convert to string
-				// to prevent json.Marshal from base64-encoding it.
-				if b, ok := vals[i].([]byte); ok {
-					row[col] = string(b)
-				} else {
-					row[col] = vals[i]
-				}
-			}
-			resultRows = append(resultRows, row)
-		}
-
-		if resultRows == nil {
-			resultRows = []map[string]interface{}{}
+			// The answer is still valid — only the history is missing
+			fmt.Printf("[AI Query] Failed to record conversation turn: %v\n", err)
 		}
 
 		json.NewEncoder(w).Encode(aiQueryResult{
-			Pergunta: req.Pergunta,
-			SQL:      finalSQL,
-			Columns:  cols,
-			Rows:     resultRows,
-			RowCount: len(resultRows),
-			Model:    aiResp.Model,
+			Pergunta:  req.Pergunta,
+			SQL:       finalSQL,
+			Columns:   result.Columns,
+			Rows:      result.Rows,
+			RowCount:  len(result.Rows),
+			Truncated: result.Truncated,
+			Chart:     chart,
+			Model:     aiResp.Model,
+			Attempts:  run.attempts,
+
+			ConversationID: conversationID,
+			TurnID:         turnID,
 		})
 	}
 }
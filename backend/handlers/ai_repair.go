@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"fb_apu01/services"
+
+	"github.com/lib/pq"
+)
+
+// aiQueryRepairAttempts is how many times a failing query goes back to the
+// model with the error before the user gets an error (AI_QUERY_REPAIR_ATTEMPTS).
+var aiQueryRepairAttempts = envNonNegativeInt("AI_QUERY_REPAIR_ATTEMPTS", 2)
+
+func envNonNegativeInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+// aiQueryRun is a generated query that executed successfully.
+type aiQueryRun struct {
+	aiResp       *services.AIResponse
+	generatedSQL string // as written by the model (with __COMPANY_ID__)
+	finalSQL     string // with the company bound as $1
+	result       *sandboxResult
+	attempts     int
+}
+
+// aiQueryError is the response sent when every attempt failed. sql, model
+// and cause describe the last attempt for the conversation history.
+type aiQueryError struct {
+	status int
+	msg    string
+	extra  []map[string]string
+
+	sql   string
+	model string
+	cause string
+}
+
+// generateAndRunSQL asks the model for SQL and executes it in the sandbox.
+// Extraction, validation and execution failures are fed back to the model as
+// a repair prompt, up to aiQueryRepairAttempts times. Every attempt is logged
+// to ai_query_attempts.
+func generateAndRunSQL(ctx context.Context, db *sql.DB, aiClient *services.AIClient, companyID, pergunta string, messages []services.LLMMessage) (*aiQueryRun, *aiQueryError) {
+	attemptLog := &aiAttemptLog{db: db, companyID: companyID, pergunta: pergunta}
+	var lastErr *aiQueryError
+
+	for attempt := 1; attempt <= aiQueryRepairAttempts+1; attempt++ {
+		start := time.Now()
+		aiResp, err := aiClient.GenerateChatRaw(services.SystemPromptTextToSQL, messages, "", 2048)
+		if err != nil {
+			// Provider failure — the model never saw the question, nothing to repair
+			attemptLog.record(attempt, "ia", "", err, "", start)
+			return nil, &aiQueryError{status: http.StatusInternalServerError, msg: fmt.Sprintf("Erro na IA: %v", err), cause: err.Error()}
+		}
+
+		// repair feeds the failure back and moves on to the next attempt
+		var failedSQL string
+		repair := func(stage string, cause error, e *aiQueryError) {
+			attemptLog.record(attempt, stage, failedSQL, cause, aiResp.Model, start)
+			e.sql, e.model, e.cause = failedSQL, aiResp.Model, describeSQLError(cause)
+			lastErr = e
+			answer := aiResp.Text
+			if failedSQL != "" {
+				answer = "```sql\n" + failedSQL + "\n```"
+			} else if len(answer) > 2000 {
+				answer = answer[len(answer)-2000:]
+			}
+			messages = append(messages,
+				services.LLMMessage{Role: "assistant", Content: answer},
+				services.LLMMessage{Role: "user", Content: services.BuildSQLRepairPrompt(failedSQL, describeSQLError(cause))},
+			)
+		}
+
+		// Extract and validate SQL from AI response
+		generatedSQL, err := services.ExtractSQL(aiResp.Text)
+		if err != nil {
+			fmt.Printf("[AI Query] Attempt %d: ExtractSQL failed: %v\nRaw AI text (first 500): %.500s\n", attempt, err, aiResp.Text)
+			repair("extract", err, &aiQueryError{
+				status: http.StatusUnprocessableEntity,
+				msg:    "IA não retornou SQL válido. Tente reformular a pergunta.",
+			})
+			continue
+		}
+		failedSQL = generatedSQL
+
+		// Validate that the AI-generated SQL only contains read operations
+		if err := validateReadOnlySQL(generatedSQL); err != nil {
+			fmt.Printf("[AI Query] Attempt %d: SQL denied by whitelist: %v\nSQL: %.500s\n", attempt, err, generatedSQL)
+			repair("validate", err, &aiQueryError{
+				status: http.StatusUnprocessableEntity,
+				msg:    "SQL gerado contém operação não permitida. Tente reformular a pergunta.",
+			})
+			continue
+		}
+
+		// company_id vai como parâmetro ($1) — substitui __COMPANY_ID__ e qualquer
+		// variação truncada pela IA (ex: '__COMPANY_ID', '__COMPANY', com ou sem aspas)
+		finalSQL := reCompanyPlaceholder.ReplaceAllString(generatedSQL, "$$1::uuid")
+
+		// Verificação de segurança: se ainda sobrou algum placeholder não resolvido, rejeitar
+		if strings.Contains(finalSQL, "__COMPANY") {
+			repair("placeholder", errors.New("placeholder __COMPANY_ID__ malformado"), &aiQueryError{
+				status: http.StatusUnprocessableEntity,
+				msg:    "SQL gerado contém placeholder não resolvido — tente reformular a pergunta",
+				extra:  []map[string]string{{"sql": finalSQL}},
+			})
+			continue
+		}
+
+		// Execute inside the sandbox (read-only role, company-scoped views, caps)
+		result, err := runSandboxedQuery(ctx, db, companyID, finalSQL)
+		if err != nil {
+			fmt.Printf("[AI Query] Attempt %d: query execution failed: %v\nSQL: %.500s\n", attempt, err, finalSQL)
+			if errors.Is(err, errSandboxUnavailable) || ctx.Err() != nil {
+				attemptLog.record(attempt, "execute", generatedSQL, err, aiResp.Model, start)
+				return nil, &aiQueryError{status: http.StatusServiceUnavailable, msg: "Consulta indisponível no momento.",
+					sql: generatedSQL, model: aiResp.Model, cause: err.Error()}
+			}
+			repair("execute", err, &aiQueryError{
+				status: http.StatusBadRequest,
+				msg:    "Erro ao executar a consulta. Tente reformular a pergunta.",
+			})
+			continue
+		}
+
+		attemptLog.record(attempt, "ok", generatedSQL, nil, aiResp.Model, start)
+		if attempt > 1 {
+			fmt.Printf("[AI Query] Query repaired after %d attempt(s)\n", attempt)
+		}
+		return &aiQueryRun{aiResp: aiResp, generatedSQL: generatedSQL, finalSQL: finalSQL, result: result, attempts: attempt}, nil
+	}
+	return nil, lastErr
+}
+
+// describeSQLError renders an error for the repair prompt. PostgreSQL errors
+// keep message, detail and hint; the position is dropped because it refers
+// to the sandbox wrapper, not the model's SQL.
+func describeSQLError(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		msg := fmt.Sprintf("%s (SQLSTATE %s)", pqErr.Message, pqErr.Code)
+		if pqErr.Detail != "" {
+			msg += "\nDetalhe: " + pqErr.Detail
+		}
+		if pqErr.Hint != "" {
+			msg += "\nDica: " + pqErr.Hint
+		}
+		if pqErr.Code == "42501" || pqErr.Code == "42P01" {
+			msg += "\nUse somente as tabelas e views listadas no schema."
+		}
+		return msg
+	}
+	return err.Error()
+}
+
+// aiAttemptLog writes one ai_query_attempts row per attempt, all sharing the
+// request_id of the first one.
+type aiAttemptLog struct {
+	db        *sql.DB
+	companyID string
+	pergunta  string
+	requestID sql.NullString
+}
+
+func (l *aiAttemptLog) record(attempt int, stage, generatedSQL string, cause error, model string, start time.Time) {
+	var errMsg, sqlState sql.NullString
+	if cause != nil {
+		errMsg = sql.NullString{String: cause.Error(), Valid: true}
+		var pqErr *pq.Error
+		if errors.As(cause, &pqErr) {
+			sqlState = sql.NullString{String: string(pqErr.Code), Valid: true}
+		}
+	}
+	var requestID string
+	err := l.db.QueryRow(`
+		INSERT INTO ai_query_attempts
+			(request_id, company_id, pergunta, tentativa, etapa, sql_gerado, erro, sqlstate, model, duration_ms)
+		VALUES (COALESCE($1::uuid, gen_random_uuid()), $2, $3, $4, $5, NULLIF($6, ''), $7, $8, NULLIF($9, ''), $10)
+		RETURNING request_id
+	`, l.requestID, l.companyID, l.pergunta, attempt, stage, generatedSQL, errMsg, sqlState, model,
+		time.Since(start).Milliseconds()).Scan(&requestID)
+	if err != nil {
+		fmt.Printf("[AI Query] Failed to log attempt: %v\n", err)
+		return
+	}
+	l.requestID = sql.NullString{String: requestID, Valid: true}
+}
+
+// AIQueryFailuresHandler lists recent failed attempts of the effective company
+// for prompt tuning (GET /api/admin/ai-query-failures?limit=100), read in the
+// tenant transaction. "recuperada" tells whether a later repair attempt of the
+// same question succeeded.
+func AIQueryFailuresHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 || limit > 500 {
+			limit = 100
+		}
+
+		rows, err := tx.Query(`
+			SELECT a.request_id, a.pergunta, a.tentativa, a.etapa, COALESCE(a.sql_gerado, ''),
+			       COALESCE(a.erro, ''), COALESCE(a.sqlstate, ''), COALESCE(a.model, ''), a.created_at,
+			       EXISTS (SELECT 1 FROM ai_query_attempts ok
+			               WHERE ok.request_id = a.request_id AND ok.company_id = a.company_id AND ok.etapa = 'ok')
+			FROM ai_query_attempts a
+			WHERE a.company_id = $1 AND a.etapa <> 'ok'
+			ORDER BY a.created_at DESC
+			LIMIT $2
+		`, companyID, limit)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		defer rows.Close()
+
+		type failure struct {
+			RequestID  string    `json:"request_id"`
+			Pergunta   string    `json:"pergunta"`
+			Tentativa  int       `json:"tentativa"`
+			Etapa      string    `json:"etapa"`
+			SQL        string    `json:"sql"`
+			Erro       string    `json:"erro"`
+			SQLState   string    `json:"sqlstate"`
+			Model      string    `json:"model"`
+			CreatedAt  time.Time `json:"created_at"`
+			Recuperada bool      `json:"recuperada"`
+		}
+		list := []failure{}
+		for rows.Next() {
+			var f failure
+			if err := rows.Scan(&f.RequestID, &f.Pergunta, &f.Tentativa, &f.Etapa, &f.SQL,
+				&f.Erro, &f.SQLState, &f.Model, &f.CreatedAt, &f.Recuperada); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			list = append(list, f)
+		}
+		if err := rows.Err(); err != nil {
+			jsonErr(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		json.NewEncoder(w).Encode(list)
+	}
+}
@@ -26,50 +26,10 @@ var (
 	insightCacheMu  sync.Mutex
 )
 
-// ApuracaoResumo holds aggregated fiscal data for AI prompt generation.
-type ApuracaoResumo struct {
-	CompanyName string  `json:"company_name"`
-	CNPJ        string  `json:"cnpj"`
-	Periodo     string  `json:"periodo"`
-	// Current period
-	FaturamentoBruto  float64 `json:"faturamento_bruto"`
-	TotalEntradas     float64 `json:"total_entradas"`
-	TotalSaidas       float64 `json:"total_saidas"`
-	IcmsEntrada       float64 `json:"icms_entrada"`
-	IcmsSaida         float64 `json:"icms_saida"`
-	IcmsAPagar        float64 `json:"icms_a_pagar"`
-	IbsProjetado      float64 `json:"ibs_projetado"`
-	CbsProjetado      float64 `json:"cbs_projetado"`
-	TotalNFes         int     `json:"total_nfes"`
-	// Previous period (for comparison)
-	PeriodoAnterior       string  `json:"periodo_anterior"`
-	FaturamentoAnterior   float64 `json:"faturamento_anterior"`
-	IcmsAPagarAnterior    float64 `json:"icms_a_pagar_anterior"`
-	TotalNFesAnterior     int     `json:"total_nfes_anterior"`
-	// Breakdown by operation type
-	Operacoes []OperacaoResumo `json:"operacoes"`
-	// Import jobs info
-	UltimaImportacao string `json:"ultima_importacao"`
-	TotalJobs        int    `json:"total_jobs"`
-	// Alíquotas efetivas (% sobre faturamento bruto)
-	AliquotaEfetivaICMS         float64 `json:"aliquota_efetiva_icms"`
-	AliquotaEfetivaIBS          float64 `json:"aliquota_efetiva_ibs"`
-	AliquotaEfetivaCBS          float64 `json:"aliquota_efetiva_cbs"`
-	AliquotaEfetivaTotalReforma float64 `json:"aliquota_efetiva_total_reforma"`
-	AliquotaEfetivaICMSAnterior float64 `json:"aliquota_efetiva_icms_anterior"`
-}
-
-type OperacaoResumo struct {
-	TipoOperacao string  `json:"tipo_operacao"`
-	Tipo         string  `json:"tipo"` // ENTRADA or SAIDA
-	Valor        float64 `json:"valor"`
-	Icms         float64 `json:"icms"`
-}
-
 // Executive Summary response
 type ExecutiveSummaryResponse struct {
 	Narrativa string          `json:"narrativa"`
-	Dados     *ApuracaoResumo `json:"dados"`
+	Dados     *services.ApuracaoResumo `json:"dados"`
 	Periodo   string          `json:"periodo"`
 	Model     string          `json:"model,omitempty"`
 	Cached    bool            `json:"cached"`
@@ -84,213 +44,7 @@ type InsightResponse struct {
 	Cached   bool   `json:"cached"`
 }
 
-// buildFilialClause builds " AND filial_cnpj IN ($N, ...)" for optional filtering.
-// nextIdx is the 1-based index of the next query parameter.
-func buildFilialClause(filiais []string, nextIdx int) (string, []interface{}) {
-	if len(filiais) == 0 {
-		return "", nil
-	}
-	placeholders := make([]string, len(filiais))
-	args := make([]interface{}, len(filiais))
-	for i, c := range filiais {
-		placeholders[i] = fmt.Sprintf("$%d", nextIdx+i)
-		args[i] = c
-	}
-	return " AND filial_cnpj IN (" + strings.Join(placeholders, ", ") + ")", args
-}
-
-// getApuracaoResumo aggregates fiscal data from materialized views.
-// filiais restricts results to specific filial CNPJs (nil/empty = all filiais).
-func getApuracaoResumo(db *sql.DB, companyID, periodo string, filiais []string) (*ApuracaoResumo, error) {
-	resumo := &ApuracaoResumo{Periodo: periodo}
-
-	// Get company info (cnpj may not exist in all schemas)
-	err := db.QueryRow(`
-		SELECT COALESCE(c.name, ''), COALESCE(c.trade_name, '')
-		FROM companies c WHERE c.id = $1
-	`, companyID).Scan(&resumo.CompanyName, &resumo.CNPJ)
-	if err != nil && err != sql.ErrNoRows {
-		return nil, fmt.Errorf("query company: %w", err)
-	}
-
-	// Aggregate current period from MV
-	filialClause, filialArgs := buildFilialClause(filiais, 3)
-	currentArgs := append([]interface{}{companyID, periodo}, filialArgs...)
-	rows, err := db.Query(`
-		SELECT
-			mv.tipo,
-			mv.tipo_operacao,
-			COALESCE(SUM(mv.valor_contabil), 0) as valor,
-			COALESCE(SUM(mv.vl_icms_origem), 0) as icms
-		FROM mv_mercadorias_agregada mv
-		WHERE mv.company_id = $1 AND mv.mes_ano = $2`+filialClause+`
-		GROUP BY mv.tipo, mv.tipo_operacao
-	`, currentArgs...)
-	if err != nil {
-		return nil, fmt.Errorf("query current period: %w", err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var op OperacaoResumo
-		if err := rows.Scan(&op.Tipo, &op.TipoOperacao, &op.Valor, &op.Icms); err != nil {
-			return nil, fmt.Errorf("scan operation: %w", err)
-		}
-		resumo.Operacoes = append(resumo.Operacoes, op)
-		if op.Tipo == "ENTRADA" {
-			resumo.TotalEntradas += op.Valor
-			resumo.IcmsEntrada += op.Icms
-		} else {
-			resumo.TotalSaidas += op.Valor
-			resumo.IcmsSaida += op.Icms
-		}
-	}
-	resumo.FaturamentoBruto = resumo.TotalSaidas
-	resumo.IcmsAPagar = resumo.IcmsSaida - resumo.IcmsEntrada
-	if resumo.IcmsAPagar < 0 {
-		resumo.IcmsAPagar = 0
-	}
-
-	// Count NFes for current period
-	nfClause, nfArgs := buildFilialClause(filiais, 3)
-	nfQueryArgs := append([]interface{}{companyID, periodo}, nfArgs...)
-	db.QueryRow(`
-		SELECT COUNT(DISTINCT mv.filial_cnpj || mv.mes_ano || mv.tipo_operacao)
-		FROM mv_mercadorias_agregada mv
-		WHERE mv.company_id = $1 AND mv.mes_ano = $2`+nfClause, nfQueryArgs...).Scan(&resumo.TotalNFes)
-
-	// Previous period comparison
-	prevPeriodo := calcPreviousPeriod(periodo)
-	resumo.PeriodoAnterior = prevPeriodo
-
-	var prevEntradas, prevSaidas, prevIcmsEntrada, prevIcmsSaida float64
-	prevClause, prevArgs := buildFilialClause(filiais, 3)
-	prevQueryArgs := append([]interface{}{companyID, prevPeriodo}, prevArgs...)
-	prevRows, err := db.Query(`
-		SELECT
-			mv.tipo,
-			COALESCE(SUM(mv.valor_contabil), 0) as valor,
-			COALESCE(SUM(mv.vl_icms_origem), 0) as icms
-		FROM mv_mercadorias_agregada mv
-		WHERE mv.company_id = $1 AND mv.mes_ano = $2`+prevClause+`
-		GROUP BY mv.tipo
-	`, prevQueryArgs...)
-	if err == nil {
-		defer prevRows.Close()
-		for prevRows.Next() {
-			var tipo string
-			var valor, icms float64
-			if err := prevRows.Scan(&tipo, &valor, &icms); err == nil {
-				if tipo == "ENTRADA" {
-					prevEntradas = valor
-					prevIcmsEntrada = icms
-				} else {
-					prevSaidas = valor
-					prevIcmsSaida = icms
-				}
-			}
-		}
-	}
-	resumo.FaturamentoAnterior = prevSaidas
-	resumo.IcmsAPagarAnterior = prevIcmsSaida - prevIcmsEntrada
-	if resumo.IcmsAPagarAnterior < 0 {
-		resumo.IcmsAPagarAnterior = 0
-	}
-	_ = prevEntradas // used implicitly in icms calc
-
-	// Last import info
-	db.QueryRow(`
-		SELECT COUNT(*), COALESCE(MAX(created_at)::text, 'nunca')
-		FROM import_jobs WHERE company_id = $1 AND status = 'completed'
-	`, companyID).Scan(&resumo.TotalJobs, &resumo.UltimaImportacao)
-
-	// Calculate IBS/CBS projections using same logic as Dashboard (year 2033 = full reform)
-	// Uses mv_mercadorias_agregada with NET calculation (Debit - Credit), excludes CFOP T and O
-	ibsClause, ibsArgs := buildFilialClause(filiais, 3)
-	ibsQueryArgs := append([]interface{}{companyID, periodo}, ibsArgs...)
-	ibsCbsRows, err := db.Query(`
-		SELECT
-			tipo,
-			COALESCE(SUM(CASE WHEN tipo_cfop NOT IN ('T', 'O') THEN valor_contabil ELSE 0 END), 0) as taxable_valor,
-			COALESCE(SUM(CASE WHEN tipo_cfop NOT IN ('T', 'O') THEN vl_icms_origem ELSE 0 END), 0) as taxable_icms
-		FROM mv_mercadorias_agregada
-		WHERE company_id = $1 AND mes_ano = $2`+ibsClause+`
-		GROUP BY tipo
-	`, ibsQueryArgs...)
-	if err == nil {
-		defer ibsCbsRows.Close()
-		// Use 2033 rates (full reform implementation)
-		var percIBSUF, percIBSMun, percCBS, percReducICMS float64
-		rateErr := db.QueryRow(`SELECT perc_ibs_uf, perc_ibs_mun, perc_cbs, perc_reduc_icms FROM tabela_aliquotas WHERE ano = 2033`).
-			Scan(&percIBSUF, &percIBSMun, &percCBS, &percReducICMS)
-		if rateErr != nil {
-			// Default 2033 rates
-			percIBSUF = 26.0
-			percIBSMun = 5.0
-			percCBS = 8.80
-			percReducICMS = 100.0
-		}
-		ibsRate := (percIBSUF + percIBSMun) / 100.0
-		cbsRate := percCBS / 100.0
-		var ibsDebit, ibsCredit, cbsDebit, cbsCredit float64
-		for ibsCbsRows.Next() {
-			var tipo string
-			var valTax, icmsTax float64
-			if err := ibsCbsRows.Scan(&tipo, &valTax, &icmsTax); err != nil {
-				continue
-			}
-			icmsProj := icmsTax * (1.0 - (percReducICMS / 100.0))
-			base := valTax - icmsProj
-			if tipo == "SAIDA" {
-				ibsDebit = base * ibsRate
-				cbsDebit = base * cbsRate
-			} else {
-				ibsCredit = base * ibsRate
-				cbsCredit = base * cbsRate
-			}
-		}
-		resumo.IbsProjetado = ibsDebit - ibsCredit
-		resumo.CbsProjetado = cbsDebit - cbsCredit
-		if resumo.IbsProjetado < 0 {
-			resumo.IbsProjetado = 0
-		}
-		if resumo.CbsProjetado < 0 {
-			resumo.CbsProjetado = 0
-		}
-	}
-
-	// Calcular alíquotas efetivas (% sobre faturamento bruto)
-	if resumo.FaturamentoBruto > 0 {
-		resumo.AliquotaEfetivaICMS = math.Round((resumo.IcmsAPagar/resumo.FaturamentoBruto)*10000) / 100
-		resumo.AliquotaEfetivaIBS = math.Round((resumo.IbsProjetado/resumo.FaturamentoBruto)*10000) / 100
-		resumo.AliquotaEfetivaCBS = math.Round((resumo.CbsProjetado/resumo.FaturamentoBruto)*10000) / 100
-		resumo.AliquotaEfetivaTotalReforma = math.Round(((resumo.IbsProjetado+resumo.CbsProjetado)/resumo.FaturamentoBruto)*10000) / 100
-	}
-	if resumo.FaturamentoAnterior > 0 {
-		resumo.AliquotaEfetivaICMSAnterior = math.Round((resumo.IcmsAPagarAnterior/resumo.FaturamentoAnterior)*10000) / 100
-	}
-
-	return resumo, nil
-}
-
-func calcPreviousPeriod(periodo string) string {
-	// Format: MM/YYYY
-	parts := strings.Split(periodo, "/")
-	if len(parts) != 2 {
-		return periodo
-	}
-	var month, year int
-	fmt.Sscanf(parts[0], "%d", &month)
-	fmt.Sscanf(parts[1], "%d", &year)
-	month--
-	if month < 1 {
-		month = 12
-		year--
-	}
-	return fmt.Sprintf("%02d/%04d", month, year)
-}
-
-func buildExecutiveSummaryPrompt(resumo *ApuracaoResumo) string {
+func buildExecutiveSummaryPrompt(resumo *services.ApuracaoResumo) string {
 	var sb strings.Builder
 	sb.WriteString("IMPORTANTE: Responda EXCLUSIVAMENTE em português brasileiro (pt-BR). NÃO escreva em inglês.\n\n")
 	sb.WriteString(fmt.Sprintf("Empresa: %s (CNPJ: %s)\n", resumo.CompanyName, resumo.CNPJ))
@@ -314,22 +68,9 @@ func buildExecutiveSummaryPrompt(resumo *ApuracaoResumo) string {
 		sb.WriteString(fmt.Sprintf("- IBS efetivo projetado (2033): %.2f%%\n", resumo.AliquotaEfetivaIBS))
 		sb.WriteString(fmt.Sprintf("- CBS efetivo projetado (2033): %.2f%%\n", resumo.AliquotaEfetivaCBS))
 		sb.WriteString(fmt.Sprintf("- Total IBS+CBS efetivo (2033): %.2f%%\n", resumo.AliquotaEfetivaTotalReforma))
-		if resumo.AliquotaEfetivaICMSAnterior > 0 {
-			varAliq := resumo.AliquotaEfetivaICMS - resumo.AliquotaEfetivaICMSAnterior
-			sb.WriteString(fmt.Sprintf("- ICMS efetivo periodo anterior: %.2f%% (variacao: %+.2f p.p.)\n", resumo.AliquotaEfetivaICMSAnterior, varAliq))
-		}
 	}
 
-	if resumo.FaturamentoAnterior > 0 {
-		varFat := ((resumo.FaturamentoBruto - resumo.FaturamentoAnterior) / resumo.FaturamentoAnterior) * 100
-		varIcms := 0.0
-		if resumo.IcmsAPagarAnterior > 0 {
-			varIcms = ((resumo.IcmsAPagar - resumo.IcmsAPagarAnterior) / resumo.IcmsAPagarAnterior) * 100
-		}
-		sb.WriteString(fmt.Sprintf("\nCOMPARATIVO COM PERIODO ANTERIOR (%s):\n", resumo.PeriodoAnterior))
-		sb.WriteString(fmt.Sprintf("- Faturamento anterior: R$ %.2f (variacao: %.1f%%)\n", resumo.FaturamentoAnterior, varFat))
-		sb.WriteString(fmt.Sprintf("- ICMS a recolher anterior: R$ %.2f (variacao: %.1f%%)\n", resumo.IcmsAPagarAnterior, varIcms))
-	}
+	sb.WriteString(resumo.ComparativoPrompt())
 
 	if len(resumo.Operacoes) > 0 {
 		sb.WriteString("\nDETALHAMENTO POR TIPO DE OPERACAO:\n")
@@ -367,7 +108,7 @@ REGRAS:
      | CBS Projetado a Pagar | R$ X | X.XX% | Novo imposto - projecao 2033 |
      | Total IBS + CBS a Pagar | R$ X | X.XX% | Substituira ICMS + PIS/COFINS |
   4. Comentario sobre aliquota efetiva: compare ICMS efetivo atual vs total IBS+CBS efetivo, explique o impacto pratico
-  5. Comparativo com periodo anterior (se disponivel) com variacao percentual e variacao em pontos percentuais da aliquota efetiva
+  5. Comparativo com o mes anterior e com o mesmo mes do ano anterior (se disponiveis) com variacao percentual e variacao em pontos percentuais da aliquota efetiva; comente os alertas de variacao
   6. Destaques relevantes
   7. Recomendacoes praticas (2-3 itens)
 - NAO invente dados. Use APENAS os numeros fornecidos.
@@ -431,13 +172,20 @@ func GetExecutiveSummaryHandler(db *sql.DB) http.HandlerFunc {
 			}
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		// Check if we already have a saved report for this company/period (to save tokens)
 		var savedNarrativa string
 		var savedModel string
-		var resumo *ApuracaoResumo
+		var resumo *services.ApuracaoResumo
 
 		if !forceRegen {
-			db.QueryRow(`
+			tx.QueryRow(`
 				SELECT resumo, 'cached' as model
 				FROM ai_reports
 				WHERE company_id = $1 AND periodo = $2
@@ -448,7 +196,7 @@ func GetExecutiveSummaryHandler(db *sql.DB) http.HandlerFunc {
 
 		// If found saved report, aggregate data and return cached version
 		if !forceRegen && savedNarrativa != "" {
-			resumo, err = getApuracaoResumo(db, companyID, periodo, filiais)
+			resumo, err = services.GetApuracaoResumo(tx, companyID, periodo, filiais)
 			if err != nil {
 				http.Error(w, "Error aggregating data: "+err.Error(), http.StatusInternalServerError)
 				return
@@ -467,11 +215,13 @@ func GetExecutiveSummaryHandler(db *sql.DB) http.HandlerFunc {
 
 		// No saved report found - generate new one
 		// Aggregate data
-		resumo, err = getApuracaoResumo(db, companyID, periodo, filiais)
+		resumo, err = services.GetApuracaoResumo(tx, companyID, periodo, filiais)
 		if err != nil {
 			http.Error(w, "Error aggregating data: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// Libera a conexão antes da chamada à IA; o envio em background usa o pool
+		tx.Rollback()
 
 		response := ExecutiveSummaryResponse{
 			Dados:   resumo,
@@ -503,25 +253,35 @@ func GetExecutiveSummaryHandler(db *sql.DB) http.HandlerFunc {
 					fmt.Printf("[Regenerate] Error saving report: %v\n", errSave)
 				}
 
-				var managers []struct{ Email string }
-				rows, errMgr := db.Query(`SELECT email FROM managers WHERE company_id = $1 AND ativo = true`, companyID)
+				// Gestores que assinam o resumo executivo (qualquer frequência), um e-mail cada;
+				// quem pediu o PDF recebe o relatório anexado
+				var recipients, pdfRecipients []services.ReportRecipient
+				rows, errMgr := db.Query(`
+					SELECT DISTINCT ON (m.id) m.email, s.unsubscribe_token, s.anexar_pdf
+					FROM report_subscriptions s
+					JOIN managers m ON m.id = s.manager_id
+					WHERE s.company_id = $1 AND s.relatorio = $2 AND s.ativo AND m.ativo
+					ORDER BY m.id, (s.frequencia = $3) DESC
+				`, companyID, services.ReportResumoExecutivo, services.FrequencyOnImport)
 				if errMgr == nil {
 					defer rows.Close()
 					for rows.Next() {
-						var m struct{ Email string }
-						if rows.Scan(&m.Email) == nil {
-							managers = append(managers, m)
+						var email, token string
+						var anexarPDF bool
+						if rows.Scan(&email, &token, &anexarPDF) == nil {
+							to := services.ReportRecipient{Email: email, UnsubscribeURL: services.ReportUnsubscribeURL(token)}
+							if anexarPDF {
+								pdfRecipients = append(pdfRecipients, to)
+							} else {
+								recipients = append(recipients, to)
+							}
 						}
 					}
 				}
-				if len(managers) == 0 {
-					fmt.Printf("[Regenerate] No active managers found for company %s\n", companyID)
+				if len(recipients) == 0 && len(pdfRecipients) == 0 {
+					fmt.Printf("[Regenerate] No managers subscribed to the executive summary for company %s\n", companyID)
 					return
 				}
-				recipients := make([]string, len(managers))
-				for i, m := range managers {
-					recipients[i] = m.Email
-				}
 				// Busca créditos em risco (NF-e sem IBS/CBS + Simples Nacional)
 				var ibsRate, cbsRate float64
 				db.QueryRow(`SELECT perc_ibs_uf + perc_ibs_mun, perc_cbs FROM tabela_aliquotas WHERE ano = 2033 LIMIT 1`).Scan(&ibsRate, &cbsRate)
@@ -538,31 +298,28 @@ func GetExecutiveSummaryHandler(db *sql.DB) http.HandlerFunc {
 				nfeCredLost := nfeValorSemCredito * totalRate
 				simplesCredLost := simplesTotalValor * totalRate
 
-				taxData := services.TaxComparisonData{
-					IcmsAPagar:                  resumo.IcmsAPagar,
-					IbsProjetado:                resumo.IbsProjetado,
-					CbsProjetado:                resumo.CbsProjetado,
-					FaturamentoBruto:            resumo.FaturamentoBruto,
-					TotalEntradas:               resumo.TotalEntradas,
-					IcmsSaida:                   resumo.IcmsSaida,
-					IcmsEntrada:                 resumo.IcmsEntrada,
-					AliquotaEfetivaICMS:         resumo.AliquotaEfetivaICMS,
-					AliquotaEfetivaIBS:          resumo.AliquotaEfetivaIBS,
-					AliquotaEfetivaCBS:          resumo.AliquotaEfetivaCBS,
-					AliquotaEfetivaTotalReforma: resumo.AliquotaEfetivaTotalReforma,
-					PeriodoAnterior:             resumo.PeriodoAnterior,
-					FaturamentoAnterior:         resumo.FaturamentoAnterior,
-					IcmsAPagarAnterior:          resumo.IcmsAPagarAnterior,
-					AliquotaEfetivaICMSAnterior: resumo.AliquotaEfetivaICMSAnterior,
-					CreditosEmRiscoTotal:        nfeCredLost + simplesCredLost,
-					CreditosNFeSemIBS:           nfeCredLost,
-					CreditosSimplesNacional:     simplesCredLost,
+				taxData := resumo.TaxComparison()
+				taxData.CreditosEmRiscoTotal = nfeCredLost + simplesCredLost
+				taxData.CreditosNFeSemIBS = nfeCredLost
+				taxData.CreditosSimplesNacional = simplesCredLost
+				var errEmail error
+				if len(recipients) > 0 {
+					errEmail = services.SendAIReportEmail(db, recipients, resumo.CompanyName, periodo, narrativa, dadosBrutos, taxData)
+				}
+				if len(pdfRecipients) > 0 && errEmail == nil {
+					var attachments []services.Attachment
+					pdfData, errPDF := services.RenderExecutiveSummaryPDF(resumo.CompanyName, periodo, narrativa, taxData)
+					if errPDF != nil {
+						fmt.Printf("[Regenerate] Error rendering PDF, sending without it: %v\n", errPDF)
+					} else {
+						attachments = append(attachments, services.PDFAttachment(services.ReportPDFFilename("Resumo Executivo", periodo), pdfData))
+					}
+					errEmail = services.SendAIReportEmail(db, pdfRecipients, resumo.CompanyName, periodo, narrativa, dadosBrutos, taxData, attachments...)
 				}
-				errEmail := services.SendAIReportEmail(recipients, resumo.CompanyName, periodo, narrativa, dadosBrutos, taxData)
 				if errEmail != nil {
 					fmt.Printf("[Regenerate] Error sending email: %v\n", errEmail)
 				} else {
-					fmt.Printf("[Regenerate] Email sent to %d managers: %v\n", len(recipients), recipients)
+					fmt.Printf("[Regenerate] Email queued for %d managers\n", len(recipients)+len(pdfRecipients))
 				}
 			}()
 		}
@@ -578,16 +335,20 @@ func GetExecutiveSummaryHandler(db *sql.DB) http.HandlerFunc {
 
 		dataPrompt := buildExecutiveSummaryPrompt(resumo)
 		// GenerateFast: 1 tentativa, 25s timeout — worker trata retries em background
-		aiResp, err := aiClient.GenerateFast(executiveSummarySystem, dataPrompt, services.ModelFlash, 4096)
+		aiResp, err := aiClient.GenerateFast(executiveSummarySystem, dataPrompt, "", 4096)
 		if err != nil {
 			fmt.Printf("[Regenerate] AI generation error (falling back): %v\n", err)
 			// Re-check cache — worker may have saved a report while we were waiting
 			var workerNarrativa string
-			errRecheck := db.QueryRow(`
-				SELECT resumo FROM ai_reports
-				WHERE company_id = $1 AND periodo = $2
-				ORDER BY created_at DESC LIMIT 1
-			`, companyID, periodo).Scan(&workerNarrativa)
+			errRecheck := sql.ErrNoRows
+			if rtx, errTx := BeginTenantTx(r.Context(), db, companyID); errTx == nil {
+				errRecheck = rtx.QueryRow(`
+					SELECT resumo FROM ai_reports
+					WHERE company_id = $1 AND periodo = $2
+					ORDER BY created_at DESC LIMIT 1
+				`, companyID, periodo).Scan(&workerNarrativa)
+				rtx.Rollback()
+			}
 			if errRecheck == nil && workerNarrativa != "" {
 				response.Narrativa = workerNarrativa
 				response.Model = "cached"
@@ -607,8 +368,8 @@ func GetExecutiveSummaryHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// buildDadosBrutosJSON converts ApuracaoResumo to JSON string for storage
-func buildDadosBrutosJSON(r *ApuracaoResumo) string {
+// buildDadosBrutosJSON converts the summary to JSON string for storage
+func buildDadosBrutosJSON(r *services.ApuracaoResumo) string {
 	data := map[string]any{
 		"empresa":        r.CompanyName,
 		"cnpj":           r.CNPJ,
@@ -624,6 +385,8 @@ func buildDadosBrutosJSON(r *ApuracaoResumo) string {
 		"ibs_cbs_total":  r.IbsProjetado + r.CbsProjetado,
 		"total_nfes":     r.TotalNFes,
 		"operacoes":      r.Operacoes,
+		"tendencias":     r.Tendencias,
+		"anomalias":      r.Anomalias,
 	}
 	jsonBytes, _ := json.Marshal(data)
 	return string(jsonBytes)
@@ -650,6 +413,13 @@ func GetDailyInsightHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		// Check cache first (1-hour TTL per company)
 		insightCacheMu.Lock()
 		if cached, ok := insightCacheMap[companyID]; ok && time.Now().Before(cached.expiresAt) {
@@ -663,7 +433,7 @@ func GetDailyInsightHandler(db *sql.DB) http.HandlerFunc {
 
 		// Use most recent period with data instead of current calendar month
 		var periodo string
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT mes_ano
 			FROM mv_mercadorias_agregada
 			WHERE company_id = $1
@@ -680,11 +450,13 @@ func GetDailyInsightHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		resumo, err := getApuracaoResumo(db, companyID, periodo, nil)
+		resumo, err := services.GetApuracaoResumo(tx, companyID, periodo, nil)
 		if err != nil {
 			http.Error(w, "Error aggregating data: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// Libera a conexão antes da chamada à IA
+		tx.Rollback()
 
 		// If no AI client, generate deterministic insight
 		if aiClient == nil || !aiClient.IsAvailable() {
@@ -697,7 +469,7 @@ func GetDailyInsightHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		dataPrompt := buildExecutiveSummaryPrompt(resumo)
-		aiResp, err := aiClient.GenerateFast(insightSystem, dataPrompt, services.ModelFlash, 256)
+		aiResp, err := aiClient.GenerateFast(insightSystem, dataPrompt, "", 256)
 		if err != nil {
 			fmt.Printf("AI insight error (falling back): %v\n", err)
 			resp := buildFallbackInsight(resumo)
@@ -729,7 +501,7 @@ func GetDailyInsightHandler(db *sql.DB) http.HandlerFunc {
 }
 
 // buildFallbackNarrative generates a narrative without AI when the API is unavailable.
-func buildFallbackNarrative(r *ApuracaoResumo) string {
+func buildFallbackNarrative(r *services.ApuracaoResumo) string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("## Resumo Executivo - %s\n\n", r.Periodo))
 	sb.WriteString(fmt.Sprintf("**Empresa:** %s | **CNPJ:** %s\n\n", r.CompanyName, r.CNPJ))
@@ -752,13 +524,21 @@ func buildFallbackNarrative(r *ApuracaoResumo) string {
 		}
 		sb.WriteString(fmt.Sprintf("**Comparativo com %s:** %s de %.1f%% no faturamento.\n\n", r.PeriodoAnterior, direcao, math.Abs(varFat)))
 	}
+	sb.WriteString(r.AnomaliasMarkdown())
 
 	sb.WriteString("*Relatorio gerado com dados fiscais. A narrativa com IA sera incluida automaticamente quando disponivel.*")
 	return sb.String()
 }
 
 // buildFallbackInsight generates a deterministic insight when AI is unavailable.
-func buildFallbackInsight(r *ApuracaoResumo) InsightResponse {
+func buildFallbackInsight(r *services.ApuracaoResumo) InsightResponse {
+	// Priority 0: Effective ICMS rate out of the usual range
+	for _, a := range r.Anomalias {
+		if a.Indicador == "aliquota_efetiva_icms" {
+			return InsightResponse{Texto: a.Mensagem + ".", Tipo: "alerta"}
+		}
+	}
+
 	// Priority 1: Significant variation from previous period
 	if r.FaturamentoAnterior > 0 {
 		varPct := ((r.FaturamentoBruto - r.FaturamentoAnterior) / r.FaturamentoAnterior) * 100
@@ -843,7 +623,14 @@ func GetAvailablePeriodsHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query(`
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`
 			SELECT DISTINCT mes_ano
 			FROM import_jobs
 			WHERE company_id = $1 AND status = 'completed' AND mes_ano IS NOT NULL AND mes_ano != ''
@@ -901,7 +688,14 @@ func ListSavedAIReportsHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query(`
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`
 			SELECT id, company_id, job_id, periodo, titulo, resumo, gerado_automaticamente, created_at
 			FROM ai_reports
 			WHERE company_id = $1
@@ -950,6 +744,13 @@ func GetSavedAIReportHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		// Extract report ID from URL path
 		path := r.URL.Path
 		reportID := ""
@@ -963,7 +764,7 @@ func GetSavedAIReportHandler(db *sql.DB) http.HandlerFunc {
 
 		// Get report
 		var report SavedAIReport
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT id, company_id, job_id, periodo, titulo, resumo, gerado_automaticamente, created_at
 			FROM ai_reports
 			WHERE id = $1 AND company_id = $2
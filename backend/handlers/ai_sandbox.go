@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AIReaderRole is the PostgreSQL LOGIN role (migrations 067 and 081) the
+// sandbox connects as to run AI-generated SQL. It belongs to no other role and
+// can only read the per-company security-barrier views in ai_sandbox.
+const AIReaderRole = "fb_ai_reader"
+
+// aiSandboxDB is the pool of sandbox connections, opened on first use from
+// AI_SANDBOX_DATABASE_URL (a DSN logging in as AIReaderRole). It is never the
+// application's pool: a session that started as the table owner can always
+// switch back to it, whatever SET ROLE did.
+var (
+	aiSandboxOnce sync.Once
+	aiSandboxPool *sql.DB
+	aiSandboxErr  error
+)
+
+func aiSandboxDB() (*sql.DB, error) {
+	aiSandboxOnce.Do(func() {
+		dsn := os.Getenv("AI_SANDBOX_DATABASE_URL")
+		if dsn == "" {
+			aiSandboxErr = errors.New("AI_SANDBOX_DATABASE_URL not set")
+			return
+		}
+		aiSandboxPool, aiSandboxErr = sql.Open("postgres", dsn)
+		if aiSandboxErr == nil {
+			aiSandboxPool.SetMaxOpenConns(5)
+			aiSandboxPool.SetMaxIdleConns(2)
+			aiSandboxPool.SetConnMaxLifetime(30 * time.Minute)
+		}
+	})
+	return aiSandboxPool, aiSandboxErr
+}
+
+// Sandbox limits, overridable per environment.
+var (
+	aiQueryTimeout  = time.Duration(envPositiveInt("AI_QUERY_TIMEOUT_MS", 5000)) * time.Millisecond
+	aiQueryMaxRows  = envPositiveInt("AI_QUERY_MAX_ROWS", 500)
+	aiQueryMaxBytes = envPositiveInt("AI_QUERY_MAX_BYTES", 1<<20)
+)
+
+func envPositiveInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// sandboxResult holds what the sandbox returned and whether a cap cut it short.
+type sandboxResult struct {
+	Columns   []string
+	Types     []string // database type names (NUMERIC, INT8, VARCHAR...), same order as Columns
+	Rows      []map[string]interface{}
+	Truncated bool
+}
+
+// errSandboxUnavailable marks failures preparing the sandbox (DSN, role or
+// views missing) — not the generated SQL's fault, so not worth a repair attempt.
+var errSandboxUnavailable = errors.New("ai sandbox unavailable")
+
+// reTrailingSemicolons strips the statement terminator the model usually adds;
+// the query is wrapped in a subquery, where ';' would be a syntax error.
+var reTrailingSemicolons = regexp.MustCompile(`[;\s]+$`)
+
+// runSandboxedQuery executes query for one company on a sandbox connection
+// (aiSandboxDB). The isolation does not depend on validateReadOnlySQL:
+//   - the connection logs in as AIReaderRole, which has no role to switch to
+//     and no access to schema public;
+//   - the company is bound to the connection's backend pid in
+//     ai_sandbox_sessoes, written through db (the owner), and the views filter
+//     on it — the read-only sandbox cannot change it;
+//   - READ ONLY transaction with a statement_timeout, search_path = ai_sandbox;
+//   - the company id is also bound as $1 for the query's own filters, and the
+//     query is wrapped as a subquery with LIMIT $2, which also forces a single
+//     statement; results stop at aiQueryMaxBytes.
+func runSandboxedQuery(ctx context.Context, db *sql.DB, companyID, query string) (*sandboxResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, aiQueryTimeout+2*time.Second)
+	defer cancel()
+
+	sandbox, err := aiSandboxDB()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errSandboxUnavailable, err)
+	}
+	conn, err := sandbox.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errSandboxUnavailable, err)
+	}
+	defer conn.Close()
+
+	// Refuse a DSN that logs in as anything but the unprivileged reader
+	var pid int
+	var user string
+	var privileged bool
+	err = conn.QueryRowContext(ctx, `
+		SELECT pg_backend_pid(), session_user::text, r.rolsuper OR r.rolbypassrls
+			OR EXISTS (SELECT 1 FROM pg_auth_members m WHERE m.member = r.oid)
+		FROM pg_roles r WHERE r.rolname = session_user
+	`).Scan(&pid, &user, &privileged)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errSandboxUnavailable, err)
+	}
+	if user != AIReaderRole || privileged {
+		return nil, fmt.Errorf("%w: AI_SANDBOX_DATABASE_URL must log in as %s (no superuser, no role memberships), got %s",
+			errSandboxUnavailable, AIReaderRole, user)
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO ai_sandbox_sessoes (pid, company_id) VALUES ($1, $2)
+		ON CONFLICT (pid) DO UPDATE SET company_id = EXCLUDED.company_id, criado_em = now()
+	`, pid, companyID); err != nil {
+		return nil, fmt.Errorf("%w: bind company: %w", errSandboxUnavailable, err)
+	}
+	// Unbound before the connection goes back to the pool
+	defer db.Exec("DELETE FROM ai_sandbox_sessoes WHERE pid = $1", pid)
+
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errSandboxUnavailable, err)
+	}
+	defer tx.Rollback()
+
+	setup := []struct {
+		stmt string
+		args []interface{}
+	}{
+		{"SELECT set_config('statement_timeout', $1, true)", []interface{}{strconv.Itoa(int(aiQueryTimeout.Milliseconds()))}},
+		{"SET LOCAL search_path = ai_sandbox", nil},
+	}
+	for _, s := range setup {
+		if _, err := tx.ExecContext(ctx, s.stmt, s.args...); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errSandboxUnavailable, s.stmt, err)
+		}
+	}
+
+	// $1 must also be the company bound to the connection: a mismatch returns nothing
+	wrapped := fmt.Sprintf("SELECT * FROM (\n%s\n) AS ai_q WHERE $1::uuid = ai_sandbox.company_id() LIMIT $2::int",
+		reTrailingSemicolons.ReplaceAllString(strings.TrimSpace(query), ""))
+
+	rows, err := tx.QueryContext(ctx, wrapped, companyID, aiQueryMaxRows+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	res := &sandboxResult{Columns: cols, Rows: []map[string]interface{}{}}
+	if colTypes, err := rows.ColumnTypes(); err == nil {
+		for _, ct := range colTypes {
+			res.Types = append(res.Types, ct.DatabaseTypeName())
+		}
+	}
+	size := 0
+	for rows.Next() {
+		if len(res.Rows) == aiQueryMaxRows || size > aiQueryMaxBytes {
+			res.Truncated = true
+			break
+		}
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			continue
+		}
+		row := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			// PostgreSQL DECIMAL/NUMERIC scans as []byte; convert to string
+			// to prevent json.Marshal from base64-encoding it.
+			if b, ok := vals[i].([]byte); ok {
+				row[col] = string(b)
+				size += len(b)
+			} else {
+				row[col] = vals[i]
+				size += len(fmt.Sprint(vals[i]))
+			}
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	return res, rows.Err()
+}
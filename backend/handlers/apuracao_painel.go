@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -71,129 +72,141 @@ func ApuracaoPainelHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// ── Meses disponíveis (union das 3 tabelas) ──────────────────────────
-		rows, err := db.Query(`
-			SELECT DISTINCT mes_ano FROM (
-				SELECT mes_ano FROM nfe_saidas   WHERE company_id = $1
-				UNION
-				SELECT mes_ano FROM nfe_entradas WHERE company_id = $1
-				UNION
-				SELECT mes_ano FROM cte_entradas WHERE company_id = $1
-			) t ORDER BY mes_ano DESC
-		`, companyID)
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
 		if err != nil {
-			jsonErr(w, http.StatusInternalServerError, "Erro ao listar períodos: "+err.Error())
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
 			return
 		}
-		defer rows.Close()
-
-		var meses []string
-		for rows.Next() {
-			var m string
-			if err := rows.Scan(&m); err == nil {
-				meses = append(meses, m)
-			}
-		}
-		if meses == nil {
-			meses = []string{}
-		}
+		defer tx.Rollback()
 
-		// ── Mês selecionado ──────────────────────────────────────────────────
-		mesAno := r.URL.Query().Get("mes_ano")
-		if mesAno == "" && len(meses) > 0 {
-			mesAno = meses[0] // mais recente
+		resp, err := loadApuracaoPainel(tx, companyID, r.URL.Query().Get("mes_ano"))
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, err.Error())
+			return
 		}
 
-		var resp apuracaoPainelResponse
-		resp.MesesDisponiveis = meses
-		resp.MesSelecionado = mesAno
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
 
-		if mesAno == "" {
-			// Sem dados — retorna zeros
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(resp)
-			return
-		}
+// loadApuracaoPainel computes the IBS/CBS panel for mesAno (MM/YYYY), or for
+// the most recent month with documents when mesAno is empty.
+func loadApuracaoPainel(db dbQuerier, companyID, mesAno string) (*apuracaoPainelResponse, error) {
+	// ── Meses disponíveis (union das 3 tabelas) ──────────────────────────
+	rows, err := db.Query(`
+		SELECT DISTINCT mes_ano FROM (
+			SELECT mes_ano FROM nfe_saidas   WHERE company_id = $1
+			UNION
+			SELECT mes_ano FROM nfe_entradas WHERE company_id = $1
+			UNION
+			SELECT mes_ano FROM cte_entradas WHERE company_id = $1
+		) t ORDER BY mes_ano DESC
+	`, companyID)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao listar períodos: %w", err)
+	}
+	defer rows.Close()
 
-		// ── Débitos (nfe_saidas) ─────────────────────────────────────────────
-		var debitoIBSUF, debitoIBSMun, debitoIBS, debitoCBS float64
-		var qtdSaidas int
-		err = db.QueryRow(`
-			SELECT
-				COALESCE(SUM(v_ibs_uf),  0),
-				COALESCE(SUM(v_ibs_mun), 0),
-				COALESCE(SUM(v_ibs),     0),
-				COALESCE(SUM(v_cbs),     0),
-				COUNT(*)
-			FROM nfe_saidas
-			WHERE company_id = $1 AND mes_ano = $2
-		`, companyID, mesAno).Scan(&debitoIBSUF, &debitoIBSMun, &debitoIBS, &debitoCBS, &qtdSaidas)
-		if err != nil && err != sql.ErrNoRows {
-			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar saídas: "+err.Error())
-			return
+	var meses []string
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err == nil {
+			meses = append(meses, m)
 		}
+	}
+	if meses == nil {
+		meses = []string{}
+	}
 
-		// ── Créditos NF-e (nfe_entradas) ─────────────────────────────────────
-		var creditoNfeIBSUF, creditoNfeIBSMun, creditoNfeIBS, creditoNfeCBS float64
-		var qtdEntradas int
-		err = db.QueryRow(`
-			SELECT
-				COALESCE(SUM(v_ibs_uf),  0),
-				COALESCE(SUM(v_ibs_mun), 0),
-				COALESCE(SUM(v_ibs),     0),
-				COALESCE(SUM(v_cbs),     0),
-				COUNT(*)
-			FROM nfe_entradas
-			WHERE company_id = $1 AND mes_ano = $2
-		`, companyID, mesAno).Scan(&creditoNfeIBSUF, &creditoNfeIBSMun, &creditoNfeIBS, &creditoNfeCBS, &qtdEntradas)
-		if err != nil && err != sql.ErrNoRows {
-			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar entradas: "+err.Error())
-			return
-		}
+	// ── Mês selecionado ──────────────────────────────────────────────────
+	if mesAno == "" && len(meses) > 0 {
+		mesAno = meses[0] // mais recente
+	}
 
-		// ── Créditos CT-e (cte_entradas) ─────────────────────────────────────
-		var creditoCteIBS, creditoCteCBS float64
-		var qtdCtes int
-		err = db.QueryRow(`
-			SELECT
-				COALESCE(SUM(v_ibs), 0),
-				COALESCE(SUM(v_cbs), 0),
-				COUNT(*)
-			FROM cte_entradas
-			WHERE company_id = $1 AND mes_ano = $2
-		`, companyID, mesAno).Scan(&creditoCteIBS, &creditoCteCBS, &qtdCtes)
-		if err != nil && err != sql.ErrNoRows {
-			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar CT-e: "+err.Error())
-			return
-		}
+	var resp apuracaoPainelResponse
+	resp.MesesDisponiveis = meses
+	resp.MesSelecionado = mesAno
 
-		// ── Cálculo dos saldos ────────────────────────────────────────────────
-		resp.IBS = apuracaoIBSResult{
-			DebitoUF:        debitoIBSUF,
-			DebitoMun:       debitoIBSMun,
-			DebitoTotal:     debitoIBS,
-			QtdSaidas:       qtdSaidas,
-			CreditoNfeUF:    creditoNfeIBSUF,
-			CreditoNfeMun:   creditoNfeIBSMun,
-			CreditoNfeTotal: creditoNfeIBS,
-			QtdEntradas:     qtdEntradas,
-			CreditoCte:      creditoCteIBS,
-			QtdCtes:         qtdCtes,
-			SaldoUF:         debitoIBSUF - creditoNfeIBSUF,
-			SaldoMun:        debitoIBSMun - creditoNfeIBSMun,
-			SaldoTotal:      debitoIBS - creditoNfeIBS - creditoCteIBS,
-		}
-		resp.CBS = apuracaoCBSResult{
-			DebitoTotal:     debitoCBS,
-			QtdSaidas:       qtdSaidas,
-			CreditoNfeTotal: creditoNfeCBS,
-			QtdEntradas:     qtdEntradas,
-			CreditoCte:      creditoCteCBS,
-			QtdCtes:         qtdCtes,
-			SaldoTotal:      debitoCBS - creditoNfeCBS - creditoCteCBS,
-		}
+	if mesAno == "" {
+		// Sem dados — retorna zeros
+		return &resp, nil
+	}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(resp)
+	// ── Débitos (nfe_saidas) ─────────────────────────────────────────────
+	var debitoIBSUF, debitoIBSMun, debitoIBS, debitoCBS float64
+	var qtdSaidas int
+	err = db.QueryRow(`
+		SELECT
+			COALESCE(SUM(v_ibs_uf),  0),
+			COALESCE(SUM(v_ibs_mun), 0),
+			COALESCE(SUM(v_ibs),     0),
+			COALESCE(SUM(v_cbs),     0),
+			COUNT(*)
+		FROM nfe_saidas
+		WHERE company_id = $1 AND mes_ano = $2
+	`, companyID, mesAno).Scan(&debitoIBSUF, &debitoIBSMun, &debitoIBS, &debitoCBS, &qtdSaidas)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("Erro ao consultar saídas: %w", err)
 	}
+
+	// ── Créditos NF-e (nfe_entradas) ─────────────────────────────────────
+	var creditoNfeIBSUF, creditoNfeIBSMun, creditoNfeIBS, creditoNfeCBS float64
+	var qtdEntradas int
+	err = db.QueryRow(`
+		SELECT
+			COALESCE(SUM(v_ibs_uf),  0),
+			COALESCE(SUM(v_ibs_mun), 0),
+			COALESCE(SUM(v_ibs),     0),
+			COALESCE(SUM(v_cbs),     0),
+			COUNT(*)
+		FROM nfe_entradas
+		WHERE company_id = $1 AND mes_ano = $2
+	`, companyID, mesAno).Scan(&creditoNfeIBSUF, &creditoNfeIBSMun, &creditoNfeIBS, &creditoNfeCBS, &qtdEntradas)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("Erro ao consultar entradas: %w", err)
+	}
+
+	// ── Créditos CT-e (cte_entradas) ─────────────────────────────────────
+	var creditoCteIBS, creditoCteCBS float64
+	var qtdCtes int
+	err = db.QueryRow(`
+		SELECT
+			COALESCE(SUM(v_ibs), 0),
+			COALESCE(SUM(v_cbs), 0),
+			COUNT(*)
+		FROM cte_entradas
+		WHERE company_id = $1 AND mes_ano = $2
+	`, companyID, mesAno).Scan(&creditoCteIBS, &creditoCteCBS, &qtdCtes)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("Erro ao consultar CT-e: %w", err)
+	}
+
+	// ── Cálculo dos saldos ────────────────────────────────────────────────
+	resp.IBS = apuracaoIBSResult{
+		DebitoUF:        debitoIBSUF,
+		DebitoMun:       debitoIBSMun,
+		DebitoTotal:     debitoIBS,
+		QtdSaidas:       qtdSaidas,
+		CreditoNfeUF:    creditoNfeIBSUF,
+		CreditoNfeMun:   creditoNfeIBSMun,
+		CreditoNfeTotal: creditoNfeIBS,
+		QtdEntradas:     qtdEntradas,
+		CreditoCte:      creditoCteIBS,
+		QtdCtes:         qtdCtes,
+		SaldoUF:         debitoIBSUF - creditoNfeIBSUF,
+		SaldoMun:        debitoIBSMun - creditoNfeIBSMun,
+		SaldoTotal:      debitoIBS - creditoNfeIBS - creditoCteIBS,
+	}
+	resp.CBS = apuracaoCBSResult{
+		DebitoTotal:     debitoCBS,
+		QtdSaidas:       qtdSaidas,
+		CreditoNfeTotal: creditoNfeCBS,
+		QtdEntradas:     qtdEntradas,
+		CreditoCte:      creditoCteCBS,
+		QtdCtes:         qtdCtes,
+		SaldoTotal:      debitoCBS - creditoNfeCBS - creditoCteCBS,
+	}
+
+	return &resp, nil
 }
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -69,10 +70,23 @@ func getJWTSecret() []byte {
 	return []byte(secret)
 }
 
+// IsProduction reports whether the server runs in production:
+// ENVIRONMENT=production (or prod). Deploys that predate ENVIRONMENT are
+// recognised, as before, by a configured DATABASE_URL.
+func IsProduction() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("ENVIRONMENT"))) {
+	case "production", "prod":
+		return true
+	case "":
+		return os.Getenv("DATABASE_URL") != ""
+	}
+	return false
+}
+
 // ValidateJWTSecret logs a warning (dev) or fatals (prod) if JWT_SECRET is not set.
 func ValidateJWTSecret() {
 	if os.Getenv("JWT_SECRET") == "" {
-		if os.Getenv("DATABASE_URL") != "" {
+		if IsProduction() {
 			log.Fatal("FATAL: JWT_SECRET not set — set it to a 32+ byte random value before deploying.")
 		}
 		log.Println("WARNING: JWT_SECRET not set — using insecure default (OK for local dev only).")
@@ -777,7 +791,7 @@ func ForgotPasswordHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		err = services.SendPasswordResetEmail(req.Email, token)
+		err = services.SendPasswordResetEmail(db, req.Email, token)
 		if err != nil {
 			log.Printf("[ForgotPassword] Failed to send email: %v", err)
 			w.Header().Set("Content-Type", "application/json")
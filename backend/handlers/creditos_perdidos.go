@@ -3,9 +3,12 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
+	"fb_apu01/export"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -112,213 +115,341 @@ func CreditosPerdidosHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Alíquotas 2033
-		var ibsRate, cbsRate float64
-		err = db.QueryRow(`
-			SELECT perc_ibs_uf + perc_ibs_mun, perc_cbs
-			FROM tabela_aliquotas WHERE ano = 2033 LIMIT 1
-		`).Scan(&ibsRate, &cbsRate)
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
 		if err != nil {
-			ibsRate = 17.7
-			cbsRate = 8.8
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
 		}
+		defer tx.Rollback()
 
-		resp := CreditosPerdidosResponse{
-			Aliquotas: credPerdAliquota{Ano: 2033, IBS: ibsRate, CBS: cbsRate},
+		format, ok := exportFormat(w, r)
+		if !ok {
+			return
 		}
 
-		// ── 1. NF-e sem IBS/CBS ──────────────────────────────────────────────
-		// Exclui transferências internas: mesma raiz CNPJ (8 primeiros dígitos)
-		// cobre transferências entre filiais, uso e consumo e ativo imobilizado.
-
-		// Total de notas de terceiros (excluindo intra-grupo)
-		var totalUniverse int
-		db.QueryRow(`
-			SELECT COUNT(*)
-			FROM nfe_entradas
-			WHERE company_id = $1
-			  AND LEFT(forn_cnpj, 8) != LEFT(dest_cnpj_cpf, 8)
-		`, companyID).Scan(&totalUniverse)
-
-		// Notas sem IBS/CBS de terceiros, agrupadas por fornecedor
-		rows, err := db.Query(`
-			SELECT
-				forn_cnpj,
-				COALESCE(forn_nome, ''),
-				COUNT(*)          AS qtd_notas,
-				SUM(v_nf)         AS valor_total
-			FROM nfe_entradas
-			WHERE company_id = $1
-			  AND v_ibs = 0
-			  AND v_cbs = 0
-			  AND LEFT(forn_cnpj, 8) != LEFT(dest_cnpj_cpf, 8)
-			GROUP BY forn_cnpj, forn_nome
-			ORDER BY valor_total DESC
-			LIMIT 50
-		`, companyID)
+		resp, err := loadCreditosPerdidos(tx, companyID)
 		if err != nil {
-			log.Printf("CreditosPerdidos nfe query error: %v", err)
-			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar NF-e")
+			jsonErr(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer rows.Close()
 
-		var nfeFornList []credPerdFornecedor
-		var nfeTotalNotas int
-		var nfeValorTotal float64
-
-		for rows.Next() {
-			var f credPerdFornecedor
-			if err := rows.Scan(&f.FornCNPJ, &f.FornNome, &f.QtdNotas, &f.ValorTotal); err != nil {
-				continue
+		if format != "" {
+			xw, err := beginExport(w, format, "creditos-perdidos")
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, err.Error())
+				return
 			}
-			f.IBSEstimado = f.ValorTotal * (ibsRate / 100.0)
-			f.CBSEstimado = f.ValorTotal * (cbsRate / 100.0)
-			f.TotalEstimado = f.IBSEstimado + f.CBSEstimado
-			nfeFornList = append(nfeFornList, f)
-			nfeTotalNotas += f.QtdNotas
-			nfeValorTotal += f.ValorTotal
+			finishExport(xw, "CreditosPerdidos", writeCreditosPerdidosExport(xw, resp))
+			return
 		}
 
-		if nfeFornList == nil {
-			nfeFornList = []credPerdFornecedor{}
-		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
 
-		percSem := 0.0
-		if totalUniverse > 0 {
-			percSem = float64(nfeTotalNotas) / float64(totalUniverse) * 100.0
-		}
-		nfeIBS := nfeValorTotal * (ibsRate / 100.0)
-		nfeCBS := nfeValorTotal * (cbsRate / 100.0)
-
-		resp.NFeSemCredito = credPerdNFe{
-			TotalNotas:     nfeTotalNotas,
-			TotalUniverse:  totalUniverse,
-			PercSemCredito: percSem,
-			ValorTotal:     nfeValorTotal,
-			IBSEstimado:    nfeIBS,
-			CBSEstimado:    nfeCBS,
-			TotalEstimado:  nfeIBS + nfeCBS,
-			PorFornecedor:  nfeFornList,
+// writeCreditosPerdidosExport writes one sheet per section of the response:
+// the summary by origin, the rates used and each breakdown list.
+func writeCreditosPerdidosExport(xw export.Writer, cp *CreditosPerdidosResponse) error {
+	if err := xw.Sheet("Resumo", []export.Column{
+		{Header: "Origem", Kind: export.Text, Width: 24},
+		{Header: "Documentos/Fornecedores", Kind: export.Integer, Width: 24},
+		{Header: "Universo", Kind: export.Integer},
+		{Header: "% sem Crédito", Kind: export.Percent},
+		{Header: "Valor Total", Kind: export.Money},
+		{Header: "IBS", Kind: export.Money},
+		{Header: "CBS", Kind: export.Money},
+		{Header: "Total em Risco", Kind: export.Money},
+	}); err != nil {
+		return err
+	}
+	nfe, sn, cte := cp.NFeSemCredito, cp.SimplesNacional, cp.CteSemCredito
+	rows := [][]interface{}{
+		{"NF-e sem IBS/CBS", nfe.TotalNotas, nfe.TotalUniverse, nfe.PercSemCredito, nfe.ValorTotal, nfe.IBSEstimado, nfe.CBSEstimado, nfe.TotalEstimado},
+		{"Simples Nacional", sn.TotalFornecedores, nil, nil, sn.ValorTotal, sn.IBSPerdido, sn.CBSPerdido, sn.TotalPerdido},
+		{"CT-e sem IBS/CBS", cte.TotalCTes, cte.TotalUniverse, cte.PercSemCredito, cte.ValorTotal, cte.IBSEstimado, cte.CBSEstimado, cte.TotalEstimado},
+		{"Total", nil, nil, nil, nil, nil, nil, cp.TotalCreditoEmRisco},
+	}
+	for _, row := range rows {
+		if err := xw.Row(row...); err != nil {
+			return err
 		}
+	}
 
-		// ── 2. Simples Nacional (EFD) ────────────────────────────────────────
-		simplesRows, err := db.Query(`
-			SELECT
-				fornecedor_cnpj,
-				fornecedor_nome,
-				SUM(total_valor) AS valor_total
-			FROM mv_operacoes_simples
-			WHERE company_id = $1
-			GROUP BY fornecedor_cnpj, fornecedor_nome
-			ORDER BY valor_total DESC
-			LIMIT 50
-		`, companyID)
-		if err != nil {
-			log.Printf("CreditosPerdidos simples query error: %v", err)
-			// Não aborta — retorna sem dados do Simples
-		}
+	if err := xw.Sheet("Alíquotas", []export.Column{
+		{Header: "Ano", Kind: export.Integer},
+		{Header: "IBS", Kind: export.Percent},
+		{Header: "CBS", Kind: export.Percent},
+	}); err != nil {
+		return err
+	}
+	if err := xw.Row(cp.Aliquotas.Ano, cp.Aliquotas.IBS, cp.Aliquotas.CBS); err != nil {
+		return err
+	}
 
-		var simplesFornList []credPerdSimplesForn
-		var simplesTotalValor, simplesIBS, simplesCBS float64
-
-		if simplesRows != nil {
-			defer simplesRows.Close()
-			for simplesRows.Next() {
-				var f credPerdSimplesForn
-				if err := simplesRows.Scan(&f.FornCNPJ, &f.FornNome, &f.ValorTotal); err != nil {
-					continue
-				}
-				f.IBSPerdido = f.ValorTotal * (ibsRate / 100.0)
-				f.CBSPerdido = f.ValorTotal * (cbsRate / 100.0)
-				f.TotalPerdido = f.IBSPerdido + f.CBSPerdido
-				simplesFornList = append(simplesFornList, f)
-				simplesTotalValor += f.ValorTotal
-				simplesIBS += f.IBSPerdido
-				simplesCBS += f.CBSPerdido
-			}
+	if err := xw.Sheet("NF-e por Fornecedor", []export.Column{
+		{Header: "CNPJ", Kind: export.Text, Width: 18},
+		{Header: "Fornecedor", Kind: export.Text, Width: 40},
+		{Header: "Notas", Kind: export.Integer},
+		{Header: "Valor Total", Kind: export.Money},
+		{Header: "IBS Estimado", Kind: export.Money},
+		{Header: "CBS Estimado", Kind: export.Money},
+		{Header: "Total Estimado", Kind: export.Money},
+	}); err != nil {
+		return err
+	}
+	for _, f := range nfe.PorFornecedor {
+		if err := xw.Row(f.FornCNPJ, f.FornNome, f.QtdNotas, f.ValorTotal, f.IBSEstimado, f.CBSEstimado, f.TotalEstimado); err != nil {
+			return err
 		}
-		if simplesFornList == nil {
-			simplesFornList = []credPerdSimplesForn{}
+	}
+
+	if err := xw.Sheet("Simples Nacional", []export.Column{
+		{Header: "CNPJ", Kind: export.Text, Width: 18},
+		{Header: "Fornecedor", Kind: export.Text, Width: 40},
+		{Header: "Valor Total", Kind: export.Money},
+		{Header: "IBS Perdido", Kind: export.Money},
+		{Header: "CBS Perdido", Kind: export.Money},
+		{Header: "Total Perdido", Kind: export.Money},
+	}); err != nil {
+		return err
+	}
+	for _, f := range sn.PorFornecedor {
+		if err := xw.Row(f.FornCNPJ, f.FornNome, f.ValorTotal, f.IBSPerdido, f.CBSPerdido, f.TotalPerdido); err != nil {
+			return err
 		}
+	}
 
-		resp.SimplesNacional = credPerdSimples{
-			TotalFornecedores: len(simplesFornList),
-			ValorTotal:        simplesTotalValor,
-			IBSPerdido:        simplesIBS,
-			CBSPerdido:        simplesCBS,
-			TotalPerdido:      simplesIBS + simplesCBS,
-			PorFornecedor:     simplesFornList,
+	if err := xw.Sheet("CT-e por Transportadora", []export.Column{
+		{Header: "CNPJ", Kind: export.Text, Width: 18},
+		{Header: "Transportadora", Kind: export.Text, Width: 40},
+		{Header: "CT-e", Kind: export.Integer},
+		{Header: "Valor Total", Kind: export.Money},
+		{Header: "IBS Estimado", Kind: export.Money},
+		{Header: "CBS Estimado", Kind: export.Money},
+		{Header: "Total Estimado", Kind: export.Money},
+	}); err != nil {
+		return err
+	}
+	for _, t := range cte.PorTransportadora {
+		if err := xw.Row(t.EmitCNPJ, t.EmitNome, t.QtdCTes, t.ValorTotal, t.IBSEstimado, t.CBSEstimado, t.TotalEstimado); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// ── 3. CT-e sem IBS/CBS ──────────────────────────────────────────────
-		var cteTotalUniverse int
-		db.QueryRow(`SELECT COUNT(*) FROM cte_entradas WHERE company_id = $1`, companyID).Scan(&cteTotalUniverse)
-
-		cteRows, err := db.Query(`
-			SELECT
-				emit_cnpj,
-				COALESCE(emit_nome, ''),
-				COUNT(*)        AS qtd_ctes,
-				SUM(v_prest)    AS valor_total
-			FROM cte_entradas
-			WHERE company_id = $1
-			  AND (v_ibs IS NULL OR v_ibs = 0)
-			  AND (v_cbs IS NULL OR v_cbs = 0)
-			GROUP BY emit_cnpj, emit_nome
-			ORDER BY valor_total DESC
-			LIMIT 50
-		`, companyID)
-		if err != nil {
-			log.Printf("CreditosPerdidos cte query error: %v", err)
+// loadCreditosPerdidos estimates the IBS/CBS credits at risk for the company;
+// shared by the JSON endpoint and the PDF export.
+func loadCreditosPerdidos(tx *sql.Tx, companyID string) (*CreditosPerdidosResponse, error) {
+	// Alíquotas 2033
+	var ibsRate, cbsRate float64
+	err := tx.QueryRow(`
+		SELECT perc_ibs_uf + perc_ibs_mun, perc_cbs
+		FROM tabela_aliquotas WHERE ano = 2033 LIMIT 1
+	`).Scan(&ibsRate, &cbsRate)
+	if err != nil {
+		ibsRate = 17.7
+		cbsRate = 8.8
+	}
+
+	resp := CreditosPerdidosResponse{
+		Aliquotas: credPerdAliquota{Ano: 2033, IBS: ibsRate, CBS: cbsRate},
+	}
+
+	// ── 1. NF-e sem IBS/CBS ──────────────────────────────────────────────
+	// Exclui transferências internas: mesma raiz CNPJ (8 primeiros dígitos)
+	// cobre transferências entre filiais, uso e consumo e ativo imobilizado.
+
+	// Total de notas de terceiros (excluindo intra-grupo)
+	var totalUniverse int
+	tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM nfe_entradas
+		WHERE company_id = $1
+		  AND LEFT(forn_cnpj, 8) != LEFT(dest_cnpj_cpf, 8)
+	`, companyID).Scan(&totalUniverse)
+
+	// Notas sem IBS/CBS de terceiros, agrupadas por fornecedor
+	rows, err := tx.Query(`
+		SELECT
+			forn_cnpj,
+			COALESCE(forn_nome, ''),
+			COUNT(*)          AS qtd_notas,
+			SUM(v_nf)         AS valor_total
+		FROM nfe_entradas
+		WHERE company_id = $1
+		  AND v_ibs = 0
+		  AND v_cbs = 0
+		  AND LEFT(forn_cnpj, 8) != LEFT(dest_cnpj_cpf, 8)
+		GROUP BY forn_cnpj, forn_nome
+		ORDER BY valor_total DESC
+		LIMIT 50
+	`, companyID)
+	if err != nil {
+		log.Printf("CreditosPerdidos nfe query error: %v", err)
+		return nil, errors.New("Erro ao consultar NF-e")
+	}
+	defer rows.Close()
+
+	var nfeFornList []credPerdFornecedor
+	var nfeTotalNotas int
+	var nfeValorTotal float64
+
+	for rows.Next() {
+		var f credPerdFornecedor
+		if err := rows.Scan(&f.FornCNPJ, &f.FornNome, &f.QtdNotas, &f.ValorTotal); err != nil {
+			continue
 		}
+		f.IBSEstimado = f.ValorTotal * (ibsRate / 100.0)
+		f.CBSEstimado = f.ValorTotal * (cbsRate / 100.0)
+		f.TotalEstimado = f.IBSEstimado + f.CBSEstimado
+		nfeFornList = append(nfeFornList, f)
+		nfeTotalNotas += f.QtdNotas
+		nfeValorTotal += f.ValorTotal
+	}
+
+	if nfeFornList == nil {
+		nfeFornList = []credPerdFornecedor{}
+	}
+
+	percSem := 0.0
+	if totalUniverse > 0 {
+		percSem = float64(nfeTotalNotas) / float64(totalUniverse) * 100.0
+	}
+	nfeIBS := nfeValorTotal * (ibsRate / 100.0)
+	nfeCBS := nfeValorTotal * (cbsRate / 100.0)
+
+	resp.NFeSemCredito = credPerdNFe{
+		TotalNotas:     nfeTotalNotas,
+		TotalUniverse:  totalUniverse,
+		PercSemCredito: percSem,
+		ValorTotal:     nfeValorTotal,
+		IBSEstimado:    nfeIBS,
+		CBSEstimado:    nfeCBS,
+		TotalEstimado:  nfeIBS + nfeCBS,
+		PorFornecedor:  nfeFornList,
+	}
+
+	// ── 2. Simples Nacional (EFD) ────────────────────────────────────────
+	// The Simples view is optional: a failure is rolled back to the savepoint
+	// so it does not abort the tenant transaction
+	tx.Exec("SAVEPOINT simples")
+	simplesRows, err := tx.Query(`
+		SELECT
+			fornecedor_cnpj,
+			fornecedor_nome,
+			SUM(total_valor) AS valor_total
+		FROM mv_operacoes_simples
+		WHERE company_id = $1
+		GROUP BY fornecedor_cnpj, fornecedor_nome
+		ORDER BY valor_total DESC
+		LIMIT 50
+	`, companyID)
+	if err != nil {
+		log.Printf("CreditosPerdidos simples query error: %v", err)
+		tx.Exec("ROLLBACK TO SAVEPOINT simples")
+		// Não aborta — retorna sem dados do Simples
+	}
 
-		var cteTranspList []credPerdTransportadora
-		var cteTotalCTes int
-		var cteValorTotal float64
-
-		if cteRows != nil {
-			defer cteRows.Close()
-			for cteRows.Next() {
-				var t credPerdTransportadora
-				if err := cteRows.Scan(&t.EmitCNPJ, &t.EmitNome, &t.QtdCTes, &t.ValorTotal); err != nil {
-					continue
-				}
-				t.IBSEstimado = t.ValorTotal * (ibsRate / 100.0)
-				t.CBSEstimado = t.ValorTotal * (cbsRate / 100.0)
-				t.TotalEstimado = t.IBSEstimado + t.CBSEstimado
-				cteTranspList = append(cteTranspList, t)
-				cteTotalCTes += t.QtdCTes
-				cteValorTotal += t.ValorTotal
+	var simplesFornList []credPerdSimplesForn
+	var simplesTotalValor, simplesIBS, simplesCBS float64
+
+	if simplesRows != nil {
+		defer simplesRows.Close()
+		for simplesRows.Next() {
+			var f credPerdSimplesForn
+			if err := simplesRows.Scan(&f.FornCNPJ, &f.FornNome, &f.ValorTotal); err != nil {
+				continue
 			}
+			f.IBSPerdido = f.ValorTotal * (ibsRate / 100.0)
+			f.CBSPerdido = f.ValorTotal * (cbsRate / 100.0)
+			f.TotalPerdido = f.IBSPerdido + f.CBSPerdido
+			simplesFornList = append(simplesFornList, f)
+			simplesTotalValor += f.ValorTotal
+			simplesIBS += f.IBSPerdido
+			simplesCBS += f.CBSPerdido
 		}
-		if cteTranspList == nil {
-			cteTranspList = []credPerdTransportadora{}
-		}
+	}
+	if simplesFornList == nil {
+		simplesFornList = []credPerdSimplesForn{}
+	}
 
-		ctePercSem := 0.0
-		if cteTotalUniverse > 0 {
-			ctePercSem = float64(cteTotalCTes) / float64(cteTotalUniverse) * 100.0
-		}
-		cteIBS := cteValorTotal * (ibsRate / 100.0)
-		cteCBS := cteValorTotal * (cbsRate / 100.0)
-
-		resp.CteSemCredito = credPerdCTe{
-			TotalCTes:         cteTotalCTes,
-			TotalUniverse:     cteTotalUniverse,
-			PercSemCredito:    ctePercSem,
-			ValorTotal:        cteValorTotal,
-			IBSEstimado:       cteIBS,
-			CBSEstimado:       cteCBS,
-			TotalEstimado:     cteIBS + cteCBS,
-			PorTransportadora: cteTranspList,
-		}
+	resp.SimplesNacional = credPerdSimples{
+		TotalFornecedores: len(simplesFornList),
+		ValorTotal:        simplesTotalValor,
+		IBSPerdido:        simplesIBS,
+		CBSPerdido:        simplesCBS,
+		TotalPerdido:      simplesIBS + simplesCBS,
+		PorFornecedor:     simplesFornList,
+	}
 
-		// ── Total combinado ──────────────────────────────────────────────────
-		resp.TotalCreditoEmRisco = resp.NFeSemCredito.TotalEstimado +
-			resp.SimplesNacional.TotalPerdido +
-			resp.CteSemCredito.TotalEstimado
+	// ── 3. CT-e sem IBS/CBS ──────────────────────────────────────────────
+	var cteTotalUniverse int
+	tx.QueryRow(`SELECT COUNT(*) FROM cte_entradas WHERE company_id = $1`, companyID).Scan(&cteTotalUniverse)
+
+	cteRows, err := tx.Query(`
+		SELECT
+			emit_cnpj,
+			COALESCE(emit_nome, ''),
+			COUNT(*)        AS qtd_ctes,
+			SUM(v_prest)    AS valor_total
+		FROM cte_entradas
+		WHERE company_id = $1
+		  AND (v_ibs IS NULL OR v_ibs = 0)
+		  AND (v_cbs IS NULL OR v_cbs = 0)
+		GROUP BY emit_cnpj, emit_nome
+		ORDER BY valor_total DESC
+		LIMIT 50
+	`, companyID)
+	if err != nil {
+		log.Printf("CreditosPerdidos cte query error: %v", err)
+	}
 
-		json.NewEncoder(w).Encode(resp)
+	var cteTranspList []credPerdTransportadora
+	var cteTotalCTes int
+	var cteValorTotal float64
+
+	if cteRows != nil {
+		defer cteRows.Close()
+		for cteRows.Next() {
+			var t credPerdTransportadora
+			if err := cteRows.Scan(&t.EmitCNPJ, &t.EmitNome, &t.QtdCTes, &t.ValorTotal); err != nil {
+				continue
+			}
+			t.IBSEstimado = t.ValorTotal * (ibsRate / 100.0)
+			t.CBSEstimado = t.ValorTotal * (cbsRate / 100.0)
+			t.TotalEstimado = t.IBSEstimado + t.CBSEstimado
+			cteTranspList = append(cteTranspList, t)
+			cteTotalCTes += t.QtdCTes
+			cteValorTotal += t.ValorTotal
+		}
+	}
+	if cteTranspList == nil {
+		cteTranspList = []credPerdTransportadora{}
+	}
+
+	ctePercSem := 0.0
+	if cteTotalUniverse > 0 {
+		ctePercSem = float64(cteTotalCTes) / float64(cteTotalUniverse) * 100.0
+	}
+	cteIBS := cteValorTotal * (ibsRate / 100.0)
+	cteCBS := cteValorTotal * (cbsRate / 100.0)
+
+	resp.CteSemCredito = credPerdCTe{
+		TotalCTes:         cteTotalCTes,
+		TotalUniverse:     cteTotalUniverse,
+		PercSemCredito:    ctePercSem,
+		ValorTotal:        cteValorTotal,
+		IBSEstimado:       cteIBS,
+		CBSEstimado:       cteCBS,
+		TotalEstimado:     cteIBS + cteCBS,
+		PorTransportadora: cteTranspList,
 	}
+
+	// ── Total combinado ──────────────────────────────────────────────────
+	resp.TotalCreditoEmRisco = resp.NFeSemCredito.TotalEstimado +
+		resp.SimplesNacional.TotalPerdido +
+		resp.CteSemCredito.TotalEstimado
+
+	return &resp, nil
 }
@@ -12,6 +12,8 @@ import (
 	"strconv"
 	"strings"
 
+	"fb_apu01/export"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -271,6 +273,14 @@ func CteEntradasUploadHandler(db *sql.DB) http.HandlerFunc {
 
 		result := cteUploadResult{Erros: []cteErro{}}
 
+		// Um XML com erro não derruba os demais: cada INSERT tem seu savepoint
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
+		}
+		defer tx.Rollback()
+
 		for _, fh := range files {
 			filename := fh.Filename
 
@@ -339,7 +349,7 @@ func CteEntradasUploadHandler(db *sql.DB) http.HandlerFunc {
 			ib := inf.Imp.IBSCBSTot
 			modInt, _ := strconv.Atoi(mod)
 
-			_, err = db.Exec(`
+			_, err = execSavepoint(tx, `
 				INSERT INTO cte_entradas (
 					company_id, chave_cte, modelo, serie, numero_cte,
 					data_emissao, mes_ano, nat_op, cfop, modal,
@@ -384,6 +394,11 @@ func CteEntradasUploadHandler(db *sql.DB) http.HandlerFunc {
 			result.Ignorados = 0
 		}
 
+		if err := tx.Commit(); err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao salvar no banco: "+err.Error())
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(result)
 	}
@@ -421,40 +436,29 @@ func CteEntradasListHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		q := r.URL.Query()
-		mesAno   := q.Get("mes_ano")
-		emitCNPJ := q.Get("emit_cnpj")
-
-		query := `
-			SELECT
-				id, chave_cte, modelo, serie, numero_cte,
-				TO_CHAR(data_emissao, 'DD/MM/YYYY'), mes_ano,
-				COALESCE(nat_op,''), COALESCE(cfop,''), COALESCE(modal,''),
-				emit_cnpj, COALESCE(emit_nome,''), COALESCE(emit_uf,''),
-				COALESCE(rem_cnpj_cpf,''), COALESCE(rem_nome,''), COALESCE(rem_uf,''),
-				COALESCE(dest_cnpj_cpf,''), COALESCE(dest_nome,''), COALESCE(dest_uf,''),
-				v_prest, v_rec, v_carga, v_bc_icms, v_icms,
-				v_bc_ibs_cbs, v_ibs, v_cbs
-			FROM cte_entradas
-			WHERE company_id = $1`
-
-		args := []interface{}{companyID}
-		idx := 2
-
-		if mesAno != "" {
-			query += fmt.Sprintf(" AND mes_ano = $%d", idx)
-			args = append(args, mesAno)
-			idx++
+		format, ok := exportFormat(w, r)
+		if !ok {
+			return
 		}
-		if emitCNPJ != "" {
-			query += fmt.Sprintf(" AND emit_cnpj = $%d", idx)
-			args = append(args, emitCNPJ)
-			idx++
+
+		q := r.URL.Query()
+		list, err := parseFiscalDocList(&cteEntradasSpec, companyID, q)
+		if err != nil {
+			jsonErr(w, http.StatusBadRequest, err.Error())
+			return
 		}
+		// Exports stream every row of the filtered set; the screen gets a page
+		query, args := list.selectSQL(cteColumns, format == "")
 
-		query += " ORDER BY data_emissao DESC, numero_cte DESC LIMIT 500"
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			log.Printf("CteEntradasList tenant tx error: %v", err)
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
+		}
+		defer tx.Rollback()
 
-		rows, err := db.Query(query, args...)
+		rows, err := tx.Query(query, args...)
 		if err != nil {
 			log.Printf("CteEntradasList error: %v", err)
 			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
@@ -462,28 +466,115 @@ func CteEntradasListHandler(db *sql.DB) http.HandlerFunc {
 		}
 		defer rows.Close()
 
-		list := []cteRow{}
+		if format != "" {
+			xw, err := beginExport(w, format, exportFilename("cte-entradas", q.Get("mes_ano"), q.Get("emit_cnpj")))
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			err = xw.Sheet("CT-e de Entrada", cteExportColumns)
+			for err == nil && rows.Next() {
+				var row cteRow
+				if err = scanCteRow(rows, &row); err == nil {
+					err = xw.Row(row.exportValues()...)
+				}
+			}
+			if err == nil {
+				err = rows.Err()
+			}
+			finishExport(xw, "CteEntradasList", err)
+			return
+		}
+
+		items := []cteRow{}
+		page := list.page()
 		for rows.Next() {
 			var row cteRow
-			err := rows.Scan(
-				&row.ID, &row.ChaveCTe, &row.Modelo, &row.Serie, &row.NumeroCTe,
-				&row.DataEmissao, &row.MesAno, &row.NatOp, &row.CFOP, &row.Modal,
-				&row.EmitCNPJ, &row.EmitNome, &row.EmitUF,
-				&row.RemCNPJCPF, &row.RemNome, &row.RemUF,
-				&row.DestCNPJCPF, &row.DestNome, &row.DestUF,
-				&row.VPrest, &row.VRec, &row.VCarga, &row.VBcICMS, &row.VICMS,
-				&row.VBcIbsCbs, &row.VIBS, &row.VCBS,
-			)
+			err := scanCteRow(rows, &row, page.dest()...)
 			if err != nil {
 				log.Printf("CteEntradasList scan error: %v", err)
 				continue
 			}
-			list = append(list, row)
+			if !page.keep() {
+				break
+			}
+			items = append(items, row)
+		}
+		rows.Close()
+
+		totais, err := list.totals(tx)
+		if err != nil {
+			log.Printf("CteEntradasList totals error: %v", err)
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
 		}
+		json.NewEncoder(w).Encode(fiscalDocResponse(items, page, totais))
+	}
+}
+
+// cteColumns is the select list of CteEntradasListHandler, read by scanCteRow.
+const cteColumns = `
+	id, chave_cte, modelo, serie, numero_cte,
+	TO_CHAR(data_emissao, 'DD/MM/YYYY'), mes_ano,
+	COALESCE(nat_op,''), COALESCE(cfop,''), COALESCE(modal,''),
+	emit_cnpj, COALESCE(emit_nome,''), COALESCE(emit_uf,''),
+	COALESCE(rem_cnpj_cpf,''), COALESCE(rem_nome,''), COALESCE(rem_uf,''),
+	COALESCE(dest_cnpj_cpf,''), COALESCE(dest_nome,''), COALESCE(dest_uf,''),
+	v_prest, v_rec, v_carga, v_bc_icms, v_icms,
+	v_bc_ibs_cbs, v_ibs, v_cbs`
+
+// scanCteRow reads one row of cteColumns, followed by extra.
+func scanCteRow(rows *sql.Rows, row *cteRow, extra ...interface{}) error {
+	return rows.Scan(append([]interface{}{
+		&row.ID, &row.ChaveCTe, &row.Modelo, &row.Serie, &row.NumeroCTe,
+		&row.DataEmissao, &row.MesAno, &row.NatOp, &row.CFOP, &row.Modal,
+		&row.EmitCNPJ, &row.EmitNome, &row.EmitUF,
+		&row.RemCNPJCPF, &row.RemNome, &row.RemUF,
+		&row.DestCNPJCPF, &row.DestNome, &row.DestUF,
+		&row.VPrest, &row.VRec, &row.VCarga, &row.VBcICMS, &row.VICMS,
+		&row.VBcIbsCbs, &row.VIBS, &row.VCBS,
+	}, extra...)...)
+}
+
+// cteExportColumns are the columns of GET /api/cte-entradas?format=xlsx|csv,
+// in the order of cteRow.exportValues. IBS/CBS stay blank when the CT-e has no tags.
+var cteExportColumns = []export.Column{
+	{Header: "Chave CT-e", Kind: export.Text, Width: 48},
+	{Header: "Modelo", Kind: export.Integer},
+	{Header: "Série", Kind: export.Text, Width: 8},
+	{Header: "Número", Kind: export.Text, Width: 12},
+	{Header: "Emissão", Kind: export.Date},
+	{Header: "Mês/Ano", Kind: export.Text, Width: 10},
+	{Header: "Natureza da Operação", Kind: export.Text, Width: 30},
+	{Header: "CFOP", Kind: export.Text, Width: 8},
+	{Header: "Modal", Kind: export.Text, Width: 8},
+	{Header: "CNPJ Transportadora", Kind: export.Text, Width: 18},
+	{Header: "Transportadora", Kind: export.Text, Width: 36},
+	{Header: "UF Transportadora", Kind: export.Text},
+	{Header: "CNPJ/CPF Remetente", Kind: export.Text, Width: 18},
+	{Header: "Remetente", Kind: export.Text, Width: 36},
+	{Header: "UF Remetente", Kind: export.Text},
+	{Header: "CNPJ/CPF Destinatário", Kind: export.Text, Width: 18},
+	{Header: "Destinatário", Kind: export.Text, Width: 36},
+	{Header: "UF Destinatário", Kind: export.Text},
+	{Header: "Valor da Prestação", Kind: export.Money},
+	{Header: "Valor a Receber", Kind: export.Money},
+	{Header: "Valor da Carga", Kind: export.Money},
+	{Header: "BC ICMS", Kind: export.Money},
+	{Header: "ICMS", Kind: export.Money},
+	{Header: "BC IBS/CBS", Kind: export.Money},
+	{Header: "IBS", Kind: export.Money},
+	{Header: "CBS", Kind: export.Money},
+}
 
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"total": len(list),
-			"items": list,
-		})
+func (row cteRow) exportValues() []interface{} {
+	return []interface{}{
+		row.ChaveCTe, row.Modelo, row.Serie, row.NumeroCTe, row.DataEmissao, row.MesAno,
+		row.NatOp, row.CFOP, row.Modal,
+		row.EmitCNPJ, row.EmitNome, row.EmitUF,
+		row.RemCNPJCPF, row.RemNome, row.RemUF,
+		row.DestCNPJCPF, row.DestNome, row.DestUF,
+		row.VPrest, row.VRec, row.VCarga, row.VBcICMS, row.VICMS,
+		row.VBcIbsCbs, row.VIBS, row.VCBS,
 	}
 }
@@ -39,6 +39,13 @@ func GetDashboardProjectionHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		mesAno := r.URL.Query().Get("mes_ano")
 		filiaisParam := r.URL.Query().Get("filiais")
 
@@ -90,7 +97,7 @@ func GetDashboardProjectionHandler(db *sql.DB) http.HandlerFunc {
 		}
 		queryBase += "\n\t\t\t\tGROUP BY tipo"
 
-		rowsBase, err := db.Query(queryBase, args...)
+		rowsBase, err := tx.Query(queryBase, args...)
 		if err != nil {
 			http.Error(w, "Error querying base data: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -124,7 +131,7 @@ func GetDashboardProjectionHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// 2. Get Future Aliquotas (2027-2033)
-		rows, err := db.Query(`
+		rows, err := tx.Query(`
 			SELECT ano, perc_reduc_icms, perc_ibs_uf, perc_ibs_mun, perc_cbs
 			FROM tabela_aliquotas
 			WHERE ano BETWEEN 2027 AND 2033
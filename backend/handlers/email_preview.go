@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"fb_apu01/services"
+)
+
+// EmailPreviewHandler renders an email template with sample data, without
+// queueing anything (GET /api/admin/email-preview?template=relatorio&locale=pt-BR&format=html|text).
+// Templates are read from disk on every request, so edits show up on reload.
+// Without ?template= it lists the available templates.
+func EmailPreviewHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		q := r.URL.Query()
+		name := q.Get("template")
+		if name == "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"templates": services.EmailTemplates})
+			return
+		}
+		known := false
+		for _, t := range services.EmailTemplates {
+			known = known || t == name
+		}
+		if !known {
+			jsonErr(w, http.StatusBadRequest, "template de e-mail desconhecido: "+name)
+			return
+		}
+
+		rendered, err := services.RenderEmailPreview(name, q.Get("locale"))
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if q.Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "Assunto: %s\n\n%s", rendered.Subject, rendered.Text)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, rendered.HTML)
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"fb_apu01/export"
+)
+
+// exportFormat returns the format asked for with ?format=xlsx|csv, or "" when
+// the client wants the usual JSON. An unknown format is answered with 400 and
+// ok is false.
+func exportFormat(w http.ResponseWriter, r *http.Request) (format string, ok bool) {
+	raw := r.URL.Query().Get("format")
+	if raw == "" || raw == "json" {
+		return "", true
+	}
+	format, ok = export.ParseFormat(raw)
+	if !ok {
+		jsonErr(w, http.StatusBadRequest, "formato inválido: use xlsx ou csv")
+	}
+	return format, ok
+}
+
+// beginExport sets the download headers and returns a writer that streams
+// straight into the response. filename has no extension. Once rows start
+// going out the status is already 200, so errors after this point can only
+// be logged and the download is truncated.
+func beginExport(w http.ResponseWriter, format, filename string) (export.Writer, error) {
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, format))
+	w.Header().Del("Content-Length")
+	return export.New(w, format)
+}
+
+// exportFilename joins base with the non-empty filters, e.g.
+// exportFilename("nfe-entradas", "03/2026") is "nfe-entradas-03-2026".
+func exportFilename(base string, filters ...string) string {
+	name := base
+	for _, f := range filters {
+		if f != "" {
+			name += "-" + strings.NewReplacer("/", "-", " ", "-", `"`, "").Replace(f)
+		}
+	}
+	return name
+}
+
+// finishExport closes the writer and logs a failed stream. After an error the
+// file is left unterminated, so it fails to open instead of looking complete.
+func finishExport(xw export.Writer, what string, err error) {
+	if err == nil {
+		err = xw.Close()
+	}
+	if err != nil {
+		log.Printf("%s export error: %v", what, err)
+	}
+}
@@ -35,7 +35,14 @@ func GetFiliaisHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query(`
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`
 			SELECT DISTINCT m.filial_cnpj, m.filial_nome, COALESCE(a.apelido, '') as apelido
 			FROM mv_mercadorias_agregada m
 			LEFT JOIN filial_apelidos a ON a.cnpj = m.filial_cnpj AND a.company_id = $1
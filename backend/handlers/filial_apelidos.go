@@ -37,9 +37,16 @@ func FilialApelidosHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		switch r.Method {
 		case http.MethodGet:
-			rows, err := db.Query(
+			rows, err := tx.Query(
 				"SELECT cnpj, apelido FROM filial_apelidos WHERE company_id = $1 ORDER BY cnpj",
 				companyID,
 			)
@@ -63,7 +70,10 @@ func FilialApelidosHandler(db *sql.DB) http.HandlerFunc {
 			json.NewEncoder(w).Encode(list)
 
 		case http.MethodDelete:
-			_, err := db.Exec("DELETE FROM filial_apelidos WHERE company_id = $1", companyID)
+			_, err := tx.Exec("DELETE FROM filial_apelidos WHERE company_id = $1", companyID)
+			if err == nil {
+				err = tx.Commit()
+			}
 			if err != nil {
 				log.Printf("FilialApelidos DELETE error: %v", err)
 				http.Error(w, "Database error", http.StatusInternalServerError)
@@ -102,6 +112,13 @@ func ImportFilialApelidosHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		file, _, err := r.FormFile("file")
 		if err != nil {
 			http.Error(w, "Invalid file: "+err.Error(), http.StatusBadRequest)
@@ -168,7 +185,7 @@ func ImportFilialApelidosHandler(db *sql.DB) http.HandlerFunc {
 				continue
 			}
 
-			_, err := db.Exec(
+			_, err := execSavepoint(tx,
 				`INSERT INTO filial_apelidos (company_id, cnpj, apelido)
 				 VALUES ($1, $2, $3)
 				 ON CONFLICT (company_id, cnpj) DO UPDATE SET apelido = $3, updated_at = NOW()`,
@@ -181,6 +198,10 @@ func ImportFilialApelidosHandler(db *sql.DB) http.HandlerFunc {
 			}
 			imported++
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]interface{}{
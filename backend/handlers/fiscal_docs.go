@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shared query layer of the fiscal document lists (GET /api/nfe-saidas,
+// /api/nfe-entradas, /api/cte-entradas). Every list accepts:
+//
+//	mes_ano=MM/YYYY              period
+//	data_de, data_ate=YYYY-MM-DD emission date range
+//	<v_col>_min, <v_col>_max     amount range on any value column (v_nf_min=1000)
+//	q=text                       search in the party names
+//	<party>_uf=SP,RJ             UF of a party (dest_uf, emit_uf, ...)
+//	modelo=55,65                 document model
+//	cfop=5353,6353               CFOP (CT-e only: NF-e headers have none)
+//	<party CNPJ column>=...      exact CNPJ/CPF (emit_cnpj, forn_cnpj, ...)
+//	sort=-v_nf                   data_emissao, numero or a value column; "-" = descending
+//	limit=500, cursor=...        keyset pagination: pass back next_cursor
+//
+// The response carries the page, next_cursor ("" on the last page) and the
+// count and value totals of the whole filtered set.
+
+const (
+	fiscalDocDefaultLimit = 500
+	fiscalDocMaxLimit     = 2000
+)
+
+// fiscalDocSpec describes a fiscal document table.
+type fiscalDocSpec struct {
+	table   string
+	numero  string   // document number column (sort=numero)
+	valores []string // value columns: sortable, range-filtered and totalled
+	nomes   []string // columns searched by q
+	ufs     []string // UF columns, each filtered by its own parameter
+	cnpjs   []string // CNPJ/CPF columns, each filtered by its own parameter
+	cfop    bool     // table has a cfop column
+}
+
+var nfeSaidasSpec = fiscalDocSpec{
+	table:  "nfe_saidas",
+	numero: "numero_nfe",
+	valores: []string{"v_bc", "v_icms", "v_icms_deson", "v_fcp", "v_bc_st", "v_st", "v_fcp_st", "v_fcp_st_ret",
+		"v_prod", "v_frete", "v_seg", "v_desc", "v_ii", "v_ipi", "v_ipi_devol", "v_pis", "v_cofins", "v_outro", "v_nf",
+		"v_bc_ibs_cbs", "v_ibs_uf", "v_ibs_mun", "v_ibs", "v_cred_pres_ibs", "v_cbs", "v_cred_pres_cbs"},
+	nomes: []string{"emit_nome", "dest_nome"},
+	ufs:   []string{"emit_uf", "dest_uf"},
+	cnpjs: []string{"emit_cnpj", "dest_cnpj_cpf"},
+}
+
+var nfeEntradasSpec = fiscalDocSpec{
+	table:   "nfe_entradas",
+	numero:  "numero_nfe",
+	valores: nfeSaidasSpec.valores,
+	nomes:   []string{"forn_nome", "dest_nome"},
+	ufs:     []string{"forn_uf", "dest_uf"},
+	cnpjs:   []string{"forn_cnpj", "dest_cnpj_cpf"},
+}
+
+var cteEntradasSpec = fiscalDocSpec{
+	table:   "cte_entradas",
+	numero:  "numero_cte",
+	valores: []string{"v_prest", "v_rec", "v_carga", "v_bc_icms", "v_icms", "v_bc_ibs_cbs", "v_ibs", "v_cbs"},
+	nomes:   []string{"emit_nome", "rem_nome", "dest_nome"},
+	ufs:     []string{"emit_uf", "rem_uf", "dest_uf"},
+	cnpjs:   []string{"emit_cnpj", "rem_cnpj_cpf", "dest_cnpj_cpf"},
+	cfop:    true,
+}
+
+var (
+	fiscalDocUF   = regexp.MustCompile(`^[A-Z]{2}$`)
+	fiscalDocCFOP = regexp.MustCompile(`^\d{4}$`)
+)
+
+// Suffixes of the range parameters: data_de/data_ate and <v_col>_min/<v_col>_max.
+var (
+	fiscalDocDateRanges  = []struct{ suffix, op string }{{"_de", ">="}, {"_ate", "<="}}
+	fiscalDocValueRanges = []struct{ suffix, op string }{{"_min", ">="}, {"_max", "<="}}
+)
+
+// fiscalDocList is a parsed list request: filters, order and page.
+type fiscalDocList struct {
+	spec    *fiscalDocSpec
+	where   []string
+	args    []interface{}
+	sort    string // as requested, e.g. "-v_nf"
+	sortKey string // SQL expression ordered by (with id as tie-break)
+	keyType string // cast of the cursor key
+	desc    bool
+	cursor  *fiscalDocCursor
+	limit   int
+}
+
+// fiscalDocCursor is the position after the last row of a page.
+type fiscalDocCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"id"`
+}
+
+// arg adds a query parameter and returns its placeholder.
+func (l *fiscalDocList) arg(v interface{}) string {
+	l.args = append(l.args, v)
+	return "$" + strconv.Itoa(len(l.args))
+}
+
+// in adds "col IN (...)" for a comma-separated parameter. parse validates
+// each value and returns it with the column's type, so the column is compared
+// as is (and its index stays usable).
+func (l *fiscalDocList) in(col, raw string, parse func(string) (interface{}, bool)) error {
+	var ph []string
+	for _, v := range strings.Split(raw, ",") {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		val, ok := parse(v)
+		if !ok {
+			return fmt.Errorf("%s: valor inválido %q", col, v)
+		}
+		ph = append(ph, l.arg(val))
+	}
+	if len(ph) > 0 {
+		l.where = append(l.where, col+" IN ("+strings.Join(ph, ", ")+")")
+	}
+	return nil
+}
+
+// fiscalDocMatch accepts the values re matches, as text.
+func fiscalDocMatch(re *regexp.Regexp) func(string) (interface{}, bool) {
+	return func(v string) (interface{}, bool) { return v, re.MatchString(v) }
+}
+
+// fiscalDocNumero is the numeric value of a document number column; the
+// columns are VARCHAR, and an empty or non-numeric number sorts as 0.
+func fiscalDocNumero(col string) string {
+	return "COALESCE(CASE WHEN " + col + " ~ '^[0-9]{1,18}$' THEN " + col + "::bigint END, 0)"
+}
+
+func parseFiscalDocList(spec *fiscalDocSpec, companyID string, q url.Values) (*fiscalDocList, error) {
+	l := &fiscalDocList{spec: spec, limit: fiscalDocDefaultLimit}
+	l.where = append(l.where, "company_id = "+l.arg(companyID))
+
+	if v := strings.TrimSpace(q.Get("mes_ano")); v != "" {
+		l.where = append(l.where, "mes_ano = "+l.arg(v))
+	}
+	for _, r := range fiscalDocDateRanges {
+		if v := strings.TrimSpace(q.Get("data" + r.suffix)); v != "" {
+			if _, err := time.Parse("2006-01-02", v); err != nil {
+				return nil, fmt.Errorf("data%s inválida (use AAAA-MM-DD)", r.suffix)
+			}
+			l.where = append(l.where, "data_emissao "+r.op+" "+l.arg(v)+"::date")
+		}
+	}
+	for _, col := range spec.valores {
+		for _, r := range fiscalDocValueRanges {
+			if v := strings.TrimSpace(q.Get(col + r.suffix)); v != "" {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+					return nil, fmt.Errorf("%s inválido", col+r.suffix)
+				}
+				l.where = append(l.where, "COALESCE("+col+", 0) "+r.op+" "+l.arg(f))
+			}
+		}
+	}
+	if v := strings.TrimSpace(q.Get("q")); v != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(v) + "%"
+		ph := l.arg(pattern)
+		var or []string
+		for _, col := range spec.nomes {
+			or = append(or, col+" ILIKE "+ph)
+		}
+		l.where = append(l.where, "("+strings.Join(or, " OR ")+")")
+	}
+	for _, col := range spec.ufs {
+		if err := l.in(col, q.Get(col), fiscalDocMatch(fiscalDocUF)); err != nil {
+			return nil, err
+		}
+	}
+	for _, col := range spec.cnpjs {
+		if v := normalizeCNPJ(q.Get(col)); v != "" {
+			l.where = append(l.where, col+" = "+l.arg(v))
+		}
+	}
+	if err := l.in("modelo", q.Get("modelo"), func(v string) (interface{}, bool) {
+		n, err := strconv.ParseInt(v, 10, 16)
+		return n, err == nil
+	}); err != nil {
+		return nil, err
+	}
+	if q.Get("cfop") != "" {
+		if !spec.cfop {
+			return nil, fmt.Errorf("filtro cfop indisponível: %s não guarda CFOP no cabeçalho", spec.table)
+		}
+		if err := l.in("cfop", q.Get("cfop"), fiscalDocMatch(fiscalDocCFOP)); err != nil {
+			return nil, err
+		}
+	}
+
+	l.sort = strings.TrimSpace(q.Get("sort"))
+	if l.sort == "" {
+		l.sort = "-data_emissao"
+	}
+	col := strings.TrimPrefix(l.sort, "-")
+	l.desc = col != l.sort
+	switch {
+	case col == "data_emissao":
+		l.sortKey, l.keyType = "data_emissao", "date"
+	case col == "numero":
+		l.sortKey, l.keyType = fiscalDocNumero(spec.numero), "bigint"
+	case contains(spec.valores, col):
+		l.sortKey, l.keyType = "COALESCE("+col+", 0)", "numeric"
+	default:
+		return nil, fmt.Errorf("sort inválido: use data_emissao, numero ou uma coluna de valor (%s)", strings.Join(spec.valores, ", "))
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("limit inválido")
+		}
+		l.limit = min(n, fiscalDocMaxLimit)
+	}
+	if v := q.Get("cursor"); v != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(v)
+		var c fiscalDocCursor
+		if err == nil {
+			err = json.Unmarshal(raw, &c)
+		}
+		if err == nil {
+			switch l.keyType {
+			case "date":
+				_, err = time.Parse("2006-01-02", c.Key)
+			case "numeric":
+				_, err = strconv.ParseFloat(c.Key, 64)
+			case "bigint":
+				_, err = strconv.ParseInt(c.Key, 10, 64)
+			}
+		}
+		if err != nil || !isValidUUID(c.ID) {
+			return nil, fmt.Errorf("cursor inválido")
+		}
+		if c.Sort != l.sort {
+			return nil, fmt.Errorf("cursor de outra ordenação (%s): recomece sem cursor", c.Sort)
+		}
+		l.cursor = &c
+	}
+	return l, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// selectSQL returns the query of columns over the filtered set, in order.
+// With page, one row past the limit is fetched (to know whether there is a
+// next page) and every row ends with its cursor key and id (see
+// fiscalDocPage.dest); without it, every row is returned (exports).
+func (l *fiscalDocList) selectSQL(columns string, page bool) (string, []interface{}) {
+	dir := "ASC"
+	if l.desc {
+		dir = "DESC"
+	}
+	where := l.where
+	args := append([]interface{}{}, l.args...)
+	ph := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if page {
+		columns += ", " + l.sortKey + "::text, id::text"
+		if l.cursor != nil {
+			cmp := ">"
+			if l.desc {
+				cmp = "<"
+			}
+			where = append(where[:len(where):len(where)], fmt.Sprintf("(%s, id) %s (%s::%s, %s::uuid)",
+				l.sortKey, cmp, ph(l.cursor.Key), l.keyType, ph(l.cursor.ID)))
+		}
+	}
+	query := "SELECT " + columns + " FROM " + l.spec.table + " WHERE " + strings.Join(where, " AND ") +
+		" ORDER BY " + l.sortKey + " " + dir + ", id " + dir
+	if page {
+		query += " LIMIT " + ph(l.limit+1)
+	}
+	return query, args
+}
+
+// fiscalDocTotals are the count and value sums of the filtered set.
+type fiscalDocTotals struct {
+	Count   int
+	Valores map[string]float64
+}
+
+func (l *fiscalDocList) totals(tx *sql.Tx) (fiscalDocTotals, error) {
+	t := fiscalDocTotals{Valores: map[string]float64{}}
+	sums := make([]float64, len(l.spec.valores))
+	dest := []interface{}{&t.Count}
+	var cols []string
+	for i, col := range l.spec.valores {
+		cols = append(cols, "COALESCE(SUM("+col+"), 0)")
+		dest = append(dest, &sums[i])
+	}
+	err := tx.QueryRow("SELECT COUNT(*), "+strings.Join(cols, ", ")+" FROM "+l.spec.table+
+		" WHERE "+strings.Join(l.where, " AND "), l.args...).Scan(dest...)
+	if err != nil {
+		return t, err
+	}
+	for i, col := range l.spec.valores {
+		t.Valores[col] = math.Round(sums[i]*100) / 100
+	}
+	return t, nil
+}
+
+// fiscalDocPage follows the rows of a page to build next_cursor.
+type fiscalDocPage struct {
+	list    *fiscalDocList
+	n       int
+	key, id string
+	last    fiscalDocCursor
+	more    bool
+}
+
+func (l *fiscalDocList) page() *fiscalDocPage { return &fiscalDocPage{list: l} }
+
+// dest are the scan targets of the cursor columns selectSQL appends.
+func (p *fiscalDocPage) dest() []interface{} { return []interface{}{&p.key, &p.id} }
+
+// keep reports whether the row just scanned belongs to the page: the extra
+// row past the limit only signals a next page.
+func (p *fiscalDocPage) keep() bool {
+	if p.n == p.list.limit {
+		p.more = true
+		return false
+	}
+	p.n++
+	p.last = fiscalDocCursor{Sort: p.list.sort, Key: p.key, ID: p.id}
+	return true
+}
+
+// next is the cursor of the next page, "" on the last one.
+func (p *fiscalDocPage) next() string {
+	if !p.more {
+		return ""
+	}
+	raw, _ := json.Marshal(p.last)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// fiscalDocResponse is the JSON body of a list page.
+func fiscalDocResponse(items interface{}, p *fiscalDocPage, t fiscalDocTotals) map[string]interface{} {
+	return map[string]interface{}{
+		"total":       t.Count,
+		"totais":      t.Valores,
+		"items":       items,
+		"count":       p.n,
+		"sort":        p.list.sort,
+		"limit":       p.list.limit,
+		"next_cursor": p.next(),
+	}
+}
@@ -66,9 +66,17 @@ func GetJobParticipantsHandler(db *sql.DB) http.HandlerFunc {
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
 
+		// Tenant-scoped transaction: RLS restricts import_jobs/participants to companyID
+		tx, err := BeginTenantTx(ctx, db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		// Verify Job Ownership
 		var exists bool
-		err = db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM import_jobs WHERE id = $1 AND company_id = $2)", jobID, companyID).Scan(&exists)
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM import_jobs WHERE id = $1 AND company_id = $2)", jobID, companyID).Scan(&exists)
 		if err != nil {
 			http.Error(w, "Database error checking ownership: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -78,7 +86,7 @@ func GetJobParticipantsHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.QueryContext(ctx, `
+		rows, err := tx.QueryContext(ctx, `
 			SELECT id, cod_part, nome, cnpj, cpf, ie
 			FROM participants
 			WHERE job_id = $1
@@ -131,7 +139,14 @@ func ListJobsHandler(db *sql.DB) http.HandlerFunc {
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
 
-		rows, err := db.QueryContext(ctx, `
+		tx, err := BeginTenantTx(ctx, db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.QueryContext(ctx, `
 			SELECT id, filename, status, message, created_at, updated_at
 			FROM import_jobs
 			WHERE company_id = $1
@@ -195,10 +210,17 @@ func GetJobStatusHandler(db *sql.DB) http.HandlerFunc {
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
 
+		tx, err := BeginTenantTx(ctx, db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		var job JobStatusResponse
 		query := `SELECT id, filename, status, message, created_at, updated_at FROM import_jobs WHERE id = $1 AND company_id = $2`
 
-		err = db.QueryRowContext(ctx, query, jobID, companyID).Scan(&job.ID, &job.Filename, &job.Status, &job.Message, &job.CreatedAt, &job.UpdatedAt)
+		err = tx.QueryRowContext(ctx, query, jobID, companyID).Scan(&job.ID, &job.Filename, &job.Status, &job.Message, &job.CreatedAt, &job.UpdatedAt)
 		if err == sql.ErrNoRows {
 			http.Error(w, "Job not found", http.StatusNotFound)
 			return
@@ -240,6 +262,13 @@ func CancelJobHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		// Extract job ID: /api/jobs/{id}/cancel
 		pathParts := strings.Split(r.URL.Path, "/")
 		if len(pathParts) < 5 {
@@ -249,7 +278,7 @@ func CancelJobHandler(db *sql.DB) http.HandlerFunc {
 		jobID := pathParts[3]
 
 		// Only cancel jobs that are pending or processing, and belong to this company
-		res, err := db.Exec(
+		res, err := tx.Exec(
 			"UPDATE import_jobs SET status = 'cancelling', message = 'Cancelamento solicitado pelo usuário', updated_at = NOW() WHERE id = $1 AND company_id = $2 AND status IN ('pending', 'processing')",
 			jobID, companyID,
 		)
@@ -263,8 +292,77 @@ func CancelJobHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Job not found or already completed", http.StatusNotFound)
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "cancelling", "message": "Job cancellation requested"})
 	}
 }
+
+// RetryJobHandler re-queues a dead-lettered job (POST /api/jobs/{id}/retry).
+// The upload file is kept for dead jobs, so the retry resumes from the last
+// checkpoint with a fresh attempt budget.
+func RetryJobHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, ok := r.Context().Value(ClaimsKey).(jwt.MapClaims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID := claims["user_id"].(string)
+
+		companyID, err := GetEffectiveCompanyID(db, userID, r.Header.Get("X-Company-ID"))
+		if err != nil {
+			http.Error(w, "Error getting user company: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Extract job ID: /api/jobs/{id}/retry
+		pathParts := strings.Split(r.URL.Path, "/")
+		if len(pathParts) < 5 {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+		jobID := pathParts[3]
+
+		res, err := tx.Exec(`
+			UPDATE import_jobs
+			SET status = 'pending', attempts = 0, run_after = NOW(), finished_at = NULL,
+			    message = 'Reenviado para a fila', updated_at = NOW()
+			WHERE id = $1 AND company_id = $2 AND status = 'dead'`,
+			jobID, companyID,
+		)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, _ := res.RowsAffected()
+		if rows == 0 {
+			http.Error(w, "Job not found or not in dead-letter", http.StatusNotFound)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "pending", "message": "Job re-queued"})
+	}
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"fb_apu01/jobevents"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jobStreamTokenTTL is how long a stream token can be used to open the
+// stream; an open stream is not cut when it expires.
+const jobStreamTokenTTL = time.Minute
+
+// jobStreamKey signs stream tokens. It is derived from the JWT secret but
+// differs from it, so a stream token is never accepted as a session token nor
+// the reverse.
+func jobStreamKey() []byte {
+	sum := sha256.Sum256(append(getJWTSecret(), ":job-events"...))
+	return sum[:]
+}
+
+// jobEventsJobID returns the job of /api/jobs/{id}/events[/token], "" for
+// the company-wide /api/jobs/events[/token].
+func jobEventsJobID(path string) string {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "/api/jobs/"), "/token")
+	if id := strings.TrimSuffix(path, "/events"); id != "events" && id != "" {
+		return id
+	}
+	return ""
+}
+
+// JobEventsTokenHandler issues a short-lived token for one event stream:
+//
+//	POST /api/jobs/events/token       — every job of the effective company
+//	POST /api/jobs/{id}/events/token  — a single job
+//
+// EventSource cannot send headers, so the stream is opened with
+// ?stream_token= instead of putting the session JWT in the URL.
+func JobEventsTokenHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		userID := GetUserIDFromContext(r)
+		if userID == "" {
+			jsonErr(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		companyID, err := GetEffectiveCompanyID(db, userID, r.Header.Get("X-Company-ID"))
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Error getting user company: "+err.Error())
+			return
+		}
+
+		jobID := jobEventsJobID(r.URL.Path)
+		if jobID != "" {
+			var exists bool
+			tx, err := BeginTenantTx(r.Context(), db, companyID)
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM import_jobs WHERE id = $1 AND company_id = $2)`,
+				jobID, companyID).Scan(&exists)
+			tx.Rollback()
+			if err != nil || !exists {
+				jsonErr(w, http.StatusNotFound, "Job not found")
+				return
+			}
+		}
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"typ":        "job_events",
+			"user_id":    userID,
+			"company_id": companyID,
+			"job_id":     jobID,
+			"exp":        time.Now().Add(jobStreamTokenTTL).Unix(),
+		}).SignedString(jobStreamKey())
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Error issuing stream token")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      token,
+			"expires_in": int(jobStreamTokenTTL.Seconds()),
+		})
+	}
+}
+
+// JobStreamAuth authenticates an event stream: the usual Authorization
+// header, or a token from JobEventsTokenHandler in ?stream_token=, valid only
+// for the company and job it was issued for.
+func JobStreamAuth(next http.HandlerFunc) http.HandlerFunc {
+	withSession := AuthMiddleware(next, "")
+	return func(w http.ResponseWriter, r *http.Request) {
+		streamToken := r.URL.Query().Get("stream_token")
+		if r.Header.Get("Authorization") != "" || streamToken == "" {
+			withSession(w, r)
+			return
+		}
+
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(streamToken, claims, func(*jwt.Token) (interface{}, error) {
+			return jobStreamKey(), nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		if err != nil || !token.Valid || claims["typ"] != "job_events" {
+			http.Error(w, "Invalid stream token", http.StatusUnauthorized)
+			return
+		}
+		jobID, _ := claims["job_id"].(string)
+		if jobID != jobEventsJobID(r.URL.Path) {
+			http.Error(w, "Stream token issued for another stream", http.StatusForbidden)
+			return
+		}
+		companyID, _ := claims["company_id"].(string)
+		r.Header.Set("X-Company-ID", companyID)
+		ctx := context.WithValue(r.Context(), ClaimsKey, jwt.MapClaims{"user_id": claims["user_id"]})
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// JobEventsHandler streams import progress as Server-Sent Events.
+//
+//	GET /api/jobs/events          — every job of the effective company
+//	GET /api/jobs/{id}/events     — a single job; starts with a snapshot of its row
+func JobEventsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := GetUserIDFromContext(r)
+		if userID == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		companyID, err := GetEffectiveCompanyID(db, userID, r.Header.Get("X-Company-ID"))
+		if err != nil {
+			http.Error(w, "Error getting user company: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		hub := jobevents.Default()
+		if hub == nil {
+			http.Error(w, "Event stream unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		jobID := jobEventsJobID(r.URL.Path)
+
+		var snapshot *jobevents.Event
+		if jobID != "" {
+			// Short tenant transaction: the stream itself holds no connection
+			var status, message string
+			tx, err := BeginTenantTx(r.Context(), db, companyID)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			err = tx.QueryRow(`SELECT status, COALESCE(message, '') FROM import_jobs WHERE id = $1 AND company_id = $2`,
+				jobID, companyID).Scan(&status, &message)
+			tx.Rollback()
+			if err != nil {
+				http.Error(w, "Job not found", http.StatusNotFound)
+				return
+			}
+			snapshot = &jobevents.Event{
+				JobID: jobID, CompanyID: companyID, Type: jobevents.TypeSnapshot,
+				Status: status, Message: message, Time: time.Now().Format(time.RFC3339),
+			}
+		}
+
+		// Long-lived response: lift the server-wide write timeout for this request
+		rc := http.NewResponseController(w)
+		_ = rc.SetWriteDeadline(time.Time{})
+
+		events, cancel := hub.Subscribe(jobevents.Filter{CompanyID: companyID, JobID: jobID})
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no") // disable proxy buffering (nginx/Traefik)
+		w.WriteHeader(http.StatusOK)
+
+		send := func(ev jobevents.Event) error {
+			data, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		if snapshot != nil {
+			if send(*snapshot) != nil {
+				return
+			}
+			// Already finished: nothing more will be published for this job
+			switch snapshot.Status {
+			case "completed", "error", "dead", "cancelled":
+				return
+			}
+		}
+
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev := <-events:
+				if send(ev) != nil {
+					return
+				}
+				// A single-job stream ends with the job
+				if jobID != "" && isFinalJobEvent(ev.Type) {
+					return
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				if rc.Flush() != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func isFinalJobEvent(t string) bool {
+	return t == jobevents.TypeCompleted || t == jobevents.TypeFailed || t == jobevents.TypeCancelled
+}
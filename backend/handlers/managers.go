@@ -8,6 +8,8 @@ import (
 	"strings"
 	"time"
 
+	"fb_apu01/services"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -42,7 +44,14 @@ func ListManagersHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query(`
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`
 			SELECT id, company_id, nome_completo, cargo, email, ativo, created_at, updated_at
 			FROM managers
 			WHERE company_id = $1
@@ -95,6 +104,13 @@ func CreateManagerHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		var req struct {
 			NomeCompleto string `json:"nome_completo"`
 			Cargo        string `json:"cargo"`
@@ -123,7 +139,7 @@ func CreateManagerHandler(db *sql.DB) http.HandlerFunc {
 
 		// Check if email already exists for this company
 		var exists bool
-		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM managers WHERE company_id = $1 AND email = $2 AND ativo = true)", companyID, req.Email).Scan(&exists)
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM managers WHERE company_id = $1 AND email = $2 AND ativo = true)", companyID, req.Email).Scan(&exists)
 		if err == nil && exists {
 			http.Error(w, "Já existe um gestor com este e-mail nesta empresa", http.StatusConflict)
 			return
@@ -131,7 +147,7 @@ func CreateManagerHandler(db *sql.DB) http.HandlerFunc {
 
 		// Insert manager
 		var id string
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			INSERT INTO managers (company_id, nome_completo, cargo, email, ativo)
 			VALUES ($1, $2, $3, $4, true)
 			RETURNING id
@@ -141,9 +157,18 @@ func CreateManagerHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// New managers get the post-import executive summary, as before subscriptions existed
+		if _, err := execSavepoint(tx, `
+			INSERT INTO report_subscriptions (company_id, manager_id, relatorio, frequencia)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (manager_id, relatorio, frequencia) DO NOTHING
+		`, companyID, id, services.ReportResumoExecutivo, services.FrequencyOnImport); err != nil {
+			fmt.Printf("[Managers] Could not subscribe manager %s to the executive summary: %v\n", id, err)
+		}
+
 		// Fetch created manager
 		var m Manager
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT id, company_id, nome_completo, cargo, email, ativo, created_at, updated_at
 			FROM managers WHERE id = $1
 		`, id).Scan(&m.ID, &m.CompanyID, &m.NomeCompleto, &m.Cargo, &m.Email, &m.Ativo, &m.CreatedAt, &m.UpdatedAt)
@@ -151,6 +176,10 @@ func CreateManagerHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Manager created but error fetching", http.StatusInternalServerError)
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Error creating manager: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(m)
@@ -181,6 +210,13 @@ func UpdateManagerHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		// Extract manager ID from URL path
 		path := strings.TrimPrefix(r.URL.Path, "/api/managers/")
 		managerID := strings.TrimSpace(path)
@@ -202,7 +238,7 @@ func UpdateManagerHandler(db *sql.DB) http.HandlerFunc {
 
 		// Validate manager belongs to user's company
 		var existingCompanyID string
-		err = db.QueryRow("SELECT company_id FROM managers WHERE id = $1", managerID).Scan(&existingCompanyID)
+		err = tx.QueryRow("SELECT company_id FROM managers WHERE id = $1", managerID).Scan(&existingCompanyID)
 		if err == sql.ErrNoRows {
 			http.Error(w, "Manager not found", http.StatusNotFound)
 			return
@@ -257,7 +293,7 @@ func UpdateManagerHandler(db *sql.DB) http.HandlerFunc {
 		args = append(args, managerID)
 		query := fmt.Sprintf("UPDATE managers SET %s WHERE id = $%d", strings.Join(updates, ", "), argPos)
 
-		_, err = db.Exec(query, args...)
+		_, err = tx.Exec(query, args...)
 		if err != nil {
 			http.Error(w, "Error updating manager: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -265,7 +301,7 @@ func UpdateManagerHandler(db *sql.DB) http.HandlerFunc {
 
 		// Fetch updated manager
 		var m Manager
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT id, company_id, nome_completo, cargo, email, ativo, created_at, updated_at
 			FROM managers WHERE id = $1
 		`, managerID).Scan(&m.ID, &m.CompanyID, &m.NomeCompleto, &m.Cargo, &m.Email, &m.Ativo, &m.CreatedAt, &m.UpdatedAt)
@@ -273,6 +309,10 @@ func UpdateManagerHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Manager updated but error fetching", http.StatusInternalServerError)
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Error updating manager: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		json.NewEncoder(w).Encode(m)
 	}
@@ -302,6 +342,13 @@ func DeleteManagerHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		// Extract manager ID from URL path
 		path := strings.TrimPrefix(r.URL.Path, "/api/managers/")
 		managerID := strings.TrimSpace(path)
@@ -312,7 +359,7 @@ func DeleteManagerHandler(db *sql.DB) http.HandlerFunc {
 
 		// Validate manager belongs to user's company
 		var existingCompanyID string
-		err = db.QueryRow("SELECT company_id FROM managers WHERE id = $1", managerID).Scan(&existingCompanyID)
+		err = tx.QueryRow("SELECT company_id FROM managers WHERE id = $1", managerID).Scan(&existingCompanyID)
 		if err == sql.ErrNoRows {
 			http.Error(w, "Manager not found", http.StatusNotFound)
 			return
@@ -327,11 +374,15 @@ func DeleteManagerHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Soft delete (set ativo = false)
-		_, err = db.Exec("UPDATE managers SET ativo = false WHERE id = $1", managerID)
+		_, err = tx.Exec("UPDATE managers SET ativo = false WHERE id = $1", managerID)
 		if err != nil {
 			http.Error(w, "Error deleting manager: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Error deleting manager: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusNoContent)
 	}
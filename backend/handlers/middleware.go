@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -86,6 +88,19 @@ func (s *secureResponseWriter) Write(b []byte) (int, error) {
 	return s.ResponseWriter.Write(b)
 }
 
+// Flush lets streaming handlers (Server-Sent Events) push data through the wrapper.
+func (s *secureResponseWriter) Flush() {
+	s.applyHeaders()
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (s *secureResponseWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
 // ─── Security Middleware ──────────────────────────────────────────────────────
 // Wrap the entire mux: handles CORS, preflight OPTIONS, and security headers.
 
@@ -194,20 +209,96 @@ func (rl *rateLimiter) Reset(key string) {
 	delete(rl.requests, key)
 }
 
-// GetClientIP extracts the real client IP from reverse proxy headers.
-// Uses the LAST entry in X-Forwarded-For (set by trusted proxy) to prevent spoofing.
+// ─── Client IP behind the reverse proxy ──────────────────────────────────────
+
+// TRUSTED_PROXIES lists the IPs/CIDRs of the reverse proxies in front of the
+// backend, comma-separated. Forwarding headers (X-Forwarded-For, X-Real-IP,
+// X-Forwarded-Tls-Client-Cert) are honoured only on connections from them;
+// anyone else could set them freely.
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxies     []*net.IPNet
+)
+
+// parseIPNets parses a comma-separated list of IPs/CIDRs (a bare IP is a
+// single-address network). Invalid entries are logged and skipped.
+func parseIPNets(list, envName string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, network)
+		} else {
+			log.Printf("Ignoring invalid %s entry %q", envName, entry)
+		}
+	}
+	return nets
+}
+
+func ipInNets(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range nets {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTrustedProxy(ip string) bool {
+	trustedProxiesOnce.Do(func() {
+		trustedProxies = parseIPNets(os.Getenv("TRUSTED_PROXIES"), "TRUSTED_PROXIES")
+	})
+	return ipInNets(ip, trustedProxies)
+}
+
+// remoteIP is the peer address of the TCP connection.
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// FromTrustedProxy reports whether the request arrived through a configured
+// reverse proxy, i.e. whether its forwarding headers can be believed.
+func FromTrustedProxy(r *http.Request) bool {
+	return isTrustedProxy(remoteIP(r))
+}
+
+// GetClientIP returns the client IP. Without a trusted proxy in front it is
+// the connection peer; through one, the rightmost X-Forwarded-For entry that
+// is not itself a trusted proxy (entries to its left are client-supplied).
 func GetClientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	if !isTrustedProxy(peer) {
+		return peer
+	}
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		parts := strings.Split(xff, ",")
-		// Use rightmost IP (added by our trusted reverse proxy, not spoofable by client)
-		return strings.TrimSpace(parts[len(parts)-1])
+		for i := len(parts) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(parts[i])
+			if ip != "" && !isTrustedProxy(ip) {
+				return ip
+			}
+		}
 	}
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
 		return xri
 	}
-	addr := r.RemoteAddr
-	if idx := strings.LastIndex(addr, ":"); idx > 0 {
-		return addr[:idx]
-	}
-	return addr
+	return peer
 }
@@ -3,13 +3,14 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"fb_apu01/export"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -124,6 +125,14 @@ func NfeEntradasUploadHandler(db *sql.DB) http.HandlerFunc {
 
 		result := nfeEntradaUploadResult{Erros: []nfeEntradaErro{}}
 
+		// Um XML com erro não derruba os demais: cada INSERT tem seu savepoint
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
+		}
+		defer tx.Rollback()
+
 		for _, fh := range files {
 			filename := fh.Filename
 
@@ -182,7 +191,7 @@ func NfeEntradasUploadHandler(db *sql.DB) http.HandlerFunc {
 			ib := inf.Total.IBSCBSTot
 
 			// IBS/CBS: usa toDecimal (não toNullDecimal) — fornecedores sem tags ficam com 0
-			_, err = db.Exec(`
+			_, err = execSavepoint(tx, `
 				INSERT INTO nfe_entradas (
 					company_id, chave_nfe, modelo, serie, numero_nfe,
 					data_emissao, mes_ano, nat_op,
@@ -233,6 +242,11 @@ func NfeEntradasUploadHandler(db *sql.DB) http.HandlerFunc {
 			result.Ignorados = 0
 		}
 
+		if err := tx.Commit(); err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao salvar no banco: "+err.Error())
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(result)
 	}
@@ -270,42 +284,29 @@ func NfeEntradasListHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		q := r.URL.Query()
-		mesAno := q.Get("mes_ano")
-		fornCNPJ := q.Get("forn_cnpj")
-
-		query := `
-			SELECT
-				id, chave_nfe, modelo, serie, numero_nfe,
-				TO_CHAR(data_emissao, 'DD/MM/YYYY'), mes_ano, COALESCE(nat_op,''),
-				forn_cnpj, COALESCE(forn_nome,''), COALESCE(forn_uf,''), COALESCE(forn_municipio,''),
-				COALESCE(dest_cnpj_cpf,''), COALESCE(dest_nome,''), COALESCE(dest_uf,''), COALESCE(dest_c_mun,''),
-				v_bc, v_icms, v_icms_deson, v_fcp,
-				v_bc_st, v_st, v_fcp_st, v_fcp_st_ret,
-				v_prod, v_frete, v_seg, v_desc,
-				v_ii, v_ipi, v_ipi_devol, v_pis, v_cofins, v_outro, v_nf,
-				v_bc_ibs_cbs, v_ibs_uf, v_ibs_mun, v_ibs, v_cred_pres_ibs,
-				v_cbs, v_cred_pres_cbs
-			FROM nfe_entradas
-			WHERE company_id = $1`
-
-		args := []interface{}{companyID}
-		idx := 2
-
-		if mesAno != "" {
-			query += fmt.Sprintf(" AND mes_ano = $%d", idx)
-			args = append(args, mesAno)
-			idx++
+		format, ok := exportFormat(w, r)
+		if !ok {
+			return
 		}
-		if fornCNPJ != "" {
-			query += fmt.Sprintf(" AND forn_cnpj = $%d", idx)
-			args = append(args, fornCNPJ)
-			idx++
+
+		q := r.URL.Query()
+		list, err := parseFiscalDocList(&nfeEntradasSpec, companyID, q)
+		if err != nil {
+			jsonErr(w, http.StatusBadRequest, err.Error())
+			return
 		}
+		// Exports stream every row of the filtered set; the screen gets a page
+		query, args := list.selectSQL(nfeEntradaColumns, format == "")
 
-		query += " ORDER BY data_emissao DESC, numero_nfe DESC LIMIT 500"
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			log.Printf("NfeEntradasList tenant tx error: %v", err)
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
+		}
+		defer tx.Rollback()
 
-		rows, err := db.Query(query, args...)
+		rows, err := tx.Query(query, args...)
 		if err != nil {
 			log.Printf("NfeEntradasList error: %v", err)
 			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
@@ -313,31 +314,137 @@ func NfeEntradasListHandler(db *sql.DB) http.HandlerFunc {
 		}
 		defer rows.Close()
 
-		list := []nfeEntradaRow{}
+		if format != "" {
+			xw, err := beginExport(w, format, exportFilename("nfe-entradas", q.Get("mes_ano"), q.Get("forn_cnpj")))
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			err = xw.Sheet("NF-e de Entrada", nfeEntradaExportColumns)
+			for err == nil && rows.Next() {
+				var row nfeEntradaRow
+				if err = scanNfeEntradaRow(rows, &row); err == nil {
+					err = xw.Row(row.exportValues()...)
+				}
+			}
+			if err == nil {
+				err = rows.Err()
+			}
+			finishExport(xw, "NfeEntradasList", err)
+			return
+		}
+
+		items := []nfeEntradaRow{}
+		page := list.page()
 		for rows.Next() {
 			var row nfeEntradaRow
-			err := rows.Scan(
-				&row.ID, &row.ChaveNFe, &row.Modelo, &row.Serie, &row.NumeroNFe,
-				&row.DataEmissao, &row.MesAno, &row.NatOp,
-				&row.FornCNPJ, &row.FornNome, &row.FornUF, &row.FornMunicipio,
-				&row.DestCNPJCPF, &row.DestNome, &row.DestUF, &row.DestCMun,
-				&row.VBC, &row.VICMS, &row.VICMSDeson, &row.VFCP,
-				&row.VBcST, &row.VST, &row.VFcpST, &row.VFcpSTRet,
-				&row.VProd, &row.VFrete, &row.VSeg, &row.VDesc,
-				&row.VII, &row.VIPI, &row.VIPIDevol, &row.VPIS, &row.VCOFINS, &row.VOutro, &row.VNF,
-				&row.VBCIbsCbs, &row.VIBSuf, &row.VIBSMun, &row.VIBS, &row.VCredPresIBS,
-				&row.VCBS, &row.VCredPresCBS,
-			)
+			err := scanNfeEntradaRow(rows, &row, page.dest()...)
 			if err != nil {
 				log.Printf("NfeEntradasList scan error: %v", err)
 				continue
 			}
-			list = append(list, row)
+			if !page.keep() {
+				break
+			}
+			items = append(items, row)
+		}
+		rows.Close()
+
+		totais, err := list.totals(tx)
+		if err != nil {
+			log.Printf("NfeEntradasList totals error: %v", err)
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
 		}
+		json.NewEncoder(w).Encode(fiscalDocResponse(items, page, totais))
+	}
+}
+
+// nfeEntradaColumns is the select list of NfeEntradasListHandler, read by scanNfeEntradaRow.
+const nfeEntradaColumns = `
+	id, chave_nfe, modelo, serie, numero_nfe,
+	TO_CHAR(data_emissao, 'DD/MM/YYYY'), mes_ano, COALESCE(nat_op,''),
+	forn_cnpj, COALESCE(forn_nome,''), COALESCE(forn_uf,''), COALESCE(forn_municipio,''),
+	COALESCE(dest_cnpj_cpf,''), COALESCE(dest_nome,''), COALESCE(dest_uf,''), COALESCE(dest_c_mun,''),
+	v_bc, v_icms, v_icms_deson, v_fcp,
+	v_bc_st, v_st, v_fcp_st, v_fcp_st_ret,
+	v_prod, v_frete, v_seg, v_desc,
+	v_ii, v_ipi, v_ipi_devol, v_pis, v_cofins, v_outro, v_nf,
+	v_bc_ibs_cbs, v_ibs_uf, v_ibs_mun, v_ibs, v_cred_pres_ibs,
+	v_cbs, v_cred_pres_cbs`
+
+// scanNfeEntradaRow reads one row of nfeEntradaColumns, followed by extra.
+func scanNfeEntradaRow(rows *sql.Rows, row *nfeEntradaRow, extra ...interface{}) error {
+	return rows.Scan(append([]interface{}{
+		&row.ID, &row.ChaveNFe, &row.Modelo, &row.Serie, &row.NumeroNFe,
+		&row.DataEmissao, &row.MesAno, &row.NatOp,
+		&row.FornCNPJ, &row.FornNome, &row.FornUF, &row.FornMunicipio,
+		&row.DestCNPJCPF, &row.DestNome, &row.DestUF, &row.DestCMun,
+		&row.VBC, &row.VICMS, &row.VICMSDeson, &row.VFCP,
+		&row.VBcST, &row.VST, &row.VFcpST, &row.VFcpSTRet,
+		&row.VProd, &row.VFrete, &row.VSeg, &row.VDesc,
+		&row.VII, &row.VIPI, &row.VIPIDevol, &row.VPIS, &row.VCOFINS, &row.VOutro, &row.VNF,
+		&row.VBCIbsCbs, &row.VIBSuf, &row.VIBSMun, &row.VIBS, &row.VCredPresIBS,
+		&row.VCBS, &row.VCredPresCBS,
+	}, extra...)...)
+}
+
+// nfeEntradaExportColumns are the columns of GET /api/nfe-entradas?format=xlsx|csv,
+// in the order of nfeEntradaRow.exportValues.
+var nfeEntradaExportColumns = []export.Column{
+	{Header: "Chave NF-e", Kind: export.Text, Width: 48},
+	{Header: "Modelo", Kind: export.Integer},
+	{Header: "Série", Kind: export.Text, Width: 8},
+	{Header: "Número", Kind: export.Text, Width: 12},
+	{Header: "Emissão", Kind: export.Date},
+	{Header: "Mês/Ano", Kind: export.Text, Width: 10},
+	{Header: "Natureza da Operação", Kind: export.Text, Width: 30},
+	{Header: "CNPJ Fornecedor", Kind: export.Text, Width: 18},
+	{Header: "Fornecedor", Kind: export.Text, Width: 36},
+	{Header: "UF Fornecedor", Kind: export.Text},
+	{Header: "Município Fornecedor", Kind: export.Text, Width: 24},
+	{Header: "CNPJ/CPF Destinatário", Kind: export.Text, Width: 18},
+	{Header: "Destinatário", Kind: export.Text, Width: 36},
+	{Header: "UF Destinatário", Kind: export.Text},
+	{Header: "Cód. Município Destinatário", Kind: export.Text},
+	{Header: "BC ICMS", Kind: export.Money},
+	{Header: "ICMS", Kind: export.Money},
+	{Header: "ICMS Desonerado", Kind: export.Money},
+	{Header: "FCP", Kind: export.Money},
+	{Header: "BC ICMS ST", Kind: export.Money},
+	{Header: "ICMS ST", Kind: export.Money},
+	{Header: "FCP ST", Kind: export.Money},
+	{Header: "FCP ST Retido", Kind: export.Money},
+	{Header: "Produtos", Kind: export.Money},
+	{Header: "Frete", Kind: export.Money},
+	{Header: "Seguro", Kind: export.Money},
+	{Header: "Desconto", Kind: export.Money},
+	{Header: "II", Kind: export.Money},
+	{Header: "IPI", Kind: export.Money},
+	{Header: "IPI Devolvido", Kind: export.Money},
+	{Header: "PIS", Kind: export.Money},
+	{Header: "COFINS", Kind: export.Money},
+	{Header: "Outras Despesas", Kind: export.Money},
+	{Header: "Valor da NF", Kind: export.Money},
+	{Header: "BC IBS/CBS", Kind: export.Money},
+	{Header: "IBS UF", Kind: export.Money},
+	{Header: "IBS Município", Kind: export.Money},
+	{Header: "IBS", Kind: export.Money},
+	{Header: "Crédito Presumido IBS", Kind: export.Money},
+	{Header: "CBS", Kind: export.Money},
+	{Header: "Crédito Presumido CBS", Kind: export.Money},
+}
 
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"total": len(list),
-			"items": list,
-		})
+func (row nfeEntradaRow) exportValues() []interface{} {
+	return []interface{}{
+		row.ChaveNFe, row.Modelo, row.Serie, row.NumeroNFe, row.DataEmissao, row.MesAno, row.NatOp,
+		row.FornCNPJ, row.FornNome, row.FornUF, row.FornMunicipio,
+		row.DestCNPJCPF, row.DestNome, row.DestUF, row.DestCMun,
+		row.VBC, row.VICMS, row.VICMSDeson, row.VFCP,
+		row.VBcST, row.VST, row.VFcpST, row.VFcpSTRet,
+		row.VProd, row.VFrete, row.VSeg, row.VDesc,
+		row.VII, row.VIPI, row.VIPIDevol, row.VPIS, row.VCOFINS, row.VOutro, row.VNF,
+		row.VBCIbsCbs, row.VIBSuf, row.VIBSMun, row.VIBS, row.VCredPresIBS,
+		row.VCBS, row.VCredPresCBS,
 	}
 }
@@ -287,6 +287,14 @@ func NfeSaidasUploadHandler(db *sql.DB) http.HandlerFunc {
 
 		result := nfeSaidaUploadResult{Erros: []nfeSaidaErro{}}
 
+		// Um XML com erro não derruba os demais: cada INSERT tem seu savepoint
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
+		}
+		defer tx.Rollback()
+
 		for _, fh := range files {
 			filename := fh.Filename
 
@@ -348,7 +356,7 @@ func NfeSaidasUploadHandler(db *sql.DB) http.HandlerFunc {
 			ic := inf.Total.ICMSTot
 			ib := inf.Total.IBSCBSTot
 
-			_, err = db.Exec(`
+			_, err = execSavepoint(tx, `
 				INSERT INTO nfe_saidas (
 					company_id, chave_nfe, modelo, serie, numero_nfe,
 					data_emissao, mes_ano, nat_op,
@@ -400,6 +408,11 @@ func NfeSaidasUploadHandler(db *sql.DB) http.HandlerFunc {
 			result.Ignorados = 0
 		}
 
+		if err := tx.Commit(); err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao salvar no banco: "+err.Error())
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(result)
 	}
@@ -459,6 +472,8 @@ type nfeSaidaRow struct {
 	VCredPresCBS *float64 `json:"v_cred_pres_cbs"`
 }
 
+// NfeSaidasListHandler lists the company's outgoing NF-e a page at a time,
+// with the filters, order and totals of parseFiscalDocList.
 func NfeSaidasListHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -487,42 +502,22 @@ func NfeSaidasListHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		q := r.URL.Query()
-		mesAno := q.Get("mes_ano")
-		emitCNPJ := q.Get("emit_cnpj")
-
-		query := `
-			SELECT
-				id, chave_nfe, modelo, serie, numero_nfe,
-				TO_CHAR(data_emissao, 'DD/MM/YYYY'), mes_ano, COALESCE(nat_op,''),
-				emit_cnpj, COALESCE(emit_nome,''), COALESCE(emit_uf,''), COALESCE(emit_municipio,''),
-				COALESCE(dest_cnpj_cpf,''), COALESCE(dest_nome,''), COALESCE(dest_uf,''), COALESCE(dest_c_mun,''),
-				v_bc, v_icms, v_icms_deson, v_fcp,
-				v_bc_st, v_st, v_fcp_st, v_fcp_st_ret,
-				v_prod, v_frete, v_seg, v_desc,
-				v_ii, v_ipi, v_ipi_devol, v_pis, v_cofins, v_outro, v_nf,
-				v_bc_ibs_cbs, v_ibs_uf, v_ibs_mun, v_ibs, v_cred_pres_ibs,
-				v_cbs, v_cred_pres_cbs
-			FROM nfe_saidas
-			WHERE company_id = $1`
-
-		args := []interface{}{companyID}
-		idx := 2
-
-		if mesAno != "" {
-			query += fmt.Sprintf(" AND mes_ano = $%d", idx)
-			args = append(args, mesAno)
-			idx++
-		}
-		if emitCNPJ != "" {
-			query += fmt.Sprintf(" AND emit_cnpj = $%d", idx)
-			args = append(args, emitCNPJ)
-			idx++
+		list, err := parseFiscalDocList(&nfeSaidasSpec, companyID, r.URL.Query())
+		if err != nil {
+			jsonErr(w, http.StatusBadRequest, err.Error())
+			return
 		}
 
-		query += " ORDER BY data_emissao DESC, numero_nfe DESC LIMIT 500"
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			log.Printf("NfeSaidasList tenant tx error: %v", err)
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
+		}
+		defer tx.Rollback()
 
-		rows, err := db.Query(query, args...)
+		query, args := list.selectSQL(nfeSaidaColumns, true)
+		rows, err := tx.Query(query, args...)
 		if err != nil {
 			log.Printf("NfeSaidasList error: %v", err)
 			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
@@ -530,31 +525,57 @@ func NfeSaidasListHandler(db *sql.DB) http.HandlerFunc {
 		}
 		defer rows.Close()
 
-		list := []nfeSaidaRow{}
+		items := []nfeSaidaRow{}
+		page := list.page()
 		for rows.Next() {
 			var row nfeSaidaRow
-			err := rows.Scan(
-				&row.ID, &row.ChaveNFe, &row.Modelo, &row.Serie, &row.NumeroNFe,
-				&row.DataEmissao, &row.MesAno, &row.NatOp,
-				&row.EmitCNPJ, &row.EmitNome, &row.EmitUF, &row.EmitMunicipio,
-				&row.DestCNPJCPF, &row.DestNome, &row.DestUF, &row.DestCMun,
-				&row.VBC, &row.VICMS, &row.VICMSDeson, &row.VFCP,
-				&row.VBcST, &row.VST, &row.VFcpST, &row.VFcpSTRet,
-				&row.VProd, &row.VFrete, &row.VSeg, &row.VDesc,
-				&row.VII, &row.VIPI, &row.VIPIDevol, &row.VPIS, &row.VCOFINS, &row.VOutro, &row.VNF,
-				&row.VBCIbsCbs, &row.VIBSuf, &row.VIBSMun, &row.VIBS, &row.VCredPresIBS,
-				&row.VCBS, &row.VCredPresCBS,
-			)
+			err := scanNfeSaidaRow(rows, &row, page.dest()...)
 			if err != nil {
 				log.Printf("NfeSaidasList scan error: %v", err)
 				continue
 			}
-			list = append(list, row)
+			if !page.keep() {
+				break
+			}
+			items = append(items, row)
 		}
+		rows.Close()
 
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"total": len(list),
-			"items": list,
-		})
+		totais, err := list.totals(tx)
+		if err != nil {
+			log.Printf("NfeSaidasList totals error: %v", err)
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+			return
+		}
+		json.NewEncoder(w).Encode(fiscalDocResponse(items, page, totais))
 	}
 }
+
+// nfeSaidaColumns is the select list of NfeSaidasListHandler, read by scanNfeSaidaRow.
+const nfeSaidaColumns = `
+	id, chave_nfe, modelo, serie, numero_nfe,
+	TO_CHAR(data_emissao, 'DD/MM/YYYY'), mes_ano, COALESCE(nat_op,''),
+	emit_cnpj, COALESCE(emit_nome,''), COALESCE(emit_uf,''), COALESCE(emit_municipio,''),
+	COALESCE(dest_cnpj_cpf,''), COALESCE(dest_nome,''), COALESCE(dest_uf,''), COALESCE(dest_c_mun,''),
+	v_bc, v_icms, v_icms_deson, v_fcp,
+	v_bc_st, v_st, v_fcp_st, v_fcp_st_ret,
+	v_prod, v_frete, v_seg, v_desc,
+	v_ii, v_ipi, v_ipi_devol, v_pis, v_cofins, v_outro, v_nf,
+	v_bc_ibs_cbs, v_ibs_uf, v_ibs_mun, v_ibs, v_cred_pres_ibs,
+	v_cbs, v_cred_pres_cbs`
+
+// scanNfeSaidaRow reads one row of nfeSaidaColumns, followed by extra.
+func scanNfeSaidaRow(rows *sql.Rows, row *nfeSaidaRow, extra ...interface{}) error {
+	return rows.Scan(append([]interface{}{
+		&row.ID, &row.ChaveNFe, &row.Modelo, &row.Serie, &row.NumeroNFe,
+		&row.DataEmissao, &row.MesAno, &row.NatOp,
+		&row.EmitCNPJ, &row.EmitNome, &row.EmitUF, &row.EmitMunicipio,
+		&row.DestCNPJCPF, &row.DestNome, &row.DestUF, &row.DestCMun,
+		&row.VBC, &row.VICMS, &row.VICMSDeson, &row.VFCP,
+		&row.VBcST, &row.VST, &row.VFcpST, &row.VFcpSTRet,
+		&row.VProd, &row.VFrete, &row.VSeg, &row.VDesc,
+		&row.VII, &row.VIPI, &row.VIPIDevol, &row.VPIS, &row.VCOFINS, &row.VOutro, &row.VNF,
+		&row.VBCIbsCbs, &row.VIBSuf, &row.VIBSMun, &row.VIBS, &row.VCredPresIBS,
+		&row.VCBS, &row.VCredPresCBS,
+	}, extra...)...)
+}
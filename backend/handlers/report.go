@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"strconv"
 
+	"fb_apu01/export"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -25,6 +27,27 @@ type MercadoriasReport struct {
 	CbsProjetado  float64 `json:"vl_cbs_projetado"`
 }
 
+func (m *MercadoriasReport) scan(rows *sql.Rows) error {
+	return rows.Scan(&m.FilialNome, &m.FilialCNPJ, &m.MesAno, &m.Tipo, &m.TipoCfop, &m.Origem, &m.TipoOperacao, &m.Valor, &m.Icms, &m.IcmsProjetado, &m.IbsProjetado, &m.CbsProjetado)
+}
+
+// mercadoriasExportColumns are the columns of
+// GET /api/reports/mercadorias?format=xlsx|csv, one per MercadoriasReport field.
+var mercadoriasExportColumns = []export.Column{
+	{Header: "Filial", Kind: export.Text, Width: 36},
+	{Header: "CNPJ", Kind: export.Text, Width: 18},
+	{Header: "Mês/Ano", Kind: export.Text, Width: 10},
+	{Header: "Tipo", Kind: export.Text, Width: 10},
+	{Header: "Tipo CFOP", Kind: export.Text, Width: 10},
+	{Header: "Origem", Kind: export.Text, Width: 10},
+	{Header: "Tipo de Operação", Kind: export.Text, Width: 16},
+	{Header: "Valor Contábil", Kind: export.Money},
+	{Header: "ICMS", Kind: export.Money},
+	{Header: "ICMS Projetado", Kind: export.Money},
+	{Header: "IBS Projetado", Kind: export.Money},
+	{Header: "CBS Projetado", Kind: export.Money},
+}
+
 func GetMercadoriasReportHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -44,6 +67,18 @@ func GetMercadoriasReportHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		format, ok := exportFormat(w, r)
+		if !ok {
+			return
+		}
+
 		targetYearStr := r.URL.Query().Get("target_year")
 		var targetYear interface{} = nil
 		if targetYearStr != "" {
@@ -113,7 +148,7 @@ func GetMercadoriasReportHandler(db *sql.DB) http.HandlerFunc {
 			GROUP BY 1, 2, 3, 4, 5, 6, 7
 		`, typeFilter)
 
-		rows, err := db.Query(query, targetYear, companyID)
+		rows, err := tx.Query(query, targetYear, companyID)
 		if err != nil {
 			fmt.Printf("Error querying mercadorias report: %v\n", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -121,10 +156,31 @@ func GetMercadoriasReportHandler(db *sql.DB) http.HandlerFunc {
 		}
 		defer rows.Close()
 
+		if format != "" {
+			xw, err := beginExport(w, format, exportFilename("mercadorias", opType, targetYearStr))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			err = xw.Sheet("Mercadorias", mercadoriasExportColumns)
+			for err == nil && rows.Next() {
+				var r MercadoriasReport
+				if err = r.scan(rows); err == nil {
+					err = xw.Row(r.FilialNome, r.FilialCNPJ, r.MesAno, r.Tipo, r.TipoCfop, r.Origem, r.TipoOperacao,
+						r.Valor, r.Icms, r.IcmsProjetado, r.IbsProjetado, r.CbsProjetado)
+				}
+			}
+			if err == nil {
+				err = rows.Err()
+			}
+			finishExport(xw, "MercadoriasReport", err)
+			return
+		}
+
 		var reports []MercadoriasReport
 		for rows.Next() {
 			var r MercadoriasReport
-			if err := rows.Scan(&r.FilialNome, &r.FilialCNPJ, &r.MesAno, &r.Tipo, &r.TipoCfop, &r.Origem, &r.TipoOperacao, &r.Valor, &r.Icms, &r.IcmsProjetado, &r.IbsProjetado, &r.CbsProjetado); err != nil {
+			if err := r.scan(rows); err != nil {
 				fmt.Printf("Error scanning mercadorias report: %v\n", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -159,6 +215,13 @@ func GetTransporteReportHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		targetYearStr := r.URL.Query().Get("target_year")
 		var targetYear interface{} = nil
 		if targetYearStr != "" {
@@ -184,7 +247,7 @@ func GetTransporteReportHandler(db *sql.DB) http.HandlerFunc {
 			GROUP BY 1, 2, 3
 		`
 
-		rows, err := db.Query(query, targetYear, companyID)
+		rows, err := tx.Query(query, targetYear, companyID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -231,6 +294,13 @@ func GetEnergiaReportHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		targetYearStr := r.URL.Query().Get("target_year")
 		var targetYear interface{} = nil
 		if targetYearStr != "" {
@@ -256,7 +326,7 @@ func GetEnergiaReportHandler(db *sql.DB) http.HandlerFunc {
 			GROUP BY 1, 2
 		`
 
-		rows, err := db.Query(query, targetYear, companyID)
+		rows, err := tx.Query(query, targetYear, companyID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -302,6 +372,13 @@ func GetComunicacoesReportHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		targetYearStr := r.URL.Query().Get("target_year")
 		var targetYear interface{} = nil
 		if targetYearStr != "" {
@@ -328,7 +405,7 @@ func GetComunicacoesReportHandler(db *sql.DB) http.HandlerFunc {
 			GROUP BY 1, 2, 3
 		`
 
-		rows, err := db.Query(query, targetYear, companyID)
+		rows, err := tx.Query(query, targetYear, companyID)
 		if err != nil {
 			// Se a tabela não existir ou erro de query, retorna vazio por enquanto para não quebrar
 			fmt.Printf("Error querying comunicacoes report: %v\n", err)
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"fb_apu01/pdf"
+	"fb_apu01/services"
+)
+
+// writePDF sends a rendered report as a download.
+func writePDF(w http.ResponseWriter, filename string, data []byte) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func companyName(db dbQuerier, companyID string) string {
+	var name string
+	db.QueryRow(`SELECT COALESCE(name, '') FROM companies WHERE id = $1`, companyID).Scan(&name)
+	return name
+}
+
+// AIReportPDFHandler renders a saved executive summary (GET /api/reports/{id}/pdf).
+func AIReportPDFHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		reportID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/reports/"), "/pdf")
+		if reportID == "" || strings.Contains(reportID, "/") {
+			jsonErr(w, http.StatusBadRequest, "id de relatório inválido")
+			return
+		}
+
+		var periodo, resumo string
+		var dadosBrutos []byte
+		err := tx.QueryRow(`
+			SELECT periodo, resumo, dados_brutos
+			FROM ai_reports
+			WHERE id = $1 AND company_id = $2
+		`, reportID, companyID).Scan(&periodo, &resumo, &dadosBrutos)
+		if err == sql.ErrNoRows {
+			jsonErr(w, http.StatusNotFound, "relatório não encontrado")
+			return
+		}
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "erro ao buscar relatório: "+err.Error())
+			return
+		}
+
+		taxData, err := services.TaxComparisonFromDadosBrutos(dadosBrutos)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "dados do relatório inválidos: "+err.Error())
+			return
+		}
+		data, err := services.RenderExecutiveSummaryPDF(companyName(tx, companyID), periodo, resumo, taxData)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "erro ao gerar PDF: "+err.Error())
+			return
+		}
+		writePDF(w, services.ReportPDFFilename("Resumo Executivo", periodo), data)
+	}
+}
+
+// ApuracaoPainelPDFHandler renders the IBS/CBS panel
+// (GET /api/apuracao/painel/pdf?mes_ano=MM/YYYY).
+func ApuracaoPainelPDFHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		painel, err := loadApuracaoPainel(tx, companyID, r.URL.Query().Get("mes_ano"))
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if painel.MesSelecionado == "" {
+			jsonErr(w, http.StatusNotFound, "nenhum documento importado")
+			return
+		}
+
+		ibs, cbs := painel.IBS, painel.CBS
+		sections := []services.ReportSection{
+			{
+				Title: "IBS",
+				Rows: []services.ReportRow{
+					{Label: "Débito UF", Value: "R$ " + formatBRL(ibs.DebitoUF)},
+					{Label: "Débito Municipal", Value: "R$ " + formatBRL(ibs.DebitoMun)},
+					{Label: fmt.Sprintf("Débito — NF-e de saída (%d)", ibs.QtdSaidas), Value: "R$ " + formatBRL(ibs.DebitoTotal)},
+					{Label: "Crédito UF", Value: "- R$ " + formatBRL(ibs.CreditoNfeUF)},
+					{Label: "Crédito Municipal", Value: "- R$ " + formatBRL(ibs.CreditoNfeMun)},
+					{Label: fmt.Sprintf("Crédito — NF-e de entrada (%d)", ibs.QtdEntradas), Value: "- R$ " + formatBRL(ibs.CreditoNfeTotal)},
+					{Label: fmt.Sprintf("Crédito — CT-e (%d)", ibs.QtdCtes), Value: "- R$ " + formatBRL(ibs.CreditoCte)},
+					{Label: "Saldo UF", Value: "R$ " + formatBRL(ibs.SaldoUF)},
+					{Label: "Saldo Municipal", Value: "R$ " + formatBRL(ibs.SaldoMun)},
+					{Label: "Saldo IBS", Value: "R$ " + formatBRL(ibs.SaldoTotal), Destaque: true},
+				},
+			},
+			{
+				Title: "CBS",
+				Rows: []services.ReportRow{
+					{Label: fmt.Sprintf("Débito — NF-e de saída (%d)", cbs.QtdSaidas), Value: "R$ " + formatBRL(cbs.DebitoTotal)},
+					{Label: fmt.Sprintf("Crédito — NF-e de entrada (%d)", cbs.QtdEntradas), Value: "- R$ " + formatBRL(cbs.CreditoNfeTotal)},
+					{Label: fmt.Sprintf("Crédito — CT-e (%d)", cbs.QtdCtes), Value: "- R$ " + formatBRL(cbs.CreditoCte)},
+					{Label: "Saldo CBS", Value: "R$ " + formatBRL(cbs.SaldoTotal), Destaque: true},
+				},
+			},
+		}
+		chart := &services.ReportChart{
+			Title: "Débitos x Créditos",
+			Bars: []pdf.Bar{
+				{Label: "Débito IBS", Value: ibs.DebitoTotal, Text: "R$ " + formatBRL(ibs.DebitoTotal), Color: pdf.Hex("#10B981")},
+				{Label: "Crédito IBS", Value: ibs.CreditoNfeTotal + ibs.CreditoCte, Text: "R$ " + formatBRL(ibs.CreditoNfeTotal+ibs.CreditoCte), Color: pdf.Hex("#9AE6B4")},
+				{Label: "Débito CBS", Value: cbs.DebitoTotal, Text: "R$ " + formatBRL(cbs.DebitoTotal), Color: pdf.Hex("#F59E0B")},
+				{Label: "Crédito CBS", Value: cbs.CreditoNfeTotal + cbs.CreditoCte, Text: "R$ " + formatBRL(cbs.CreditoNfeTotal+cbs.CreditoCte), Color: pdf.Hex("#FBD38D")},
+			},
+		}
+
+		titulo := services.ReportNames[services.ReportApuracaoPainel]
+		data, err := services.RenderReportPDF(titulo, companyName(tx, companyID), painel.MesSelecionado, sections, chart)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "erro ao gerar PDF: "+err.Error())
+			return
+		}
+		writePDF(w, services.ReportPDFFilename(titulo, painel.MesSelecionado), data)
+	}
+}
+
+// CreditosPerdidosPDFHandler renders the IBS/CBS credits at risk with the
+// largest suppliers and carriers (GET /api/apuracao/creditos-perdidos/pdf).
+func CreditosPerdidosPDFHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		cp, err := loadCreditosPerdidos(tx, companyID)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// The PDF lists the 20 largest of each group; the screen shows up to 50
+		const top = 20
+		sections := []services.ReportSection{{
+			Title: fmt.Sprintf("Créditos IBS/CBS em Risco (alíquotas %.0f: IBS %.2f%%, CBS %.2f%%)", cp.Aliquotas.Ano, cp.Aliquotas.IBS, cp.Aliquotas.CBS),
+			Rows: []services.ReportRow{
+				{Label: fmt.Sprintf("NF-e sem IBS/CBS (%d de %d notas, %.1f%%)", cp.NFeSemCredito.TotalNotas, cp.NFeSemCredito.TotalUniverse, cp.NFeSemCredito.PercSemCredito), Value: "R$ " + formatBRL(cp.NFeSemCredito.TotalEstimado)},
+				{Label: fmt.Sprintf("Fornecedores do Simples Nacional (%d)", cp.SimplesNacional.TotalFornecedores), Value: "R$ " + formatBRL(cp.SimplesNacional.TotalPerdido)},
+				{Label: fmt.Sprintf("CT-e sem IBS/CBS (%d de %d, %.1f%%)", cp.CteSemCredito.TotalCTes, cp.CteSemCredito.TotalUniverse, cp.CteSemCredito.PercSemCredito), Value: "R$ " + formatBRL(cp.CteSemCredito.TotalEstimado)},
+				{Label: "Total em risco", Value: "R$ " + formatBRL(cp.TotalCreditoEmRisco), Destaque: true},
+			},
+		}}
+		if len(cp.NFeSemCredito.PorFornecedor) > 0 {
+			sec := services.ReportSection{Title: "NF-e sem crédito — maiores fornecedores"}
+			for i, f := range cp.NFeSemCredito.PorFornecedor {
+				if i == top {
+					break
+				}
+				sec.Rows = append(sec.Rows, services.ReportRow{
+					Label: fmt.Sprintf("%s — %s (%d notas)", f.FornCNPJ, f.FornNome, f.QtdNotas),
+					Value: "R$ " + formatBRL(f.TotalEstimado),
+				})
+			}
+			sections = append(sections, sec)
+		}
+		if len(cp.SimplesNacional.PorFornecedor) > 0 {
+			sec := services.ReportSection{Title: "Simples Nacional — maiores fornecedores"}
+			for i, f := range cp.SimplesNacional.PorFornecedor {
+				if i == top {
+					break
+				}
+				sec.Rows = append(sec.Rows, services.ReportRow{
+					Label: fmt.Sprintf("%s — %s", f.FornCNPJ, f.FornNome),
+					Value: "R$ " + formatBRL(f.TotalPerdido),
+				})
+			}
+			sections = append(sections, sec)
+		}
+		if len(cp.CteSemCredito.PorTransportadora) > 0 {
+			sec := services.ReportSection{Title: "CT-e sem crédito — maiores transportadoras"}
+			for i, t := range cp.CteSemCredito.PorTransportadora {
+				if i == top {
+					break
+				}
+				sec.Rows = append(sec.Rows, services.ReportRow{
+					Label: fmt.Sprintf("%s — %s (%d CT-e)", t.EmitCNPJ, t.EmitNome, t.QtdCTes),
+					Value: "R$ " + formatBRL(t.TotalEstimado),
+				})
+			}
+			sections = append(sections, sec)
+		}
+		chart := &services.ReportChart{
+			Title: "Crédito estimado por origem",
+			Bars: []pdf.Bar{
+				{Label: "NF-e sem IBS/CBS", Value: cp.NFeSemCredito.TotalEstimado, Text: "R$ " + formatBRL(cp.NFeSemCredito.TotalEstimado), Color: pdf.Hex("#E53E3E")},
+				{Label: "Simples Nacional", Value: cp.SimplesNacional.TotalPerdido, Text: "R$ " + formatBRL(cp.SimplesNacional.TotalPerdido), Color: pdf.Hex("#DD6B20")},
+				{Label: "CT-e sem IBS/CBS", Value: cp.CteSemCredito.TotalEstimado, Text: "R$ " + formatBRL(cp.CteSemCredito.TotalEstimado), Color: pdf.Hex("#D69E2E")},
+			},
+		}
+
+		titulo := services.ReportNames[services.ReportCreditosRisco]
+		data, err := services.RenderReportPDF(titulo, companyName(tx, companyID), "Acumulado", sections, chart)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "erro ao gerar PDF: "+err.Error())
+			return
+		}
+		writePDF(w, services.ReportPDFFilename(titulo, "Acumulado"), data)
+	}
+}
@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fb_apu01/services"
+
+	"github.com/lib/pq"
+)
+
+// ReportSubscription is a manager's subscription to a scheduled report.
+type ReportSubscription struct {
+	ID            string     `json:"id"`
+	ManagerID     string     `json:"manager_id"`
+	ManagerNome   string     `json:"manager_nome"`
+	ManagerEmail  string     `json:"manager_email"`
+	Relatorio     string     `json:"relatorio"`
+	RelatorioNome string     `json:"relatorio_nome"`
+	Frequencia    string     `json:"frequencia"`
+	Dia           int        `json:"dia"`
+	Hora          int        `json:"hora"`
+	Ativo         bool       `json:"ativo"`
+	AnexarPDF     bool       `json:"anexar_pdf"`
+	NextRunAt     *time.Time `json:"next_run_at"`
+	LastRunAt     *time.Time `json:"last_run_at"`
+	UltimoStatus  string     `json:"ultimo_status"` // status of the latest delivery, "" if none yet
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+const reportSubscriptionSelect = `
+	SELECT s.id, s.manager_id, m.nome_completo, m.email, s.relatorio, s.frequencia, s.dia, s.hora,
+	       s.ativo, s.anexar_pdf, s.next_run_at, s.last_run_at,
+	       COALESCE((SELECT d.status FROM report_deliveries d
+	                 WHERE d.subscription_id = s.id ORDER BY d.created_at DESC LIMIT 1), ''),
+	       s.created_at
+	FROM report_subscriptions s
+	JOIN managers m ON m.id = s.manager_id`
+
+func scanReportSubscription(row interface{ Scan(...interface{}) error }) (ReportSubscription, error) {
+	var s ReportSubscription
+	var next, last sql.NullTime
+	err := row.Scan(&s.ID, &s.ManagerID, &s.ManagerNome, &s.ManagerEmail, &s.Relatorio, &s.Frequencia, &s.Dia, &s.Hora,
+		&s.Ativo, &s.AnexarPDF, &next, &last, &s.UltimoStatus, &s.CreatedAt)
+	if next.Valid {
+		s.NextRunAt = &next.Time
+	}
+	if last.Valid {
+		s.LastRunAt = &last.Time
+	}
+	s.RelatorioNome = services.ReportNames[s.Relatorio]
+	return s, err
+}
+
+// nextRunAtFor is the next_run_at stored for a subscription (NULL for post-import).
+func nextRunAtFor(frequencia string, dia, hora int) sql.NullTime {
+	next := services.NextReportRun(frequencia, dia, hora, time.Now())
+	return sql.NullTime{Time: next, Valid: !next.IsZero()}
+}
+
+// ReportSubscriptionsHandler lists the company's subscriptions (GET) or
+// creates one (POST {manager_id, relatorio, frequencia, dia, hora, anexar_pdf}).
+// GET /api/report-subscriptions also returns the available reports.
+func ReportSubscriptionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := tx.Query(reportSubscriptionSelect+`
+				WHERE s.company_id = $1
+				ORDER BY m.nome_completo, s.relatorio, s.frequencia
+			`, companyID)
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			defer rows.Close()
+
+			list := []ReportSubscription{}
+			for rows.Next() {
+				s, err := scanReportSubscription(rows)
+				if err != nil {
+					continue
+				}
+				list = append(list, s)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"subscriptions": list,
+				"relatorios":    services.ReportNames,
+			})
+
+		case http.MethodPost:
+			var req struct {
+				ManagerID  string `json:"manager_id"`
+				Relatorio  string `json:"relatorio"`
+				Frequencia string `json:"frequencia"`
+				Dia        int    `json:"dia"`
+				Hora       *int   `json:"hora"`
+				AnexarPDF  bool   `json:"anexar_pdf"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				jsonErr(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			hora := 8
+			if req.Hora != nil {
+				hora = *req.Hora
+			}
+			if req.Frequencia == services.FrequencyOnImport {
+				req.Dia = 1
+			}
+			if err := services.ValidateReportSchedule(req.Relatorio, req.Frequencia, req.Dia, hora); err != nil {
+				jsonErr(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			var id string
+			err := tx.QueryRow(`
+				INSERT INTO report_subscriptions (company_id, manager_id, relatorio, frequencia, dia, hora, next_run_at, anexar_pdf)
+				SELECT $1, m.id, $3, $4, $5, $6, $7, $8
+				FROM managers m WHERE m.id = $2 AND m.company_id = $1
+				RETURNING id
+			`, companyID, req.ManagerID, req.Relatorio, req.Frequencia, req.Dia, hora,
+				nextRunAtFor(req.Frequencia, req.Dia, hora), req.AnexarPDF).Scan(&id)
+			if err == sql.ErrNoRows {
+				jsonErr(w, http.StatusNotFound, "gestor não encontrado")
+				return
+			}
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				jsonErr(w, http.StatusConflict, "o gestor já assina este relatório com esta frequência")
+				return
+			}
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+
+			s, err := scanReportSubscription(tx.QueryRow(reportSubscriptionSelect+` WHERE s.id = $1`, id))
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(s)
+
+		default:
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// ReportSubscriptionHandler handles one subscription:
+//
+//	PUT/PATCH /api/report-subscriptions/{id}            {frequencia, dia, hora, ativo, anexar_pdf}
+//	DELETE    /api/report-subscriptions/{id}
+//	GET       /api/report-subscriptions/{id}/deliveries  delivery history (?limit=50)
+func ReportSubscriptionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/report-subscriptions/"), "/")
+		id, action, _ := strings.Cut(path, "/")
+		if id == "" {
+			jsonErr(w, http.StatusBadRequest, "assinatura não informada")
+			return
+		}
+
+		switch {
+		case (r.Method == http.MethodPut || r.Method == http.MethodPatch) && action == "":
+			current, err := scanReportSubscription(tx.QueryRow(reportSubscriptionSelect+`
+				WHERE s.id = $1 AND s.company_id = $2`, id, companyID))
+			if err == sql.ErrNoRows {
+				jsonErr(w, http.StatusNotFound, "assinatura não encontrada")
+				return
+			} else if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+
+			var req struct {
+				Frequencia *string `json:"frequencia"`
+				Dia        *int    `json:"dia"`
+				Hora       *int    `json:"hora"`
+				Ativo      *bool   `json:"ativo"`
+				AnexarPDF  *bool   `json:"anexar_pdf"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				jsonErr(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if req.Frequencia != nil {
+				current.Frequencia = *req.Frequencia
+			}
+			if req.Dia != nil {
+				current.Dia = *req.Dia
+			}
+			if req.Hora != nil {
+				current.Hora = *req.Hora
+			}
+			if req.Ativo != nil {
+				current.Ativo = *req.Ativo
+			}
+			if req.AnexarPDF != nil {
+				current.AnexarPDF = *req.AnexarPDF
+			}
+			if current.Frequencia == services.FrequencyOnImport {
+				current.Dia = 1
+			}
+			if err := services.ValidateReportSchedule(current.Relatorio, current.Frequencia, current.Dia, current.Hora); err != nil {
+				jsonErr(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			_, err = tx.Exec(`
+				UPDATE report_subscriptions
+				SET frequencia = $3, dia = $4, hora = $5, ativo = $6, next_run_at = $7, anexar_pdf = $8, updated_at = NOW()
+				WHERE id = $1 AND company_id = $2
+			`, id, companyID, current.Frequencia, current.Dia, current.Hora, current.Ativo,
+				nextRunAtFor(current.Frequencia, current.Dia, current.Hora), current.AnexarPDF)
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				jsonErr(w, http.StatusConflict, "o gestor já assina este relatório com esta frequência")
+				return
+			}
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			s, err := scanReportSubscription(tx.QueryRow(reportSubscriptionSelect+` WHERE s.id = $1`, id))
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			json.NewEncoder(w).Encode(s)
+
+		case r.Method == http.MethodDelete && action == "":
+			res, err := tx.Exec("DELETE FROM report_subscriptions WHERE id = $1 AND company_id = $2", id, companyID)
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				jsonErr(w, http.StatusNotFound, "assinatura não encontrada")
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"message": "Assinatura removida"})
+
+		case r.Method == http.MethodGet && action == "deliveries":
+			limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil || limit <= 0 || limit > 500 {
+				limit = 50
+			}
+			rows, err := tx.Query(`
+				SELECT id, COALESCE(periodo, ''), email, status, COALESCE(erro, ''), scheduled_for, created_at
+				FROM report_deliveries
+				WHERE subscription_id = $1 AND company_id = $2
+				ORDER BY created_at DESC
+				LIMIT $3
+			`, id, companyID, limit)
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			defer rows.Close()
+
+			type delivery struct {
+				ID           string     `json:"id"`
+				Periodo      string     `json:"periodo"`
+				Email        string     `json:"email"`
+				Status       string     `json:"status"`
+				Erro         string     `json:"erro,omitempty"`
+				ScheduledFor *time.Time `json:"scheduled_for"`
+				CreatedAt    time.Time  `json:"created_at"`
+			}
+			list := []delivery{}
+			for rows.Next() {
+				var d delivery
+				var scheduled sql.NullTime
+				if err := rows.Scan(&d.ID, &d.Periodo, &d.Email, &d.Status, &d.Erro, &scheduled, &d.CreatedAt); err != nil {
+					continue
+				}
+				if scheduled.Valid {
+					d.ScheduledFor = &scheduled.Time
+				}
+				list = append(list, d)
+			}
+			json.NewEncoder(w).Encode(list)
+
+		default:
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// ReportUnsubscribeHandler is the public link in report emails
+// (/api/reports/unsubscribe?token=...). GET shows a confirmation page so
+// link scanners don't unsubscribe anyone; POST deactivates the subscription,
+// which also serves RFC 8058 one-click unsubscribe from mail clients.
+func ReportUnsubscribeHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		token := r.URL.Query().Get("token")
+
+		var relatorio, email string
+		err := db.QueryRow(`
+			SELECT s.relatorio, m.email
+			FROM report_subscriptions s JOIN managers m ON m.id = s.manager_id
+			WHERE s.unsubscribe_token = $1
+		`, token).Scan(&relatorio, &email)
+		if token == "" || err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, unsubscribePage("Link inválido", "Este link de cancelamento não é válido ou a assinatura foi removida.", ""))
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, unsubscribePage("Erro", "Não foi possível processar o cancelamento. Tente novamente mais tarde.", ""))
+			return
+		}
+		nome := html.EscapeString(services.ReportNames[relatorio])
+
+		switch r.Method {
+		case http.MethodGet:
+			form := fmt.Sprintf(`<form method="POST" action="?token=%s"><button type="submit">Cancelar assinatura</button></form>`, html.EscapeString(token))
+			fmt.Fprint(w, unsubscribePage("Cancelar assinatura",
+				fmt.Sprintf("Deixar de receber o relatório <strong>%s</strong> em %s?", nome, html.EscapeString(email)), form))
+
+		case http.MethodPost:
+			if _, err := db.Exec(`
+				UPDATE report_subscriptions SET ativo = false, updated_at = NOW()
+				WHERE unsubscribe_token = $1
+			`, token); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, unsubscribePage("Erro", "Não foi possível processar o cancelamento. Tente novamente mais tarde.", ""))
+				return
+			}
+			fmt.Printf("[Reports] Subscription to %s cancelled by %s via unsubscribe link\n", relatorio, email)
+			fmt.Fprint(w, unsubscribePage("Assinatura cancelada",
+				fmt.Sprintf("Você não receberá mais o relatório <strong>%s</strong>.", nome), ""))
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func unsubscribePage(titulo, mensagem, extra string) string {
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html><head><meta charset="UTF-8"><title>FBTax Cloud - %s</title>
+<style>body{font-family:Arial,sans-serif;background:#f4f4f8;color:#333;max-width:480px;margin:60px auto;text-align:center}
+.box{background:#fff;padding:32px;border-radius:8px}button{padding:10px 24px;background:#2d3748;color:#fff;border:0;border-radius:6px;font-weight:700;cursor:pointer}</style>
+</head><body><div class="box"><h2>%s</h2><p>%s</p>%s</div></body></html>`, titulo, titulo, mensagem, extra)
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"fb_apu01/services"
+)
+
+// RFBAgendamento is a company's calendar of automatic RFB solicitations.
+type RFBAgendamento struct {
+	Frequencia    string     `json:"frequencia"`
+	Dia           int        `json:"dia"`
+	Hora          int        `json:"hora"`
+	Ativo         bool       `json:"ativo"`
+	NextRunAt     *time.Time `json:"next_run_at"`
+	LastRunAt     *time.Time `json:"last_run_at"`
+	LastRequestID *string    `json:"last_request_id"`
+	LastError     *string    `json:"last_error"`
+}
+
+func loadRFBAgendamento(db dbQuerier, companyID string) (*RFBAgendamento, error) {
+	var a RFBAgendamento
+	var next, last sql.NullTime
+	err := db.QueryRow(`
+		SELECT frequencia, dia, hora, ativo, next_run_at, last_run_at, last_request_id::text, last_error
+		FROM rfb_agendamentos WHERE company_id = $1
+	`, companyID).Scan(&a.Frequencia, &a.Dia, &a.Hora, &a.Ativo, &next, &last, &a.LastRequestID, &a.LastError)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if next.Valid {
+		a.NextRunAt = &next.Time
+	}
+	if last.Valid {
+		a.LastRunAt = &last.Time
+	}
+	return &a, nil
+}
+
+// RFBAgendamentoHandler manages the company's automatic solicitations
+// (/api/rfb/agendamento):
+//
+//	GET     the calendar, or null when there is none
+//	PUT     {frequencia: mensal|semanal, dia, hora, ativo} creates or replaces it
+//	DELETE  removes it
+//
+// Each run requests a new apuração like the "Solicitar" button, within the
+// same daily limit; the download follows by webhook or polling.
+func RFBAgendamentoHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		switch r.Method {
+		case http.MethodGet:
+
+		case http.MethodPut:
+			var req struct {
+				Frequencia string `json:"frequencia"`
+				Dia        int    `json:"dia"`
+				Hora       *int   `json:"hora"`
+				Ativo      *bool  `json:"ativo"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				jsonErr(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			hora := 6
+			if req.Hora != nil {
+				hora = *req.Hora
+			}
+			ativo := req.Ativo == nil || *req.Ativo
+			if err := services.ValidateSchedule(req.Frequencia, req.Dia, hora); err != nil {
+				jsonErr(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			next := services.NextReportRun(req.Frequencia, req.Dia, hora, time.Now())
+			_, err := tx.Exec(`
+				INSERT INTO rfb_agendamentos (company_id, frequencia, dia, hora, ativo, next_run_at)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (company_id) DO UPDATE
+				SET frequencia = $2, dia = $3, hora = $4, ativo = $5, next_run_at = $6,
+				    falhas = 0, updated_at = CURRENT_TIMESTAMP
+			`, companyID, req.Frequencia, req.Dia, hora, ativo, next)
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+
+		case http.MethodDelete:
+			if _, err := tx.Exec(`DELETE FROM rfb_agendamentos WHERE company_id = $1`, companyID); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+
+		default:
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		a, err := loadRFBAgendamento(tx, companyID)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			jsonErr(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"agendamento": a})
+	}
+}
@@ -3,7 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"io"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
@@ -25,6 +25,11 @@ type RFBRequest struct {
 	Ambiente     string      `json:"ambiente"`
 	ErrorCode    *string     `json:"error_code,omitempty"`
 	ErrorMessage *string     `json:"error_message,omitempty"`
+	Origem       string      `json:"origem"`
+	// Retry state kept by the RFB scheduler (worker/rfb_scheduler.go)
+	DownloadAttempts int        `json:"download_attempts"`
+	ErrorRetryable   bool       `json:"error_retryable"`
+	NextAttemptAt    *time.Time `json:"next_attempt_at,omitempty"`
 	CreatedAt    time.Time   `json:"created_at"`
 	UpdatedAt    time.Time   `json:"updated_at"`
 	Resumo       *RFBResumo  `json:"resumo,omitempty"`
@@ -42,6 +47,7 @@ type RFBResumo struct {
 	TotalCorrente    int     `json:"total_corrente"`
 	TotalAjuste      int     `json:"total_ajuste"`
 	TotalExtemporaneo int    `json:"total_extemporaneo"`
+	Atual            bool    `json:"atual"` // latest version of the period's apuração
 }
 
 // RFBDebitoRow represents a normalized debit row for the frontend
@@ -85,74 +91,34 @@ func SolicitarApuracaoHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Check if company has active credentials
-		var clientID, clientSecret, cnpjMatriz, ambiente string
-		err = db.QueryRow(`
-			SELECT client_id, client_secret, cnpj_matriz, COALESCE(ambiente, 'producao') FROM rfb_credentials
-			WHERE company_id = $1 AND ativo = true
-		`, companyID).Scan(&clientID, &clientSecret, &cnpjMatriz, &ambiente)
-		clientSecret = DecryptFieldWithFallback(clientSecret)
-		if err == sql.ErrNoRows {
-			http.Error(w, "Credenciais RFB não configuradas. Configure em Conectar Receita Federal > Credenciais API.", http.StatusBadRequest)
-			return
+		// Optional credential_id (body or query); default is the company's first credential
+		var body struct {
+			CredentialID string `json:"credential_id"`
 		}
-		if err != nil {
-			http.Error(w, "Erro ao buscar credenciais: "+err.Error(), http.StatusInternalServerError)
-			return
+		json.NewDecoder(r.Body).Decode(&body)
+		credentialID := strings.TrimSpace(body.CredentialID)
+		if credentialID == "" {
+			credentialID = strings.TrimSpace(r.URL.Query().Get("credential_id"))
 		}
-
-		// Check daily limit (max 2 requests per day)
-		var todayCount int
-		err = db.QueryRow(`
-			SELECT COUNT(*) FROM rfb_requests
-			WHERE company_id = $1 AND status != 'error'
-			AND created_at >= CURRENT_DATE
-		`, companyID).Scan(&todayCount)
-		if err == nil && todayCount >= 2 {
-			http.Error(w, "Limite diário atingido (máximo 2 solicitações por dia)", http.StatusTooManyRequests)
+		if credentialID != "" && !isValidUUID(credentialID) {
+			http.Error(w, "credential_id inválido", http.StatusBadRequest)
 			return
 		}
 
-		// Extract CNPJ base (first 8 digits)
-		cnpjBase := cnpjMatriz
-		if len(cnpjBase) > 8 {
-			cnpjBase = cnpjBase[:8]
-		}
-
-		// 1. Get OAuth2 token
-		rfbClient := services.NewRFBClient()
-		rfbClient.SetAmbiente(ambiente)
-		token, err := rfbClient.GetToken(clientID, clientSecret)
-		if err != nil {
-			// Save failed request
-			db.Exec(`
-				INSERT INTO rfb_requests (company_id, cnpj_base, status, error_code, error_message)
-				VALUES ($1, $2, 'error', 'TOKEN_ERROR', $3)
-			`, companyID, cnpjBase, err.Error())
-			http.Error(w, "Erro ao obter token da RFB: "+err.Error(), http.StatusBadGateway)
+		requestID, tiquete, err := services.SolicitarApuracaoRFB(db, companyID, credentialID, services.RFBOrigemManual)
+		var solErr *services.RFBSolicitacaoError
+		switch {
+		case errors.Is(err, services.ErrRFBSemCredenciais), errors.Is(err, services.ErrRFBCertificadoVencido):
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
-		}
-
-		// 2. Request CBS assessment
-		tiquete, err := rfbClient.SolicitarApuracao(token, cnpjBase)
-		if err != nil {
-			db.Exec(`
-				INSERT INTO rfb_requests (company_id, cnpj_base, status, error_code, error_message)
-				VALUES ($1, $2, 'error', 'REQUEST_ERROR', $3)
-			`, companyID, cnpjBase, err.Error())
-			http.Error(w, "Erro ao solicitar apuração: "+err.Error(), http.StatusBadGateway)
+		case errors.Is(err, services.ErrRFBLimiteDiario):
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
 			return
-		}
-
-		// 3. Save request with ticket
-		var requestID string
-		err = db.QueryRow(`
-			INSERT INTO rfb_requests (company_id, cnpj_base, tiquete, status)
-			VALUES ($1, $2, $3, 'requested')
-			RETURNING id
-		`, companyID, cnpjBase, tiquete).Scan(&requestID)
-		if err != nil {
-			http.Error(w, "Erro ao salvar solicitação: "+err.Error(), http.StatusInternalServerError)
+		case errors.As(err, &solErr):
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
@@ -190,6 +156,13 @@ func DownloadManualHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		var req struct {
 			RequestID string `json:"request_id"`
 		}
@@ -201,7 +174,7 @@ func DownloadManualHandler(db *sql.DB) http.HandlerFunc {
 		// Verify request belongs to company and has a tiquete
 		var requestID, tiquete, status string
 		var tiqueteDownload *string
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT id, COALESCE(tiquete, ''), status, tiquete_download FROM rfb_requests
 			WHERE id = $1 AND company_id = $2
 		`, req.RequestID, companyID).Scan(&requestID, &tiquete, &status, &tiqueteDownload)
@@ -268,10 +241,18 @@ func DeleteRequestHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		requestID := strings.TrimPrefix(r.URL.Path, "/api/rfb/apuracao/")
 		requestID = strings.TrimSpace(requestID)
 
-		res, err := db.Exec(`
+		res, err := tx.Exec(`
 			DELETE FROM rfb_requests
 			WHERE id = $1 AND company_id = $2 AND status = 'error'
 		`, requestID, companyID)
@@ -284,6 +265,10 @@ func DeleteRequestHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Registro não encontrado ou não pode ser removido (apenas erros podem ser excluídos)", http.StatusNotFound)
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -307,11 +292,23 @@ func ClearErrorsHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		res, err := db.Exec(`DELETE FROM rfb_requests WHERE company_id = $1 AND status = 'error'`, companyID)
+
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec(`DELETE FROM rfb_requests WHERE company_id = $1 AND status = 'error'`, companyID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		rows, _ := res.RowsAffected()
 		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": rows})
 	}
@@ -342,6 +339,13 @@ func ReprocessHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		var req struct {
 			RequestID string `json:"request_id"`
 		}
@@ -352,7 +356,7 @@ func ReprocessHandler(db *sql.DB) http.HandlerFunc {
 
 		// Verify ownership
 		var exists bool
-		err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM rfb_requests WHERE id = $1 AND company_id = $2)`,
+		err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM rfb_requests WHERE id = $1 AND company_id = $2)`,
 			req.RequestID, companyID).Scan(&exists)
 		if err != nil || !exists {
 			http.Error(w, "Solicitação não encontrada", http.StatusNotFound)
@@ -372,102 +376,8 @@ func ReprocessHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// RFBWebhookHandler receives callbacks from the RFB API (PUBLIC - no JWT auth)
-func RFBWebhookHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("[RFB Webhook] Error reading body: %v", err)
-			http.Error(w, "Error reading body", http.StatusBadRequest)
-			return
-		}
-		defer r.Body.Close()
-
-		log.Printf("[RFB Webhook] ===== CALLBACK RECEIVED =====")
-		log.Printf("[RFB Webhook] Method: %s | RemoteAddr: %s", r.Method, r.RemoteAddr)
-		log.Printf("[RFB Webhook] Headers: %v", r.Header)
-		log.Printf("[RFB Webhook] Body: %s", string(body))
-		log.Printf("[RFB Webhook] ==============================")
-
-		// Parse webhook payload - try to extract tiquete
-		var payload map[string]interface{}
-		if err := json.Unmarshal(body, &payload); err != nil {
-			log.Printf("[RFB Webhook] Error parsing JSON: %v", err)
-			// Return 200 even on parse error so RFB doesn't retry indefinitely
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(map[string]string{"status": "received", "warning": "invalid JSON"})
-			return
-		}
-
-		log.Printf("[RFB Webhook] Parsed fields: %v", func() []string {
-			keys := make([]string, 0, len(payload))
-			for k := range payload {
-				keys = append(keys, k)
-			}
-			return keys
-		}())
-
-		// RFB sends two distinct tíquetes:
-		//   tiqueteSolicitacao = identifies the original request (stored in rfb_requests.tiquete)
-		//   tiqueteDownload    = the tíquete to use when calling the download endpoint
-		tiqueteSolicitacao, _ := payload["tiqueteSolicitacao"].(string)
-		tiqueteDownload, _ := payload["tiqueteDownload"].(string)
-
-		log.Printf("[RFB Webhook] tiqueteSolicitacao: %s | tiqueteDownload: %s",
-			tiqueteSolicitacao, tiqueteDownload)
-
-		if tiqueteSolicitacao == "" || tiqueteDownload == "" {
-			log.Printf("[RFB Webhook] Missing required tíquetes in payload — fields: %v", payload)
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(map[string]string{"status": "received", "warning": "missing tiqueteSolicitacao or tiqueteDownload"})
-			return
-		}
-
-		// Find the request by tiqueteSolicitacao
-		var requestID string
-		err = db.QueryRow(`
-			SELECT id FROM rfb_requests WHERE tiquete = $1 AND status = 'requested'
-		`, tiqueteSolicitacao).Scan(&requestID)
-		if err != nil {
-			log.Printf("[RFB Webhook] Request not found for tiqueteSolicitacao %s: %v", tiqueteSolicitacao, err)
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(map[string]string{"status": "received", "warning": "request not found"})
-			return
-		}
-
-		// Save tiqueteDownload and update status
-		_, err = db.Exec(`
-			UPDATE rfb_requests
-			SET status = 'webhook_received', tiquete_download = $1, updated_at = CURRENT_TIMESTAMP
-			WHERE id = $2
-		`, tiqueteDownload, requestID)
-		if err != nil {
-			log.Printf("[RFB Webhook] Error updating status/tiqueteDownload: %v", err)
-		}
-
-		log.Printf("[RFB Webhook] Request %s updated — tiqueteDownload saved, triggering download", requestID)
-
-		// Trigger async download and processing
-		go func() {
-			rfbClient := services.NewRFBClient()
-			if err := services.ProcessarDownloadRFB(db, rfbClient, requestID); err != nil {
-				log.Printf("[RFB Webhook] Error processing download for request %s: %v", requestID, err)
-			}
-		}()
-
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "processing"})
-	}
-}
-
-// StatusApuracaoHandler returns the list of RFB requests for the company
+// StatusApuracaoHandler returns the company's RFB requests, newest first,
+// paginated (?page=, ?page_size= default 20).
 func StatusApuracaoHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -486,18 +396,34 @@ func StatusApuracaoHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query(`
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		page, pageSize := rfbPaginacao(r.URL.Query(), 20, 100)
+		var total int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM rfb_requests WHERE company_id = $1`, companyID).Scan(&total); err != nil {
+			http.Error(w, "Error counting requests: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := tx.Query(`
 			SELECT r.id, r.company_id, r.cnpj_base, COALESCE(r.tiquete, ''), r.status, r.ambiente,
-				r.error_code, r.error_message, r.created_at, r.updated_at,
+				r.error_code, r.error_message, r.origem, r.download_attempts, r.error_retryable,
+				CASE WHEN r.status IN ('requested', 'webhook_received') OR r.error_retryable THEN r.next_attempt_at END,
+				r.created_at, r.updated_at,
 				res.id, res.request_id, COALESCE(res.data_apuracao, ''), res.total_debitos,
 				res.valor_cbs_total, res.valor_cbs_extinto, res.valor_cbs_nao_extinto,
-				res.total_corrente, res.total_ajuste, res.total_extemporaneo
+				res.total_corrente, res.total_ajuste, res.total_extemporaneo, COALESCE(res.atual, false)
 			FROM rfb_requests r
 			LEFT JOIN rfb_resumo res ON res.request_id = r.id
 			WHERE r.company_id = $1
 			ORDER BY r.created_at DESC
-			LIMIT 20
-		`, companyID)
+			LIMIT $2 OFFSET $3
+		`, companyID, pageSize, (page-1)*pageSize)
 		if err != nil {
 			http.Error(w, "Error querying requests: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -510,13 +436,15 @@ func StatusApuracaoHandler(db *sql.DB) http.HandlerFunc {
 			var resID, resReqID, resData sql.NullString
 			var resTotalDebitos, resCorrente, resAjuste, resExtemp sql.NullInt64
 			var resCBSTotal, resCBSExtinto, resCBSNaoExtinto sql.NullFloat64
+			var resAtual bool
 
 			if err := rows.Scan(
 				&req.ID, &req.CompanyID, &req.CNPJBase, &req.Tiquete, &req.Status, &req.Ambiente,
-				&req.ErrorCode, &req.ErrorMessage, &req.CreatedAt, &req.UpdatedAt,
+				&req.ErrorCode, &req.ErrorMessage, &req.Origem, &req.DownloadAttempts, &req.ErrorRetryable,
+				&req.NextAttemptAt, &req.CreatedAt, &req.UpdatedAt,
 				&resID, &resReqID, &resData, &resTotalDebitos,
 				&resCBSTotal, &resCBSExtinto, &resCBSNaoExtinto,
-				&resCorrente, &resAjuste, &resExtemp,
+				&resCorrente, &resAjuste, &resExtemp, &resAtual,
 			); err != nil {
 				http.Error(w, "Error scanning request: "+err.Error(), http.StatusInternalServerError)
 				return
@@ -533,19 +461,24 @@ func StatusApuracaoHandler(db *sql.DB) http.HandlerFunc {
 					TotalCorrente:      int(resCorrente.Int64),
 					TotalAjuste:        int(resAjuste.Int64),
 					TotalExtemporaneo:  int(resExtemp.Int64),
+					Atual:              resAtual,
 				}
 			}
 			requests = append(requests, req)
 		}
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"requests": requests,
-			"count":    len(requests),
+			"requests":   requests,
+			"count":      len(requests),
+			"pagination": rfbPaginacaoJSON(page, pageSize, total),
 		})
 	}
 }
 
 // DetalheApuracaoHandler returns details of a specific RFB request (GET) or deletes it (DELETE).
+// The details include the debits (paginated, filtered by ?tipo_apuracao=, ?ni_emitente=
+// and ?ni_adquirente=) and, for the whole apuração, the CBS extinguished per
+// extinction form and the debit events per type.
 func DetalheApuracaoHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -564,13 +497,20 @@ func DetalheApuracaoHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		// Extract request ID from path
 		requestID := strings.TrimPrefix(r.URL.Path, "/api/rfb/apuracao/")
 		requestID = strings.TrimSpace(requestID)
 
 		// Handle DELETE — remove error records only
 		if r.Method == http.MethodDelete {
-			res, err := db.Exec(`DELETE FROM rfb_requests WHERE id = $1 AND company_id = $2 AND status = 'error'`,
+			res, err := tx.Exec(`DELETE FROM rfb_requests WHERE id = $1 AND company_id = $2 AND status = 'error'`,
 				requestID, companyID)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -581,6 +521,10 @@ func DetalheApuracaoHandler(db *sql.DB) http.HandlerFunc {
 				http.Error(w, "Registro não encontrado ou não pode ser removido", http.StatusNotFound)
 				return
 			}
+			if err := tx.Commit(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -591,7 +535,7 @@ func DetalheApuracaoHandler(db *sql.DB) http.HandlerFunc {
 
 		// Fetch request (verify company ownership)
 		var req RFBRequest
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT id, company_id, cnpj_base, COALESCE(tiquete, ''), status, ambiente,
 				error_code, error_message, created_at, updated_at
 			FROM rfb_requests
@@ -610,18 +554,24 @@ func DetalheApuracaoHandler(db *sql.DB) http.HandlerFunc {
 		// Fetch summary if available
 		var resumo *RFBResumo
 		var r2 RFBResumo
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT id, request_id, COALESCE(data_apuracao, ''), total_debitos,
 				valor_cbs_total, valor_cbs_extinto, valor_cbs_nao_extinto,
-				total_corrente, total_ajuste, total_extemporaneo
+				total_corrente, total_ajuste, total_extemporaneo, atual
 			FROM rfb_resumo WHERE request_id = $1
 		`, requestID).Scan(&r2.ID, &r2.RequestID, &r2.DataApuracao, &r2.TotalDebitos,
 			&r2.ValorCBSTotal, &r2.ValorCBSExtinto, &r2.ValorCBSNaoExtinto,
-			&r2.TotalCorrente, &r2.TotalAjuste, &r2.TotalExtemporaneo)
+			&r2.TotalCorrente, &r2.TotalAjuste, &r2.TotalExtemporaneo, &r2.Atual)
 		if err == nil {
 			resumo = &r2
 		}
 
+		filtro, err := parseRFBDebitoFiltro(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// Pagination — default 500 per page
 		const pageSize = 500
 		page := 1
@@ -630,12 +580,13 @@ func DetalheApuracaoHandler(db *sql.DB) http.HandlerFunc {
 		}
 		offset := (page - 1) * pageSize
 
-		// Total debit count (uses summary if available, falls back to COUNT)
+		// Total debit count (uses summary if available and unfiltered, falls back to COUNT)
 		totalDebits := 0
-		if resumo != nil {
+		if resumo != nil && !filtro.ativo() {
 			totalDebits = resumo.TotalDebitos
 		} else {
-			db.QueryRow(`SELECT COUNT(*) FROM rfb_debitos WHERE request_id = $1`, requestID).Scan(&totalDebits)
+			tx.QueryRow(`SELECT COUNT(*) FROM rfb_debitos d WHERE d.request_id = $1 AND `+filtro.sql("d", 2),
+				append([]interface{}{requestID}, filtro.args()...)...).Scan(&totalDebits)
 		}
 		totalPages := (totalDebits + pageSize - 1) / pageSize
 		if totalPages == 0 {
@@ -643,7 +594,7 @@ func DetalheApuracaoHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Fetch debits — paginated
-		debitRows, err := db.Query(`
+		debitRows, err := tx.Query(`
 			SELECT id, tipo_apuracao, COALESCE(modelo_dfe, ''), COALESCE(numero_dfe, ''),
 				COALESCE(chave_dfe, ''),
 				CASE WHEN data_dfe_emissao IS NOT NULL THEN to_char(data_dfe_emissao, 'YYYY-MM-DD"T"HH24:MI:SS"Z"') END,
@@ -651,11 +602,11 @@ func DetalheApuracaoHandler(db *sql.DB) http.HandlerFunc {
 				COALESCE(ni_emitente, ''), COALESCE(ni_adquirente, ''),
 				COALESCE(valor_cbs_total, 0), COALESCE(valor_cbs_extinto, 0), COALESCE(valor_cbs_nao_extinto, 0),
 				COALESCE(situacao_debito, '')
-			FROM rfb_debitos
-			WHERE request_id = $1
+			FROM rfb_debitos d
+			WHERE request_id = $1 AND `+filtro.sql("d", 4)+`
 			ORDER BY tipo_apuracao, data_apuracao
 			LIMIT $2 OFFSET $3
-		`, requestID, pageSize, offset)
+		`, append([]interface{}{requestID, pageSize, offset}, filtro.args()...)...)
 		if err != nil {
 			http.Error(w, "Error querying debits: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -676,10 +627,24 @@ func DetalheApuracaoHandler(db *sql.DB) http.HandlerFunc {
 			debitos = append(debitos, d)
 		}
 
+		// Totals per extinction form and per event type, over the whole apuração
+		extincoes, err := loadRFBExtincoesPorForma(tx, requestID)
+		if err != nil {
+			http.Error(w, "Error querying extinction forms: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		eventos, err := loadRFBEventosPorTipo(tx, requestID)
+		if err != nil {
+			http.Error(w, "Error querying debit events: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"request": req,
-			"resumo":  resumo,
-			"debitos": debitos,
+			"request":             req,
+			"resumo":              resumo,
+			"debitos":             debitos,
+			"extincoes_por_forma": extincoes,
+			"eventos_por_tipo":    eventos,
 			"pagination": map[string]int{
 				"page":        page,
 				"page_size":   pageSize,
@@ -2,28 +2,98 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
+	"fb_apu01/secrets"
+	"fb_apu01/services"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// RFBCredential is one of the company's RFB API credentials: one per CNPJ
+// base and ambiente, authenticated by client secret or by A1 certificate.
 type RFBCredential struct {
 	ID           string    `json:"id"`
 	CompanyID    string    `json:"company_id"`
 	CNPJMatriz   string    `json:"cnpj_matriz"`
+	CNPJBase     string    `json:"cnpj_base"`
 	ClientID     string    `json:"client_id"`
 	ClientSecret string    `json:"client_secret"`
 	Ambiente     string    `json:"ambiente"`
+	AuthTipo     string    `json:"auth_tipo"`
 	Ativo        bool      `json:"ativo"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
+
+	// A1 certificate, for auth_tipo "certificado"
+	CertificadoTitular       *string    `json:"certificado_titular,omitempty"`
+	CertificadoCNPJ          *string    `json:"certificado_cnpj,omitempty"`
+	CertificadoEmissor       *string    `json:"certificado_emissor,omitempty"`
+	CertificadoValidade      *time.Time `json:"certificado_validade,omitempty"`
+	CertificadoDiasRestantes *int       `json:"certificado_dias_restantes,omitempty"`
+	CertificadoAlerta        string     `json:"certificado_alerta,omitempty"` // ok, vence_em_breve, vencido
+}
+
+const rfbCredentialColumns = `id, company_id, cnpj_matriz, cnpj_base, client_id, COALESCE(client_secret, ''),
+	COALESCE(ambiente, 'producao'), auth_tipo, ativo, created_at, updated_at,
+	certificado_titular, certificado_cnpj, certificado_emissor, certificado_validade`
+
+// scanRFBCredential reads rfbCredentialColumns, masking the secret and
+// computing the certificate's expiry warning.
+func scanRFBCredential(row interface{ Scan(...interface{}) error }) (RFBCredential, error) {
+	var cred RFBCredential
+	var validade sql.NullTime
+	err := row.Scan(&cred.ID, &cred.CompanyID, &cred.CNPJMatriz, &cred.CNPJBase, &cred.ClientID, &cred.ClientSecret,
+		&cred.Ambiente, &cred.AuthTipo, &cred.Ativo, &cred.CreatedAt, &cred.UpdatedAt,
+		&cred.CertificadoTitular, &cred.CertificadoCNPJ, &cred.CertificadoEmissor, &validade)
+	if err != nil {
+		return cred, err
+	}
+
+	// Decrypt for display, then mask; an undecryptable secret is flagged, not shown
+	if cred.ClientSecret != "" {
+		if cred.ClientSecret, err = secrets.Decrypt(cred.ClientSecret); err != nil {
+			log.Printf("[RFB] client_secret of credential %s: %v", cred.ID, err)
+			cred.ClientSecret = "(ilegível — cadastre novamente)"
+		} else if len(cred.ClientSecret) > 4 {
+			cred.ClientSecret = strings.Repeat("*", len(cred.ClientSecret)-4) + cred.ClientSecret[len(cred.ClientSecret)-4:]
+		}
+	}
+
+	if validade.Valid {
+		now := time.Now()
+		dias := int(validade.Time.Sub(now).Hours() / 24)
+		cred.CertificadoValidade = &validade.Time
+		cred.CertificadoDiasRestantes = &dias
+		cred.CertificadoAlerta = services.RFBCertificadoAlerta(validade.Time, now)
+	}
+	return cred, nil
+}
+
+// normalizeCNPJ removes formatting chars from a CNPJ.
+func normalizeCNPJ(cnpj string) string {
+	cnpj = strings.TrimSpace(cnpj)
+	cnpj = strings.ReplaceAll(cnpj, ".", "")
+	cnpj = strings.ReplaceAll(cnpj, "/", "")
+	return strings.ReplaceAll(cnpj, "-", "")
 }
 
-// GetRFBCredentialHandler returns the RFB credential for the user's company
+// normalizeAmbiente maps anything but "producao_restrita" to "producao".
+func normalizeAmbiente(ambiente string) string {
+	if ambiente != "producao_restrita" {
+		return "producao"
+	}
+	return ambiente
+}
+
+// GetRFBCredentialHandler returns the RFB credentials of the user's company.
+// "credential" (the first one) is kept for clients of the single-credential API.
 func GetRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -42,37 +112,48 @@ func GetRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var cred RFBCredential
-		err = db.QueryRow(`
-			SELECT id, company_id, cnpj_matriz, client_id, client_secret, COALESCE(ambiente, 'producao'), ativo, created_at, updated_at
-			FROM rfb_credentials
-			WHERE company_id = $1
-		`, companyID).Scan(&cred.ID, &cred.CompanyID, &cred.CNPJMatriz, &cred.ClientID, &cred.ClientSecret, &cred.Ambiente, &cred.Ativo, &cred.CreatedAt, &cred.UpdatedAt)
-
-		if err == sql.ErrNoRows {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"credential": nil,
-			})
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`
+			SELECT `+rfbCredentialColumns+`
+			FROM rfb_credentials
+			WHERE company_id = $1
+			ORDER BY created_at, id
+		`, companyID)
 		if err != nil {
 			http.Error(w, "Error querying credential: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer rows.Close()
 
-		// Decrypt for display (fallback to raw if not yet migrated), then mask
-		cred.ClientSecret = DecryptFieldWithFallback(cred.ClientSecret)
-		if len(cred.ClientSecret) > 4 {
-			cred.ClientSecret = strings.Repeat("*", len(cred.ClientSecret)-4) + cred.ClientSecret[len(cred.ClientSecret)-4:]
+		creds := []RFBCredential{}
+		for rows.Next() {
+			cred, err := scanRFBCredential(rows)
+			if err != nil {
+				http.Error(w, "Error querying credential: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			creds = append(creds, cred)
 		}
 
+		var first interface{}
+		if len(creds) > 0 {
+			first = creds[0]
+		}
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"credential": cred,
+			"credential":  first,
+			"credentials": creds,
 		})
 	}
 }
 
-// SaveRFBCredentialHandler creates or updates an RFB credential (UPSERT)
+// SaveRFBCredentialHandler creates or updates the client-secret credential of
+// a CNPJ base and ambiente (UPSERT).
 func SaveRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -96,6 +177,13 @@ func SaveRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		var req struct {
 			CNPJMatriz   string `json:"cnpj_matriz"`
 			ClientID     string `json:"client_id"`
@@ -108,17 +196,10 @@ func SaveRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Validation
-		req.CNPJMatriz = strings.TrimSpace(req.CNPJMatriz)
+		req.CNPJMatriz = normalizeCNPJ(req.CNPJMatriz)
 		req.ClientID = strings.TrimSpace(req.ClientID)
 		req.ClientSecret = strings.TrimSpace(req.ClientSecret)
-		if req.Ambiente != "producao_restrita" {
-			req.Ambiente = "producao"
-		}
-
-		// Remove formatting chars from CNPJ
-		req.CNPJMatriz = strings.ReplaceAll(req.CNPJMatriz, ".", "")
-		req.CNPJMatriz = strings.ReplaceAll(req.CNPJMatriz, "/", "")
-		req.CNPJMatriz = strings.ReplaceAll(req.CNPJMatriz, "-", "")
+		req.Ambiente = normalizeAmbiente(req.Ambiente)
 
 		if len(req.CNPJMatriz) != 14 {
 			http.Error(w, "CNPJ Matriz deve ter 14 dígitos", http.StatusBadRequest)
@@ -134,42 +215,36 @@ func SaveRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Encrypt client_secret before persisting
-		encryptedSecret, encErr := EncryptField(req.ClientSecret)
+		encryptedSecret, encErr := secrets.Encrypt(req.ClientSecret)
 		if encErr != nil {
 			log.Printf("[RFB] Error encrypting client_secret: %v", encErr)
 			http.Error(w, "Error processing credentials", http.StatusInternalServerError)
 			return
 		}
 
-		// UPSERT - insert or update on conflict
+		// UPSERT - one credential per CNPJ base and ambiente
 		var id string
-		err = db.QueryRow(`
-			INSERT INTO rfb_credentials (company_id, cnpj_matriz, client_id, client_secret, ambiente, ativo)
-			VALUES ($1, $2, $3, $4, $5, true)
-			ON CONFLICT (company_id)
-			DO UPDATE SET cnpj_matriz = $2, client_id = $3, client_secret = $4, ambiente = $5, ativo = true, updated_at = CURRENT_TIMESTAMP
+		err = tx.QueryRow(`
+			INSERT INTO rfb_credentials (company_id, cnpj_matriz, cnpj_base, client_id, client_secret, ambiente, auth_tipo, ativo)
+			VALUES ($1, $2, $3, $4, $5, $6, 'client_secret', true)
+			ON CONFLICT (company_id, cnpj_base, ambiente)
+			DO UPDATE SET cnpj_matriz = $2, client_id = $4, client_secret = $5, auth_tipo = 'client_secret',
+				ativo = true, updated_at = CURRENT_TIMESTAMP
 			RETURNING id
-		`, companyID, req.CNPJMatriz, req.ClientID, encryptedSecret, req.Ambiente).Scan(&id)
+		`, companyID, req.CNPJMatriz, req.CNPJMatriz[:8], req.ClientID, encryptedSecret, req.Ambiente).Scan(&id)
 		if err != nil {
 			http.Error(w, "Error saving credential: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Fetch saved credential
-		var cred RFBCredential
-		err = db.QueryRow(`
-			SELECT id, company_id, cnpj_matriz, client_id, client_secret, COALESCE(ambiente, 'producao'), ativo, created_at, updated_at
-			FROM rfb_credentials WHERE id = $1
-		`, id).Scan(&cred.ID, &cred.CompanyID, &cred.CNPJMatriz, &cred.ClientID, &cred.ClientSecret, &cred.Ambiente, &cred.Ativo, &cred.CreatedAt, &cred.UpdatedAt)
+		cred, err := scanRFBCredential(tx.QueryRow(`SELECT `+rfbCredentialColumns+` FROM rfb_credentials WHERE id = $1`, id))
 		if err != nil {
 			http.Error(w, "Credential saved but error fetching", http.StatusInternalServerError)
 			return
 		}
-
-		// Decrypt (fallback to raw if not yet migrated), then mask for response
-		cred.ClientSecret = DecryptFieldWithFallback(cred.ClientSecret)
-		if len(cred.ClientSecret) > 4 {
-			cred.ClientSecret = strings.Repeat("*", len(cred.ClientSecret)-4) + cred.ClientSecret[len(cred.ClientSecret)-4:]
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Error saving credential: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		w.WriteHeader(http.StatusCreated)
@@ -180,7 +255,137 @@ func SaveRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// DeleteRFBCredentialHandler removes the RFB credential for the user's company
+// rfbCertificadoMaxBytes bounds the .pfx upload (A1 files are a few KB).
+const rfbCertificadoMaxBytes = 256 << 10
+
+// UploadRFBCertificadoHandler creates or updates the certificate credential
+// of a CNPJ base and ambiente (POST /api/rfb/credentials/certificado,
+// multipart): file "certificado" (.pfx/.p12), "senha", "cnpj_matriz",
+// "client_id", "ambiente" and, when the RFB also asks for one, "client_secret".
+// The file and its password are stored encrypted; an expired certificate is
+// refused, and one issued to another CNPJ base is accepted with a warning.
+func UploadRFBCertificadoHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		r.Body = http.MaxBytesReader(w, r.Body, rfbCertificadoMaxBytes+64<<10)
+		if err := r.ParseMultipartForm(rfbCertificadoMaxBytes); err != nil {
+			jsonErr(w, http.StatusBadRequest, "Envie o certificado .pfx (até 256 KB) em multipart/form-data")
+			return
+		}
+		cnpjMatriz := normalizeCNPJ(r.FormValue("cnpj_matriz"))
+		clientID := strings.TrimSpace(r.FormValue("client_id"))
+		clientSecret := strings.TrimSpace(r.FormValue("client_secret"))
+		ambiente := normalizeAmbiente(r.FormValue("ambiente"))
+		senha := r.FormValue("senha")
+		if len(cnpjMatriz) != 14 {
+			jsonErr(w, http.StatusBadRequest, "CNPJ Matriz deve ter 14 dígitos")
+			return
+		}
+		if clientID == "" {
+			jsonErr(w, http.StatusBadRequest, "Client ID é obrigatório")
+			return
+		}
+
+		file, _, err := r.FormFile("certificado")
+		if err != nil {
+			jsonErr(w, http.StatusBadRequest, "Arquivo do certificado (campo certificado) é obrigatório")
+			return
+		}
+		defer file.Close()
+		pfx, err := io.ReadAll(file)
+		if err != nil {
+			jsonErr(w, http.StatusBadRequest, "Erro ao ler o certificado")
+			return
+		}
+
+		cert, err := services.ParseCertificadoA1(pfx, senha)
+		if err != nil {
+			jsonErr(w, http.StatusBadRequest, "Certificado inválido: "+err.Error())
+			return
+		}
+		if services.RFBCertificadoAlerta(cert.NotAfter, time.Now()) == services.RFBCertificadoVencido {
+			jsonErr(w, http.StatusBadRequest, "Certificado vencido em "+cert.NotAfter.Format("02/01/2006"))
+			return
+		}
+		var aviso string
+		if cert.CNPJ != "" && cert.CNPJ[:8] != cnpjMatriz[:8] {
+			aviso = "O certificado é do CNPJ " + cert.CNPJ + ", de outra raiz que " + cnpjMatriz[:8] + "."
+		}
+
+		encryptedPFX, err := secrets.Encrypt(base64.StdEncoding.EncodeToString(pfx))
+		if err != nil {
+			log.Printf("[RFB] Error encrypting certificate: %v", err)
+			jsonErr(w, http.StatusInternalServerError, "Error processing certificate")
+			return
+		}
+		encryptedSenha, err := secrets.Encrypt(senha)
+		if err != nil {
+			log.Printf("[RFB] Error encrypting certificate password: %v", err)
+			jsonErr(w, http.StatusInternalServerError, "Error processing certificate")
+			return
+		}
+		var encryptedSecret sql.NullString
+		if clientSecret != "" {
+			s, err := secrets.Encrypt(clientSecret)
+			if err != nil {
+				log.Printf("[RFB] Error encrypting client_secret: %v", err)
+				jsonErr(w, http.StatusInternalServerError, "Error processing credentials")
+				return
+			}
+			encryptedSecret = sql.NullString{String: s, Valid: true}
+		}
+
+		var id string
+		err = tx.QueryRow(`
+			INSERT INTO rfb_credentials (company_id, cnpj_matriz, cnpj_base, client_id, client_secret, ambiente, auth_tipo, ativo,
+				certificado_pfx, certificado_senha, certificado_titular, certificado_cnpj, certificado_emissor, certificado_validade)
+			VALUES ($1, $2, $3, $4, $5, $6, 'certificado', true, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT (company_id, cnpj_base, ambiente)
+			DO UPDATE SET cnpj_matriz = $2, client_id = $4, client_secret = $5, auth_tipo = 'certificado', ativo = true,
+				certificado_pfx = $7, certificado_senha = $8, certificado_titular = $9, certificado_cnpj = $10,
+				certificado_emissor = $11, certificado_validade = $12, updated_at = CURRENT_TIMESTAMP
+			RETURNING id
+		`, companyID, cnpjMatriz, cnpjMatriz[:8], clientID, encryptedSecret, ambiente,
+			encryptedPFX, encryptedSenha, cert.Titular, sql.NullString{String: cert.CNPJ, Valid: cert.CNPJ != ""}, cert.Emissor, cert.NotAfter).Scan(&id)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Error saving credential: "+err.Error())
+			return
+		}
+		log.Printf("[RFB] A1 certificate %s (sha256 %s, valid until %s) saved for company %s, CNPJ base %s",
+			cert.Titular, cert.SHA256, cert.NotAfter.Format("2006-01-02"), companyID, cnpjMatriz[:8])
+
+		cred, err := scanRFBCredential(tx.QueryRow(`SELECT `+rfbCredentialColumns+` FROM rfb_credentials WHERE id = $1`, id))
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Credential saved but error fetching")
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Error saving credential: "+err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"credential": cred,
+			"aviso":      aviso,
+			"message":    "Certificado salvo com sucesso",
+		})
+	}
+}
+
+// DeleteRFBCredentialHandler removes one RFB credential (?id=) or, without
+// id, all of the user's company.
 func DeleteRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -204,7 +409,19 @@ func DeleteRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		result, err := db.Exec("DELETE FROM rfb_credentials WHERE company_id = $1", companyID)
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		id := strings.TrimSpace(r.URL.Query().Get("id"))
+		if id != "" && !isValidUUID(id) {
+			http.Error(w, "id inválido", http.StatusBadRequest)
+			return
+		}
+		result, err := tx.Exec("DELETE FROM rfb_credentials WHERE company_id = $1 AND ($2 = '' OR id::text = $2)", companyID, id)
 		if err != nil {
 			http.Error(w, "Error deleting credential: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -215,6 +432,10 @@ func DeleteRFBCredentialHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Nenhuma credencial encontrada", http.StatusNotFound)
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Error deleting credential: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusNoContent)
 	}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rfbDivergenciaTolerancia is the largest CBS difference per document still
+// taken as rounding.
+const rfbDivergenciaTolerancia = 0.01
+
+// Situations of a document in the divergence report.
+const (
+	divergenciaSomenteRFB     = "somente_rfb"
+	divergenciaSomenteEmpresa = "somente_empresa"
+	divergenciaValor          = "valor_divergente"
+)
+
+// RFBDivergencia is one document on which the RFB assessment and the
+// company's own CBS (nfe_saidas.v_cbs) disagree.
+type RFBDivergencia struct {
+	ChaveDfe        string   `json:"chave_dfe"`
+	Situacao        string   `json:"situacao"`
+	ModeloDfe       string   `json:"modelo_dfe"`
+	NumeroDfe       string   `json:"numero_dfe"`
+	TiposApuracao   string   `json:"tipos_apuracao,omitempty"`
+	ValorRFB        *float64 `json:"valor_rfb"`
+	ValorEmpresa    *float64 `json:"valor_empresa"`
+	Diferenca       float64  `json:"diferenca"`
+	MesAnoEmpresa   string   `json:"mes_ano_empresa,omitempty"`   // somente_rfb: the note is in another month of nfe_saidas
+	PeriodoRFBOutro string   `json:"periodo_rfb_outro,omitempty"` // somente_empresa: the RFB has it in another apuração
+}
+
+// RFBDivergenciaResumo totals the comparison. Variacao is RFB minus company.
+type RFBDivergenciaResumo struct {
+	QtdRFB             int     `json:"qtd_rfb"`
+	QtdEmpresa         int     `json:"qtd_empresa"`
+	QtdConferidos      int     `json:"qtd_conferidos"`
+	QtdSomenteRFB      int     `json:"qtd_somente_rfb"`
+	QtdSomenteEmpresa  int     `json:"qtd_somente_empresa"`
+	QtdValorDivergente int     `json:"qtd_valor_divergente"`
+	QtdRFBSemChave     int     `json:"qtd_rfb_sem_chave"`
+	CBSRFB             float64 `json:"cbs_rfb"`
+	CBSEmpresa         float64 `json:"cbs_empresa"`
+	Variacao           float64 `json:"variacao"`
+	VariacaoPercentual float64 `json:"variacao_percentual"`
+	ValorSomenteRFB    float64 `json:"valor_somente_rfb"`
+	ValorSomenteEmp    float64 `json:"valor_somente_empresa"`
+	ValorDiferencas    float64 `json:"valor_diferencas"`
+	ValorRFBSemChave   float64 `json:"valor_rfb_sem_chave"`
+}
+
+// RFBDivergencias is the divergence report of one period.
+type RFBDivergencias struct {
+	MesAno       string               `json:"mes_ano"`
+	RequestID    string               `json:"request_id"`
+	DataApuracao string               `json:"data_apuracao"`
+	Resumo       RFBDivergenciaResumo `json:"resumo"`
+	Divergencias []RFBDivergencia     `json:"divergencias"`
+}
+
+// periodoRFB converts the RFB's data_apuracao (YYYYMM, or YYYY-MM as in the
+// simulator) to the project's MM/YYYY.
+func periodoRFB(dataApuracao string) (string, bool) {
+	for _, layout := range []string{"200601", "2006-01"} {
+		if t, err := time.Parse(layout, dataApuracao); err == nil {
+			return t.Format("01/2006"), true
+		}
+	}
+	return "", false
+}
+
+// findRFBApuracao picks the imported apuração to compare: the given request,
+// the latest one of the month mes, or the company's latest one when both are
+// empty (zero mes).
+func findRFBApuracao(db dbQuerier, companyID, requestID string, mes time.Time) (id, dataApuracao string, err error) {
+	var yyyymm, yyyyDashMM string
+	if !mes.IsZero() {
+		yyyymm, yyyyDashMM = mes.Format("200601"), mes.Format("2006-01")
+	}
+	err = db.QueryRow(`
+		SELECT rs.request_id, rs.data_apuracao
+		FROM rfb_resumo rs
+		JOIN rfb_requests rq ON rq.id = rs.request_id
+		WHERE rs.company_id = $1
+		  AND ($2 = '' OR rs.request_id::text = $2)
+		  AND ($3 = '' OR rs.data_apuracao IN ($3, $4))
+		ORDER BY rq.created_at DESC
+		LIMIT 1
+	`, companyID, requestID, yyyymm, yyyyDashMM).Scan(&id, &dataApuracao)
+	return id, dataApuracao, err
+}
+
+// loadRFBDivergencias compares, document by document (chave_dfe), the debits
+// of one RFB apuração with the company's own CBS on nfe_saidas of the same
+// month. A document's RFB value is the sum of its debits (corrente, ajuste
+// and extemporâneo).
+func loadRFBDivergencias(db dbQuerier, companyID, requestID, dataApuracao string) (*RFBDivergencias, error) {
+	mesAno, ok := periodoRFB(dataApuracao)
+	if !ok {
+		return nil, fmt.Errorf("período da apuração da RFB não reconhecido: %q", dataApuracao)
+	}
+	out := &RFBDivergencias{MesAno: mesAno, RequestID: requestID, DataApuracao: dataApuracao, Divergencias: []RFBDivergencia{}}
+	res := &out.Resumo
+
+	if err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(valor_cbs_total), 0)
+		FROM rfb_debitos
+		WHERE request_id = $1 AND COALESCE(chave_dfe, '') = ''
+	`, requestID).Scan(&res.QtdRFBSemChave, &res.ValorRFBSemChave); err != nil {
+		return nil, fmt.Errorf("Erro ao consultar débitos da RFB: %w", err)
+	}
+
+	rows, err := db.Query(`
+		WITH rfb AS (
+			SELECT chave_dfe, MAX(modelo_dfe) AS modelo, MAX(numero_dfe) AS numero,
+				string_agg(DISTINCT tipo_apuracao, ',') AS tipos,
+				SUM(COALESCE(valor_cbs_total, 0)) AS valor
+			FROM rfb_debitos
+			WHERE request_id = $1 AND COALESCE(chave_dfe, '') <> ''
+			GROUP BY chave_dfe
+		), empresa AS (
+			SELECT chave_nfe, modelo::text AS modelo, COALESCE(numero_nfe, '') AS numero,
+				COALESCE(v_cbs, 0) AS valor
+			FROM nfe_saidas
+			WHERE company_id = $2 AND mes_ano = $3
+		)
+		SELECT COALESCE(rfb.chave_dfe, empresa.chave_nfe),
+			COALESCE(rfb.modelo, empresa.modelo, ''), COALESCE(rfb.numero, empresa.numero, ''),
+			COALESCE(rfb.tipos, ''), rfb.valor, empresa.valor,
+			CASE WHEN empresa.chave_nfe IS NULL THEN
+				(SELECT o.mes_ano FROM nfe_saidas o WHERE o.company_id = $2 AND o.chave_nfe = rfb.chave_dfe LIMIT 1)
+			END,
+			CASE WHEN rfb.chave_dfe IS NULL THEN
+				(SELECT d.data_apuracao FROM rfb_debitos d
+				 JOIN rfb_resumo rs ON rs.request_id = d.request_id AND rs.atual
+				 WHERE d.company_id = $2 AND d.chave_dfe = empresa.chave_nfe AND d.request_id <> $1
+				 LIMIT 1)
+			END
+		FROM rfb
+		FULL OUTER JOIN empresa ON empresa.chave_nfe = rfb.chave_dfe
+	`, requestID, companyID, mesAno)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao comparar documentos: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d RFBDivergencia
+		var valorRFB, valorEmpresa sql.NullFloat64
+		var mesAnoEmpresa, periodoOutro sql.NullString
+		if err := rows.Scan(&d.ChaveDfe, &d.ModeloDfe, &d.NumeroDfe, &d.TiposApuracao,
+			&valorRFB, &valorEmpresa, &mesAnoEmpresa, &periodoOutro); err != nil {
+			return nil, fmt.Errorf("Erro ao ler comparação: %w", err)
+		}
+		switch {
+		case !valorEmpresa.Valid:
+			d.Situacao = divergenciaSomenteRFB
+			d.ValorRFB = &valorRFB.Float64
+			d.Diferenca = valorRFB.Float64
+			d.MesAnoEmpresa = mesAnoEmpresa.String
+			res.QtdRFB++
+			res.QtdSomenteRFB++
+			res.CBSRFB += valorRFB.Float64
+			res.ValorSomenteRFB += valorRFB.Float64
+		case !valorRFB.Valid:
+			d.Situacao = divergenciaSomenteEmpresa
+			d.ValorEmpresa = &valorEmpresa.Float64
+			d.Diferenca = -valorEmpresa.Float64
+			if p, ok := periodoRFB(periodoOutro.String); ok {
+				d.PeriodoRFBOutro = p
+			}
+			res.QtdEmpresa++
+			res.QtdSomenteEmpresa++
+			res.CBSEmpresa += valorEmpresa.Float64
+			res.ValorSomenteEmp += valorEmpresa.Float64
+		default:
+			res.QtdRFB++
+			res.QtdEmpresa++
+			res.CBSRFB += valorRFB.Float64
+			res.CBSEmpresa += valorEmpresa.Float64
+			diff := valorRFB.Float64 - valorEmpresa.Float64
+			if math.Abs(diff) <= rfbDivergenciaTolerancia {
+				res.QtdConferidos++
+				continue
+			}
+			d.Situacao = divergenciaValor
+			d.ValorRFB = &valorRFB.Float64
+			d.ValorEmpresa = &valorEmpresa.Float64
+			d.Diferenca = diff
+			res.QtdValorDivergente++
+			res.ValorDiferencas += diff
+		}
+		d.Diferenca = math.Round(d.Diferenca*100) / 100
+		out.Divergencias = append(out.Divergencias, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Erro ao ler comparação: %w", err)
+	}
+
+	res.CBSRFB += res.ValorRFBSemChave
+	res.Variacao = res.CBSRFB - res.CBSEmpresa
+	if res.CBSEmpresa != 0 {
+		res.VariacaoPercentual = res.Variacao / math.Abs(res.CBSEmpresa) * 100
+	}
+
+	// Largest differences first
+	sort.SliceStable(out.Divergencias, func(i, j int) bool {
+		di, dj := math.Abs(out.Divergencias[i].Diferenca), math.Abs(out.Divergencias[j].Diferenca)
+		if di != dj {
+			return di > dj
+		}
+		return out.Divergencias[i].ChaveDfe < out.Divergencias[j].ChaveDfe
+	})
+	return out, nil
+}
+
+// RFBDivergenciasHandler compares the RFB's CBS assessment with the CBS the
+// company computes from its own outgoing notes (GET /api/rfb/divergencias):
+// documents only the RFB counts, documents only the company has, value
+// differences per chave_dfe and the total variance. The apuração is chosen by
+// ?request_id= or ?mes_ano=MM/YYYY (default: the latest imported one);
+// ?situacao= filters the list (somente_rfb, somente_empresa, valor_divergente).
+func RFBDivergenciasHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		q := r.URL.Query()
+		requestID := strings.TrimSpace(q.Get("request_id"))
+		if requestID != "" && !isValidUUID(requestID) {
+			jsonErr(w, http.StatusBadRequest, "request_id inválido")
+			return
+		}
+		var mes time.Time
+		if mesAno := strings.TrimSpace(q.Get("mes_ano")); mesAno != "" && requestID == "" {
+			var err error
+			if mes, err = time.Parse("01/2006", mesAno); err != nil {
+				jsonErr(w, http.StatusBadRequest, "mes_ano inválido (use MM/AAAA)")
+				return
+			}
+		}
+		id, dataApuracao, err := findRFBApuracao(tx, companyID, requestID, mes)
+		if err == sql.ErrNoRows {
+			jsonErr(w, http.StatusNotFound, "Nenhuma apuração da RFB importada para o período")
+			return
+		}
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao buscar apuração da RFB: "+err.Error())
+			return
+		}
+
+		rep, err := loadRFBDivergencias(tx, companyID, id, dataApuracao)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if situacao := q.Get("situacao"); situacao != "" {
+			filtradas := []RFBDivergencia{}
+			for _, d := range rep.Divergencias {
+				if d.Situacao == situacao {
+					filtradas = append(filtradas, d)
+				}
+			}
+			rep.Divergencias = filtradas
+		}
+		json.NewEncoder(w).Encode(rep)
+	}
+}
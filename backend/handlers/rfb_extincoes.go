@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RFBExtincaoPorForma totals how much CBS of one apuração was extinguished by
+// each form (payment, split payment, credit offset...).
+type RFBExtincaoPorForma struct {
+	CodigoForma    string     `json:"codigo_forma"`
+	DescricaoForma string     `json:"descricao_forma"`
+	QtdDebitos     int        `json:"qtd_debitos"`
+	ValorExtinto   float64    `json:"valor_extinto"`
+	PrimeiraData   *time.Time `json:"primeira_data"`
+	UltimaData     *time.Time `json:"ultima_data"`
+}
+
+// RFBEventoPorTipo counts the debit events of one apuração by event type.
+type RFBEventoPorTipo struct {
+	CodigoEvento    string     `json:"codigo_evento"`
+	DescricaoEvento string     `json:"descricao_evento"`
+	Quantidade      int        `json:"quantidade"`
+	ValorCBS        float64    `json:"valor_cbs"`
+	UltimaData      *time.Time `json:"ultima_data"`
+}
+
+func loadRFBExtincoesPorForma(db dbQuerier, requestID string) ([]RFBExtincaoPorForma, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(codigo_forma, ''), COALESCE(MAX(descricao_forma), ''),
+			COUNT(DISTINCT debito_id), COALESCE(SUM(valor_extinto), 0),
+			MIN(data_extincao), MAX(data_extincao)
+		FROM rfb_debito_extincoes
+		WHERE request_id = $1
+		GROUP BY COALESCE(codigo_forma, '')
+		ORDER BY 4 DESC
+	`, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	formas := []RFBExtincaoPorForma{}
+	for rows.Next() {
+		var f RFBExtincaoPorForma
+		var primeira, ultima sql.NullTime
+		if err := rows.Scan(&f.CodigoForma, &f.DescricaoForma, &f.QtdDebitos, &f.ValorExtinto, &primeira, &ultima); err != nil {
+			return nil, err
+		}
+		if primeira.Valid {
+			f.PrimeiraData = &primeira.Time
+		}
+		if ultima.Valid {
+			f.UltimaData = &ultima.Time
+		}
+		formas = append(formas, f)
+	}
+	return formas, rows.Err()
+}
+
+func loadRFBEventosPorTipo(db dbQuerier, requestID string) ([]RFBEventoPorTipo, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(codigo_evento, ''), COALESCE(MAX(descricao_evento), ''),
+			COUNT(*), COALESCE(SUM(valor_cbs), 0), MAX(data_evento)
+		FROM rfb_debito_eventos
+		WHERE request_id = $1
+		GROUP BY COALESCE(codigo_evento, '')
+		ORDER BY 3 DESC
+	`, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	eventos := []RFBEventoPorTipo{}
+	for rows.Next() {
+		var e RFBEventoPorTipo
+		var ultima sql.NullTime
+		if err := rows.Scan(&e.CodigoEvento, &e.DescricaoEvento, &e.Quantidade, &e.ValorCBS, &ultima); err != nil {
+			return nil, err
+		}
+		if ultima.Valid {
+			e.UltimaData = &ultima.Time
+		}
+		eventos = append(eventos, e)
+	}
+	return eventos, rows.Err()
+}
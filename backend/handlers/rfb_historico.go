@@ -0,0 +1,549 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rfbDebitoFiltro narrows the debits of an apuração by tipo_apuracao and by
+// emitter/acquirer document (CNPJ or CPF). Empty fields do not filter.
+type rfbDebitoFiltro struct {
+	Tipo       string
+	Emitente   string
+	Adquirente string
+}
+
+// parseRFBDebitoFiltro reads ?tipo_apuracao=, ?ni_emitente= and ?ni_adquirente=.
+func parseRFBDebitoFiltro(q url.Values) (rfbDebitoFiltro, error) {
+	f := rfbDebitoFiltro{
+		Tipo:       strings.TrimSpace(q.Get("tipo_apuracao")),
+		Emitente:   normalizeCNPJ(q.Get("ni_emitente")),
+		Adquirente: normalizeCNPJ(q.Get("ni_adquirente")),
+	}
+	switch f.Tipo {
+	case "", "corrente", "ajuste", "extemporaneo":
+	default:
+		return f, errors.New("tipo_apuracao inválido (corrente, ajuste ou extemporaneo)")
+	}
+	return f, nil
+}
+
+func (f rfbDebitoFiltro) ativo() bool {
+	return f.Tipo != "" || f.Emitente != "" || f.Adquirente != ""
+}
+
+// sql returns the filter condition on the rfb_debitos alias, its parameters
+// numbered from n (see args).
+func (f rfbDebitoFiltro) sql(alias string, n int) string {
+	return fmt.Sprintf(`($%[2]d = '' OR %[1]s.tipo_apuracao = $%[2]d)
+		AND ($%[3]d = '' OR %[1]s.ni_emitente = $%[3]d)
+		AND ($%[4]d = '' OR %[1]s.ni_adquirente = $%[4]d)`, alias, n, n+1, n+2)
+}
+
+func (f rfbDebitoFiltro) args() []interface{} {
+	return []interface{}{f.Tipo, f.Emitente, f.Adquirente}
+}
+
+// rfbPaginacao reads ?page= and ?page_size= (default padrao, at most maximo).
+func rfbPaginacao(q url.Values, padrao, maximo int) (page, pageSize int) {
+	page, pageSize = 1, padrao
+	if p, err := strconv.Atoi(q.Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	if s, err := strconv.Atoi(q.Get("page_size")); err == nil && s > 0 {
+		pageSize = s
+	}
+	if pageSize > maximo {
+		pageSize = maximo
+	}
+	return page, pageSize
+}
+
+func rfbPaginacaoJSON(page, pageSize, total int) map[string]int {
+	totalPages := (total + pageSize - 1) / pageSize
+	if totalPages == 0 {
+		totalPages = 1
+	}
+	return map[string]int{
+		"page":        page,
+		"page_size":   pageSize,
+		"total":       total,
+		"total_pages": totalPages,
+	}
+}
+
+// parseMesAnoRFB converts ?mes_ano=MM/YYYY to the RFB's YYYYMM.
+func parseMesAnoRFB(mesAno string) (string, error) {
+	t, err := time.Parse("01/2006", strings.TrimSpace(mesAno))
+	if err != nil {
+		return "", errors.New("período inválido (use MM/AAAA)")
+	}
+	return t.Format("200601"), nil
+}
+
+// rfbPeriodoSQL is rfb_resumo.data_apuracao as YYYYMM: the simulator writes
+// YYYY-MM.
+const rfbPeriodoSQL = "replace(rs.data_apuracao, '-', '')"
+
+// RFBHistoricoVersao is one downloaded version of an apuração. With a debit
+// filter, the totals cover only the matching debits.
+type RFBHistoricoVersao struct {
+	RequestID          string    `json:"request_id"`
+	Origem             string    `json:"origem"`
+	Atual              bool      `json:"atual"`
+	SolicitadoEm       time.Time `json:"solicitado_em"`
+	TotalDebitos       int       `json:"total_debitos"`
+	ValorCBSTotal      float64   `json:"valor_cbs_total"`
+	ValorCBSExtinto    float64   `json:"valor_cbs_extinto"`
+	ValorCBSNaoExtinto float64   `json:"valor_cbs_nao_extinto"`
+	TotalCorrente      int       `json:"total_corrente"`
+	TotalAjuste        int       `json:"total_ajuste"`
+	TotalExtemporaneo  int       `json:"total_extemporaneo"`
+}
+
+// RFBHistoricoPeriodo groups the versions of a period of one CNPJ base,
+// newest first.
+type RFBHistoricoPeriodo struct {
+	MesAno   string               `json:"mes_ano"`
+	CNPJBase string               `json:"cnpj_base"`
+	Versoes  []RFBHistoricoVersao `json:"versoes"`
+}
+
+// RFBHistoricoHandler pages through the company's RFB apurações by period
+// (GET /api/rfb/historico), newest period first, listing every downloaded
+// version of each. Query: cnpj_base, de / ate (MM/AAAA), tipo_apuracao,
+// ni_emitente, ni_adquirente, page, page_size (periods, default 12). With a
+// debit filter only periods with matching debits are listed.
+func RFBHistoricoHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		q := r.URL.Query()
+		filtro, err := parseRFBDebitoFiltro(q)
+		if err != nil {
+			jsonErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var de, ate string
+		if v := q.Get("de"); v != "" {
+			if de, err = parseMesAnoRFB(v); err != nil {
+				jsonErr(w, http.StatusBadRequest, "de: "+err.Error())
+				return
+			}
+		}
+		if v := q.Get("ate"); v != "" {
+			if ate, err = parseMesAnoRFB(v); err != nil {
+				jsonErr(w, http.StatusBadRequest, "ate: "+err.Error())
+				return
+			}
+		}
+		page, pageSize := rfbPaginacao(q, 12, 60)
+
+		// $1 company, $2 cnpj_base, $3 de, $4 ate, $5-$7 debit filter, $8 filter active
+		args := append([]interface{}{companyID, normalizeCNPJ(q.Get("cnpj_base")), de, ate}, filtro.args()...)
+		args = append(args, filtro.ativo())
+		periodos := `
+			SELECT DISTINCT ` + rfbPeriodoSQL + ` AS periodo, COALESCE(rs.cnpj_base, '') AS cnpj_base
+			FROM rfb_resumo rs
+			WHERE rs.company_id = $1 AND rs.data_apuracao IS NOT NULL
+			  AND ($2 = '' OR rs.cnpj_base = $2)
+			  AND ($3 = '' OR ` + rfbPeriodoSQL + ` >= $3)
+			  AND ($4 = '' OR ` + rfbPeriodoSQL + ` <= $4)
+			  AND (NOT $8 OR EXISTS (SELECT 1 FROM rfb_debitos d WHERE d.request_id = rs.request_id AND ` + filtro.sql("d", 5) + `))`
+
+		var total int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM (`+periodos+`) p`, args...).Scan(&total); err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao contar períodos: "+err.Error())
+			return
+		}
+
+		rows, err := tx.Query(`
+			WITH pagina AS (`+periodos+`
+				ORDER BY periodo DESC, cnpj_base
+				LIMIT $9 OFFSET $10
+			)
+			SELECT p.periodo, p.cnpj_base, rs.request_id, COALESCE(rq.origem, ''), rs.atual, rq.created_at,
+				CASE WHEN $8 THEN f.qtd ELSE COALESCE(rs.total_debitos, 0) END,
+				CASE WHEN $8 THEN f.total ELSE COALESCE(rs.valor_cbs_total, 0) END,
+				CASE WHEN $8 THEN f.extinto ELSE COALESCE(rs.valor_cbs_extinto, 0) END,
+				CASE WHEN $8 THEN f.nao_extinto ELSE COALESCE(rs.valor_cbs_nao_extinto, 0) END,
+				CASE WHEN $8 THEN f.corrente ELSE COALESCE(rs.total_corrente, 0) END,
+				CASE WHEN $8 THEN f.ajuste ELSE COALESCE(rs.total_ajuste, 0) END,
+				CASE WHEN $8 THEN f.extemporaneo ELSE COALESCE(rs.total_extemporaneo, 0) END
+			FROM pagina p
+			JOIN rfb_resumo rs ON rs.company_id = $1 AND `+rfbPeriodoSQL+` = p.periodo
+				AND COALESCE(rs.cnpj_base, '') = p.cnpj_base
+			JOIN rfb_requests rq ON rq.id = rs.request_id
+			LEFT JOIN LATERAL (
+				SELECT COUNT(*) AS qtd,
+					COALESCE(SUM(d.valor_cbs_total), 0) AS total,
+					COALESCE(SUM(d.valor_cbs_extinto), 0) AS extinto,
+					COALESCE(SUM(d.valor_cbs_nao_extinto), 0) AS nao_extinto,
+					COUNT(*) FILTER (WHERE d.tipo_apuracao = 'corrente') AS corrente,
+					COUNT(*) FILTER (WHERE d.tipo_apuracao = 'ajuste') AS ajuste,
+					COUNT(*) FILTER (WHERE d.tipo_apuracao = 'extemporaneo') AS extemporaneo
+				FROM rfb_debitos d
+				WHERE $8 AND d.request_id = rs.request_id AND `+filtro.sql("d", 5)+`
+			) f ON true
+			ORDER BY p.periodo DESC, p.cnpj_base, rq.created_at DESC
+		`, append(args, pageSize, (page-1)*pageSize)...)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao consultar histórico: "+err.Error())
+			return
+		}
+		defer rows.Close()
+
+		historico := []RFBHistoricoPeriodo{}
+		for rows.Next() {
+			var periodo, cnpjBase string
+			var v RFBHistoricoVersao
+			if err := rows.Scan(&periodo, &cnpjBase, &v.RequestID, &v.Origem, &v.Atual, &v.SolicitadoEm,
+				&v.TotalDebitos, &v.ValorCBSTotal, &v.ValorCBSExtinto, &v.ValorCBSNaoExtinto,
+				&v.TotalCorrente, &v.TotalAjuste, &v.TotalExtemporaneo); err != nil {
+				jsonErr(w, http.StatusInternalServerError, "Erro ao ler histórico: "+err.Error())
+				return
+			}
+			mesAno, _ := periodoRFB(periodo)
+			if n := len(historico); n == 0 || historico[n-1].MesAno != mesAno || historico[n-1].CNPJBase != cnpjBase {
+				historico = append(historico, RFBHistoricoPeriodo{MesAno: mesAno, CNPJBase: cnpjBase})
+			}
+			last := &historico[len(historico)-1]
+			last.Versoes = append(last.Versoes, v)
+		}
+		if err := rows.Err(); err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao ler histórico: "+err.Error())
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"periodos":   historico,
+			"pagination": rfbPaginacaoJSON(page, pageSize, total),
+		})
+	}
+}
+
+// Kinds of change between two versions of an apuração.
+const (
+	rfbMudancaNovo     = "novo"
+	rfbMudancaRemovido = "removido"
+	rfbMudancaAlterado = "alterado"
+)
+
+// RFBHistoricoMudanca is a document (chave_dfe, or model/number/emitter when
+// the debit has no key) whose debits of one tipo_apuracao changed between two
+// versions. Situacao lists the distinct situacaoDebito of its debits.
+type RFBHistoricoMudanca struct {
+	Mudanca       string   `json:"mudanca"`
+	ChaveDfe      string   `json:"chave_dfe"`
+	TipoApuracao  string   `json:"tipo_apuracao"`
+	ModeloDfe     string   `json:"modelo_dfe"`
+	NumeroDfe     string   `json:"numero_dfe"`
+	NiEmitente    string   `json:"ni_emitente"`
+	NiAdquirente  string   `json:"ni_adquirente"`
+	ValorDe       *float64 `json:"valor_cbs_de"`
+	ValorPara     *float64 `json:"valor_cbs_para"`
+	ExtintoDe     *float64 `json:"valor_extinto_de"`
+	ExtintoPara   *float64 `json:"valor_extinto_para"`
+	ExtintoDelta  float64  `json:"valor_extinto_delta"`
+	SituacaoDe    string   `json:"situacao_de,omitempty"`
+	SituacaoPara  string   `json:"situacao_para,omitempty"`
+	SituacaoMudou bool     `json:"situacao_mudou,omitempty"`
+}
+
+// RFBHistoricoDiffResumo totals the changes. ValorExtintoNovo is the CBS
+// extinguished since the older version on debits present in both.
+type RFBHistoricoDiffResumo struct {
+	QtdNovos            int     `json:"qtd_novos"`
+	ValorNovos          float64 `json:"valor_novos"`
+	QtdRemovidos        int     `json:"qtd_removidos"`
+	ValorRemovidos      float64 `json:"valor_removidos"`
+	QtdAlterados        int     `json:"qtd_alterados"`
+	QtdSituacaoAlterada int     `json:"qtd_situacao_alterada"`
+	QtdNovasExtincoes   int     `json:"qtd_novas_extincoes"`
+	ValorExtintoNovo    float64 `json:"valor_extinto_novo"`
+}
+
+// rfbVersao identifies one version of an apuração.
+type rfbVersao struct {
+	RequestID    string    `json:"request_id"`
+	SolicitadoEm time.Time `json:"solicitado_em"`
+	Atual        bool      `json:"atual"`
+	periodo      string
+	cnpjBase     string
+}
+
+func loadRFBVersao(db dbQuerier, companyID, requestID string) (*rfbVersao, error) {
+	var v rfbVersao
+	err := db.QueryRow(`
+		SELECT rs.request_id, rq.created_at, rs.atual, COALESCE(`+rfbPeriodoSQL+`, ''), COALESCE(rs.cnpj_base, '')
+		FROM rfb_resumo rs
+		JOIN rfb_requests rq ON rq.id = rs.request_id
+		WHERE rs.company_id = $1 AND rs.request_id = $2
+	`, companyID, requestID).Scan(&v.RequestID, &v.SolicitadoEm, &v.Atual, &v.periodo, &v.cnpjBase)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// errRFBVersoes marks a period whose versions cannot be compared.
+var errRFBVersoes = errors.New("não é possível comparar as versões do período")
+
+// ultimasRFBVersoes returns the two newest versions of a period (the older
+// first); the CNPJ base may be omitted when the company has only one.
+func ultimasRFBVersoes(db dbQuerier, companyID, periodo, cnpjBase string) (de, para *rfbVersao, err error) {
+	rows, err := db.Query(`
+		SELECT rs.request_id, rq.created_at, rs.atual, `+rfbPeriodoSQL+`, COALESCE(rs.cnpj_base, '')
+		FROM rfb_resumo rs
+		JOIN rfb_requests rq ON rq.id = rs.request_id
+		WHERE rs.company_id = $1 AND `+rfbPeriodoSQL+` = $2 AND ($3 = '' OR rs.cnpj_base = $3)
+		ORDER BY rq.created_at DESC
+	`, companyID, periodo, cnpjBase)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var versoes []*rfbVersao
+	for rows.Next() {
+		var v rfbVersao
+		if err := rows.Scan(&v.RequestID, &v.SolicitadoEm, &v.Atual, &v.periodo, &v.cnpjBase); err != nil {
+			return nil, nil, err
+		}
+		if len(versoes) > 0 && v.cnpjBase != versoes[0].cnpjBase {
+			return nil, nil, fmt.Errorf("%w: há apurações de mais de uma raiz de CNPJ, informe cnpj_base", errRFBVersoes)
+		}
+		versoes = append(versoes, &v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(versoes) < 2 {
+		return nil, nil, fmt.Errorf("%w: o período tem menos de duas versões da apuração", errRFBVersoes)
+	}
+	return versoes[1], versoes[0], nil
+}
+
+// loadRFBHistoricoDiff compares two versions debit by debit, per document and
+// tipo_apuracao, over the debits that match filtro.
+func loadRFBHistoricoDiff(db dbQuerier, de, para string, filtro rfbDebitoFiltro) ([]RFBHistoricoMudanca, RFBHistoricoDiffResumo, error) {
+	var res RFBHistoricoDiffResumo
+	versao := func(param int) string {
+		return `
+			SELECT COALESCE(NULLIF(d.chave_dfe, ''), concat_ws(':', d.modelo_dfe, d.numero_dfe, d.ni_emitente)) AS chave,
+				d.tipo_apuracao,
+				MAX(COALESCE(d.modelo_dfe, '')) AS modelo, MAX(COALESCE(d.numero_dfe, '')) AS numero,
+				MAX(COALESCE(d.ni_emitente, '')) AS emitente, MAX(COALESCE(d.ni_adquirente, '')) AS adquirente,
+				string_agg(DISTINCT COALESCE(d.situacao_debito, ''), ',' ORDER BY COALESCE(d.situacao_debito, '')) AS situacao,
+				SUM(COALESCE(d.valor_cbs_total, 0)) AS valor,
+				SUM(COALESCE(d.valor_cbs_extinto, 0)) AS extinto
+			FROM rfb_debitos d
+			WHERE d.request_id = $` + strconv.Itoa(param) + ` AND ` + filtro.sql("d", 3) + `
+			GROUP BY 1, 2`
+	}
+	rows, err := db.Query(`
+		WITH de AS (`+versao(1)+`), para AS (`+versao(2)+`)
+		SELECT COALESCE(para.chave, de.chave), COALESCE(para.tipo_apuracao, de.tipo_apuracao),
+			COALESCE(para.modelo, de.modelo), COALESCE(para.numero, de.numero),
+			COALESCE(para.emitente, de.emitente), COALESCE(para.adquirente, de.adquirente),
+			de.situacao, para.situacao, de.valor, para.valor, de.extinto, para.extinto
+		FROM de
+		FULL OUTER JOIN para ON para.chave = de.chave AND para.tipo_apuracao = de.tipo_apuracao
+	`, append([]interface{}{de, para}, filtro.args()...)...)
+	if err != nil {
+		return nil, res, err
+	}
+	defer rows.Close()
+
+	mudancas := []RFBHistoricoMudanca{}
+	for rows.Next() {
+		var m RFBHistoricoMudanca
+		var situacaoDe, situacaoPara sql.NullString
+		var valorDe, valorPara, extintoDe, extintoPara sql.NullFloat64
+		if err := rows.Scan(&m.ChaveDfe, &m.TipoApuracao, &m.ModeloDfe, &m.NumeroDfe, &m.NiEmitente, &m.NiAdquirente,
+			&situacaoDe, &situacaoPara, &valorDe, &valorPara, &extintoDe, &extintoPara); err != nil {
+			return nil, res, err
+		}
+		m.SituacaoDe, m.SituacaoPara = situacaoDe.String, situacaoPara.String
+		if valorDe.Valid {
+			m.ValorDe, m.ExtintoDe = &valorDe.Float64, &extintoDe.Float64
+		}
+		if valorPara.Valid {
+			m.ValorPara, m.ExtintoPara = &valorPara.Float64, &extintoPara.Float64
+		}
+		m.ExtintoDelta = math.Round((extintoPara.Float64-extintoDe.Float64)*100) / 100
+
+		switch {
+		case !valorDe.Valid:
+			m.Mudanca = rfbMudancaNovo
+			res.QtdNovos++
+			res.ValorNovos += valorPara.Float64
+		case !valorPara.Valid:
+			m.Mudanca = rfbMudancaRemovido
+			res.QtdRemovidos++
+			res.ValorRemovidos += valorDe.Float64
+		default:
+			m.SituacaoMudou = m.SituacaoDe != m.SituacaoPara
+			valorMudou := math.Abs(valorPara.Float64-valorDe.Float64) > rfbDivergenciaTolerancia
+			extintoMudou := math.Abs(m.ExtintoDelta) > rfbDivergenciaTolerancia
+			if !m.SituacaoMudou && !valorMudou && !extintoMudou {
+				continue
+			}
+			m.Mudanca = rfbMudancaAlterado
+			res.QtdAlterados++
+			if m.SituacaoMudou {
+				res.QtdSituacaoAlterada++
+			}
+			if m.ExtintoDelta > rfbDivergenciaTolerancia {
+				res.QtdNovasExtincoes++
+				res.ValorExtintoNovo += m.ExtintoDelta
+			}
+		}
+		mudancas = append(mudancas, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, res, err
+	}
+
+	// New first, then removed, then changed; larger amounts first within each
+	ordem := map[string]int{rfbMudancaNovo: 0, rfbMudancaRemovido: 1, rfbMudancaAlterado: 2}
+	peso := func(m RFBHistoricoMudanca) float64 {
+		if m.Mudanca == rfbMudancaAlterado {
+			return math.Abs(m.ExtintoDelta)
+		}
+		if m.ValorPara != nil {
+			return *m.ValorPara
+		}
+		return *m.ValorDe
+	}
+	sort.SliceStable(mudancas, func(i, j int) bool {
+		if oi, oj := ordem[mudancas[i].Mudanca], ordem[mudancas[j].Mudanca]; oi != oj {
+			return oi < oj
+		}
+		if pi, pj := peso(mudancas[i]), peso(mudancas[j]); pi != pj {
+			return pi > pj
+		}
+		return mudancas[i].ChaveDfe < mudancas[j].ChaveDfe
+	})
+	return mudancas, res, nil
+}
+
+// RFBHistoricoDiffHandler compares two versions of the same apuração
+// (GET /api/rfb/historico/diff): debits that appeared or disappeared, changed
+// situacaoDebito and newly extinguished CBS. The versions are ?de= and ?para=
+// (request ids of the same company, period and CNPJ base) or, with
+// ?mes_ano=MM/AAAA [&cnpj_base=], the period's two newest. Also accepts
+// tipo_apuracao, ni_emitente, ni_adquirente, mudanca (novo, removido,
+// alterado), page and page_size (default 100).
+func RFBHistoricoDiffHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		_, companyID, tx, ok := tenantScope(db, w, r)
+		if !ok {
+			return
+		}
+		defer tx.Rollback()
+
+		q := r.URL.Query()
+		filtro, err := parseRFBDebitoFiltro(q)
+		if err != nil {
+			jsonErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var de, para *rfbVersao
+		deID, paraID := strings.TrimSpace(q.Get("de")), strings.TrimSpace(q.Get("para"))
+		switch {
+		case deID != "" || paraID != "":
+			if !isValidUUID(deID) || !isValidUUID(paraID) {
+				jsonErr(w, http.StatusBadRequest, "de e para devem ser ids de solicitação válidos")
+				return
+			}
+			if de, err = loadRFBVersao(tx, companyID, deID); err == nil {
+				para, err = loadRFBVersao(tx, companyID, paraID)
+			}
+			if err == sql.ErrNoRows {
+				jsonErr(w, http.StatusNotFound, "Apuração não encontrada")
+				return
+			}
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "Erro ao buscar apurações: "+err.Error())
+				return
+			}
+			if de.periodo == "" || de.periodo != para.periodo || de.cnpjBase != para.cnpjBase {
+				jsonErr(w, http.StatusBadRequest, "As apurações comparadas devem ser do mesmo período e da mesma raiz de CNPJ")
+				return
+			}
+		case q.Get("mes_ano") != "":
+			periodo, err := parseMesAnoRFB(q.Get("mes_ano"))
+			if err != nil {
+				jsonErr(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			de, para, err = ultimasRFBVersoes(tx, companyID, periodo, normalizeCNPJ(q.Get("cnpj_base")))
+			if errors.Is(err, errRFBVersoes) {
+				jsonErr(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err != nil {
+				jsonErr(w, http.StatusInternalServerError, "Erro ao buscar apurações: "+err.Error())
+				return
+			}
+		default:
+			jsonErr(w, http.StatusBadRequest, "Informe de e para, ou mes_ano")
+			return
+		}
+
+		mudancas, resumo, err := loadRFBHistoricoDiff(tx, de.RequestID, para.RequestID, filtro)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, "Erro ao comparar apurações: "+err.Error())
+			return
+		}
+		if mudanca := q.Get("mudanca"); mudanca != "" {
+			filtradas := []RFBHistoricoMudanca{}
+			for _, m := range mudancas {
+				if m.Mudanca == mudanca {
+					filtradas = append(filtradas, m)
+				}
+			}
+			mudancas = filtradas
+		}
+
+		page, pageSize := rfbPaginacao(q, 100, 1000)
+		total := len(mudancas)
+		inicio := min((page-1)*pageSize, total)
+		fim := min(inicio+pageSize, total)
+
+		mesAno, _ := periodoRFB(para.periodo)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mes_ano":    mesAno,
+			"cnpj_base":  para.cnpjBase,
+			"de":         de,
+			"para":       para,
+			"resumo":     resumo,
+			"mudancas":   mudancas[inicio:fim],
+			"pagination": rfbPaginacaoJSON(page, pageSize, total),
+		})
+	}
+}
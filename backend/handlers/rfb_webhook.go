@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"fb_apu01/services"
+)
+
+// rfbWebhookConfig is the optional hardening of the RFB callback:
+//
+//	RFB_WEBHOOK_ALLOWED_IPS         IPs/CIDRs allowed to call, comma-separated (empty = any)
+//	RFB_WEBHOOK_CLIENT_CERT_SHA256  SHA-256 fingerprints of the accepted mTLS
+//	                                client certificates (empty = no check)
+//	RFB_WEBHOOK_LEGACY_UNTIL        YYYY-MM-DD: until then, callbacks for requests
+//	                                made before migration 074 (no token) are
+//	                                accepted; unset = rejected
+//
+// The caller IP and a forwarded client certificate are only taken from the
+// proxy headers when the connection comes from TRUSTED_PROXIES. The
+// per-request token in urlRetorno is always checked.
+type rfbWebhookConfig struct {
+	allowed     []*net.IPNet
+	certs       map[string]bool
+	legacyUntil time.Time
+}
+
+func loadRFBWebhookConfig() rfbWebhookConfig {
+	cfg := rfbWebhookConfig{
+		allowed: parseIPNets(os.Getenv("RFB_WEBHOOK_ALLOWED_IPS"), "RFB_WEBHOOK_ALLOWED_IPS"),
+	}
+	if v := strings.TrimSpace(os.Getenv("RFB_WEBHOOK_LEGACY_UNTIL")); v != "" {
+		if until, err := time.Parse("2006-01-02", v); err == nil {
+			cfg.legacyUntil = until.AddDate(0, 0, 1) // through the end of that day
+		} else {
+			log.Printf("[RFB Webhook] Ignoring invalid RFB_WEBHOOK_LEGACY_UNTIL %q (use YYYY-MM-DD)", v)
+		}
+	}
+	for _, fp := range strings.Split(os.Getenv("RFB_WEBHOOK_CLIENT_CERT_SHA256"), ",") {
+		if fp = normalizeFingerprint(fp); fp != "" {
+			if cfg.certs == nil {
+				cfg.certs = map[string]bool{}
+			}
+			cfg.certs[fp] = true
+		}
+	}
+	return cfg
+}
+
+func (c rfbWebhookConfig) ipAllowed(ip string) bool {
+	return len(c.allowed) == 0 || ipInNets(ip, c.allowed)
+}
+
+// legacyAllowed reports whether tokenless callbacks are still accepted.
+func (c rfbWebhookConfig) legacyAllowed(now time.Time) bool {
+	return now.Before(c.legacyUntil)
+}
+
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+// clientCertFingerprint returns the SHA-256 of the caller's client
+// certificate: the TLS peer when the backend terminates TLS itself, else the
+// certificate forwarded by the reverse proxy (Traefik passTLSClientCert with
+// pem=true, X-Forwarded-Tls-Client-Cert). The header is ignored unless the
+// connection comes from TRUSTED_PROXIES, which must set or strip it on every
+// request to the webhook.
+func clientCertFingerprint(r *http.Request) (string, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	if !FromTrustedProxy(r) {
+		return "", errors.New("nenhum certificado cliente apresentado (conexão fora de TRUSTED_PROXIES)")
+	}
+	forwarded := r.Header.Get("X-Forwarded-Tls-Client-Cert")
+	if forwarded == "" {
+		return "", errors.New("nenhum certificado cliente apresentado")
+	}
+	// Several certificates (the chain) are comma-separated; the first is the client's
+	pemBody, err := url.QueryUnescape(strings.SplitN(forwarded, ",", 2)[0])
+	if err != nil {
+		return "", err
+	}
+	pemBody = strings.NewReplacer("-----BEGIN CERTIFICATE-----", "", "-----END CERTIFICATE-----", "",
+		"\n", "", "\r", "", " ", "").Replace(pemBody)
+	der, err := base64.StdEncoding.DecodeString(pemBody)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// rfbWebhookDelivery is one row of rfb_webhook_deliveries.
+type rfbWebhookDelivery struct {
+	RequestID          string    `json:"request_id,omitempty"`
+	CompanyID          string    `json:"company_id,omitempty"`
+	TiqueteSolicitacao string    `json:"tiquete_solicitacao,omitempty"`
+	TiqueteDownload    string    `json:"tiquete_download,omitempty"`
+	RemoteIP           string    `json:"remote_ip"`
+	Resultado          string    `json:"resultado"`
+	Detalhe            string    `json:"detalhe,omitempty"`
+	ReceivedAt         time.Time `json:"received_at"`
+}
+
+// maxStoredWebhookBody caps rfb_webhook_deliveries.body.
+const maxStoredWebhookBody = 16 << 10
+
+// recordRFBWebhook stores a received callback, accepted or not.
+func recordRFBWebhook(db *sql.DB, r *http.Request, body []byte, d rfbWebhookDelivery) {
+	headers := map[string]string{}
+	for name, values := range r.Header {
+		if name == "Authorization" || name == "Cookie" {
+			continue
+		}
+		headers[name] = strings.Join(values, ", ")
+	}
+	headersJSON, _ := json.Marshal(headers)
+	if len(body) > maxStoredWebhookBody {
+		body = body[:maxStoredWebhookBody]
+	}
+	_, err := db.Exec(`
+		INSERT INTO rfb_webhook_deliveries
+			(request_id, company_id, tiquete_solicitacao, tiquete_download, remote_ip, resultado, detalhe, headers, body)
+		VALUES (NULLIF($1, '')::uuid, NULLIF($2, '')::uuid, NULLIF($3, ''), NULLIF($4, ''), $5, $6, NULLIF($7, ''), $8, $9)
+	`, d.RequestID, d.CompanyID, d.TiqueteSolicitacao, d.TiqueteDownload, d.RemoteIP, d.Resultado, d.Detalhe,
+		string(headersJSON), strings.ToValidUTF8(string(body), "?"))
+	if err != nil {
+		log.Printf("[RFB Webhook] Error recording delivery: %v", err)
+	}
+}
+
+// RFBWebhookHandler receives callbacks from the RFB API (PUBLIC - no JWT auth).
+// A callback must come from an allowed IP and client certificate (when
+// configured) and carry the token of the request it names; it starts the
+// download only the first time. Every callback is stored in
+// rfb_webhook_deliveries.
+func RFBWebhookHandler(db *sql.DB) http.HandlerFunc {
+	cfg := loadRFBWebhookConfig()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			log.Printf("[RFB Webhook] Error reading body: %v", err)
+			http.Error(w, "Error reading body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		d := rfbWebhookDelivery{RemoteIP: GetClientIP(r)}
+		respond := func(status int, resultado, detalhe string, resp map[string]string) {
+			d.Resultado, d.Detalhe = resultado, detalhe
+			recordRFBWebhook(db, r, body, d)
+			log.Printf("[RFB Webhook] %s from %s (tiquete %s): %s", resultado, d.RemoteIP, d.TiqueteSolicitacao, detalhe)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(resp)
+		}
+
+		if !cfg.ipAllowed(d.RemoteIP) {
+			respond(http.StatusForbidden, "ip_nao_permitido", "IP fora de RFB_WEBHOOK_ALLOWED_IPS",
+				map[string]string{"status": "rejected"})
+			return
+		}
+		if cfg.certs != nil {
+			fp, err := clientCertFingerprint(r)
+			if err != nil || !cfg.certs[fp] {
+				detalhe := "certificado cliente não autorizado"
+				if err != nil {
+					detalhe = err.Error()
+				}
+				respond(http.StatusForbidden, "certificado_invalido", detalhe, map[string]string{"status": "rejected"})
+				return
+			}
+		}
+
+		// RFB sends two distinct tíquetes:
+		//   tiqueteSolicitacao = identifies the original request (stored in rfb_requests.tiquete)
+		//   tiqueteDownload    = the tíquete to use when calling the download endpoint
+		var payload struct {
+			TiqueteSolicitacao string `json:"tiqueteSolicitacao"`
+			TiqueteDownload    string `json:"tiqueteDownload"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil || payload.TiqueteSolicitacao == "" || payload.TiqueteDownload == "" {
+			// Return 200 so RFB doesn't retry indefinitely
+			respond(http.StatusOK, "payload_invalido", "JSON inválido ou sem tiqueteSolicitacao/tiqueteDownload",
+				map[string]string{"status": "received", "warning": "missing tiqueteSolicitacao or tiqueteDownload"})
+			return
+		}
+		d.TiqueteSolicitacao, d.TiqueteDownload = payload.TiqueteSolicitacao, payload.TiqueteDownload
+
+		var status, tokenHash string
+		err = db.QueryRow(`
+			SELECT id, company_id, status, COALESCE(webhook_token_hash, '')
+			FROM rfb_requests WHERE tiquete = $1
+			ORDER BY created_at DESC LIMIT 1
+		`, payload.TiqueteSolicitacao).Scan(&d.RequestID, &d.CompanyID, &status, &tokenHash)
+		if err != nil {
+			respond(http.StatusOK, "nao_encontrado", "nenhuma solicitação com este tiqueteSolicitacao",
+				map[string]string{"status": "received", "warning": "request not found"})
+			return
+		}
+
+		// Requests made before migration 074 have no token: accepted only
+		// while RFB_WEBHOOK_LEGACY_UNTIL is in the future
+		if tokenHash == "" {
+			if !cfg.legacyAllowed(time.Now()) {
+				respond(http.StatusUnauthorized, "token_ausente", "solicitação sem token (anterior à migration 074) e RFB_WEBHOOK_LEGACY_UNTIL expirado ou ausente",
+					map[string]string{"status": "rejected"})
+				return
+			}
+		} else {
+			given := services.RFBWebhookTokenHash(r.URL.Query().Get("token"))
+			if subtle.ConstantTimeCompare([]byte(given), []byte(tokenHash)) != 1 {
+				respond(http.StatusUnauthorized, "token_invalido", "token ausente ou diferente do enviado na solicitação",
+					map[string]string{"status": "rejected"})
+				return
+			}
+		}
+
+		// Only the first callback moves the request on and starts the download
+		res, err := db.Exec(`
+			UPDATE rfb_requests
+			SET status = 'webhook_received', tiquete_download = $1,
+			    webhook_received_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $2 AND status = 'requested'
+		`, payload.TiqueteDownload, d.RequestID)
+		if err != nil {
+			log.Printf("[RFB Webhook] Error updating status/tiqueteDownload: %v", err)
+			http.Error(w, "Erro ao registrar callback", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// The scheduler may be polling this request right now; keep the
+			// tíquete so its next attempt downloads with it
+			db.Exec(`
+				UPDATE rfb_requests
+				SET tiquete_download = $1, webhook_received_at = CURRENT_TIMESTAMP
+				WHERE id = $2 AND tiquete_download IS NULL AND status <> 'completed'
+			`, payload.TiqueteDownload, d.RequestID)
+			respond(http.StatusOK, "duplicado", "solicitação já estava em '"+status+"'",
+				map[string]string{"status": "duplicate"})
+			return
+		}
+
+		respond(http.StatusOK, "aceito", "", map[string]string{"status": "processing"})
+
+		// Trigger async download and processing
+		requestID := d.RequestID
+		go func() {
+			rfbClient := services.NewRFBClient()
+			if err := services.ProcessarDownloadRFB(db, rfbClient, requestID); err != nil {
+				log.Printf("[RFB Webhook] Error processing download for request %s: %v", requestID, err)
+			}
+		}()
+	}
+}
+
+// RFBWebhookDeliveriesHandler lists the received callbacks, newest first
+// (GET /api/rfb/webhook/deliveries?request_id=). Admin only: rejected
+// callbacks belong to no company.
+func RFBWebhookDeliveriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			jsonErr(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		requestID := r.URL.Query().Get("request_id")
+		rows, err := db.Query(`
+			SELECT COALESCE(request_id::text, ''), COALESCE(company_id::text, ''),
+			       COALESCE(tiquete_solicitacao, ''), COALESCE(tiquete_download, ''),
+			       COALESCE(remote_ip, ''), resultado, COALESCE(detalhe, ''), received_at
+			FROM rfb_webhook_deliveries
+			WHERE $1 = '' OR request_id::text = $1
+			ORDER BY received_at DESC
+			LIMIT 200
+		`, requestID)
+		if err != nil {
+			jsonErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		deliveries := []rfbWebhookDelivery{}
+		for rows.Next() {
+			var d rfbWebhookDelivery
+			if err := rows.Scan(&d.RequestID, &d.CompanyID, &d.TiqueteSolicitacao, &d.TiqueteDownload,
+				&d.RemoteIP, &d.Resultado, &d.Detalhe, &d.ReceivedAt); err != nil {
+				jsonErr(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			deliveries = append(deliveries, d)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": deliveries})
+	}
+}
@@ -39,6 +39,13 @@ func GetSimplesDashboardHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		mesAno := r.URL.Query().Get("mes_ano")
 		filiaisParam := r.URL.Query().Get("filiais")
 		projectionYearStr := r.URL.Query().Get("projection_year")
@@ -85,16 +92,10 @@ func GetSimplesDashboardHandler(db *sql.DB) http.HandlerFunc {
 
 		query := queryBase + "\n\t\t\tGROUP BY fornecedor_nome, fornecedor_cnpj"
 
-		rows, err := db.Query(query, args...)
-		if err != nil {
-			http.Error(w, "Error querying simples data: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
 		// Fetch Aliquots for Selected Year (Default 2033) for "Lost Credit" Calculation
+		// (before the suppliers: one query at a time on the tenant transaction)
 		var ibsRate, cbsRate, reducIcms float64
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			SELECT perc_ibs_uf + perc_ibs_mun, perc_cbs, perc_reduc_icms
 			FROM tabela_aliquotas
 			WHERE ano = $1
@@ -108,6 +109,13 @@ func GetSimplesDashboardHandler(db *sql.DB) http.HandlerFunc {
 			reducIcms = 100.0
 		}
 
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			http.Error(w, "Error querying simples data: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
 		var results []SimplesSupplierData
 
 		for rows.Next() {
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// TenantRole is the PostgreSQL role (migration 065) whose row-level security
+// policies restrict every tenant table to app.company_id.
+const TenantRole = "fb_tenant"
+
+// BeginTenantTx opens a transaction scoped to a single company: it switches to
+// TenantRole and sets app.company_id, so any query in the transaction only sees
+// that company's rows even if the handler forgets its WHERE company_id filter.
+// Both settings are LOCAL and vanish on Commit/Rollback, so the pooled
+// connection returns clean.
+func BeginTenantTx(ctx context.Context, db *sql.DB, companyID string) (*sql.Tx, error) {
+	if companyID == "" {
+		return nil, fmt.Errorf("tenant tx: company id is required")
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT set_config('app.company_id', $1, true)", companyID); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("tenant tx: set app.company_id: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "SET LOCAL ROLE "+TenantRole); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("tenant tx: set role %s: %w", TenantRole, err)
+	}
+	return tx, nil
+}
+
+// dbQuerier is what handler helpers query through, so they run the same on a
+// tenant transaction (*sql.Tx) and on the owner's pool (*sql.DB).
+type dbQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// tenantScope resolves the company of an authenticated request (see
+// aiRequestScope) and opens its BeginTenantTx. On failure it has already
+// answered the request. The caller defers tx.Rollback() and commits its
+// writes before answering.
+func tenantScope(db *sql.DB, w http.ResponseWriter, r *http.Request) (userID, companyID string, tx *sql.Tx, ok bool) {
+	userID, companyID, ok = aiRequestScope(db, w, r)
+	if !ok {
+		return "", "", nil, false
+	}
+	tx, err := BeginTenantTx(r.Context(), db, companyID)
+	if err != nil {
+		log.Printf("tenant tx (company %s): %v", companyID, err)
+		jsonErr(w, http.StatusInternalServerError, "Erro ao consultar banco")
+		return "", "", nil, false
+	}
+	return userID, companyID, tx, true
+}
+
+// execSavepoint runs one statement of a tolerant batch (imports that skip bad
+// rows) under a savepoint: a failing row is rolled back alone instead of
+// aborting the whole tenant transaction.
+func execSavepoint(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	if _, err := tx.Exec("SAVEPOINT linha"); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT linha"); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
+	}
+	_, err = tx.Exec("RELEASE SAVEPOINT linha")
+	return res, err
+}
@@ -222,8 +222,22 @@ func UploadHandler(db *sql.DB) http.HandlerFunc {
 		if expectedLines != "" && expectedLines != "unknown" && expectedLines != "not_found" {
 			expLines, _ = strconv.Atoi(expectedLines)
 		}
-		query := `INSERT INTO import_jobs (filename, status, message, company_id, expected_lines) VALUES ($1, $2, $3, $4, $5) RETURNING id`
-		err = db.QueryRow(query, safeFilename, "pending", "File received and saved", companyID, expLines).Scan(&jobID)
+		// Optional queue priority (higher runs first among this company's jobs)
+		priority, _ := strconv.Atoi(r.FormValue("priority"))
+		if priority < -10 {
+			priority = -10
+		} else if priority > 10 {
+			priority = 10
+		}
+		query := `INSERT INTO import_jobs (filename, status, message, company_id, expected_lines, priority) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err == nil {
+			defer tx.Rollback()
+			err = tx.QueryRow(query, safeFilename, "pending", "File received and saved", companyID, expLines, priority).Scan(&jobID)
+			if err == nil {
+				err = tx.Commit()
+			}
+		}
 		if err != nil {
 			// Try to cleanup file if DB fails
 			os.Remove(savePath)
@@ -279,6 +293,13 @@ func CheckDuplicityHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		tx, err := BeginTenantTx(r.Context(), db, companyID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		cnpj := r.URL.Query().Get("cnpj")
 		dtIniStr := r.URL.Query().Get("dt_ini") // Expecting format YYYY-MM-DD or DDMMYYYY
 
@@ -319,7 +340,7 @@ func CheckDuplicityHandler(db *sql.DB) http.HandlerFunc {
 			LIMIT 1
 		`
 
-		err = db.QueryRow(query, cnpj, int(date.Month()), date.Year(), companyID).Scan(&jobID, &filename)
+		err = tx.QueryRow(query, cnpj, int(date.Month()), date.Year(), companyID).Scan(&jobID, &filename)
 
 		resp := DuplicityResponse{Exists: false}
 		if err == nil {
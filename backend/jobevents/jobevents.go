@@ -0,0 +1,194 @@
+// Package jobevents relays SPED import progress between backend instances.
+//
+// Workers publish with pg_notify on the job_events channel; every instance
+// runs one Hub that LISTENs on that channel and fans the events out to its
+// local subscribers (the SSE handlers). Whichever instance runs a job, every
+// instance can stream its progress.
+package jobevents
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Channel is the PostgreSQL NOTIFY channel used for job events.
+const Channel = "job_events"
+
+// Event types.
+const (
+	TypeProgress  = "progress"
+	TypePhase     = "phase"
+	TypeCompleted = "completed"
+	TypeFailed    = "failed"
+	TypeRetry     = "retry"
+	TypeCancelled = "cancelled"
+	TypeSnapshot  = "snapshot"
+)
+
+// Processing phases reported with TypePhase.
+const (
+	PhaseParsing      = "parsing"
+	PhaseAggregations = "aggregations"
+	PhaseViewRefresh  = "view_refresh"
+	PhaseAIReport     = "ai_report"
+)
+
+// Event is one job notification. Payloads stay well under the 8000-byte
+// NOTIFY limit: messages are truncated by Publish.
+type Event struct {
+	JobID     string  `json:"job_id"`
+	CompanyID string  `json:"company_id"`
+	Type      string  `json:"type"`
+	Phase     string  `json:"phase,omitempty"`
+	Status    string  `json:"status,omitempty"`
+	Message   string  `json:"message,omitempty"`
+	Progress  float64 `json:"progress,omitempty"` // 0–100 when known
+	Line      int     `json:"line,omitempty"`
+	Time      string  `json:"time"`
+}
+
+const maxMessageLen = 2000
+
+// Publish sends an event for jobID. The company is resolved from import_jobs
+// inside the same statement, so callers only need the job id. Errors are
+// logged and swallowed: progress streaming must never fail an import.
+func Publish(db *sql.DB, jobID string, ev Event) {
+	ev.JobID = jobID
+	if len(ev.Message) > maxMessageLen {
+		ev.Message = ev.Message[:maxMessageLen] + "…"
+	}
+	if ev.Time == "" {
+		ev.Time = time.Now().Format(time.RFC3339)
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`
+		SELECT pg_notify($1, jsonb_set($2::jsonb, '{company_id}',
+			to_jsonb(COALESCE((SELECT company_id::text FROM import_jobs WHERE id = $3::uuid), ''))
+		)::text)`, Channel, string(payload), jobID)
+	if err != nil {
+		log.Printf("jobevents: publish failed for job %s: %v", jobID, err)
+	}
+}
+
+// ─── Hub ─────────────────────────────────────────────────────────────────────
+
+// Filter selects which events a subscriber receives. Empty JobID means every
+// job of CompanyID.
+type Filter struct {
+	CompanyID string
+	JobID     string
+}
+
+func (f Filter) match(ev Event) bool {
+	if f.CompanyID != "" && ev.CompanyID != f.CompanyID {
+		return false
+	}
+	return f.JobID == "" || ev.JobID == f.JobID
+}
+
+type subscriber struct {
+	filter Filter
+	ch     chan Event
+}
+
+// Hub owns the LISTEN connection and the local subscribers.
+type Hub struct {
+	mu       sync.RWMutex
+	subs     map[*subscriber]struct{}
+	listener *pq.Listener
+}
+
+var (
+	defaultHub *Hub
+	hubMu      sync.RWMutex
+)
+
+// Start opens the LISTEN connection and installs the process-wide hub.
+func Start(connStr string) (*Hub, error) {
+	h := &Hub{subs: make(map[*subscriber]struct{})}
+	h.listener = pq.NewListener(connStr, 2*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("jobevents: listener event %d: %v", ev, err)
+		}
+	})
+	if err := h.listener.Listen(Channel); err != nil {
+		h.listener.Close()
+		return nil, fmt.Errorf("listen %s: %w", Channel, err)
+	}
+	go h.loop()
+
+	hubMu.Lock()
+	defaultHub = h
+	hubMu.Unlock()
+	log.Printf("jobevents: listening on channel %q", Channel)
+	return h, nil
+}
+
+// Default returns the hub installed by Start, or nil before the DB is up.
+func Default() *Hub {
+	hubMu.RLock()
+	defer hubMu.RUnlock()
+	return defaultHub
+}
+
+func (h *Hub) loop() {
+	for {
+		select {
+		case n := <-h.listener.Notify:
+			if n == nil {
+				// Connection was re-established; notifications sent meanwhile are lost
+				continue
+			}
+			var ev Event
+			if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil {
+				log.Printf("jobevents: bad payload: %v", err)
+				continue
+			}
+			h.broadcast(ev)
+		case <-time.After(90 * time.Second):
+			go h.listener.Ping()
+		}
+	}
+}
+
+func (h *Hub) broadcast(ev Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if !s.filter.match(ev) {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			// Slow client: drop the event rather than block every other stream
+		}
+	}
+}
+
+// Subscribe registers a subscriber. The returned cancel func must be called
+// when the client goes away.
+func (h *Hub) Subscribe(f Filter) (<-chan Event, func()) {
+	s := &subscriber{filter: f, ch: make(chan Event, 64)}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, s)
+			h.mu.Unlock()
+		})
+	}
+}
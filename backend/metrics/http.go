@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = NewCounterVec("http_requests_total",
+		"HTTP requests by method, route pattern and status code.", "method", "route", "code")
+	httpDuration = NewHistogramVec("http_request_duration_seconds",
+		"HTTP request latency by method and route pattern.", DefBuckets, "method", "route")
+)
+
+// InstrumentHandler records request count and latency per route. The route
+// label is the ServeMux pattern that matched (e.g. "/api/jobs/"), never the raw
+// path, so job ids and query strings don't explode the series count.
+func InstrumentHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		mux.ServeHTTP(rec, r)
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.Inc(r.Method, route, strconv.Itoa(rec.status))
+		httpDuration.Observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush keeps SSE streaming working through the recorder.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// RegisterDBStats exports the connection pool counters of db (sql.DBStats).
+func RegisterDBStats(db *sql.DB) {
+	NewGaugeFunc("db_pool_connections",
+		"Database pool connections by state (open, in_use, idle, max_open).", []string{"state"},
+		func(emit func(float64, ...string)) {
+			s := db.Stats()
+			emit(float64(s.OpenConnections), "open")
+			emit(float64(s.InUse), "in_use")
+			emit(float64(s.Idle), "idle")
+			emit(float64(s.MaxOpenConnections), "max_open")
+		})
+	NewCounterFunc("db_pool_wait_count_total",
+		"Total connections waited for since the pool was opened.", nil,
+		func(emit func(float64, ...string)) { emit(float64(db.Stats().WaitCount)) })
+	NewCounterFunc("db_pool_wait_seconds_total",
+		"Total time blocked waiting for a new connection.", nil,
+		func(emit func(float64, ...string)) { emit(db.Stats().WaitDuration.Seconds()) })
+	NewCounterFunc("db_pool_closed_connections_total",
+		"Connections closed by the pool, by reason.", []string{"reason"},
+		func(emit func(float64, ...string)) {
+			s := db.Stats()
+			emit(float64(s.MaxIdleClosed), "max_idle")
+			emit(float64(s.MaxIdleTimeClosed), "max_idle_time")
+			emit(float64(s.MaxLifetimeClosed), "max_lifetime")
+		})
+}
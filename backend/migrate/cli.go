@@ -0,0 +1,65 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RunCLI implements the `migrate status|up|down [n]` subcommand of the
+// backend binary. args excludes the "migrate" word itself.
+func RunCLI(db *sql.DB, dir string, args []string, out io.Writer) error {
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	switch cmd {
+	case "status":
+		list, err := StatusList(db, dir)
+		if err != nil {
+			return err
+		}
+		pending := 0
+		for _, s := range list {
+			state := "pending"
+			switch {
+			case s.ChecksumMismatch:
+				state = "MODIFIED"
+			case s.Applied:
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			default:
+				pending++
+			}
+			down := ""
+			if s.DownPath != "" {
+				down = " [down]"
+			}
+			fmt.Fprintf(out, "%-60s %s%s\n", s.Name, state, down)
+		}
+		fmt.Fprintf(out, "\n%d migrations, %d pending\n", len(list), pending)
+		return nil
+
+	case "up":
+		n, err := Up(db, dir)
+		fmt.Fprintf(out, "%d migration(s) applied\n", n)
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			v, err := strconv.Atoi(args[1])
+			if err != nil || v < 1 {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+			steps = v
+		}
+		n, err := Down(db, dir, steps)
+		fmt.Fprintf(out, "%d migration(s) reverted\n", n)
+		return err
+
+	default:
+		return fmt.Errorf("unknown command %q (use status, up or down [n])", cmd)
+	}
+}
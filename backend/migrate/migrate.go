@@ -0,0 +1,423 @@
+// Package migrate applies the SQL files in backend/migrations.
+//
+// Each file is identified by its full filename (legacy files such as the three
+// 061_*.sql share a numeric prefix, so the number alone is not unique) and is
+// applied in lexical order inside its own transaction. The SHA-256 of the file
+// is stored in schema_migrations; editing an applied file is reported as an
+// error instead of being silently ignored. A file NNN_name.down.sql next to
+// NNN_name.sql is used by Down to revert it.
+//
+// Files before legacyCutoff were written for the previous runner, which ran
+// them outside a transaction and recorded them even when they failed with
+// "already exists"/"duplicate": several create objects another file already
+// created, and some manage their own BEGIN/COMMIT. They keep that treatment;
+// any other error still stops Up.
+//
+// A PostgreSQL advisory lock serialises runners, so several replicas starting
+// at the same time do not race on the same migration.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// lockKey is the pg_advisory_lock key held while migrations run ("FBAPU01M").
+const lockKey int64 = 0x4642415055303140
+
+// noTxMarker disables the per-migration transaction for statements that
+// PostgreSQL refuses inside a transaction block (e.g. CREATE INDEX CONCURRENTLY).
+const noTxMarker = "-- migrate:no-transaction"
+
+// legacyCutoff is the first migration written for this runner.
+const legacyCutoff = "065"
+
+// Migration is one up file and its optional down counterpart.
+type Migration struct {
+	Name     string // filename, e.g. 058_create_nfe_saidas.sql
+	Path     string
+	DownPath string // empty when there is no .down.sql
+	Checksum string
+	NoTx     bool
+	Legacy   bool // before legacyCutoff: no transaction, duplicates tolerated
+	sql      string
+}
+
+// Status describes a migration as seen by the database.
+type Status struct {
+	Migration
+	Applied          bool
+	AppliedAt        time.Time
+	ChecksumMismatch bool
+}
+
+// Dir resolves the migrations directory whether the binary runs from backend/
+// or from the repository root.
+func Dir() string {
+	dir := "migrations"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err := os.Stat("backend/migrations"); err == nil {
+			dir = "backend/migrations"
+		}
+	}
+	return dir
+}
+
+// Load reads all up migrations from dir, sorted by filename.
+func Load(dir string) ([]Migration, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var list []Migration
+	for _, f := range files {
+		if strings.HasSuffix(f, ".down.sql") {
+			continue
+		}
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", f, err)
+		}
+		m := Migration{
+			Name:     filepath.Base(f),
+			Path:     f,
+			Checksum: checksum(content),
+			NoTx:     strings.Contains(string(content), noTxMarker),
+			sql:      string(content),
+		}
+		if m.Name < legacyCutoff {
+			m.Legacy, m.NoTx = true, true
+		}
+		down := strings.TrimSuffix(f, ".sql") + ".down.sql"
+		if _, err := os.Stat(down); err == nil {
+			m.DownPath = down
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Up applies every pending migration. It stops at the first failure and
+// returns it; nothing is recorded for the failed file.
+func Up(db *sql.DB, dir string) (int, error) {
+	migrations, err := Load(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		log.Printf("Warning: no migration files found in %s", dir)
+		return 0, nil
+	}
+
+	applied := 0
+	err = withLock(db, func(conn *sql.Conn) error {
+		if err := ensureTable(conn); err != nil {
+			return err
+		}
+		recorded, err := loadApplied(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			rec, ok := recorded[m.Name]
+			if ok {
+				if rec.checksum == "" {
+					// Applied by the legacy runner: adopt the current checksum
+					if err := execConn(conn, `UPDATE schema_migrations SET checksum = $1 WHERE filename = $2`, m.Checksum, m.Name); err != nil {
+						return fmt.Errorf("record checksum for %s: %w", m.Name, err)
+					}
+					continue
+				}
+				if rec.checksum != m.Checksum {
+					return fmt.Errorf("migration %s was modified after being applied (checksum %s, file %s)", m.Name, short(rec.checksum), short(m.Checksum))
+				}
+				continue
+			}
+
+			log.Printf("Executing migration: %s", m.Name)
+			start := time.Now()
+			record := func(exec execer) error {
+				_, err := exec.ExecContext(context.Background(),
+					`INSERT INTO schema_migrations (filename, checksum) VALUES ($1, $2)`, m.Name, m.Checksum)
+				return err
+			}
+			if err := apply(conn, m.Name, m.sql, m.NoTx, record); err != nil {
+				if !m.Legacy || !isDuplicate(err) {
+					return fmt.Errorf("migration %s failed: %w", m.Name, err)
+				}
+				log.Printf("Migration %s warning (already applied, recorded): %v", m.Name, err)
+				if err := record(conn); err != nil {
+					return fmt.Errorf("record %s: %w", m.Name, err)
+				}
+			}
+			log.Printf("Migration %s applied in %v", m.Name, time.Since(start).Round(time.Millisecond))
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the last `steps` applied migrations (most recent first) using
+// their .down.sql files.
+func Down(db *sql.DB, dir string, steps int) (int, error) {
+	if steps <= 0 {
+		return 0, nil
+	}
+	migrations, err := Load(dir)
+	if err != nil {
+		return 0, err
+	}
+	byName := make(map[string]Migration, len(migrations))
+	for _, m := range migrations {
+		byName[m.Name] = m
+	}
+
+	reverted := 0
+	err = withLock(db, func(conn *sql.Conn) error {
+		if err := ensureTable(conn); err != nil {
+			return err
+		}
+		rows, err := conn.QueryContext(context.Background(),
+			`SELECT filename FROM schema_migrations ORDER BY executed_at DESC, filename DESC LIMIT $1`, steps)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for rows.Next() {
+			var n string
+			if err := rows.Scan(&n); err != nil {
+				rows.Close()
+				return err
+			}
+			names = append(names, n)
+		}
+		rows.Close()
+
+		for _, name := range names {
+			m, ok := byName[name]
+			if !ok || m.DownPath == "" {
+				return fmt.Errorf("migration %s has no .down.sql — cannot revert", name)
+			}
+			content, err := os.ReadFile(m.DownPath)
+			if err != nil {
+				return fmt.Errorf("read %s: %w", m.DownPath, err)
+			}
+			log.Printf("Reverting migration: %s", name)
+			noTx := strings.Contains(string(content), noTxMarker)
+			if err := apply(conn, name, string(content), noTx, func(exec execer) error {
+				_, err := exec.ExecContext(context.Background(), `DELETE FROM schema_migrations WHERE filename = $1`, name)
+				return err
+			}); err != nil {
+				return fmt.Errorf("revert %s failed: %w", name, err)
+			}
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// StatusList reports every migration file and whether it has been applied.
+func StatusList(db *sql.DB, dir string) ([]Status, error) {
+	migrations, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := ensureTable(conn); err != nil {
+		return nil, err
+	}
+	recorded, err := loadApplied(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Status, 0, len(migrations))
+	for _, m := range migrations {
+		s := Status{Migration: m}
+		if rec, ok := recorded[m.Name]; ok {
+			s.Applied = true
+			s.AppliedAt = rec.executedAt
+			s.ChecksumMismatch = rec.checksum != "" && rec.checksum != m.Checksum
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// ─── internals ───────────────────────────────────────────────────────────────
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type appliedRow struct {
+	checksum   string
+	executedAt time.Time
+}
+
+func withLock(db *sql.DB, fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey)
+
+	return fn(conn)
+}
+
+// apply runs body and the bookkeeping statement atomically, unless the
+// migration opted out of the transaction.
+func apply(conn *sql.Conn, name, body string, noTx bool, record func(execer) error) error {
+	ctx := context.Background()
+	if noTx {
+		if _, err := conn.ExecContext(ctx, body); err != nil {
+			// Close a transaction block the file opened itself and left aborted
+			conn.ExecContext(ctx, `ROLLBACK`)
+			return err
+		}
+		return record(conn)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("record %s: %w", name, err)
+	}
+	return tx.Commit()
+}
+
+func execConn(conn *sql.Conn, query string, args ...interface{}) error {
+	_, err := conn.ExecContext(context.Background(), query, args...)
+	return err
+}
+
+func loadApplied(conn *sql.Conn) (map[string]appliedRow, error) {
+	rows, err := conn.QueryContext(context.Background(),
+		`SELECT filename, COALESCE(checksum, ''), COALESCE(executed_at, NOW()) FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]appliedRow)
+	for rows.Next() {
+		var name string
+		var r appliedRow
+		if err := rows.Scan(&name, &r.checksum, &r.executedAt); err != nil {
+			return nil, err
+		}
+		out[name] = r
+	}
+	return out, rows.Err()
+}
+
+// ensureTable creates schema_migrations or upgrades the legacy layouts
+// (integer first column, missing executed_at) to the current one.
+func ensureTable(conn *sql.Conn) error {
+	ctx := context.Background()
+	var tableExists bool
+	if err := conn.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name='schema_migrations')`).Scan(&tableExists); err != nil {
+		return err
+	}
+
+	if tableExists {
+		var hasFilename bool
+		_ = conn.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM information_schema.columns WHERE table_name='schema_migrations' AND column_name='filename')`).Scan(&hasFilename)
+		if !hasFilename {
+			var oldCol string
+			_ = conn.QueryRowContext(ctx, `SELECT column_name FROM information_schema.columns WHERE table_name='schema_migrations' ORDER BY ordinal_position LIMIT 1`).Scan(&oldCol)
+			if oldCol != "" {
+				log.Printf("Renaming schema_migrations column '%s' → 'filename'", oldCol)
+				if _, err := conn.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE schema_migrations RENAME COLUMN %q TO filename`, oldCol)); err != nil {
+					return fmt.Errorf("rename schema_migrations column: %w", err)
+				}
+			}
+		}
+
+		// Legacy DBs may have an integer filename — that data is not useful
+		var colType string
+		_ = conn.QueryRowContext(ctx, `SELECT data_type FROM information_schema.columns WHERE table_name='schema_migrations' AND column_name='filename'`).Scan(&colType)
+		if colType != "" && colType != "character varying" && colType != "text" {
+			log.Printf("schema_migrations.filename is type '%s', recreating table", colType)
+			if _, err := conn.ExecContext(ctx, `DROP TABLE schema_migrations`); err != nil {
+				return err
+			}
+			tableExists = false
+		}
+	}
+
+	if !tableExists {
+		if _, err := conn.ExecContext(ctx, `CREATE TABLE schema_migrations (
+			filename VARCHAR(255) PRIMARY KEY,
+			executed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)`); err != nil {
+			return fmt.Errorf("create schema_migrations: %w", err)
+		}
+	}
+
+	_, err := conn.ExecContext(ctx, `
+		ALTER TABLE schema_migrations ADD COLUMN IF NOT EXISTS executed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP;
+		ALTER TABLE schema_migrations ADD COLUMN IF NOT EXISTS checksum VARCHAR(64);`)
+	return err
+}
+
+// isDuplicate reports the "already exists"/"duplicate" errors the legacy
+// runner tolerated: duplicate table, column, object, function or schema, and
+// unique violations of seed rows.
+func isDuplicate(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "42P07", "42701", "42710", "42723", "42P06", "42712", "23505":
+		return true
+	}
+	return false
+}
+
+func short(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
+}
@@ -0,0 +1,26 @@
+-- Reverte 065_tenant_rls.sql: remove policies, RLS e o trigger de company_id.
+-- As colunas company_id denormalizadas são mantidas (dados já preenchidos).
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY[
+        'import_jobs', 'participants', 'operacoes_comerciais',
+        'energia_agregado', 'frete_agregado', 'comunicacoes_agregado',
+        'reg_0140', 'reg_c010', 'reg_c100', 'reg_c190',
+        'reg_c500', 'reg_c600', 'reg_d100', 'reg_d500',
+        'nfe_saidas', 'nfe_entradas', 'cte_entradas',
+        'rfb_credentials', 'rfb_requests', 'rfb_debitos', 'rfb_resumo',
+        'managers', 'ai_reports', 'filial_apelidos', 'companies'
+    ] LOOP
+        IF to_regclass(t) IS NULL THEN
+            CONTINUE;
+        END IF;
+        EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %I', t);
+        EXECUTE format('ALTER TABLE %I DISABLE ROW LEVEL SECURITY', t);
+        EXECUTE format('DROP TRIGGER IF EXISTS trg_%s_company_id ON %I', t, t);
+    END LOOP;
+END $$;
+
+DROP FUNCTION IF EXISTS set_company_id_from_job();
+DROP FUNCTION IF EXISTS tenant_enable_rls(regclass);
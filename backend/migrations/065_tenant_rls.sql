@@ -0,0 +1,136 @@
+-- Migration 065: Row-Level Security por empresa (company_id)
+--
+-- Até aqui o isolamento entre clientes dependia de cada handler lembrar do
+-- "WHERE company_id = $1". Esta migration:
+--   1. Denormaliza company_id nas tabelas filhas de import_jobs (participants,
+--      operacoes_comerciais, reg_*, *_agregado) — preenchido por trigger a
+--      partir do job_id, sem alterar os INSERTs do worker.
+--   2. Cria o role fb_tenant (NOLOGIN). As requisições HTTP assumem esse role
+--      via SET LOCAL ROLE dentro de uma transação (handlers.BeginTenantTx),
+--      junto com set_config('app.company_id', ...).
+--   3. Habilita RLS em todas as tabelas de tenant com uma policy restrita ao
+--      role fb_tenant. O role dono das tabelas (worker, migrations, jobs de
+--      background) continua enxergando tudo, como antes.
+--
+-- Materialized views (mv_*) não suportam RLS no PostgreSQL; continuam
+-- dependendo do filtro explícito por company_id.
+
+-- ── 1. Função que lê a empresa da sessão ─────────────────────────────────────
+CREATE OR REPLACE FUNCTION app_current_company_id() RETURNS UUID
+LANGUAGE sql STABLE AS $$
+    SELECT NULLIF(current_setting('app.company_id', true), '')::uuid
+$$;
+
+COMMENT ON FUNCTION app_current_company_id() IS
+    'Empresa da requisição corrente (app.company_id), definida por handlers.BeginTenantTx';
+
+-- ── 2. Denormaliza company_id nas tabelas filhas de import_jobs ───────────────
+CREATE OR REPLACE FUNCTION set_company_id_from_job() RETURNS TRIGGER
+LANGUAGE plpgsql AS $$
+BEGIN
+    IF NEW.company_id IS NULL AND NEW.job_id IS NOT NULL THEN
+        SELECT company_id INTO NEW.company_id FROM import_jobs WHERE id = NEW.job_id;
+    END IF;
+    RETURN NEW;
+END;
+$$;
+
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY[
+        'participants', 'operacoes_comerciais',
+        'energia_agregado', 'frete_agregado', 'comunicacoes_agregado',
+        'reg_0140', 'reg_c010', 'reg_c100', 'reg_c190',
+        'reg_c500', 'reg_c600', 'reg_d100', 'reg_d500'
+    ] LOOP
+        IF to_regclass(t) IS NULL THEN
+            CONTINUE;
+        END IF;
+
+        EXECUTE format('ALTER TABLE %I ADD COLUMN IF NOT EXISTS company_id UUID REFERENCES companies(id) ON DELETE CASCADE', t);
+
+        EXECUTE format(
+            'UPDATE %I x SET company_id = j.company_id FROM import_jobs j
+              WHERE j.id = x.job_id AND x.company_id IS NULL AND j.company_id IS NOT NULL', t);
+
+        EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(company_id)', 'idx_' || t || '_company', t);
+
+        EXECUTE format('DROP TRIGGER IF EXISTS trg_%s_company_id ON %I', t, t);
+        EXECUTE format(
+            'CREATE TRIGGER trg_%s_company_id BEFORE INSERT ON %I
+               FOR EACH ROW EXECUTE FUNCTION set_company_id_from_job()', t, t);
+    END LOOP;
+END $$;
+
+-- ── 3. Role usado pelas requisições HTTP ─────────────────────────────────────
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_tenant') THEN
+        CREATE ROLE fb_tenant NOLOGIN;
+    END IF;
+    -- O usuário da aplicação precisa poder executar SET ROLE fb_tenant
+    EXECUTE format('GRANT fb_tenant TO %I', current_user);
+EXCEPTION WHEN insufficient_privilege THEN
+    RAISE WARNING 'Sem privilégio para criar/conceder o role fb_tenant: RLS por requisição ficará inativo até um DBA executar esta etapa.';
+END $$;
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_tenant') THEN
+        GRANT USAGE ON SCHEMA public TO fb_tenant;
+        GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO fb_tenant;
+        GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO fb_tenant;
+        ALTER DEFAULT PRIVILEGES IN SCHEMA public
+            GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO fb_tenant;
+    END IF;
+END $$;
+
+-- ── 4. Policies de isolamento ────────────────────────────────────────────────
+-- tenant_enable_rls() é a única definição da policy: migrations que criarem
+-- tabelas de tenant devem chamá-la em vez de repetir o bloco.
+CREATE OR REPLACE FUNCTION tenant_enable_rls(tbl regclass) RETURNS void
+LANGUAGE plpgsql AS $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_tenant') THEN
+        RETURN;
+    END IF;
+    EXECUTE format('ALTER TABLE %s ENABLE ROW LEVEL SECURITY', tbl);
+    EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %s', tbl);
+    EXECUTE format(
+        'CREATE POLICY tenant_isolation ON %s TO fb_tenant
+           USING (company_id = app_current_company_id())
+           WITH CHECK (company_id = app_current_company_id())', tbl);
+END;
+$$;
+
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_tenant') THEN
+        RETURN;
+    END IF;
+
+    FOREACH t IN ARRAY ARRAY[
+        'import_jobs', 'participants', 'operacoes_comerciais',
+        'energia_agregado', 'frete_agregado', 'comunicacoes_agregado',
+        'reg_0140', 'reg_c010', 'reg_c100', 'reg_c190',
+        'reg_c500', 'reg_c600', 'reg_d100', 'reg_d500',
+        'nfe_saidas', 'nfe_entradas', 'cte_entradas',
+        'rfb_credentials', 'rfb_requests', 'rfb_debitos', 'rfb_resumo',
+        'managers', 'ai_reports', 'filial_apelidos'
+    ] LOOP
+        IF to_regclass(t) IS NULL THEN
+            CONTINUE;
+        END IF;
+        PERFORM tenant_enable_rls(t::regclass);
+    END LOOP;
+
+    -- A própria empresa: o tenant só enxerga a sua linha
+    ALTER TABLE companies ENABLE ROW LEVEL SECURITY;
+    DROP POLICY IF EXISTS tenant_isolation ON companies;
+    CREATE POLICY tenant_isolation ON companies TO fb_tenant
+        USING (id = app_current_company_id());
+END $$;
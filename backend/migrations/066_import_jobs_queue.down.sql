@@ -0,0 +1,20 @@
+-- Reverte 066_import_jobs_queue.sql: remove as colunas e índices da fila.
+-- last_line_processed é mantida: o worker anterior à 066 já a usava (a 066
+-- apenas garante que exista). Jobs em dead-letter voltam a 'error', status
+-- que o código anterior conhece.
+UPDATE import_jobs SET status = 'error' WHERE status = 'dead';
+
+DROP INDEX IF EXISTS idx_import_jobs_ready;
+DROP INDEX IF EXISTS idx_import_jobs_lease;
+DROP INDEX IF EXISTS idx_import_jobs_company_started;
+
+ALTER TABLE import_jobs
+    DROP COLUMN IF EXISTS priority,
+    DROP COLUMN IF EXISTS attempts,
+    DROP COLUMN IF EXISTS max_attempts,
+    DROP COLUMN IF EXISTS run_after,
+    DROP COLUMN IF EXISTS locked_by,
+    DROP COLUMN IF EXISTS lease_expires_at,
+    DROP COLUMN IF EXISTS started_at,
+    DROP COLUMN IF EXISTS finished_at,
+    DROP COLUMN IF EXISTS last_error;
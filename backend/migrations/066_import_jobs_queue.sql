@@ -0,0 +1,35 @@
+-- Migration 066: fila durável de importação SPED sobre import_jobs
+--
+-- status: pending → processing → completed | error | cancelled | dead
+--   pending     aguardando (run_after define quando pode ser executado)
+--   processing  em execução por um worker com lease válido (lease_expires_at)
+--   error       falha permanente (arquivo corrompido/inexistente)
+--   dead        dead-letter: esgotou max_attempts de tentativas
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS max_attempts INT NOT NULL DEFAULT 3;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS run_after TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS locked_by VARCHAR(100);
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS started_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS finished_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS last_error TEXT;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS last_line_processed INT DEFAULT 0;
+
+-- Busca de jobs prontos para execução
+CREATE INDEX IF NOT EXISTS idx_import_jobs_ready
+    ON import_jobs(run_after, priority DESC, created_at)
+    WHERE status = 'pending';
+
+-- Leases expirados (reaper) e round-robin por empresa
+CREATE INDEX IF NOT EXISTS idx_import_jobs_lease
+    ON import_jobs(lease_expires_at)
+    WHERE status IN ('processing', 'cancelling');
+CREATE INDEX IF NOT EXISTS idx_import_jobs_company_started
+    ON import_jobs(company_id, started_at DESC);
+
+COMMENT ON COLUMN import_jobs.priority IS 'Maior valor é executado primeiro dentro da mesma empresa';
+COMMENT ON COLUMN import_jobs.attempts IS 'Tentativas de processamento já iniciadas';
+COMMENT ON COLUMN import_jobs.run_after IS 'Não executar antes deste instante (backoff exponencial entre tentativas)';
+COMMENT ON COLUMN import_jobs.locked_by IS 'Worker (host:pid#n) que detém o lease';
+COMMENT ON COLUMN import_jobs.lease_expires_at IS 'Renovado pelo heartbeat; expirado = worker morto, job volta para a fila';
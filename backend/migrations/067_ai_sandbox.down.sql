@@ -0,0 +1,4 @@
+-- Reverte 067_ai_sandbox.sql. O role fb_ai_reader é mantido (pode estar
+-- concedido a outros usuários do cluster).
+DROP SCHEMA IF EXISTS ai_sandbox CASCADE;
+DROP FUNCTION IF EXISTS ai_sandbox_create_views();
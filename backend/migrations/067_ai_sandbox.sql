@@ -0,0 +1,76 @@
+-- Migration 067: sandbox para o SQL gerado pela IA (/api/ai/query)
+--
+-- O SQL do modelo passa a rodar:
+--   - numa transação READ ONLY com statement_timeout (handlers.runSandboxedQuery);
+--   - sob o role fb_ai_reader (NOLOGIN), que NÃO tem acesso ao schema public;
+--   - com search_path = ai_sandbox, onde existem apenas views security_barrier
+--     com os mesmos nomes das tabelas/views descritas no prompt, já filtradas
+--     por app_current_company_id() (company id enviado como parâmetro).
+--
+-- Uma tabela esquecida no prompt simplesmente não existe para o modelo, e as
+-- materialized views (sem RLS) ficam isoladas pelo filtro da view.
+--
+-- Migrations que recriarem um mv_* com DROP ... CASCADE devem chamar
+-- ai_sandbox_create_views() no final para recriar as views do sandbox.
+
+CREATE SCHEMA IF NOT EXISTS ai_sandbox;
+
+-- ── 1. Views por empresa ─────────────────────────────────────────────────────
+CREATE OR REPLACE FUNCTION ai_sandbox_create_views() RETURNS void
+LANGUAGE plpgsql AS $$
+DECLARE
+    t TEXT;
+BEGIN
+    -- Views com todas as colunas, filtradas por company_id
+    FOREACH t IN ARRAY ARRAY[
+        'mv_mercadorias_agregada', 'mv_compras_fornecedores', 'mv_operacoes_simples',
+        'operacoes_comerciais', 'participants'
+    ] LOOP
+        IF to_regclass('public.' || t) IS NULL THEN
+            CONTINUE;
+        END IF;
+        EXECUTE format(
+            'CREATE OR REPLACE VIEW ai_sandbox.%I WITH (security_barrier = true) AS
+               SELECT * FROM public.%I WHERE company_id = app_current_company_id()', t, t);
+    END LOOP;
+
+    -- import_jobs: só metadados do SPED (sem arquivo, mensagens ou estado da fila)
+    CREATE OR REPLACE VIEW ai_sandbox.import_jobs WITH (security_barrier = true) AS
+        SELECT id, company_id, company_name, cnpj, mes_ano AS periodo, dt_ini, dt_fin, status, created_at
+        FROM public.import_jobs
+        WHERE company_id = app_current_company_id();
+
+    -- Alíquotas são globais (não pertencem a nenhuma empresa)
+    IF to_regclass('public.tabela_aliquotas') IS NOT NULL THEN
+        CREATE OR REPLACE VIEW ai_sandbox.tabela_aliquotas AS
+            SELECT * FROM public.tabela_aliquotas;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_ai_reader') THEN
+        GRANT SELECT ON ALL TABLES IN SCHEMA ai_sandbox TO fb_ai_reader;
+    END IF;
+END;
+$$;
+
+-- ── 2. Role do sandbox ───────────────────────────────────────────────────────
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_ai_reader') THEN
+        CREATE ROLE fb_ai_reader NOLOGIN;
+    END IF;
+    -- O usuário da aplicação precisa poder executar SET ROLE fb_ai_reader
+    EXECUTE format('GRANT fb_ai_reader TO %I', current_user);
+EXCEPTION WHEN insufficient_privilege THEN
+    RAISE WARNING 'Sem privilégio para criar/conceder o role fb_ai_reader: /api/ai/query ficará indisponível até um DBA executar esta etapa.';
+END $$;
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_ai_reader') THEN
+        REVOKE ALL ON ALL TABLES IN SCHEMA public FROM fb_ai_reader;
+        REVOKE ALL ON SCHEMA public FROM fb_ai_reader;
+        GRANT USAGE ON SCHEMA ai_sandbox TO fb_ai_reader;
+    END IF;
+END $$;
+
+SELECT ai_sandbox_create_views();
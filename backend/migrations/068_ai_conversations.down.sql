@@ -0,0 +1,4 @@
+-- Reverte 068_ai_conversations.sql
+DROP TABLE IF EXISTS ai_saved_queries;
+DROP TABLE IF EXISTS ai_conversation_turns;
+DROP TABLE IF EXISTS ai_conversations;
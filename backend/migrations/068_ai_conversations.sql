@@ -0,0 +1,56 @@
+-- Migration 068: histórico de conversas do assistente text-to-SQL
+--
+-- ai_conversations      — uma conversa por usuário/empresa (título = 1ª pergunta)
+-- ai_conversation_turns — cada pergunta com o SQL gerado e um resumo do
+--                         resultado; os últimos turnos voltam ao modelo como
+--                         contexto das perguntas de seguimento ("e por filial?")
+-- ai_saved_queries      — consultas salvas com nome, reexecutadas no sandbox
+--                         sem passar pela IA
+
+CREATE TABLE IF NOT EXISTS ai_conversations (
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id  UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    user_id     UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    titulo      TEXT NOT NULL,
+    created_at  TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at  TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_ai_conversations_company_user
+    ON ai_conversations(company_id, user_id, updated_at DESC);
+
+CREATE TABLE IF NOT EXISTS ai_conversation_turns (
+    id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    conversation_id  UUID NOT NULL REFERENCES ai_conversations(id) ON DELETE CASCADE,
+    company_id       UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    pergunta         TEXT NOT NULL,
+    sql_gerado       TEXT,
+    resumo_resultado TEXT,
+    row_count        INT NOT NULL DEFAULT 0,
+    chart            JSONB,
+    erro             TEXT,
+    model            VARCHAR(100),
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_ai_conversation_turns_conversation
+    ON ai_conversation_turns(conversation_id, created_at);
+
+CREATE TABLE IF NOT EXISTS ai_saved_queries (
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id  UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    user_id     UUID REFERENCES users(id) ON DELETE SET NULL,
+    nome        VARCHAR(120) NOT NULL,
+    pergunta    TEXT NOT NULL,
+    sql_gerado  TEXT NOT NULL,
+    chart       JSONB,
+    created_at  TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_ai_saved_queries_company_nome
+    ON ai_saved_queries(company_id, nome);
+
+-- Mesma policy de isolamento da migration 065 (tenant_enable_rls)
+SELECT tenant_enable_rls('ai_conversations');
+SELECT tenant_enable_rls('ai_conversation_turns');
+SELECT tenant_enable_rls('ai_saved_queries');
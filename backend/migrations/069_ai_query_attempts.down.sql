@@ -0,0 +1,2 @@
+-- Reverte 069_ai_query_attempts.sql
+DROP TABLE IF EXISTS ai_query_attempts;
@@ -0,0 +1,25 @@
+-- Migration 069: log de tentativas do text-to-SQL (/api/ai/query)
+--
+-- Cada pergunta pode gerar várias tentativas: a primeira resposta da IA e até
+-- AI_QUERY_REPAIR_ATTEMPTS correções, em que o erro do PostgreSQL (ou da
+-- validação) volta para o modelo. Todas ficam registradas aqui, agrupadas por
+-- request_id, para evoluir SystemPromptTextToSQL/dbSchemaContext a partir de
+-- falhas reais (ver GET /api/admin/ai-query-failures).
+
+CREATE TABLE IF NOT EXISTS ai_query_attempts (
+    id           UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    request_id   UUID NOT NULL,
+    company_id   UUID REFERENCES companies(id) ON DELETE CASCADE,
+    pergunta     TEXT NOT NULL,
+    tentativa    INT NOT NULL,
+    etapa        VARCHAR(20) NOT NULL, -- 'ia', 'extract', 'validate', 'placeholder', 'execute', 'ok'
+    sql_gerado   TEXT,
+    erro         TEXT,
+    sqlstate     VARCHAR(5),
+    model        VARCHAR(100),
+    duration_ms  INT,
+    created_at   TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_ai_query_attempts_request ON ai_query_attempts(request_id, tentativa);
+CREATE INDEX IF NOT EXISTS idx_ai_query_attempts_etapa ON ai_query_attempts(etapa, created_at DESC);
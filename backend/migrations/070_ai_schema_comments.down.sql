@@ -0,0 +1,37 @@
+-- Reverte 070_ai_schema_comments.sql: tira do sandbox as relações de
+-- documentos fiscais e da RFB. Os COMMENTs são mantidos (só documentação).
+DROP VIEW IF EXISTS ai_sandbox.nfe_saidas, ai_sandbox.nfe_entradas, ai_sandbox.cte_entradas,
+                    ai_sandbox.rfb_debitos, ai_sandbox.rfb_resumo;
+
+CREATE OR REPLACE FUNCTION ai_sandbox_create_views() RETURNS void
+LANGUAGE plpgsql AS $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY[
+        'mv_mercadorias_agregada', 'mv_compras_fornecedores', 'mv_operacoes_simples',
+        'operacoes_comerciais', 'participants'
+    ] LOOP
+        IF to_regclass('public.' || t) IS NULL THEN
+            CONTINUE;
+        END IF;
+        EXECUTE format(
+            'CREATE OR REPLACE VIEW ai_sandbox.%I WITH (security_barrier = true) AS
+               SELECT * FROM public.%I WHERE company_id = app_current_company_id()', t, t);
+    END LOOP;
+
+    CREATE OR REPLACE VIEW ai_sandbox.import_jobs WITH (security_barrier = true) AS
+        SELECT id, company_id, company_name, cnpj, mes_ano AS periodo, dt_ini, dt_fin, status, created_at
+        FROM public.import_jobs
+        WHERE company_id = app_current_company_id();
+
+    IF to_regclass('public.tabela_aliquotas') IS NOT NULL THEN
+        CREATE OR REPLACE VIEW ai_sandbox.tabela_aliquotas AS
+            SELECT * FROM public.tabela_aliquotas;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_ai_reader') THEN
+        GRANT SELECT ON ALL TABLES IN SCHEMA ai_sandbox TO fb_ai_reader;
+    END IF;
+END;
+$$;
@@ -0,0 +1,141 @@
+-- Migration 070: schema do text-to-SQL gerado a partir do catálogo
+--
+-- O contexto de schema enviado à IA deixa de ser uma string mantida à mão em
+-- services/text_to_sql.go: no startup, services.LoadSchemaContext lê as views
+-- do schema ai_sandbox (a allow-list) e as colunas/COMMENTs das relações de
+-- origem em public. Esta migration:
+--   1. inclui nfe_saidas, nfe_entradas, cte_entradas, rfb_debitos e rfb_resumo
+--      no sandbox (passam a ser consultáveis pela IA);
+--   2. grava como COMMENT as descrições que antes viviam no código.
+--
+-- Novas relações: adicione-as em ai_sandbox_create_views() e documente as
+-- colunas com COMMENT ON — nenhum código precisa mudar.
+
+CREATE OR REPLACE FUNCTION ai_sandbox_create_views() RETURNS void
+LANGUAGE plpgsql AS $$
+DECLARE
+    t TEXT;
+BEGIN
+    -- Views com todas as colunas, filtradas por company_id
+    FOREACH t IN ARRAY ARRAY[
+        'mv_mercadorias_agregada', 'mv_compras_fornecedores', 'mv_operacoes_simples',
+        'operacoes_comerciais', 'participants',
+        'nfe_saidas', 'nfe_entradas', 'cte_entradas',
+        'rfb_debitos', 'rfb_resumo'
+    ] LOOP
+        IF to_regclass('public.' || t) IS NULL THEN
+            CONTINUE;
+        END IF;
+        EXECUTE format(
+            'CREATE OR REPLACE VIEW ai_sandbox.%I WITH (security_barrier = true) AS
+               SELECT * FROM public.%I WHERE company_id = app_current_company_id()', t, t);
+    END LOOP;
+
+    -- import_jobs: só metadados do SPED (sem arquivo, mensagens ou estado da fila)
+    CREATE OR REPLACE VIEW ai_sandbox.import_jobs WITH (security_barrier = true) AS
+        SELECT id, company_id, company_name, cnpj, mes_ano AS periodo, dt_ini, dt_fin, status, created_at
+        FROM public.import_jobs
+        WHERE company_id = app_current_company_id();
+
+    -- Alíquotas são globais (não pertencem a nenhuma empresa)
+    IF to_regclass('public.tabela_aliquotas') IS NOT NULL THEN
+        CREATE OR REPLACE VIEW ai_sandbox.tabela_aliquotas AS
+            SELECT * FROM public.tabela_aliquotas;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_ai_reader') THEN
+        GRANT SELECT ON ALL TABLES IN SCHEMA ai_sandbox TO fb_ai_reader;
+    END IF;
+END;
+$$;
+
+SELECT ai_sandbox_create_views();
+
+-- Comenta relação (col = NULL) ou coluna, ignorando o que não existir nesta base
+CREATE FUNCTION pg_temp.comentar(rel TEXT, col TEXT, txt TEXT) RETURNS void
+LANGUAGE plpgsql AS $$
+DECLARE
+    kind CHAR;
+BEGIN
+    SELECT c.relkind INTO kind
+    FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE n.nspname = 'public' AND c.relname = rel;
+    IF kind IS NULL THEN
+        RETURN;
+    END IF;
+
+    IF col IS NULL THEN
+        EXECUTE format('COMMENT ON %s public.%I IS %L',
+            CASE kind WHEN 'm' THEN 'MATERIALIZED VIEW' WHEN 'v' THEN 'VIEW' ELSE 'TABLE' END, rel, txt);
+    ELSIF EXISTS (SELECT 1 FROM pg_attribute
+                  WHERE attrelid = format('public.%I', rel)::regclass AND attname = col AND NOT attisdropped) THEN
+        EXECUTE format('COMMENT ON COLUMN public.%I.%I IS %L', rel, col, txt);
+    END IF;
+END;
+$$;
+
+-- ── Views materializadas ─────────────────────────────────────────────────────
+SELECT pg_temp.comentar('mv_mercadorias_agregada', NULL, 'View principal agregada: operações fiscais por filial/período. Faturamento/vendas = tipo SAIDA; compras = tipo ENTRADA.');
+SELECT pg_temp.comentar('mv_mercadorias_agregada', 'mes_ano', '''MM/YYYY'' ex: ''05/2024'' (dados reais importados)');
+SELECT pg_temp.comentar('mv_mercadorias_agregada', 'tipo', '''ENTRADA'' (compras) ou ''SAIDA'' (vendas)');
+SELECT pg_temp.comentar('mv_mercadorias_agregada', 'tipo_cfop', '''T''=Transferência,''O''=Operacional,''R''=Revenda,''C''=Consumo,''A''=Ativo,''D''=Devolução');
+
+SELECT pg_temp.comentar('mv_compras_fornecedores', NULL, 'Compras de TODOS os fornecedores, CFOP < 5000, todas as filiais. Use para perguntas sobre maiores fornecedores por valor de compra em geral.');
+SELECT pg_temp.comentar('mv_compras_fornecedores', 'cod_part', 'código do parceiro no SPED');
+SELECT pg_temp.comentar('mv_compras_fornecedores', 'filial_nome', 'nome da filial importadora');
+SELECT pg_temp.comentar('mv_compras_fornecedores', 'tipo_cfop', '''R''=Revenda,''C''=Consumo,''A''=Ativo,''T''=Transferência,''O''=Operacional,''D''=Devolução');
+SELECT pg_temp.comentar('mv_compras_fornecedores', 'mes_ano', '''MM/YYYY''');
+SELECT pg_temp.comentar('mv_compras_fornecedores', 'total_valor', 'valor total das compras (vl_opr do reg_c190)');
+SELECT pg_temp.comentar('mv_compras_fornecedores', 'total_icms', 'ICMS das compras');
+
+SELECT pg_temp.comentar('mv_operacoes_simples', NULL, 'Compras de fornecedores do Simples Nacional. Use APENAS quando a pergunta mencionar explicitamente "Simples Nacional".');
+SELECT pg_temp.comentar('mv_operacoes_simples', 'mes_ano', '''MM/YYYY''');
+SELECT pg_temp.comentar('mv_operacoes_simples', 'origem', '''C100'' ou ''D100''');
+SELECT pg_temp.comentar('mv_operacoes_simples', 'total_valor', 'valor total da operação');
+SELECT pg_temp.comentar('mv_operacoes_simples', 'total_icms', 'crédito ICMS perdido = prejuízo do Simples');
+
+-- ── Tabelas do SPED ──────────────────────────────────────────────────────────
+SELECT pg_temp.comentar('operacoes_comerciais', NULL, 'Operações por parceiro. vl_ibs_projetado/vl_cbs_projetado são projeções da Reforma calculadas sobre os dados reais importados. JOIN com participants em DOIS campos: job_id AND cod_part.');
+SELECT pg_temp.comentar('operacoes_comerciais', 'job_id', 'importação de origem (import_jobs)');
+SELECT pg_temp.comentar('operacoes_comerciais', 'cod_part', 'código do parceiro');
+SELECT pg_temp.comentar('operacoes_comerciais', 'mes_ano', 'período real ''MM/YYYY'' dos dados importados');
+SELECT pg_temp.comentar('operacoes_comerciais', 'ind_oper', '''0''=Entrada, ''1''=Saída');
+
+SELECT pg_temp.comentar('participants', NULL, 'Parceiros/fornecedores do SPED (registro 0150). JOIN obrigatório em DOIS campos: job_id AND cod_part.');
+
+SELECT pg_temp.comentar('import_jobs', NULL, 'Importações de SPED');
+
+SELECT pg_temp.comentar('tabela_aliquotas', NULL, 'Alíquotas da Reforma Tributária por ano (global, sem company_id). IBS total = perc_ibs_uf + perc_ibs_mun.');
+SELECT pg_temp.comentar('tabela_aliquotas', 'perc_ibs_uf', 'alíquota IBS estadual');
+SELECT pg_temp.comentar('tabela_aliquotas', 'perc_ibs_mun', 'alíquota IBS municipal');
+SELECT pg_temp.comentar('tabela_aliquotas', 'perc_cbs', 'alíquota CBS federal');
+SELECT pg_temp.comentar('tabela_aliquotas', 'perc_reduc_icms', 'percentual de redução do ICMS');
+
+-- ── Documentos fiscais (XML) ─────────────────────────────────────────────────
+SELECT pg_temp.comentar('nfe_saidas', NULL, 'NF-e/NFC-e de saída importadas do XML (vendas). Valores de ICMSTot e IBSCBSTot como nas tags.');
+SELECT pg_temp.comentar('nfe_saidas', 'modelo', '55 (NF-e) ou 65 (NFC-e)');
+SELECT pg_temp.comentar('nfe_saidas', 'mes_ano', '''MM/YYYY'' da emissão');
+SELECT pg_temp.comentar('nfe_saidas', 'v_nf', 'valor total da nota');
+SELECT pg_temp.comentar('nfe_saidas', 'v_ibs', 'total IBS destacado');
+SELECT pg_temp.comentar('nfe_saidas', 'v_cbs', 'total CBS destacado');
+
+SELECT pg_temp.comentar('nfe_entradas', NULL, 'NF-e de entrada importadas do XML (compras; forn_* = fornecedor emitente). Valores de ICMSTot e IBSCBSTot como nas tags.');
+SELECT pg_temp.comentar('nfe_entradas', 'mes_ano', '''MM/YYYY'' da emissão');
+SELECT pg_temp.comentar('nfe_entradas', 'v_nf', 'valor total da nota');
+SELECT pg_temp.comentar('nfe_entradas', 'v_ibs', 'total IBS destacado (0 quando ausente)');
+SELECT pg_temp.comentar('nfe_entradas', 'v_cbs', 'total CBS destacado (0 quando ausente)');
+
+SELECT pg_temp.comentar('cte_entradas', NULL, 'CT-e de entrada (fretes contratados; emit_* = transportadora).');
+SELECT pg_temp.comentar('cte_entradas', 'modal', '01=Rodoviário 02=Aéreo 03=Aquaviário 04=Ferroviário');
+SELECT pg_temp.comentar('cte_entradas', 'v_prest', 'total da prestação do serviço de transporte');
+
+-- ── Apuração CBS da Receita Federal ──────────────────────────────────────────
+SELECT pg_temp.comentar('rfb_debitos', NULL, 'Débitos de CBS por documento fiscal, conforme a apuração oficial da Receita Federal.');
+SELECT pg_temp.comentar('rfb_debitos', 'tipo_apuracao', 'corrente, ajuste ou extemporâneo');
+SELECT pg_temp.comentar('rfb_debitos', 'data_apuracao', 'período ''YYYYMM''');
+SELECT pg_temp.comentar('rfb_debitos', 'ni_emitente', 'CNPJ/CPF do emitente');
+SELECT pg_temp.comentar('rfb_debitos', 'ni_adquirente', 'CNPJ/CPF do adquirente');
+SELECT pg_temp.comentar('rfb_debitos', 'valor_cbs_extinto', 'parte do débito já extinta (paga/compensada)');
+
+SELECT pg_temp.comentar('rfb_resumo', NULL, 'Totais da apuração CBS da Receita Federal por período.');
+SELECT pg_temp.comentar('rfb_resumo', 'data_apuracao', 'período ''YYYYMM''');
@@ -0,0 +1,3 @@
+-- Reverte 071_report_subscriptions.sql
+DROP TABLE IF EXISTS report_deliveries;
+DROP TABLE IF EXISTS report_subscriptions;
@@ -0,0 +1,66 @@
+-- Migration 071: assinaturas de relatórios por gestor e histórico de envio
+--
+-- report_subscriptions — o que cada gestor recebe e quando:
+--   relatorio  : resumo_executivo, creditos_risco, rfb_cbs, apuracao_painel
+--   frequencia : importacao (após cada importação de SPED, como antes),
+--                mensal (dia = 1..28) ou semanal (dia = 0..6, domingo = 0)
+--   hora       : hora do envio no horário de Brasília (0..23)
+--   next_run_at: próxima execução; o scheduler do backend só lê esta coluna,
+--                então a agenda sobrevive a restarts e a várias instâncias
+--   unsubscribe_token: link de descadastro nos e-mails (sem login)
+-- report_deliveries — uma linha por envio (ou falha) de cada assinatura.
+--
+-- Os gestores ativos já existentes passam a assinar o resumo executivo após
+-- importação, que era o comportamento fixo até aqui.
+
+CREATE TABLE IF NOT EXISTS report_subscriptions (
+    id                 UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id         UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    manager_id         UUID NOT NULL REFERENCES managers(id) ON DELETE CASCADE,
+    relatorio          VARCHAR(30) NOT NULL
+                       CHECK (relatorio IN ('resumo_executivo', 'creditos_risco', 'rfb_cbs', 'apuracao_painel')),
+    frequencia         VARCHAR(20) NOT NULL
+                       CHECK (frequencia IN ('importacao', 'mensal', 'semanal')),
+    dia                INT NOT NULL DEFAULT 1,
+    hora               INT NOT NULL DEFAULT 8 CHECK (hora BETWEEN 0 AND 23),
+    ativo              BOOLEAN NOT NULL DEFAULT true,
+    unsubscribe_token  VARCHAR(64) NOT NULL UNIQUE
+                       DEFAULT replace(gen_random_uuid()::text || gen_random_uuid()::text, '-', ''),
+    next_run_at        TIMESTAMP WITH TIME ZONE,
+    last_run_at        TIMESTAMP WITH TIME ZONE,
+    created_at         TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at         TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (frequencia <> 'mensal'  OR dia BETWEEN 1 AND 28),
+    CHECK (frequencia <> 'semanal' OR dia BETWEEN 0 AND 6),
+    UNIQUE (manager_id, relatorio, frequencia)
+);
+
+CREATE INDEX IF NOT EXISTS idx_report_subscriptions_company ON report_subscriptions(company_id);
+CREATE INDEX IF NOT EXISTS idx_report_subscriptions_due
+    ON report_subscriptions(next_run_at) WHERE ativo AND frequencia <> 'importacao';
+
+CREATE TABLE IF NOT EXISTS report_deliveries (
+    id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    subscription_id  UUID NOT NULL REFERENCES report_subscriptions(id) ON DELETE CASCADE,
+    company_id       UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    relatorio        VARCHAR(30) NOT NULL,
+    periodo          VARCHAR(10),
+    email            VARCHAR(255) NOT NULL,
+    status           VARCHAR(20) NOT NULL, -- 'enviado', 'sem_dados', 'erro'
+    erro             TEXT,
+    scheduled_for    TIMESTAMP WITH TIME ZONE,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_report_deliveries_subscription
+    ON report_deliveries(subscription_id, created_at DESC);
+
+INSERT INTO report_subscriptions (company_id, manager_id, relatorio, frequencia)
+SELECT company_id, id, 'resumo_executivo', 'importacao'
+FROM managers
+WHERE ativo = true
+ON CONFLICT (manager_id, relatorio, frequencia) DO NOTHING;
+
+-- Mesma policy de isolamento da migration 065 (tenant_enable_rls)
+SELECT tenant_enable_rls('report_subscriptions');
+SELECT tenant_enable_rls('report_deliveries');
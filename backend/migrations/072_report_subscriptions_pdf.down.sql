@@ -0,0 +1,2 @@
+-- Reverte 072_report_subscriptions_pdf.sql
+ALTER TABLE report_subscriptions DROP COLUMN IF EXISTS anexar_pdf;
@@ -0,0 +1,8 @@
+-- Migration 072: anexar o relatório em PDF aos e-mails agendados
+--
+-- anexar_pdf: quando verdadeiro, o e-mail da assinatura leva a edição em PDF
+-- do relatório (a mesma de GET /api/reports/{id}/pdf e dos exports do painel).
+-- Desligado por padrão para não aumentar o tamanho dos e-mails existentes.
+
+ALTER TABLE report_subscriptions
+    ADD COLUMN IF NOT EXISTS anexar_pdf BOOLEAN NOT NULL DEFAULT false;
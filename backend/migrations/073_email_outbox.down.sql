@@ -0,0 +1,2 @@
+-- Reverte 073_email_outbox.sql
+DROP TABLE IF EXISTS email_outbox;
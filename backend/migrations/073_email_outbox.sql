@@ -0,0 +1,49 @@
+-- Migration 073: caixa de saída de e-mails (outbox) com novas tentativas
+--
+-- Os e-mails deixam de ser enviados de forma síncrona: quem envia grava a
+-- mensagem MIME já renderizada em email_outbox e o sender do backend entrega.
+-- Uma falha de SMTP não perde mais o e-mail nem falha a importação.
+--
+-- status: pending → sending → sent | bounced | dead
+--   pending  aguardando (run_after define quando pode ser enviado)
+--   sending  em envio por uma instância (lease_expires_at; expirado volta à fila)
+--   sent     aceito pelo servidor SMTP
+--   bounced  recusado em definitivo (resposta 5xx ao destinatário ou à mensagem)
+--   dead     esgotou max_attempts de tentativas com falhas temporárias
+--
+-- delivery_id liga o e-mail ao histórico de report_deliveries, que agora passa
+-- por 'enfileirado' e recebe o resultado final ('enviado', 'devolvido' ou 'erro').
+
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    template         VARCHAR(50) NOT NULL,
+    to_email         VARCHAR(255) NOT NULL,
+    subject          TEXT NOT NULL,
+    message          BYTEA NOT NULL,
+    status           VARCHAR(20) NOT NULL DEFAULT 'pending'
+                     CHECK (status IN ('pending', 'sending', 'sent', 'bounced', 'dead')),
+    attempts         INT NOT NULL DEFAULT 0,
+    max_attempts     INT NOT NULL DEFAULT 8,
+    run_after        TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    lease_expires_at TIMESTAMP WITH TIME ZONE,
+    last_error       TEXT,
+    bounce_reason    TEXT,
+    bounced_at       TIMESTAMP WITH TIME ZONE,
+    sent_at          TIMESTAMP WITH TIME ZONE,
+    delivery_id      UUID REFERENCES report_deliveries(id) ON DELETE SET NULL,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Busca de e-mails prontos para envio (inclui leases expirados)
+CREATE INDEX IF NOT EXISTS idx_email_outbox_ready
+    ON email_outbox(run_after)
+    WHERE status IN ('pending', 'sending');
+CREATE INDEX IF NOT EXISTS idx_email_outbox_to_email
+    ON email_outbox(to_email, created_at DESC);
+
+COMMENT ON COLUMN email_outbox.template IS 'Template usado (templates/email/<locale>/<template>.html)';
+COMMENT ON COLUMN email_outbox.message IS 'Mensagem MIME completa, renderizada no enfileiramento';
+COMMENT ON COLUMN email_outbox.run_after IS 'Não enviar antes deste instante (backoff exponencial entre tentativas)';
+COMMENT ON COLUMN email_outbox.bounce_reason IS 'Resposta do servidor SMTP que recusou o e-mail';
+COMMENT ON COLUMN report_deliveries.status IS 'enfileirado, enviado, devolvido, erro ou sem_dados';
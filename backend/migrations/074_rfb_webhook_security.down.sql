@@ -0,0 +1,5 @@
+-- Reverte 074_rfb_webhook_security.sql
+DROP TABLE IF EXISTS rfb_webhook_deliveries;
+ALTER TABLE rfb_requests
+    DROP COLUMN IF EXISTS webhook_received_at,
+    DROP COLUMN IF EXISTS webhook_token_hash;
@@ -0,0 +1,46 @@
+-- Migration 074: autenticação e registro dos callbacks (webhook) da RFB
+--
+-- Até aqui /api/rfb/webhook aceitava qualquer POST, despejava cabeçalhos e
+-- corpo no stdout e disparava o download de qualquer solicitação 'requested'
+-- com o tiqueteSolicitacao informado. Agora:
+--   * cada solicitação envia à RFB uma urlRetorno com um segredo próprio
+--     (?token=...); só o hash SHA-256 fica em rfb_requests.webhook_token_hash;
+--   * IP de origem (RFB_WEBHOOK_ALLOWED_IPS) e certificado cliente mTLS
+--     (RFB_WEBHOOK_CLIENT_CERT_SHA256) podem ser exigidos;
+--   * callbacks repetidos não disparam um segundo download;
+--   * cada callback recebido fica registrado em rfb_webhook_deliveries.
+--
+-- Solicitações anteriores a esta migration não têm hash e continuam aceitas
+-- sem token.
+
+ALTER TABLE rfb_requests
+    ADD COLUMN IF NOT EXISTS webhook_token_hash VARCHAR(64),
+    ADD COLUMN IF NOT EXISTS webhook_received_at TIMESTAMP WITH TIME ZONE;
+
+COMMENT ON COLUMN rfb_requests.webhook_token_hash IS 'SHA-256 (hex) do segredo enviado na urlRetorno da solicitação';
+COMMENT ON COLUMN rfb_requests.webhook_received_at IS 'Primeiro callback aceito da RFB para esta solicitação';
+
+CREATE TABLE IF NOT EXISTS rfb_webhook_deliveries (
+    id                  UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    request_id          UUID REFERENCES rfb_requests(id) ON DELETE SET NULL,
+    company_id          UUID REFERENCES companies(id) ON DELETE CASCADE,
+    tiquete_solicitacao VARCHAR(255),
+    tiquete_download    VARCHAR(255),
+    remote_ip           VARCHAR(64),
+    resultado           VARCHAR(30) NOT NULL
+                        CHECK (resultado IN ('aceito', 'duplicado', 'token_invalido', 'ip_nao_permitido',
+                                             'certificado_invalido', 'payload_invalido', 'nao_encontrado')),
+    detalhe             TEXT,
+    headers             JSONB,
+    body                TEXT,
+    received_at         TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_rfb_webhook_deliveries_received
+    ON rfb_webhook_deliveries(received_at DESC);
+CREATE INDEX IF NOT EXISTS idx_rfb_webhook_deliveries_request
+    ON rfb_webhook_deliveries(request_id);
+
+COMMENT ON TABLE rfb_webhook_deliveries IS 'Callbacks recebidos em /api/rfb/webhook, aceitos ou recusados';
+COMMENT ON COLUMN rfb_webhook_deliveries.headers IS 'Cabeçalhos da requisição, sem Authorization/Cookie';
+COMMENT ON COLUMN rfb_webhook_deliveries.body IS 'Corpo recebido (truncado em 16 KB)';
@@ -0,0 +1,8 @@
+-- Reverte 075_rfb_scheduler.sql
+DROP TABLE IF EXISTS rfb_agendamentos;
+DROP INDEX IF EXISTS idx_rfb_requests_next_attempt;
+ALTER TABLE rfb_requests
+    DROP COLUMN IF EXISTS error_retryable,
+    DROP COLUMN IF EXISTS next_attempt_at,
+    DROP COLUMN IF EXISTS download_attempts,
+    DROP COLUMN IF EXISTS origem;
@@ -0,0 +1,62 @@
+-- Migration 075: polling, novas tentativas e agenda das solicitações à RFB
+--
+-- Uma solicitação cujo webhook nunca chega ficava em 'requested' para sempre,
+-- e um erro de token ou de download exigia ação manual. O scheduler do backend
+-- (worker/rfb_scheduler.go) agora:
+--   * tenta o download sozinho quando o webhook não chega (next_attempt_at);
+--   * repete erros temporários (TOKEN_ERROR, HTTP 5xx/429, falha de rede) com
+--     backoff exponencial — error_retryable marca os que ainda serão repetidos,
+--     download_attempts conta as falhas;
+--   * não repete erros definitivos (403 CNPJ divergente, tíquete já baixado);
+--   * expira solicitações antigas demais (error_code = 'EXPIRED');
+--   * solicita uma nova apuração conforme rfb_agendamentos.
+--
+-- rfb_agendamentos — agenda por empresa, mesma convenção de report_subscriptions:
+--   frequencia : mensal (dia = 1..28) ou semanal (dia = 0..6, domingo = 0)
+--   hora       : horário de Brasília (0..23)
+--   next_run_at: próxima solicitação; o scheduler só lê esta coluna
+--   falhas     : erros temporários seguidos; enquanto houver, next_run_at é a
+--                próxima tentativa (backoff) e não a próxima data da agenda
+
+ALTER TABLE rfb_requests
+    ADD COLUMN IF NOT EXISTS origem VARCHAR(20) NOT NULL DEFAULT 'manual',
+    ADD COLUMN IF NOT EXISTS download_attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS error_retryable BOOLEAN NOT NULL DEFAULT false;
+
+COMMENT ON COLUMN rfb_requests.origem IS 'manual (tela) ou agendada (rfb_agendamentos)';
+COMMENT ON COLUMN rfb_requests.download_attempts IS 'Falhas temporárias de token/download já ocorridas';
+COMMENT ON COLUMN rfb_requests.next_attempt_at IS 'Quando o scheduler tenta de novo (polling ou retry)';
+COMMENT ON COLUMN rfb_requests.error_retryable IS 'Erro temporário que o scheduler ainda vai repetir';
+
+-- Solicitações em aberto: o polling começa pela idade de cada uma
+UPDATE rfb_requests SET next_attempt_at = created_at + INTERVAL '30 minutes'
+WHERE status IN ('requested', 'webhook_received') AND next_attempt_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_rfb_requests_next_attempt
+    ON rfb_requests(next_attempt_at)
+    WHERE status IN ('requested', 'webhook_received', 'downloading', 'error');
+
+CREATE TABLE IF NOT EXISTS rfb_agendamentos (
+    id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id       UUID NOT NULL UNIQUE REFERENCES companies(id) ON DELETE CASCADE,
+    frequencia       VARCHAR(20) NOT NULL CHECK (frequencia IN ('mensal', 'semanal')),
+    dia              INT NOT NULL DEFAULT 1,
+    hora             INT NOT NULL DEFAULT 6 CHECK (hora BETWEEN 0 AND 23),
+    ativo            BOOLEAN NOT NULL DEFAULT true,
+    next_run_at      TIMESTAMP WITH TIME ZONE,
+    last_run_at      TIMESTAMP WITH TIME ZONE,
+    last_request_id  UUID REFERENCES rfb_requests(id) ON DELETE SET NULL,
+    last_error       TEXT,
+    falhas           INT NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (frequencia <> 'mensal'  OR dia BETWEEN 1 AND 28),
+    CHECK (frequencia <> 'semanal' OR dia BETWEEN 0 AND 6)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rfb_agendamentos_due
+    ON rfb_agendamentos(next_run_at) WHERE ativo;
+
+-- Mesma policy de isolamento da migration 065 (tenant_enable_rls)
+SELECT tenant_enable_rls('rfb_agendamentos');
@@ -0,0 +1,3 @@
+-- Reverte 076_rfb_arquivos.sql (os arquivos guardados em partes são perdidos)
+DROP TABLE IF EXISTS rfb_arquivos;
+ALTER TABLE rfb_requests DROP COLUMN IF EXISTS raw_json_bytes;
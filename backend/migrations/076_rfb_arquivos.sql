@@ -0,0 +1,28 @@
+-- Migration 076: arquivo da RFB comprimido e em partes
+--
+-- O JSON da apuração CBS chega a centenas de MB (~298 MB observado). Até aqui
+-- o download inteiro ficava em memória, era gravado num único valor TEXT
+-- (rfb_requests.raw_json) e depois decodificado de uma vez. Agora o download
+-- vai para um arquivo temporário, é guardado comprimido (gzip) em partes de
+-- até 1 MB em rfb_arquivos e os débitos são lidos em streaming.
+--
+-- raw_json continua existindo para as solicitações já baixadas: o
+-- reprocessamento usa rfb_arquivos quando houver partes e, senão, raw_json.
+
+CREATE TABLE IF NOT EXISTS rfb_arquivos (
+    request_id  UUID NOT NULL REFERENCES rfb_requests(id) ON DELETE CASCADE,
+    parte       INT NOT NULL,
+    company_id  UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    dados       BYTEA NOT NULL,
+    PRIMARY KEY (request_id, parte)
+);
+
+ALTER TABLE rfb_requests
+    ADD COLUMN IF NOT EXISTS raw_json_bytes BIGINT;
+
+COMMENT ON TABLE rfb_arquivos IS 'JSON baixado da RFB, gzip, em partes sequenciais (parte 0, 1, ...)';
+COMMENT ON COLUMN rfb_requests.raw_json_bytes IS 'Tamanho do JSON baixado, sem compressão';
+COMMENT ON COLUMN rfb_requests.raw_json IS 'JSON baixado antes da migration 076; os novos ficam em rfb_arquivos';
+
+-- Mesma policy de isolamento da migration 065 (tenant_enable_rls)
+SELECT tenant_enable_rls('rfb_arquivos');
@@ -0,0 +1,3 @@
+-- Reverte 077_rfb_debito_extincoes_eventos.sql (os dados seguem no JSON de rfb_debitos)
+DROP TABLE IF EXISTS rfb_debito_eventos;
+DROP TABLE IF EXISTS rfb_debito_extincoes;
@@ -0,0 +1,78 @@
+-- Migration 077: formas de extinção e eventos dos débitos da RFB em tabelas
+--
+-- rfb_debitos guarda formasExtincao e eventos como JSON bruto, o que impede
+-- somar quanto da CBS foi extinto por pagamento, split payment ou compensação
+-- com créditos, ou acompanhar os eventos dos débitos no tempo. Cada item vira
+-- uma linha:
+--   rfb_debito_extincoes — forma (código/descrição), valor e data da extinção
+--   rfb_debito_eventos   — evento (código/descrição), data, valor de CBS e o
+--                          documento a que se refere (chave do DF-e/protocolo)
+-- request_id é repetido para agregar e apagar por solicitação sem join.
+--
+-- As colunas JSON de rfb_debitos continuam sendo gravadas. Os débitos já
+-- importados são convertidos aqui mesmo; itens com formato inesperado ficam
+-- só no JSON.
+
+CREATE TABLE IF NOT EXISTS rfb_debito_extincoes (
+    id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    debito_id        UUID NOT NULL REFERENCES rfb_debitos(id) ON DELETE CASCADE,
+    request_id       UUID NOT NULL REFERENCES rfb_requests(id) ON DELETE CASCADE,
+    company_id       UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    codigo_forma     VARCHAR(20),
+    descricao_forma  VARCHAR(200),
+    valor_extinto    DECIMAL(18,2),
+    data_extincao    TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_rfb_debito_extincoes_debito ON rfb_debito_extincoes(debito_id);
+CREATE INDEX IF NOT EXISTS idx_rfb_debito_extincoes_request ON rfb_debito_extincoes(request_id, codigo_forma);
+
+CREATE TABLE IF NOT EXISTS rfb_debito_eventos (
+    id                UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    debito_id         UUID NOT NULL REFERENCES rfb_debitos(id) ON DELETE CASCADE,
+    request_id        UUID NOT NULL REFERENCES rfb_requests(id) ON DELETE CASCADE,
+    company_id        UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    codigo_evento     VARCHAR(20),
+    descricao_evento  VARCHAR(200),
+    data_evento       TIMESTAMP WITH TIME ZONE,
+    valor_cbs         DECIMAL(18,2),
+    chave_dfe         VARCHAR(50),
+    protocolo         VARCHAR(50)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rfb_debito_eventos_debito ON rfb_debito_eventos(debito_id);
+CREATE INDEX IF NOT EXISTS idx_rfb_debito_eventos_request ON rfb_debito_eventos(request_id, codigo_evento);
+CREATE INDEX IF NOT EXISTS idx_rfb_debito_eventos_data ON rfb_debito_eventos(company_id, data_evento);
+
+-- Conversão dos débitos já importados. Datas sem fuso são UTC, como no
+-- importador; datas e valores fora do formato viram NULL.
+INSERT INTO rfb_debito_extincoes (debito_id, request_id, company_id, codigo_forma, descricao_forma, valor_extinto, data_extincao)
+SELECT d.id, d.request_id, d.company_id,
+       left(f->>'codigoFormaExtincao', 20), left(f->>'descricaoFormaExtincao', 200),
+       CASE WHEN jsonb_typeof(f->'valorExtinto') = 'number' THEN (f->>'valorExtinto')::numeric END,
+       CASE WHEN f->>'dataExtincao' ~ '^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})$'
+            THEN (f->>'dataExtincao')::timestamptz
+            WHEN f->>'dataExtincao' ~ '^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?$'
+            THEN (f->>'dataExtincao')::timestamp AT TIME ZONE 'UTC' END
+FROM rfb_debitos d
+CROSS JOIN LATERAL jsonb_array_elements(d.formas_extincao) f
+WHERE jsonb_typeof(d.formas_extincao) = 'array' AND jsonb_typeof(f) = 'object'
+  AND NOT EXISTS (SELECT 1 FROM rfb_debito_extincoes x WHERE x.debito_id = d.id);
+
+INSERT INTO rfb_debito_eventos (debito_id, request_id, company_id, codigo_evento, descricao_evento, data_evento, valor_cbs, chave_dfe, protocolo)
+SELECT d.id, d.request_id, d.company_id,
+       left(e->>'codigoEvento', 20), left(e->>'descricaoEvento', 200),
+       CASE WHEN e->>'dataEvento' ~ '^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})$'
+            THEN (e->>'dataEvento')::timestamptz
+            WHEN e->>'dataEvento' ~ '^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?$'
+            THEN (e->>'dataEvento')::timestamp AT TIME ZONE 'UTC' END,
+       CASE WHEN jsonb_typeof(e->'valorCBS') = 'number' THEN (e->>'valorCBS')::numeric END,
+       left(e->>'chaveDfe', 50), left(e->>'numeroProtocolo', 50)
+FROM rfb_debitos d
+CROSS JOIN LATERAL jsonb_array_elements(d.eventos) e
+WHERE jsonb_typeof(d.eventos) = 'array' AND jsonb_typeof(e) = 'object'
+  AND NOT EXISTS (SELECT 1 FROM rfb_debito_eventos x WHERE x.debito_id = d.id);
+
+-- Mesma policy de isolamento da migration 065 (tenant_enable_rls)
+SELECT tenant_enable_rls('rfb_debito_extincoes');
+SELECT tenant_enable_rls('rfb_debito_eventos');
@@ -0,0 +1,25 @@
+-- Reverte 078_rfb_credentials_multiplas.sql. Mantém uma credencial por empresa
+-- (a mais antiga) e descarta as de certificado sem client_secret.
+ALTER TABLE rfb_requests DROP COLUMN IF EXISTS credential_id;
+
+DELETE FROM rfb_credentials WHERE client_secret IS NULL;
+DELETE FROM rfb_credentials c
+WHERE EXISTS (
+    SELECT 1 FROM rfb_credentials o
+    WHERE o.company_id = c.company_id AND (o.created_at, o.id) < (c.created_at, c.id)
+);
+
+DROP INDEX IF EXISTS idx_rfb_credentials_validade;
+DROP INDEX IF EXISTS idx_rfb_credentials_company_base_ambiente;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rfb_credentials_company_id ON rfb_credentials(company_id);
+
+ALTER TABLE rfb_credentials ALTER COLUMN client_secret SET NOT NULL;
+ALTER TABLE rfb_credentials
+    DROP COLUMN IF EXISTS certificado_validade,
+    DROP COLUMN IF EXISTS certificado_emissor,
+    DROP COLUMN IF EXISTS certificado_cnpj,
+    DROP COLUMN IF EXISTS certificado_titular,
+    DROP COLUMN IF EXISTS certificado_senha,
+    DROP COLUMN IF EXISTS certificado_pfx,
+    DROP COLUMN IF EXISTS auth_tipo,
+    DROP COLUMN IF EXISTS cnpj_base;
@@ -0,0 +1,45 @@
+-- Migration 078: várias credenciais RFB por empresa e autenticação por certificado A1
+--
+-- Grupos com várias raízes de CNPJ num mesmo cadastro de empresa precisam de
+-- uma credencial por CNPJ base, e a mesma raiz pode ter credenciais de
+-- produção e de produção restrita. A chave passa a ser
+-- (company_id, cnpj_base, ambiente).
+--
+-- auth_tipo:
+--   client_secret — client_id/client_secret em HTTP Basic, como até aqui
+--   certificado   — e-CNPJ A1 (.pfx) apresentado em mTLS; client_secret opcional
+-- O .pfx (em base64) e a senha são gravados cifrados (EncryptField). Titular,
+-- CNPJ, emissor e validade ficam em claro para listar e alertar o vencimento
+-- sem decifrar o arquivo.
+--
+-- rfb_requests.credential_id registra a credencial usada na solicitação, para
+-- que o download use a mesma.
+
+ALTER TABLE rfb_credentials
+    ADD COLUMN IF NOT EXISTS cnpj_base VARCHAR(8),
+    ADD COLUMN IF NOT EXISTS auth_tipo VARCHAR(20) NOT NULL DEFAULT 'client_secret'
+        CHECK (auth_tipo IN ('client_secret', 'certificado')),
+    ADD COLUMN IF NOT EXISTS certificado_pfx TEXT,
+    ADD COLUMN IF NOT EXISTS certificado_senha TEXT,
+    ADD COLUMN IF NOT EXISTS certificado_titular VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS certificado_cnpj VARCHAR(14),
+    ADD COLUMN IF NOT EXISTS certificado_emissor VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS certificado_validade TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE rfb_credentials ALTER COLUMN client_secret DROP NOT NULL;
+
+UPDATE rfb_credentials SET cnpj_base = left(cnpj_matriz, 8) WHERE cnpj_base IS NULL;
+ALTER TABLE rfb_credentials ALTER COLUMN cnpj_base SET NOT NULL;
+
+DROP INDEX IF EXISTS idx_rfb_credentials_company_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rfb_credentials_company_base_ambiente
+    ON rfb_credentials(company_id, cnpj_base, ambiente);
+CREATE INDEX IF NOT EXISTS idx_rfb_credentials_validade
+    ON rfb_credentials(certificado_validade) WHERE auth_tipo = 'certificado';
+
+ALTER TABLE rfb_requests
+    ADD COLUMN IF NOT EXISTS credential_id UUID REFERENCES rfb_credentials(id) ON DELETE SET NULL;
+
+UPDATE rfb_requests r SET credential_id = c.id
+FROM rfb_credentials c
+WHERE r.credential_id IS NULL AND c.company_id = r.company_id AND c.cnpj_base = r.cnpj_base;
@@ -0,0 +1,19 @@
+-- Reverte 079_rfb_resumo_historico.sql, mantendo só a versão atual de cada período
+DROP INDEX IF EXISTS idx_rfb_resumo_atual;
+DELETE FROM rfb_resumo WHERE NOT atual;
+DELETE FROM rfb_resumo rs
+WHERE EXISTS (
+    SELECT 1 FROM rfb_resumo o
+    WHERE o.company_id = rs.company_id AND o.data_apuracao IS NOT DISTINCT FROM rs.data_apuracao
+      AND (o.created_at, o.id) > (rs.created_at, rs.id)
+);
+DROP INDEX IF EXISTS idx_rfb_resumo_company_periodo;
+DROP INDEX IF EXISTS idx_rfb_resumo_request;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rfb_resumo_company_periodo ON rfb_resumo(company_id, data_apuracao);
+
+DROP VIEW IF EXISTS ai_sandbox.rfb_resumo;
+ALTER TABLE rfb_resumo DROP COLUMN IF EXISTS atual, DROP COLUMN IF EXISTS cnpj_base;
+SELECT ai_sandbox_create_views();
+
+COMMENT ON TABLE rfb_resumo IS 'Totais da apuração CBS da Receita Federal por período.';
+COMMENT ON TABLE rfb_debitos IS 'Débitos de CBS por documento fiscal, conforme a apuração oficial da Receita Federal.';
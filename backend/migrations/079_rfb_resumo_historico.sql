@@ -0,0 +1,64 @@
+-- Migration 079: histórico das apurações da RFB
+--
+-- rfb_resumo era único por (company_id, data_apuracao): cada nova solicitação
+-- do mesmo período sobrescrevia o resumo anterior (e duas raízes de CNPJ da
+-- mesma empresa disputavam a mesma linha). Os débitos já eram guardados por
+-- solicitação; agora o resumo também é, um por request_id, e cada versão da
+-- apuração pode ser consultada e comparada.
+--
+-- atual marca a versão mais recente (pela data da solicitação) de cada
+-- (company_id, cnpj_base, data_apuracao). Quem quer só o retrato vigente —
+-- relatórios, IA — filtra WHERE atual.
+--
+-- Os resumos sobrescritos são reconstruídos a partir de rfb_debitos.
+
+ALTER TABLE rfb_resumo
+    ADD COLUMN IF NOT EXISTS cnpj_base VARCHAR(8),
+    ADD COLUMN IF NOT EXISTS atual BOOLEAN NOT NULL DEFAULT false;
+
+UPDATE rfb_resumo rs SET cnpj_base = r.cnpj_base
+FROM rfb_requests r
+WHERE r.id = rs.request_id AND rs.cnpj_base IS NULL;
+
+UPDATE rfb_resumo SET data_apuracao = NULL WHERE data_apuracao = '';
+
+DROP INDEX IF EXISTS idx_rfb_resumo_company_periodo;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rfb_resumo_request ON rfb_resumo(request_id);
+CREATE INDEX IF NOT EXISTS idx_rfb_resumo_company_periodo ON rfb_resumo(company_id, data_apuracao DESC, cnpj_base);
+
+-- Resumos perdidos: solicitações com débitos e sem linha em rfb_resumo
+INSERT INTO rfb_resumo (request_id, company_id, cnpj_base, data_apuracao, total_debitos,
+    valor_cbs_total, valor_cbs_extinto, valor_cbs_nao_extinto,
+    total_corrente, total_ajuste, total_extemporaneo, created_at)
+SELECT d.request_id, r.company_id, r.cnpj_base,
+       NULLIF(MAX(d.data_apuracao) FILTER (WHERE d.tipo_apuracao = 'corrente'), ''),
+       COUNT(*),
+       COALESCE(SUM(d.valor_cbs_total), 0), COALESCE(SUM(d.valor_cbs_extinto), 0), COALESCE(SUM(d.valor_cbs_nao_extinto), 0),
+       COUNT(*) FILTER (WHERE d.tipo_apuracao = 'corrente'),
+       COUNT(*) FILTER (WHERE d.tipo_apuracao = 'ajuste'),
+       COUNT(*) FILTER (WHERE d.tipo_apuracao = 'extemporaneo'),
+       r.updated_at
+FROM rfb_debitos d
+JOIN rfb_requests r ON r.id = d.request_id
+WHERE NOT EXISTS (SELECT 1 FROM rfb_resumo rs WHERE rs.request_id = d.request_id)
+GROUP BY d.request_id, r.company_id, r.cnpj_base, r.updated_at;
+
+UPDATE rfb_resumo SET atual = true
+WHERE id IN (
+    SELECT DISTINCT ON (rs.company_id, rs.cnpj_base, rs.data_apuracao) rs.id
+    FROM rfb_resumo rs
+    JOIN rfb_requests r ON r.id = rs.request_id
+    WHERE rs.data_apuracao IS NOT NULL
+    ORDER BY rs.company_id, rs.cnpj_base, rs.data_apuracao, r.created_at DESC, rs.id DESC
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rfb_resumo_atual
+    ON rfb_resumo(company_id, cnpj_base, data_apuracao) WHERE atual;
+
+-- As views do sandbox da IA (SELECT *) passam a expor as novas colunas
+SELECT ai_sandbox_create_views();
+
+COMMENT ON TABLE rfb_resumo IS 'Totais de cada apuração CBS baixada da Receita Federal (uma linha por solicitação; o mesmo período pode ter várias versões). Para o retrato vigente use WHERE atual.';
+COMMENT ON COLUMN rfb_resumo.atual IS 'true = versão mais recente da apuração do período (por cnpj_base); filtre por ela para não somar versões';
+COMMENT ON COLUMN rfb_resumo.cnpj_base IS 'raiz (8 dígitos) do CNPJ apurado';
+COMMENT ON TABLE rfb_debitos IS 'Débitos de CBS por documento fiscal, conforme a apuração oficial da Receita Federal. Cada solicitação traz sua própria cópia: para o retrato vigente use request_id IN (SELECT request_id FROM rfb_resumo WHERE atual).';
@@ -0,0 +1,4 @@
+-- Reverte 080_segredos_cifrados.sql (client_secret continua TEXT: valores com
+-- prefixo podem não caber mais em VARCHAR(255))
+DROP TRIGGER IF EXISTS trg_rfb_credentials_cifrado ON rfb_credentials;
+DROP FUNCTION IF EXISTS exigir_cifrado();
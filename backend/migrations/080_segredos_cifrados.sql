@@ -0,0 +1,45 @@
+-- Migration 080: segredos sempre cifrados, com versão de chave
+--
+-- Os valores cifrados passam a levar o id da chave na frente
+-- ("k1:<base64>"; ver backend/secrets). O trigger exigir_cifrado() recusa
+-- gravar nas colunas de segredo qualquer valor novo fora desse formato, de
+-- modo que nem um INSERT manual guarda texto puro. Valores antigos (sem
+-- prefixo) continuam legíveis e são regravados por `server secrets rotate`;
+-- o trigger só olha valores que mudaram.
+--
+-- Nova coluna cifrada: inclua-a em secrets.Columns e nos argumentos do
+-- trigger da tabela.
+
+-- O prefixo da chave não cabe em client_secret VARCHAR(255) com segredos longos
+ALTER TABLE rfb_credentials ALTER COLUMN client_secret TYPE TEXT;
+
+CREATE OR REPLACE FUNCTION exigir_cifrado() RETURNS TRIGGER
+LANGUAGE plpgsql AS $$
+DECLARE
+    col TEXT;
+    novo TEXT;
+BEGIN
+    FOREACH col IN ARRAY TG_ARGV LOOP
+        novo := to_jsonb(NEW) ->> col;
+        IF novo IS NULL THEN
+            CONTINUE;
+        END IF;
+        IF TG_OP = 'UPDATE' AND novo IS NOT DISTINCT FROM (to_jsonb(OLD) ->> col) THEN
+            CONTINUE;
+        END IF;
+        IF novo !~ '^[A-Za-z0-9_-]{1,16}:[A-Za-z0-9+/]+={0,2}$' THEN
+            RAISE EXCEPTION '%.% deve ser gravado cifrado (secrets.Encrypt)', TG_TABLE_NAME, col
+                USING ERRCODE = 'check_violation';
+        END IF;
+    END LOOP;
+    RETURN NEW;
+END;
+$$;
+
+COMMENT ON FUNCTION exigir_cifrado() IS
+    'Trigger: recusa valores novos fora do formato "<id da chave>:<base64>" nas colunas passadas como argumento';
+
+DROP TRIGGER IF EXISTS trg_rfb_credentials_cifrado ON rfb_credentials;
+CREATE TRIGGER trg_rfb_credentials_cifrado
+    BEFORE INSERT OR UPDATE ON rfb_credentials
+    FOR EACH ROW EXECUTE FUNCTION exigir_cifrado('client_secret', 'certificado_pfx', 'certificado_senha');
@@ -0,0 +1,55 @@
+-- Reverte 081_ai_sandbox_login.sql: views voltam a filtrar por app.company_id
+-- e a aplicação volta a assumir fb_ai_reader via SET ROLE.
+CREATE OR REPLACE FUNCTION ai_sandbox_create_views() RETURNS void
+LANGUAGE plpgsql AS $$
+DECLARE
+    t TEXT;
+BEGIN
+    -- Views com todas as colunas, filtradas por company_id
+    FOREACH t IN ARRAY ARRAY[
+        'mv_mercadorias_agregada', 'mv_compras_fornecedores', 'mv_operacoes_simples',
+        'operacoes_comerciais', 'participants',
+        'nfe_saidas', 'nfe_entradas', 'cte_entradas',
+        'rfb_debitos', 'rfb_resumo'
+    ] LOOP
+        IF to_regclass('public.' || t) IS NULL THEN
+            CONTINUE;
+        END IF;
+        EXECUTE format(
+            'CREATE OR REPLACE VIEW ai_sandbox.%I WITH (security_barrier = true) AS
+               SELECT * FROM public.%I WHERE company_id = app_current_company_id()', t, t);
+    END LOOP;
+
+    -- import_jobs: só metadados do SPED (sem arquivo, mensagens ou estado da fila)
+    CREATE OR REPLACE VIEW ai_sandbox.import_jobs WITH (security_barrier = true) AS
+        SELECT id, company_id, company_name, cnpj, mes_ano AS periodo, dt_ini, dt_fin, status, created_at
+        FROM public.import_jobs
+        WHERE company_id = app_current_company_id();
+
+    -- Alíquotas são globais (não pertencem a nenhuma empresa)
+    IF to_regclass('public.tabela_aliquotas') IS NOT NULL THEN
+        CREATE OR REPLACE VIEW ai_sandbox.tabela_aliquotas AS
+            SELECT * FROM public.tabela_aliquotas;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_ai_reader') THEN
+        GRANT SELECT ON ALL TABLES IN SCHEMA ai_sandbox TO fb_ai_reader;
+    END IF;
+END;
+$$;
+
+SELECT ai_sandbox_create_views();
+
+DROP FUNCTION IF EXISTS ai_sandbox.company_id();
+DROP TABLE IF EXISTS ai_sandbox_sessoes;
+
+DO $$
+BEGIN
+    GRANT USAGE ON SCHEMA public TO PUBLIC;
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_ai_reader') THEN
+        ALTER ROLE fb_ai_reader NOLOGIN;
+        EXECUTE format('GRANT fb_ai_reader TO %I', current_user);
+    END IF;
+EXCEPTION WHEN insufficient_privilege THEN
+    RAISE WARNING 'Sem privilégio para restaurar o role fb_ai_reader / o acesso de PUBLIC ao schema public.';
+END $$;
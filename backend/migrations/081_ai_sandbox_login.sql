@@ -0,0 +1,114 @@
+-- Migration 081: sandbox da IA com login próprio e empresa vinculada à conexão
+--
+-- Até aqui o SQL do modelo rodava na conexão da aplicação após
+-- SET LOCAL ROLE fb_ai_reader, e as views filtravam por app.company_id. Os dois
+-- podiam ser desfeitos pelo próprio SQL: set_config('role', 'none', true) volta
+-- ao dono das tabelas e set_config('app.company_id', ...) troca de empresa — a
+-- lista de palavras proibidas em ai_query.go não é barreira (U&"..." a contorna).
+-- Esta migration:
+--   1. torna fb_ai_reader um role LOGIN sem participação em nenhum outro role:
+--      o sandbox conecta com ele (AI_SANDBOX_DATABASE_URL) e não há role para
+--      onde voltar. A senha é definida pelo DBA:
+--        ALTER ROLE fb_ai_reader PASSWORD '...';
+--   2. cria ai_sandbox_sessoes: a aplicação (dono) grava a empresa da consulta
+--      para o pid da conexão do sandbox, que não pode alterá-la (transação
+--      READ ONLY e nenhum privilégio na tabela);
+--   3. filtra as views por ai_sandbox.company_id(), lida dessa tabela;
+--   4. revoga o USAGE de PUBLIC no schema public: fb_ai_reader só alcança
+--      ai_sandbox. fb_tenant (065) e o dono mantêm o acesso.
+
+-- ── 1. Empresa vinculada à conexão do sandbox ────────────────────────────────
+CREATE TABLE IF NOT EXISTS ai_sandbox_sessoes (
+    pid        INT PRIMARY KEY,
+    company_id UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    criado_em  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMENT ON TABLE ai_sandbox_sessoes IS
+    'Empresa da consulta em andamento em cada conexão do sandbox da IA (pid), gravada por handlers.runSandboxedQuery';
+
+CREATE OR REPLACE FUNCTION ai_sandbox.company_id() RETURNS UUID
+LANGUAGE sql STABLE SECURITY DEFINER
+SET search_path = pg_catalog, public AS $$
+    SELECT company_id FROM public.ai_sandbox_sessoes WHERE pid = pg_backend_pid()
+$$;
+
+COMMENT ON FUNCTION ai_sandbox.company_id() IS
+    'Empresa vinculada à conexão corrente do sandbox (NULL = nenhuma linha visível)';
+
+REVOKE ALL ON FUNCTION ai_sandbox.company_id() FROM PUBLIC;
+
+-- ── 2. Views filtradas pela empresa da conexão ───────────────────────────────
+CREATE OR REPLACE FUNCTION ai_sandbox_create_views() RETURNS void
+LANGUAGE plpgsql AS $$
+DECLARE
+    t TEXT;
+BEGIN
+    -- Views com todas as colunas, filtradas por company_id
+    FOREACH t IN ARRAY ARRAY[
+        'mv_mercadorias_agregada', 'mv_compras_fornecedores', 'mv_operacoes_simples',
+        'operacoes_comerciais', 'participants',
+        'nfe_saidas', 'nfe_entradas', 'cte_entradas',
+        'rfb_debitos', 'rfb_resumo'
+    ] LOOP
+        IF to_regclass('public.' || t) IS NULL THEN
+            CONTINUE;
+        END IF;
+        EXECUTE format(
+            'CREATE OR REPLACE VIEW ai_sandbox.%I WITH (security_barrier = true) AS
+               SELECT * FROM public.%I WHERE company_id = ai_sandbox.company_id()', t, t);
+    END LOOP;
+
+    -- import_jobs: só metadados do SPED (sem arquivo, mensagens ou estado da fila)
+    CREATE OR REPLACE VIEW ai_sandbox.import_jobs WITH (security_barrier = true) AS
+        SELECT id, company_id, company_name, cnpj, mes_ano AS periodo, dt_ini, dt_fin, status, created_at
+        FROM public.import_jobs
+        WHERE company_id = ai_sandbox.company_id();
+
+    -- Alíquotas são globais (não pertencem a nenhuma empresa)
+    IF to_regclass('public.tabela_aliquotas') IS NOT NULL THEN
+        CREATE OR REPLACE VIEW ai_sandbox.tabela_aliquotas AS
+            SELECT * FROM public.tabela_aliquotas;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_ai_reader') THEN
+        GRANT SELECT ON ALL TABLES IN SCHEMA ai_sandbox TO fb_ai_reader;
+        GRANT EXECUTE ON FUNCTION ai_sandbox.company_id() TO fb_ai_reader;
+    END IF;
+END;
+$$;
+
+SELECT ai_sandbox_create_views();
+
+-- ── 3. fb_ai_reader: login próprio, sem caminho de volta ─────────────────────
+DO $$
+DECLARE
+    g TEXT;
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_ai_reader') THEN
+        RETURN;
+    END IF;
+    ALTER ROLE fb_ai_reader LOGIN NOINHERIT NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION NOBYPASSRLS;
+    -- Nenhum role para onde SET ROLE / set_config('role', ...) possa ir
+    FOR g IN
+        SELECT r.rolname FROM pg_auth_members m JOIN pg_roles r ON r.oid = m.roleid
+        WHERE m.member = (SELECT oid FROM pg_roles WHERE rolname = 'fb_ai_reader')
+    LOOP
+        EXECUTE format('REVOKE %I FROM fb_ai_reader', g);
+    END LOOP;
+    -- A aplicação não assume mais o role (conecta como ele)
+    EXECUTE format('REVOKE fb_ai_reader FROM %I', current_user);
+EXCEPTION WHEN insufficient_privilege THEN
+    RAISE WARNING 'Sem privilégio para ajustar o role fb_ai_reader: /api/ai/query ficará indisponível até um DBA executar esta etapa.';
+END $$;
+
+-- ── 4. Schema public fora do alcance de PUBLIC ───────────────────────────────
+DO $$
+BEGIN
+    REVOKE ALL ON SCHEMA public FROM PUBLIC;
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_tenant') THEN
+        GRANT USAGE ON SCHEMA public TO fb_tenant;
+    END IF;
+EXCEPTION WHEN insufficient_privilege THEN
+    RAISE WARNING 'Sem privilégio para revogar o acesso de PUBLIC ao schema public: um DBA deve executar REVOKE ALL ON SCHEMA public FROM PUBLIC.';
+END $$;
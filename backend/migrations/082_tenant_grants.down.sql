@@ -0,0 +1,12 @@
+-- Reverte 082_tenant_grants.sql: fb_tenant volta a ter DML em todas as tabelas
+-- do schema public, como na 065.
+DROP FUNCTION IF EXISTS tenant_grant_tables();
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_tenant') THEN
+        GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO fb_tenant;
+        ALTER DEFAULT PRIVILEGES IN SCHEMA public
+            GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO fb_tenant;
+    END IF;
+END $$;
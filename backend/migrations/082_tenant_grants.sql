@@ -0,0 +1,55 @@
+-- Migration 082: fb_tenant só alcança as tabelas isoladas por empresa
+--
+-- A 065 concedeu SELECT/INSERT/UPDATE/DELETE em TODAS as tabelas do schema
+-- public (e em todas as futuras, via default privileges). Como só parte delas
+-- tem policy, uma requisição com o role fb_tenant ainda lia e alterava users,
+-- environments, rfb_webhook_deliveries, email_outbox... de qualquer empresa.
+-- Agora:
+--   * DML apenas nas tabelas com a policy tenant_isolation;
+--   * companies: só SELECT (a policy da 065 é só USING);
+--   * tabelas de referência globais e views materializadas (que não aceitam
+--     RLS e já filtram por company_id nas consultas): só SELECT.
+-- tenant_grant_tables() reaplica as concessões; migrations que criarem tabelas
+-- com policy devem chamá-la ao final.
+
+CREATE OR REPLACE FUNCTION tenant_grant_tables() RETURNS void
+LANGUAGE plpgsql AS $$
+DECLARE
+    t TEXT;
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_tenant') THEN
+        RETURN;
+    END IF;
+
+    FOR t IN
+        SELECT DISTINCT tablename FROM pg_policies
+        WHERE schemaname = 'public' AND policyname = 'tenant_isolation' AND tablename <> 'companies'
+    LOOP
+        EXECUTE format('GRANT SELECT, INSERT, UPDATE, DELETE ON public.%I TO fb_tenant', t);
+    END LOOP;
+
+    GRANT SELECT ON public.companies TO fb_tenant;
+
+    -- Referência global (alíquotas, CFOP, fornecedores do Simples)
+    FOREACH t IN ARRAY ARRAY['tabela_aliquotas', 'cfop', 'forn_simples'] LOOP
+        IF to_regclass('public.' || t) IS NOT NULL THEN
+            EXECUTE format('GRANT SELECT ON public.%I TO fb_tenant', t);
+        END IF;
+    END LOOP;
+
+    FOR t IN SELECT matviewname FROM pg_matviews WHERE schemaname = 'public' LOOP
+        EXECUTE format('GRANT SELECT ON public.%I TO fb_tenant', t);
+    END LOOP;
+END;
+$$;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_tenant') THEN
+        RETURN;
+    END IF;
+    ALTER DEFAULT PRIVILEGES IN SCHEMA public
+        REVOKE SELECT, INSERT, UPDATE, DELETE ON TABLES FROM fb_tenant;
+    REVOKE ALL ON ALL TABLES IN SCHEMA public FROM fb_tenant;
+    PERFORM tenant_grant_tables();
+END $$;
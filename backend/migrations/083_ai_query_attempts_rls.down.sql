@@ -0,0 +1,10 @@
+-- Reverte 083_ai_query_attempts_rls.sql
+DROP POLICY IF EXISTS tenant_isolation ON ai_query_attempts;
+ALTER TABLE ai_query_attempts DISABLE ROW LEVEL SECURITY;
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fb_tenant') THEN
+        REVOKE ALL ON ai_query_attempts FROM fb_tenant;
+    END IF;
+END $$;
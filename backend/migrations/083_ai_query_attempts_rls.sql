@@ -0,0 +1,10 @@
+-- Migration 083: isolamento por empresa em ai_query_attempts
+--
+-- A 069 criou o log de tentativas do text-to-SQL com company_id, mas sem a
+-- policy da 065: GET /api/admin/ai-query-failures dependia só do filtro no
+-- handler. Agora a tabela tem a mesma policy das demais e fb_tenant recebe
+-- acesso a ela. Tentativas sem company_id ficam visíveis apenas ao role dono
+-- (worker, manutenção). A gravação continua com o role dono.
+
+SELECT tenant_enable_rls('ai_query_attempts');
+SELECT tenant_grant_tables();
@@ -0,0 +1,212 @@
+// Package pdf writes small PDF 1.4 documents: A4 pages with text in the
+// standard Helvetica fonts, filled rectangles and lines. Nothing is embedded;
+// text is encoded as WinAnsi (Windows-1252), which covers Portuguese.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// A4 in points. Coordinates passed to Document methods have the origin at the
+// top-left corner of the page, y growing downwards.
+const (
+	PageWidth  = 595.28
+	PageHeight = 841.89
+)
+
+// Color is an RGB color.
+type Color struct{ R, G, B uint8 }
+
+// Hex parses "#rrggbb"; anything else yields black.
+func Hex(s string) Color {
+	var c Color
+	fmt.Sscanf(strings.TrimPrefix(s, "#"), "%02x%02x%02x", &c.R, &c.G, &c.B)
+	return c
+}
+
+func (c Color) operands() string {
+	return fmt.Sprintf("%.3f %.3f %.3f", float64(c.R)/255, float64(c.G)/255, float64(c.B)/255)
+}
+
+// Document is a PDF under construction. Drawing goes to the current page;
+// SetPage returns to an earlier one (e.g. to write "page X of Y" footers).
+type Document struct {
+	pages   []*bytes.Buffer
+	cur     int
+	bold    bool
+	size    float64
+	color   Color
+	title   string
+	author  string
+	created time.Time
+}
+
+// New returns an empty document with Helvetica 10pt selected.
+func New() *Document {
+	return &Document{cur: -1, size: 10, created: time.Now()}
+}
+
+// SetInfo sets the Title and Author entries of the document information.
+func (d *Document) SetInfo(title, author string) {
+	d.title, d.author = title, author
+}
+
+// AddPage appends a blank page and makes it current.
+func (d *Document) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.cur = len(d.pages) - 1
+}
+
+// PageCount returns the number of pages added so far.
+func (d *Document) PageCount() int { return len(d.pages) }
+
+// SetPage makes page n (1-based) current.
+func (d *Document) SetPage(n int) {
+	if n >= 1 && n <= len(d.pages) {
+		d.cur = n - 1
+	}
+}
+
+// SetFont selects Helvetica or Helvetica-Bold at size points.
+func (d *Document) SetFont(bold bool, size float64) {
+	d.bold, d.size = bold, size
+}
+
+// FontSize returns the current font size.
+func (d *Document) FontSize() float64 { return d.size }
+
+// SetTextColor sets the color used by Text.
+func (d *Document) SetTextColor(c Color) { d.color = c }
+
+// TextWidth returns the width of s in points with the current font.
+func (d *Document) TextWidth(s string) float64 {
+	var w float64
+	for _, r := range s {
+		if _, ok := winAnsi(r); ok {
+			w += glyphWidth(r, d.bold)
+		}
+	}
+	return w * d.size / 1000
+}
+
+// Text draws s with its baseline at (x, y).
+func (d *Document) Text(x, y float64, s string) {
+	font := "F1"
+	if d.bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page(), "BT /%s %.2f Tf %s rg %.2f %.2f Td (%s) Tj ET\n",
+		font, d.size, d.color.operands(), x, PageHeight-y, encodeText(s))
+}
+
+// FillRect fills the rectangle whose top-left corner is (x, y).
+func (d *Document) FillRect(x, y, w, h float64, c Color) {
+	fmt.Fprintf(d.page(), "q %s rg %.2f %.2f %.2f %.2f re f Q\n", c.operands(), x, PageHeight-y-h, w, h)
+}
+
+// Line strokes a line from (x1, y1) to (x2, y2).
+func (d *Document) Line(x1, y1, x2, y2, width float64, c Color) {
+	fmt.Fprintf(d.page(), "q %s RG %.2f w %.2f %.2f m %.2f %.2f l S Q\n",
+		c.operands(), width, x1, PageHeight-y1, x2, PageHeight-y2)
+}
+
+func (d *Document) page() *bytes.Buffer {
+	if d.cur < 0 {
+		d.AddPage()
+	}
+	return d.pages[d.cur]
+}
+
+// Bytes serializes the document.
+func (d *Document) Bytes() ([]byte, error) {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+
+	var out bytes.Buffer
+	offsets := []int{0} // object 0 is the free-list head
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets)-1, body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// 1 catalog, 2 page tree, 3-4 fonts, 5 info, then page/content pairs
+	const firstPage = 6
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	obj(fmt.Sprintf("<< /Title (%s) /Author (%s) /Producer (FBTax Cloud) /CreationDate (D:%s) >>",
+		encodeText(d.title), encodeText(d.author), d.created.Format("20060102150405")))
+
+	for i, content := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			PageWidth, PageHeight, firstPage+2*i+1))
+
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		if _, err := zw.Write(content.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		obj(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", z.Len(), z.Bytes()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets))
+	for _, off := range offsets[1:] {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets), xref)
+	return out.Bytes(), nil
+}
+
+// winAnsi returns the Windows-1252 byte for r. Symbols the standard fonts
+// cannot show (emoji, dingbats, variation selectors) are dropped; any other
+// unknown character becomes '?'.
+func winAnsi(r rune) (byte, bool) {
+	if c, ok := charmap.Windows1252.EncodeRune(r); ok {
+		return c, true
+	}
+	if unicode.IsSymbol(r) || unicode.Is(unicode.Variation_Selector, r) || r == '\u200d' {
+		return 0, false
+	}
+	return '?', true
+}
+
+// encodeText converts s to a WinAnsi PDF string body, escaping delimiters.
+func encodeText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		c, ok := winAnsi(r)
+		if !ok {
+			continue
+		}
+		switch c {
+		case '(', ')', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n', '\r', '\t':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,365 @@
+package pdf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Brand palette, the same as the report emails.
+var (
+	ColorHeader  = Hex("#2d3748")
+	ColorSubtle  = Hex("#cbd5e0")
+	ColorText    = Hex("#333333")
+	ColorMuted   = Hex("#718096")
+	ColorFaint   = Hex("#a0aec0")
+	ColorBorder  = Hex("#e2e8f0")
+	ColorTableTH = Hex("#4a5568")
+	ColorTotal   = Hex("#edf2f7")
+	ColorInfoBg  = Hex("#ebf8ff")
+	ColorInfoBar = Hex("#3182ce")
+	ColorInfo    = Hex("#2c5282")
+)
+
+const (
+	marginX      = 42.0
+	contentWidth = PageWidth - 2*marginX
+	headerHeight = 56.0
+	contentTop   = headerHeight + 24
+	contentEnd   = PageHeight - 48 // footer starts below this line
+)
+
+// Report lays out a branded, paginated report top to bottom: every page gets
+// the header bar, and Bytes adds the "Página X de Y" footers.
+type Report struct {
+	doc      *Document
+	title    string
+	subtitle string
+	footer   string
+	y        float64
+}
+
+// NewReport starts a report whose header shows title and subtitle (usually
+// company and period). footer is printed on the left of every page footer.
+func NewReport(title, subtitle, footer string) *Report {
+	r := &Report{doc: New(), title: title, subtitle: subtitle, footer: footer}
+	r.doc.SetInfo(title+" - "+subtitle, "FBTax Cloud")
+	r.newPage()
+	return r
+}
+
+func (r *Report) newPage() {
+	d := r.doc
+	d.AddPage()
+	d.FillRect(0, 0, PageWidth, headerHeight, ColorHeader)
+	d.SetFont(true, 16)
+	d.SetTextColor(Color{255, 255, 255})
+	d.Text(marginX, 26, "FBTax Cloud")
+	d.SetFont(false, 10)
+	d.SetTextColor(ColorSubtle)
+	d.Text(marginX, 43, truncate(d, r.title+" — "+r.subtitle, contentWidth))
+	r.y = contentTop
+}
+
+// ensure starts a new page unless h points still fit on the current one.
+func (r *Report) ensure(h float64) {
+	if r.y+h > contentEnd {
+		r.newPage()
+	}
+}
+
+// Space adds vertical space.
+func (r *Report) Space(h float64) {
+	r.y += h
+}
+
+// InfoBox draws the highlighted line under the header (empresa, período...).
+func (r *Report) InfoBox(text string) {
+	d := r.doc
+	d.SetFont(false, 9.5)
+	lines := wrap(d, text, contentWidth-24)
+	h := float64(len(lines))*13 + 12
+	r.ensure(h)
+	d.FillRect(marginX, r.y, contentWidth, h, ColorInfoBg)
+	d.FillRect(marginX, r.y, 3, h, ColorInfoBar)
+	d.SetTextColor(ColorInfo)
+	for i, line := range lines {
+		d.Text(marginX+14, r.y+17+float64(i)*13, line)
+	}
+	r.y += h + 14
+}
+
+// Heading draws a section title with a rule under it, the way .sec-title
+// looks in the emails. It never stays alone at the bottom of a page.
+func (r *Report) Heading(text string) {
+	d := r.doc
+	r.ensure(60)
+	r.y += 8
+	d.SetFont(true, 10)
+	d.SetTextColor(ColorMuted)
+	d.Text(marginX, r.y+10, strings.ToUpper(text))
+	d.Line(marginX, r.y+16, marginX+contentWidth, r.y+16, 1.5, ColorBorder)
+	r.y += 26
+}
+
+// Subheading draws a smaller bold title.
+func (r *Report) Subheading(text string) {
+	d := r.doc
+	r.ensure(40)
+	r.y += 4
+	d.SetFont(true, 10.5)
+	d.SetTextColor(ColorHeader)
+	d.Text(marginX, r.y+10, text)
+	r.y += 18
+}
+
+// Paragraph draws wrapped text.
+func (r *Report) Paragraph(text string) {
+	r.paragraph(marginX, contentWidth, text)
+}
+
+// Bullet draws a wrapped list item.
+func (r *Report) Bullet(text string) {
+	d := r.doc
+	d.SetFont(false, 9.5)
+	r.ensure(14)
+	d.SetTextColor(ColorText)
+	d.Text(marginX+6, r.y+10, "•")
+	r.paragraph(marginX+18, contentWidth-18, text)
+}
+
+func (r *Report) paragraph(x, width float64, text string) {
+	d := r.doc
+	d.SetFont(false, 9.5)
+	for _, line := range wrap(d, text, width) {
+		r.ensure(14)
+		d.SetFont(false, 9.5)
+		d.SetTextColor(ColorText)
+		d.Text(x, r.y+10, line)
+		r.y += 14
+	}
+	r.y += 3
+}
+
+// Align is the horizontal alignment of a table column.
+type Align int
+
+const (
+	AlignLeft Align = iota
+	AlignRight
+)
+
+// Table is a grid with a dark header row. Widths are relative (they are
+// scaled to the page width); a nil Widths splits the columns evenly.
+type Table struct {
+	Header []string
+	Widths []float64
+	Align  []Align
+	Rows   []TableRow
+}
+
+// TableRow is one line of a Table; Bold rows get the totals background.
+type TableRow struct {
+	Cells []string
+	Bold  bool
+}
+
+// Table draws t, breaking pages between rows and repeating the header.
+func (r *Report) Table(t Table) {
+	d := r.doc
+	cols := len(t.Header)
+	if cols == 0 && len(t.Rows) > 0 {
+		cols = len(t.Rows[0].Cells)
+	}
+	if cols == 0 {
+		return
+	}
+
+	widths := make([]float64, cols)
+	var total float64
+	for i := range widths {
+		widths[i] = 1
+		if i < len(t.Widths) && t.Widths[i] > 0 {
+			widths[i] = t.Widths[i]
+		}
+		total += widths[i]
+	}
+	for i := range widths {
+		widths[i] = widths[i] / total * contentWidth
+	}
+	align := func(i int) Align {
+		if i < len(t.Align) {
+			return t.Align[i]
+		}
+		return AlignLeft
+	}
+
+	const pad, lineH, size = 6.0, 12.0, 9.0
+	var drawRow func(cells []string, bold, header bool)
+	drawRow = func(cells []string, bold, header bool) {
+		d.SetFont(bold || header, size)
+		wrapped := make([][]string, cols)
+		lines := 1
+		for i := 0; i < cols; i++ {
+			cell := ""
+			if i < len(cells) {
+				cell = cells[i]
+			}
+			wrapped[i] = wrap(d, cell, widths[i]-2*pad)
+			if len(wrapped[i]) > lines {
+				lines = len(wrapped[i])
+			}
+		}
+		h := float64(lines)*lineH + 2*pad
+		if !header && r.y+h > contentEnd {
+			r.newPage()
+			if len(t.Header) > 0 {
+				drawRow(t.Header, true, true)
+			}
+			d.SetFont(bold, size)
+		}
+		switch {
+		case header:
+			d.FillRect(marginX, r.y, contentWidth, h, ColorTableTH)
+			d.SetTextColor(Color{255, 255, 255})
+		case bold:
+			d.FillRect(marginX, r.y, contentWidth, h, ColorTotal)
+			d.SetTextColor(ColorText)
+		default:
+			d.SetTextColor(ColorText)
+		}
+		x := marginX
+		for i := 0; i < cols; i++ {
+			for j, line := range wrapped[i] {
+				tx := x + pad
+				if align(i) == AlignRight {
+					tx = x + widths[i] - pad - d.TextWidth(line)
+				}
+				d.Text(tx, r.y+pad+9+float64(j)*lineH, line)
+			}
+			x += widths[i]
+		}
+		r.y += h
+		if !header {
+			d.Line(marginX, r.y, marginX+contentWidth, r.y, 0.5, ColorBorder)
+		}
+	}
+	if len(t.Header) > 0 {
+		r.ensure(60)
+		drawRow(t.Header, true, true)
+	}
+	for _, row := range t.Rows {
+		drawRow(row.Cells, row.Bold, false)
+	}
+	r.y += 12
+}
+
+// Bar is one bar of a BarChart.
+type Bar struct {
+	Label string
+	Note  string // small text under the bar, e.g. "Regime atual"
+	Value float64
+	Text  string // printed after the bar, e.g. "R$ 1.234,56"
+	Color Color
+}
+
+// BarChart draws horizontal bars scaled to the largest value.
+func (r *Report) BarChart(bars []Bar) {
+	d := r.doc
+	const labelW, barH, rowH = 110.0, 18.0, 34.0
+	r.ensure(rowH*float64(len(bars)) + 8)
+
+	maxVal := 0.0
+	for _, b := range bars {
+		if b.Value > maxVal {
+			maxVal = b.Value
+		}
+	}
+	if maxVal == 0 {
+		maxVal = 1
+	}
+	maxW := contentWidth - labelW - 110
+	for _, b := range bars {
+		w := 0.0
+		if b.Value > 0 {
+			w = b.Value / maxVal * maxW
+			if w < 4 {
+				w = 4
+			}
+		}
+		d.SetFont(true, 9)
+		d.SetTextColor(ColorTableTH)
+		d.Text(marginX, r.y+13, truncate(d, b.Label, labelW-8))
+		d.FillRect(marginX+labelW, r.y, w, barH, b.Color)
+		d.SetTextColor(ColorHeader)
+		d.Text(marginX+labelW+w+6, r.y+13, b.Text)
+		if b.Note != "" {
+			d.SetFont(false, 7.5)
+			d.SetTextColor(ColorFaint)
+			d.Text(marginX+labelW, r.y+barH+9, b.Note)
+		}
+		r.y += rowH
+	}
+	r.y += 8
+}
+
+// Bytes writes the page footers and serializes the report.
+func (r *Report) Bytes() ([]byte, error) {
+	d := r.doc
+	n := d.PageCount()
+	for i := 1; i <= n; i++ {
+		d.SetPage(i)
+		d.Line(marginX, PageHeight-34, marginX+contentWidth, PageHeight-34, 0.5, ColorBorder)
+		d.SetFont(false, 8)
+		d.SetTextColor(ColorFaint)
+		d.Text(marginX, PageHeight-22, truncate(d, r.footer, contentWidth-90))
+		page := fmt.Sprintf("Página %d de %d", i, n)
+		d.Text(marginX+contentWidth-d.TextWidth(page), PageHeight-22, page)
+	}
+	return d.Bytes()
+}
+
+// wrap breaks text into lines no wider than width with the current font.
+// Words longer than a line are split.
+func wrap(d *Document, text string, width float64) []string {
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		var line string
+		for _, word := range strings.Fields(para) {
+			for d.TextWidth(word) > width {
+				cut := len([]rune(word)) - 1
+				for cut > 1 && d.TextWidth(string([]rune(word)[:cut])) > width {
+					cut--
+				}
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				lines = append(lines, string([]rune(word)[:cut]))
+				word = string([]rune(word)[cut:])
+			}
+			switch {
+			case line == "":
+				line = word
+			case d.TextWidth(line+" "+word) <= width:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// truncate shortens s with an ellipsis so that it fits in width.
+func truncate(d *Document, s string, width float64) string {
+	if d.TextWidth(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && d.TextWidth(string(runes)+"...") > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
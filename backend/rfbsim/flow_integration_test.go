@@ -0,0 +1,212 @@
+//go:build integration
+
+package rfbsim_test
+
+// End-to-end RFB flow against the simulator: solicitation, webhook callback,
+// download and import into rfb_debitos/rfb_resumo. Needs a disposable
+// PostgreSQL database (the migrations are applied to it):
+//
+//	TEST_DATABASE_URL=postgres://... go test -tags integration ./rfbsim/
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"fb_apu01/handlers"
+	"fb_apu01/migrate"
+	"fb_apu01/rfbsim"
+	"fb_apu01/secrets"
+	"fb_apu01/services"
+
+	_ "github.com/lib/pq"
+)
+
+const simCNPJBase = "11222333"
+
+func TestFluxoApuracaoSimulador(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL não definido")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := migrate.Up(db, "../migrations"); err != nil {
+		t.Fatalf("migrations: %v", err)
+	}
+
+	// Backend webhook and simulator, wired to each other
+	webhook := httptest.NewServer(handlers.RFBWebhookHandler(db))
+	defer webhook.Close()
+	sim, err := rfbsim.New(rfbsim.Options{WebhookDelay: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(sim)
+	defer api.Close()
+	t.Setenv("RFB_API_URL", api.URL)
+	t.Setenv("RFB_TOKEN_URL", "")
+	t.Setenv("RFB_WEBHOOK_URL", webhook.URL+"/api/rfb/webhook")
+	t.Setenv("RFB_WEBHOOK_ALLOWED_IPS", "")
+
+	companyID := criarEmpresa(t, db)
+	requestID, tiquete, err := services.SolicitarApuracaoRFB(db, companyID, "", services.RFBOrigemManual)
+	if err != nil {
+		t.Fatalf("SolicitarApuracaoRFB: %v", err)
+	}
+	if tiquete == "" {
+		t.Fatal("solicitação sem tíquete")
+	}
+
+	// The webhook starts the download; wait for the import to finish
+	var status, erro string
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := db.QueryRow(`SELECT status, COALESCE(error_message, '') FROM rfb_requests WHERE id = $1`,
+			requestID).Scan(&status, &erro); err != nil {
+			t.Fatal(err)
+		}
+		if status == "completed" || status == "error" {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if status != "completed" {
+		t.Fatalf("solicitação em %q (%s), esperado completed", status, erro)
+	}
+
+	esperado := lerFixture(t)
+
+	porTipo := map[string]int{}
+	rows, err := db.Query(`SELECT tipo_apuracao, COUNT(*) FROM rfb_debitos WHERE request_id = $1 GROUP BY tipo_apuracao`, requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var tipo string
+		var n int
+		if err := rows.Scan(&tipo, &n); err != nil {
+			t.Fatal(err)
+		}
+		porTipo[tipo] = n
+	}
+	rows.Close()
+	for tipo, n := range esperado.porTipo {
+		if porTipo[tipo] != n {
+			t.Errorf("rfb_debitos %s: %d linhas, esperado %d", tipo, porTipo[tipo], n)
+		}
+	}
+
+	var total, corrente, ajuste, extemporaneo int
+	var valorTotal float64
+	var atual bool
+	err = db.QueryRow(`
+		SELECT total_debitos, total_corrente, total_ajuste, total_extemporaneo, valor_cbs_total, atual
+		FROM rfb_resumo WHERE request_id = $1
+	`, requestID).Scan(&total, &corrente, &ajuste, &extemporaneo, &valorTotal, &atual)
+	if err != nil {
+		t.Fatalf("rfb_resumo: %v", err)
+	}
+	if total != esperado.total || corrente != esperado.porTipo["corrente"] ||
+		ajuste != esperado.porTipo["ajuste"] || extemporaneo != esperado.porTipo["extemporaneo"] {
+		t.Errorf("rfb_resumo: total %d (%d/%d/%d), esperado %d %v", total, corrente, ajuste, extemporaneo,
+			esperado.total, esperado.porTipo)
+	}
+	if math.Abs(valorTotal-esperado.valorTotal) > 0.005 {
+		t.Errorf("rfb_resumo.valor_cbs_total = %.2f, esperado %.2f", valorTotal, esperado.valorTotal)
+	}
+	if !atual {
+		t.Error("rfb_resumo não marcado como atual")
+	}
+
+	// The simulator calls back once, and that callback started the download
+	var entregas int
+	db.QueryRow(`SELECT COUNT(*) FROM rfb_webhook_deliveries WHERE request_id = $1 AND resultado = 'aceito'`,
+		requestID).Scan(&entregas)
+	if entregas != 1 {
+		t.Errorf("%d callbacks aceitos, esperado 1", entregas)
+	}
+}
+
+// criarEmpresa creates a company with the simulator's credential and removes
+// it (and its requests, debits and summaries) when the test ends.
+func criarEmpresa(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	var companyID string
+	err := db.QueryRow(`
+		WITH env AS (
+			INSERT INTO environments (name) VALUES ('Teste integração RFB') RETURNING id
+		), grp AS (
+			INSERT INTO enterprise_groups (environment_id, name) SELECT id, 'Teste integração RFB' FROM env RETURNING id
+		)
+		INSERT INTO companies (group_id, name) SELECT id, 'Empresa simulador RFB' FROM grp RETURNING id
+	`).Scan(&companyID)
+	if err != nil {
+		t.Fatalf("criar empresa: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM environments WHERE id = (
+			SELECT g.environment_id FROM companies c JOIN enterprise_groups g ON g.id = c.group_id WHERE c.id = $1)`, companyID)
+	})
+
+	secret, err := secrets.Encrypt("simulador")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO rfb_credentials (company_id, cnpj_matriz, cnpj_base, client_id, client_secret, ambiente, auth_tipo)
+		VALUES ($1, $2, $3, 'simulador', $4, 'producao_restrita', 'client_secret')
+	`, companyID, simCNPJBase+"000181", simCNPJBase, secret)
+	if err != nil {
+		t.Fatalf("criar credencial: %v", err)
+	}
+	return companyID
+}
+
+type fixtureEsperada struct {
+	porTipo    map[string]int
+	total      int
+	valorTotal float64
+}
+
+// lerFixture totals the file the simulator serves for simCNPJBase.
+func lerFixture(t *testing.T) fixtureEsperada {
+	t.Helper()
+	data, err := os.ReadFile("fixtures/apuracoes/" + simCNPJBase + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var arquivo map[string]*struct {
+		Debitos []struct {
+			ValorCBSTotal float64 `json:"valorCBSTotal"`
+		} `json:"debitos"`
+	}
+	if err := json.Unmarshal(data, &arquivo); err != nil {
+		t.Fatal(err)
+	}
+	grupos := map[string]string{
+		"apuracaoCorrente":     "corrente",
+		"apuracaoAjuste":       "ajuste",
+		"debitosExtemporaneos": "extemporaneo",
+	}
+	e := fixtureEsperada{porTipo: map[string]int{}}
+	for chave, grupo := range arquivo {
+		tipo, ok := grupos[chave]
+		if !ok || grupo == nil {
+			continue
+		}
+		e.porTipo[tipo] += len(grupo.Debitos)
+		e.total += len(grupo.Debitos)
+		for _, d := range grupo.Debitos {
+			e.valorTotal += d.ValorCBSTotal
+		}
+	}
+	return e
+}
@@ -0,0 +1,389 @@
+// Package rfbsim is a local stand-in for the Receita Federal CBS API, for
+// development and integration tests without the restricted-production
+// environment. It implements what services.RFBClient uses:
+//
+//	POST /token                                    OAuth2 client_credentials (HTTP Basic)
+//	POST /{rtc|prr-rtc}/apuracao-cbs/v1/{cnpjBase} solicitation, 201 {"tiquete"}
+//	GET  /{rtc|prr-rtc}/download/v1/{tiquete}      the apuração JSON, once per tíquete
+//
+// After a solicitation it calls urlRetorno back with tiqueteSolicitacao and
+// tiqueteDownload, like the real API. Errors follow the documented statuses:
+// 400 (invalid parameter), 401 (gateway: missing, unknown or expired token),
+// 403 (CNPJ of the token differs from the one requested) and 404 (unknown
+// tíquete, file not ready yet or already downloaded). The codigoErro values
+// are the simulator's own. The solicitation tíquete also downloads the file
+// once it is ready, which is what the backend's polling relies on when the
+// webhook does not arrive.
+//
+// Clients and files come from fixtures: clientes.json (clientId,
+// clientSecret, cnpjBase) and apuracoes/<cnpjBase>.json, the file served on
+// download (a CNPJ without a file gets an apuração with no debits). The
+// fixtures embedded in the package are used unless a directory is given.
+//
+// To run the whole flow locally, start tools/rfb_simulator.go and point the
+// backend at it:
+//
+//	go run -tags scripts ./tools/rfb_simulator.go -addr :8099
+//	RFB_API_URL=http://localhost:8099 RFB_WEBHOOK_URL=http://localhost:8081/api/rfb/webhook
+//
+// and save the credentials clientId/secret "simulador" with CNPJ 11222333000181.
+package rfbsim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed fixtures
+var embedded embed.FS
+
+// Cliente is an API consumer: its credentials and the CNPJ base it acts for.
+type Cliente struct {
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	CNPJBase     string `json:"cnpjBase"`
+}
+
+// Options configures a Server. The zero value serves the embedded fixtures
+// and calls the webhook after one second.
+type Options struct {
+	Fixtures     string        // directory with clientes.json and apuracoes/; "" = embedded
+	WebhookDelay time.Duration // wait before calling urlRetorno
+	WebhookURL   string        // replaces urlRetorno (keeping its ?token=), e.g. when the backend runs elsewhere
+	TokenTTL     time.Duration // access token lifetime (default 1h)
+}
+
+// Server is the fake API, an http.Handler.
+type Server struct {
+	opts       Options
+	files      fs.FS
+	clientes   map[string]Cliente
+	httpClient *http.Client
+
+	mu           sync.Mutex
+	tokens       map[string]accessToken
+	solicitacoes map[string]*solicitacao // by tiqueteSolicitacao
+}
+
+type accessToken struct {
+	cnpjBase string
+	expires  time.Time
+}
+
+// solicitacao is one assessment request and the state of its file.
+type solicitacao struct {
+	CNPJBase           string    `json:"cnpjBase"`
+	TiqueteSolicitacao string    `json:"tiqueteSolicitacao"`
+	TiqueteDownload    string    `json:"tiqueteDownload"`
+	URLRetorno         string    `json:"urlRetorno"`
+	Pronto             bool      `json:"pronto"` // webhook sent, file can be downloaded
+	Baixado            bool      `json:"baixado"`
+	CriadoEm           time.Time `json:"criadoEm"`
+}
+
+// New loads the fixtures and returns a ready Server.
+func New(opts Options) (*Server, error) {
+	if opts.TokenTTL == 0 {
+		opts.TokenTTL = time.Hour
+	}
+	if opts.WebhookDelay == 0 {
+		opts.WebhookDelay = time.Second
+	}
+	var files fs.FS
+	if opts.Fixtures != "" {
+		files = os.DirFS(opts.Fixtures)
+	} else {
+		sub, err := fs.Sub(embedded, "fixtures")
+		if err != nil {
+			return nil, err
+		}
+		files = sub
+	}
+
+	data, err := fs.ReadFile(files, "clientes.json")
+	if err != nil {
+		return nil, fmt.Errorf("read clientes.json: %w", err)
+	}
+	var lista []Cliente
+	if err := json.Unmarshal(data, &lista); err != nil {
+		return nil, fmt.Errorf("parse clientes.json: %w", err)
+	}
+	clientes := make(map[string]Cliente, len(lista))
+	for _, c := range lista {
+		clientes[c.ClientID] = c
+	}
+
+	return &Server{
+		opts:         opts,
+		files:        files,
+		clientes:     clientes,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+		tokens:       map[string]accessToken{},
+		solicitacoes: map[string]*solicitacao{},
+	}, nil
+}
+
+var (
+	cnpjBaseRe = regexp.MustCompile(`^\d{8}$`)
+	tiqueteRe  = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// ServeHTTP routes the API paths and the /_sim/ inspection endpoint.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[RFB Sim] %s %s", r.Method, r.URL.Path)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "token":
+		s.token(w, r)
+	case len(parts) == 2 && parts[0] == "_sim" && parts[1] == "solicitacoes":
+		s.listar(w, r)
+	case len(parts) == 4 && (parts[0] == "rtc" || parts[0] == "prr-rtc") && parts[2] == "v1":
+		switch parts[1] {
+		case "apuracao-cbs":
+			s.solicitar(w, r, parts[3])
+		case "download":
+			s.download(w, r, parts[3])
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// apiError writes the error envelope the client parses (codigoErro/mensagemErro).
+func apiError(w http.ResponseWriter, status int, codigo, mensagem string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"codigoErro": codigo, "mensagemErro": mensagem})
+}
+
+// gatewayError is the 401 of the API gateway, which has no codigoErro.
+func gatewayError(w http.ResponseWriter, mensagem string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": "invalid_token", "error_description": mensagem})
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "client_credentials" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	id, secret, _ := r.BasicAuth()
+	c, ok := s.clientes[id]
+	if !ok || c.ClientSecret != secret {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	tok := randomHex(32)
+	s.mu.Lock()
+	s.tokens[tok] = accessToken{cnpjBase: c.CNPJBase, expires: time.Now().Add(s.opts.TokenTTL)}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": tok,
+		"token_type":   "Bearer",
+		"expires_in":   int(s.opts.TokenTTL.Seconds()),
+	})
+}
+
+// authorize returns the CNPJ base of the bearer token, or writes the 401.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	t, ok := s.tokens[tok]
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		gatewayError(w, "token ausente ou inválido")
+		return "", false
+	case time.Now().After(t.expires):
+		gatewayError(w, "token expirado")
+		return "", false
+	}
+	return t.cnpjBase, true
+}
+
+func (s *Server) solicitar(w http.ResponseWriter, r *http.Request, cnpjBase string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	consumidor, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	if !cnpjBaseRe.MatchString(cnpjBase) {
+		apiError(w, http.StatusBadRequest, "SIM-400-CNPJ", "CNPJ base deve ter 8 dígitos")
+		return
+	}
+	var body struct {
+		URLRetorno string `json:"urlRetorno"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apiError(w, http.StatusBadRequest, "SIM-400-CORPO", "corpo da requisição inválido: "+err.Error())
+		return
+	}
+	if u, err := url.Parse(body.URLRetorno); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		apiError(w, http.StatusBadRequest, "SIM-400-URL", "urlRetorno ausente ou inválida")
+		return
+	}
+	if consumidor != cnpjBase {
+		apiError(w, http.StatusForbidden, "SIM-403", "CNPJ do consumidor não corresponde ao CNPJ da solicitação")
+		return
+	}
+
+	sol := &solicitacao{
+		CNPJBase:           cnpjBase,
+		TiqueteSolicitacao: newTiquete(),
+		TiqueteDownload:    newTiquete(),
+		URLRetorno:         body.URLRetorno,
+		CriadoEm:           time.Now(),
+	}
+	s.mu.Lock()
+	s.solicitacoes[sol.TiqueteSolicitacao] = sol
+	s.mu.Unlock()
+	go s.notificar(sol)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"tiquete": sol.TiqueteSolicitacao})
+}
+
+// notificar marks the file ready and calls the webhook, retrying a few times
+// while the backend doesn't answer 2xx.
+func (s *Server) notificar(sol *solicitacao) {
+	time.Sleep(s.opts.WebhookDelay)
+	s.mu.Lock()
+	sol.Pronto = true
+	s.mu.Unlock()
+
+	target := sol.URLRetorno
+	if s.opts.WebhookURL != "" {
+		target = s.opts.WebhookURL
+		// Keep the query of urlRetorno: it carries the request's callback token
+		if orig, err := url.Parse(sol.URLRetorno); err == nil && orig.RawQuery != "" {
+			if override, err := url.Parse(target); err == nil {
+				override.RawQuery = orig.RawQuery
+				target = override.String()
+			}
+		}
+	}
+	payload, _ := json.Marshal(map[string]string{
+		"tiqueteSolicitacao": sol.TiqueteSolicitacao,
+		"tiqueteDownload":    sol.TiqueteDownload,
+	})
+	for attempt := 1; attempt <= 3; attempt++ {
+		resp, err := s.httpClient.Post(target, "application/json", bytes.NewReader(payload))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				log.Printf("[RFB Sim] Webhook %s → HTTP %d (tiquete %s)", target, resp.StatusCode, sol.TiqueteSolicitacao)
+				return
+			}
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		log.Printf("[RFB Sim] Webhook %s attempt %d failed: %v", target, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request, tiquete string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	consumidor, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	if !tiqueteRe.MatchString(tiquete) {
+		apiError(w, http.StatusBadRequest, "SIM-400-TIQUETE", "tíquete em formato inválido")
+		return
+	}
+
+	s.mu.Lock()
+	var sol *solicitacao
+	for _, candidate := range s.solicitacoes {
+		if candidate.TiqueteDownload == tiquete || candidate.TiqueteSolicitacao == tiquete {
+			sol = candidate
+			break
+		}
+	}
+	switch {
+	case sol == nil || !sol.Pronto:
+		s.mu.Unlock()
+		apiError(w, http.StatusNotFound, "SIM-404", "arquivo não encontrado ou tíquete inválido")
+		return
+	case sol.CNPJBase != consumidor:
+		s.mu.Unlock()
+		apiError(w, http.StatusForbidden, "SIM-403", "CNPJ do consumidor não corresponde ao CNPJ da solicitação")
+		return
+	case sol.Baixado:
+		s.mu.Unlock()
+		apiError(w, http.StatusNotFound, "SIM-404-BAIXADO", "arquivo já baixado: o tíquete de download é de uso único")
+		return
+	}
+	sol.Baixado = true
+	s.mu.Unlock()
+
+	data, err := fs.ReadFile(s.files, "apuracoes/"+sol.CNPJBase+".json")
+	if err != nil {
+		data = []byte(`{"apuracaoCorrente":{"debitos":[]},"apuracaoAjuste":{"debitos":[]},"debitosExtemporaneos":{"debitos":[]}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// listar shows the solicitations, so a test can drive the webhook itself
+// when the simulator cannot reach the backend.
+func (s *Server) listar(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	lista := make([]solicitacao, 0, len(s.solicitacoes))
+	for _, sol := range s.solicitacoes {
+		lista = append(lista, *sol)
+	}
+	s.mu.Unlock()
+	sort.Slice(lista, func(i, j int) bool { return lista[i].CriadoEm.Before(lista[j].CriadoEm) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lista)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newTiquete returns a random UUID, the format of the API's tíquetes.
+func newTiquete() string {
+	h := randomHex(16)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RunCLI implements the `secrets check|rotate [--dry-run] [--plaintext]`
+// subcommand of the backend binary. args excludes the "secrets" word itself.
+//
+// Rotating to a new key: move the old one to ENCRYPTION_KEYS_PREVIOUS
+// ("k1:<old key>"), set ENCRYPTION_KEY and ENCRYPTION_KEY_ID (k2), restart,
+// run `secrets rotate`, and drop the old key once `secrets check` shows no
+// value under it.
+func RunCLI(db *sql.DB, args []string, out io.Writer) error {
+	cmd := "check"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	switch cmd {
+	case "check":
+		current, err := CurrentKeyID()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "current key: %s\n", current)
+		reports, err := Check(db)
+		if err != nil {
+			return err
+		}
+		bad := 0
+		for _, rep := range reports {
+			fmt.Fprintln(out, rep.Summary())
+			bad += len(rep.Undecryptable)
+		}
+		if bad > 0 {
+			return fmt.Errorf("%d value(s) cannot be decrypted", bad)
+		}
+		return nil
+
+	case "rotate":
+		var opts RotateOptions
+		for _, flag := range args[1:] {
+			switch flag {
+			case "--dry-run":
+				opts.DryRun = true
+			case "--plaintext":
+				opts.Plaintext = true
+			default:
+				return fmt.Errorf("unknown flag %q (use --dry-run, --plaintext)", flag)
+			}
+		}
+		reports, err := Rotate(db, opts)
+		failed := 0
+		for _, rep := range reports {
+			line := fmt.Sprintf("%s: %d re-encrypted, %d already current", rep.Column, rep.Rotated, rep.Unchanged)
+			if len(rep.Failed) > 0 {
+				line += fmt.Sprintf(", %d UNDECRYPTABLE (ids %s)", len(rep.Failed), strings.Join(rep.Failed, ", "))
+				failed += len(rep.Failed)
+			}
+			fmt.Fprintln(out, line)
+		}
+		if err != nil {
+			return err
+		}
+		if opts.DryRun {
+			fmt.Fprintln(out, "dry run: nothing was written")
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d value(s) cannot be decrypted and were left as they are", failed)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q (use check or rotate [--dry-run] [--plaintext])", cmd)
+	}
+}
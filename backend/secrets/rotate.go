@@ -0,0 +1,211 @@
+package secrets
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Column is a database column whose values are encrypted with Encrypt. Rows
+// are addressed by their id column.
+type Column struct {
+	Table string
+	Name  string
+}
+
+func (c Column) String() string { return c.Table + "." + c.Name }
+
+// Columns lists every encrypted column. A new one is added here and to the
+// exigir_cifrado trigger of its table (see migration 080), so that rotation
+// and the startup check cover it.
+var Columns = []Column{
+	{"rfb_credentials", "client_secret"},
+	{"rfb_credentials", "certificado_pfx"},
+	{"rfb_credentials", "certificado_senha"},
+}
+
+// ColumnReport counts the values of a column by the key they are under.
+type ColumnReport struct {
+	Column        Column
+	Total         int
+	ByKey         map[string]int // key id → values, "" for unversioned ones
+	Undecryptable []string       // ids of the rows no key opens
+}
+
+// Summary is a one-line description for logs and the CLI.
+func (r ColumnReport) Summary() string {
+	ids := make([]string, 0, len(r.ByKey))
+	for id := range r.ByKey {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	parts := []string{fmt.Sprintf("%d value(s)", r.Total)}
+	for _, id := range ids {
+		name := id
+		if name == "" {
+			name = "unversioned"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%d", name, r.ByKey[id]))
+	}
+	if n := len(r.Undecryptable); n > 0 {
+		parts = append(parts, fmt.Sprintf("UNDECRYPTABLE=%d (ids %s)", n, strings.Join(r.Undecryptable, ", ")))
+	}
+	return r.Column.String() + ": " + strings.Join(parts, " ")
+}
+
+// Check tries to decrypt every value of Columns.
+func Check(db *sql.DB) ([]ColumnReport, error) {
+	var reports []ColumnReport
+	for _, col := range Columns {
+		rep := ColumnReport{Column: col, ByKey: map[string]int{}}
+		rows, err := db.Query(fmt.Sprintf(`SELECT id::text, %s FROM %s WHERE %s IS NOT NULL ORDER BY id`,
+			col.Name, col.Table, col.Name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", col, err)
+		}
+		for rows.Next() {
+			var id, value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("%s: %w", col, err)
+			}
+			rep.Total++
+			if _, err := Decrypt(value); err != nil {
+				rep.Undecryptable = append(rep.Undecryptable, id)
+				continue
+			}
+			rep.ByKey[KeyID(value)]++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", col, err)
+		}
+		reports = append(reports, rep)
+	}
+	return reports, nil
+}
+
+// Verify runs Check at startup: it logs every column and fails when a value
+// cannot be decrypted. Values under a previous key or unversioned only log a
+// reminder to rotate.
+func Verify(db *sql.DB) error {
+	current, err := CurrentKeyID()
+	if err != nil {
+		return err
+	}
+	reports, err := Check(db)
+	if err != nil {
+		return err
+	}
+	var bad []string
+	for _, rep := range reports {
+		log.Printf("[secrets] %s", rep.Summary())
+		if len(rep.Undecryptable) > 0 {
+			bad = append(bad, rep.Column.String())
+		}
+		if rep.Total-len(rep.Undecryptable) > rep.ByKey[current] {
+			log.Printf("[secrets] %s has values not under the current key %q — run `server secrets rotate`", rep.Column, current)
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("undecryptable values in %s: configure the missing key in ENCRYPTION_KEYS_PREVIOUS or fix them (`server secrets check`)",
+			strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// RotateOptions tunes Rotate.
+type RotateOptions struct {
+	DryRun bool
+	// Plaintext encrypts unversioned values that no key opens as they are,
+	// taking them for plaintext stored before encryption existed. Without it
+	// they are reported and left untouched.
+	Plaintext bool
+}
+
+// RotateReport is the outcome of Rotate for one column.
+type RotateReport struct {
+	Column    Column
+	Rotated   int
+	Unchanged int      // already under the current key
+	Failed    []string // ids of the rows that could not be decrypted
+}
+
+// Rotate re-encrypts under the current key every value of Columns that is
+// not under it yet. Each column is rewritten in one transaction with its rows
+// locked, so concurrent writes are not lost; DryRun rolls it back.
+func Rotate(db *sql.DB, opts RotateOptions) ([]RotateReport, error) {
+	current, err := CurrentKeyID()
+	if err != nil {
+		return nil, err
+	}
+	var reports []RotateReport
+	for _, col := range Columns {
+		rep, err := rotateColumn(db, col, current, opts)
+		if err != nil {
+			return reports, fmt.Errorf("%s: %w", col, err)
+		}
+		reports = append(reports, rep)
+	}
+	return reports, nil
+}
+
+func rotateColumn(db *sql.DB, col Column, current string, opts RotateOptions) (RotateReport, error) {
+	rep := RotateReport{Column: col}
+	tx, err := db.Begin()
+	if err != nil {
+		return rep, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(fmt.Sprintf(`SELECT id::text, %s FROM %s WHERE %s IS NOT NULL ORDER BY id FOR UPDATE`,
+		col.Name, col.Table, col.Name))
+	if err != nil {
+		return rep, err
+	}
+	updates := map[string]string{}
+	for rows.Next() {
+		var id, value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return rep, err
+		}
+		keyID := KeyID(value)
+		if keyID == current {
+			rep.Unchanged++
+			continue
+		}
+		plaintext, err := Decrypt(value)
+		if err != nil {
+			if !(opts.Plaintext && keyID == "" && errors.Is(err, ErrUndecryptable)) {
+				rep.Failed = append(rep.Failed, id)
+				continue
+			}
+			plaintext = value
+		}
+		if updates[id], err = Encrypt(plaintext); err != nil {
+			rows.Close()
+			return rep, err
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return rep, err
+	}
+
+	for id, value := range updates {
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = $1 WHERE id = $2`, col.Table, col.Name), value, id); err != nil {
+			return rep, err
+		}
+		rep.Rotated++
+	}
+	if opts.DryRun {
+		return rep, nil
+	}
+	return rep, tx.Commit()
+}
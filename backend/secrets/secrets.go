@@ -0,0 +1,219 @@
+// Package secrets encrypts the secrets the backend keeps in the database
+// (RFB client secrets, A1 certificates and their passwords) with AES-256-GCM
+// under versioned keys.
+//
+// A stored value is "<key id>:<base64(nonce + ciphertext)>". The current key
+// is ENCRYPTION_KEY, identified by ENCRYPTION_KEY_ID (default "k1"); main
+// refuses to start in production without it, and only local development falls
+// back to JWT_SECRET or a built-in key. Retired keys stay readable while
+// listed in ENCRYPTION_KEYS_PREVIOUS as "id:key,id:key". Values written
+// before keys were versioned carry no prefix and are tried with every
+// configured key and JWT_SECRET (the key they were written with back then).
+//
+// There is no plaintext fallback: Decrypt fails on anything no key opens.
+// `server secrets rotate` re-encrypts every column in Columns under the
+// current key; `server secrets check` (also run at startup) verifies that
+// every stored value is decryptable.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DefaultKeyID identifies ENCRYPTION_KEY when ENCRYPTION_KEY_ID is not set.
+const DefaultKeyID = "k1"
+
+// devKey is the current key of last resort when neither ENCRYPTION_KEY nor
+// JWT_SECRET is set (local development). It never opens unversioned values.
+const devKey = "super-secret-key-change-me-in-prod"
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+
+var (
+	// ErrUnknownKey is returned for a value encrypted under a key id that is
+	// neither the current key nor in ENCRYPTION_KEYS_PREVIOUS.
+	ErrUnknownKey = errors.New("secrets: value encrypted with an unknown key")
+	// ErrUndecryptable is returned when no key opens the value (corrupted,
+	// encrypted elsewhere or stored as plaintext).
+	ErrUndecryptable = errors.New("secrets: value cannot be decrypted")
+)
+
+type key struct {
+	id   string
+	aead cipher.AEAD
+}
+
+type keyring struct {
+	current key
+	byID    map[string]key
+	legacy  []key // candidates for values without key id, current first
+}
+
+func newKey(id, secret string) (key, error) {
+	h := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(h[:])
+	if err != nil {
+		return key{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return key{}, err
+	}
+	return key{id: id, aead: aead}, nil
+}
+
+// loadKeyring reads the keys from the environment on every call, so a
+// rotation only needs the new variables and a restart.
+func loadKeyring() (*keyring, error) {
+	currentID := strings.TrimSpace(os.Getenv("ENCRYPTION_KEY_ID"))
+	if currentID == "" {
+		currentID = DefaultKeyID
+	}
+	if !keyIDPattern.MatchString(currentID) {
+		return nil, fmt.Errorf("secrets: ENCRYPTION_KEY_ID %q must be 1-16 letters, digits, '-' or '_'", currentID)
+	}
+	secret := os.Getenv("ENCRYPTION_KEY")
+	if secret == "" {
+		secret = os.Getenv("JWT_SECRET")
+	}
+	usingDevKey := secret == ""
+	if usingDevKey {
+		secret = devKey
+	}
+
+	kr := &keyring{byID: map[string]key{}}
+	seen := map[string]bool{}
+	add := func(id, secret string, legacyOnly bool) error {
+		k, err := newKey(id, secret)
+		if err != nil {
+			return err
+		}
+		if !legacyOnly {
+			if _, dup := kr.byID[id]; dup {
+				return fmt.Errorf("secrets: key id %q configured twice", id)
+			}
+			kr.byID[id] = k
+		}
+		if !seen[secret] {
+			seen[secret] = true
+			kr.legacy = append(kr.legacy, k)
+		}
+		return nil
+	}
+
+	if err := add(currentID, secret, false); err != nil {
+		return nil, err
+	}
+	kr.current = kr.byID[currentID]
+	if usingDevKey {
+		kr.legacy = nil
+	}
+	for i, entry := range strings.Split(os.Getenv("ENCRYPTION_KEYS_PREVIOUS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, prev, ok := strings.Cut(entry, ":")
+		if !ok || !keyIDPattern.MatchString(id) || prev == "" {
+			// the entry itself is not echoed: it holds a key
+			return nil, fmt.Errorf("secrets: ENCRYPTION_KEYS_PREVIOUS entry %d must be id:key", i+1)
+		}
+		if err := add(id, prev, false); err != nil {
+			return nil, err
+		}
+	}
+	// Unversioned values may predate ENCRYPTION_KEY and use JWT_SECRET
+	if fallback := os.Getenv("JWT_SECRET"); fallback != "" {
+		if err := add("", fallback, true); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// ValidateConfig reports a malformed key configuration.
+func ValidateConfig() error {
+	_, err := loadKeyring()
+	return err
+}
+
+// CurrentKeyID is the id new values are encrypted under.
+func CurrentKeyID() (string, error) {
+	kr, err := loadKeyring()
+	if err != nil {
+		return "", err
+	}
+	return kr.current.id, nil
+}
+
+// KeyID returns the key id of an encrypted value, "" for an unversioned one.
+func KeyID(value string) string {
+	id, _, ok := strings.Cut(value, ":")
+	if !ok || !keyIDPattern.MatchString(id) {
+		return ""
+	}
+	return id
+}
+
+// Encrypt encrypts plaintext under the current key.
+func Encrypt(plaintext string) (string, error) {
+	kr, err := loadKeyring()
+	if err != nil {
+		return "", err
+	}
+	k := kr.current
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	ct := k.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return k.id + ":" + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+// Decrypt opens a value produced by Encrypt, or an unversioned one written
+// before key ids existed.
+func Decrypt(value string) (string, error) {
+	kr, err := loadKeyring()
+	if err != nil {
+		return "", err
+	}
+	if id := KeyID(value); id != "" {
+		k, ok := kr.byID[id]
+		if !ok {
+			return "", fmt.Errorf("%w %q", ErrUnknownKey, id)
+		}
+		if plaintext, ok := open(k, value[len(id)+1:]); ok {
+			return plaintext, nil
+		}
+		return "", ErrUndecryptable
+	}
+	for _, k := range kr.legacy {
+		if plaintext, ok := open(k, value); ok {
+			return plaintext, nil
+		}
+	}
+	return "", ErrUndecryptable
+}
+
+func open(k key, encoded string) (string, bool) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < k.aead.NonceSize() {
+		return "", false
+	}
+	nonce, ct := data[:k.aead.NonceSize()], data[k.aead.NonceSize():]
+	plaintext, err := k.aead.Open(nil, nonce, ct, nil)
+	if err != nil {
+		return "", false
+	}
+	return string(plaintext), true
+}
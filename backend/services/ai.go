@@ -1,56 +1,19 @@
 package services
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
 	"strings"
 	"time"
-)
 
-// Z.AI GLM Models
-const (
-	ModelFlash         = "glm-4.7-flash" // Free tier - primary
-	ModelFlashFallback = "glm-4.5-flash" // Free tier - fallback for rate limits
+	"fb_apu01/metrics"
 )
 
-// AIClient wraps communication with the Z.AI GLM API (OpenAI-compatible).
+// AIClient runs prompts against the configured LLM provider chain
+// (LoadLLMProviders), trying each provider in order until one answers.
 type AIClient struct {
-	apiKey     string
-	httpClient *http.Client
-	baseURL    string
-}
-
-// OpenAI-compatible request/response types (used by Z.AI)
-type chatRequest struct {
-	Model     string        `json:"model"`
-	MaxTokens int           `json:"max_tokens"`
-	Messages  []chatMessage `json:"messages"`
-}
-
-type chatMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-type chatResponse struct {
-	Choices []struct {
-		Message struct {
-			Content          string `json:"content"`
-			ReasoningContent string `json:"reasoning_content"`
-		} `json:"message"`
-	} `json:"choices"`
-	Usage struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-	} `json:"usage"`
-	Error *struct {
-		Code    string `json:"code"`
-		Message string `json:"message"`
-	} `json:"error"`
+	providers []LLMProvider
 }
 
 // AIResponse is the result returned to handlers.
@@ -59,292 +22,216 @@ type AIResponse struct {
 	InputTokens  int    `json:"input_tokens"`
 	OutputTokens int    `json:"output_tokens"`
 	Model        string `json:"model"`
+	Provider     string `json:"provider"`
 }
 
-// NewAIClient creates an AIClient from environment config.
+// NewAIClient creates an AIClient from environment config. Returns nil when no
+// provider is configured, so callers keep their deterministic fallbacks.
 func NewAIClient() *AIClient {
-	apiKey := os.Getenv("ZAI_API_KEY")
-	if apiKey == "" {
+	providers := LoadLLMProviders()
+	if len(providers) == 0 {
 		return nil
 	}
-	return &AIClient{
-		apiKey: apiKey,
-		httpClient: &http.Client{
-			Timeout: 60 * time.Second,
-		},
-		baseURL: "https://api.z.ai/api/paas/v4/chat/completions",
-	}
+	return &AIClient{providers: providers}
+}
+
+// NewAIClientWithProviders builds a client over an explicit provider chain.
+func NewAIClientWithProviders(providers ...LLMProvider) *AIClient {
+	return &AIClient{providers: providers}
 }
 
 // GenerateFastRaw is like GenerateFast but returns the raw AI text without
 // running extractMarkdownReport. Use this for SQL generation and other tasks
 // where the output is not a Markdown report (e.g. code blocks).
+// An empty model uses each provider's default.
 func (c *AIClient) GenerateFastRaw(system, userPrompt, model string, maxTokens int) (*AIResponse, error) {
-	if c == nil {
+	return c.GenerateChatRaw(system, []LLMMessage{{Role: "user", Content: userPrompt}}, model, maxTokens)
+}
+
+// GenerateChatRaw is GenerateFastRaw for a multi-turn conversation: messages
+// alternate user/assistant and end with the new user question.
+func (c *AIClient) GenerateChatRaw(system string, messages []LLMMessage, model string, maxTokens int) (*AIResponse, error) {
+	if !c.IsAvailable() {
 		return nil, fmt.Errorf("AI client not configured")
 	}
-	if model == "" {
-		model = ModelFlash
-	}
-	if maxTokens == 0 {
-		maxTokens = 4096
-	}
-	fastClient := &http.Client{Timeout: 90 * time.Second}
-	origClient := c.httpClient
-	c.httpClient = fastClient
-	defer func() { c.httpClient = origClient }()
-
-	messages := []chatMessage{{Role: "user", Content: userPrompt}}
-	if system != "" {
-		messages = append([]chatMessage{{Role: "system", Content: system}}, messages...)
-	}
-	reqBody := chatRequest{Model: model, MaxTokens: maxTokens, Messages: messages}
-
-	resp, err := c.doRequestRaw(reqBody)
-	if err != nil {
-		errStr := err.Error()
-		if strings.Contains(errStr, "429") && reqBody.Model == ModelFlash {
-			fmt.Printf("[AI Raw] Rate limited on %s, single attempt with %s\n", ModelFlash, ModelFlashFallback)
-			reqBody.Model = ModelFlashFallback
-			resp, err = c.doRequestRaw(reqBody)
-		} else if isTransientNetworkError(errStr) {
-			// TLS timeout, connection reset, dial error — retry once after short backoff
-			fmt.Printf("[AI Raw] Transient network error (%s), retrying in 3s...\n", errStr)
+	req := newLLMRequest(system, "", model, maxTokens)
+	req.Messages = messages
+	return c.run(req, true, 90*time.Second, func(p LLMProvider, attempt int, err error) bool {
+		// TLS timeout, connection reset, dial error — retry once after short backoff
+		if attempt == 1 && isTransientNetworkError(err.Error()) {
+			fmt.Printf("[AI Raw] Transient network error on %s (%v), retrying in 3s...\n", p.Name(), err)
 			time.Sleep(3 * time.Second)
-			resp, err = c.doRequestRaw(reqBody)
+			return true
 		}
-	}
-	return resp, err
+		return false
+	})
 }
 
-// GenerateFast is like Generate but with a single attempt and shorter timeout.
-// Use this in HTTP handlers where the user is waiting — the background worker
-// handles retries. Returns an error immediately on rate-limit or timeout.
+// GenerateFast is like Generate but with a single attempt per provider and a
+// shorter timeout. Use this in HTTP handlers where the user is waiting — the
+// background worker handles retries.
 func (c *AIClient) GenerateFast(system, userPrompt, model string, maxTokens int) (*AIResponse, error) {
-	if c == nil {
+	if !c.IsAvailable() {
 		return nil, fmt.Errorf("AI client not configured")
 	}
-	if model == "" {
-		model = ModelFlash
-	}
-	if maxTokens == 0 {
-		maxTokens = 4096
-	}
-	// Shorter HTTP timeout for the synchronous request path
-	fastClient := &http.Client{Timeout: 25 * time.Second}
-	origClient := c.httpClient
-	c.httpClient = fastClient
-	defer func() { c.httpClient = origClient }()
-
-	messages := []chatMessage{{Role: "user", Content: userPrompt}}
-	if system != "" {
-		messages = append([]chatMessage{{Role: "system", Content: system}}, messages...)
-	}
-	reqBody := chatRequest{Model: model, MaxTokens: maxTokens, Messages: messages}
-
-	// Single attempt — no retries
-	resp, err := c.doRequest(reqBody)
-	if err != nil {
-		// On rate-limit try fallback model once, but don't loop
-		if strings.Contains(err.Error(), "429") && reqBody.Model == ModelFlash {
-			fmt.Printf("[AI Fast] Rate limited on %s, single attempt with %s\n", ModelFlash, ModelFlashFallback)
-			reqBody.Model = ModelFlashFallback
-			resp, err = c.doRequest(reqBody)
-		}
-	}
-	return resp, err
+	req := newLLMRequest(system, userPrompt, model, maxTokens)
+	return c.run(req, false, 25*time.Second, func(LLMProvider, int, error) bool { return false })
 }
 
-// Generate sends a prompt to Z.AI GLM and returns the narrative text.
-// Uses retry with exponential backoff (max 3 attempts).
+// Generate sends a prompt and returns the narrative text. Each provider gets
+// up to 3 attempts with backoff before the next provider is tried.
 func (c *AIClient) Generate(system, userPrompt, model string, maxTokens int) (*AIResponse, error) {
-	if c == nil {
-		return nil, fmt.Errorf("AI client not configured (ZAI_API_KEY not set)")
-	}
-	if model == "" {
-		model = ModelFlash
+	if !c.IsAvailable() {
+		return nil, fmt.Errorf("AI client not configured (no LLM provider available)")
 	}
+	req := newLLMRequest(system, userPrompt, model, maxTokens)
+	return c.run(req, false, 60*time.Second, func(p LLMProvider, attempt int, err error) bool {
+		if attempt >= 3 {
+			return false
+		}
+		time.Sleep(time.Duration(attempt*2) * time.Second)
+		return true
+	})
+}
+
+func newLLMRequest(system, userPrompt, model string, maxTokens int) LLMRequest {
 	if maxTokens == 0 {
 		maxTokens = 4096
 	}
-
-	// OpenAI-compatible format: system prompt goes as a message with role "system"
-	messages := []chatMessage{
-		{Role: "user", Content: userPrompt},
-	}
-	if system != "" {
-		messages = append([]chatMessage{{Role: "system", Content: system}}, messages...)
-	}
-
-	reqBody := chatRequest{
+	return LLMRequest{
+		System:    system,
+		Messages:  []LLMMessage{{Role: "user", Content: userPrompt}},
 		Model:     model,
 		MaxTokens: maxTokens,
-		Messages:  messages,
 	}
+}
 
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
-		resp, err := c.doRequest(reqBody)
-		if err == nil {
-			return resp, nil
-		}
-		lastErr = err
-
-		// On rate limit (429), switch to fallback model immediately
-		if strings.Contains(err.Error(), "429") && reqBody.Model == ModelFlash {
-			fmt.Printf("[AI] Rate limited on %s, switching to fallback %s\n", ModelFlash, ModelFlashFallback)
-			reqBody.Model = ModelFlashFallback
-			time.Sleep(2 * time.Second)
-			continue
-		}
-
-		if attempt < 3 {
-			backoff := time.Duration(attempt*2) * time.Second
-			time.Sleep(backoff)
+// run walks the provider chain. For each provider it calls complete and, on
+// failure, asks retry whether to try the same provider again; when retry says
+// no, the next provider is tried.
+func (c *AIClient) run(req LLMRequest, raw bool, timeout time.Duration, retry func(p LLMProvider, attempt int, err error) bool) (*AIResponse, error) {
+	var errs []error
+	for _, p := range c.providers {
+		for attempt := 1; ; attempt++ {
+			resp, err := c.complete(p, req, raw, timeout)
+			if err == nil {
+				return resp, nil
+			}
+			if !retry(p, attempt, err) {
+				fmt.Printf("[AI] Provider %s failed: %v\n", p.Name(), err)
+				errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+				break
+			}
 		}
 	}
-	return nil, fmt.Errorf("AI API failed after 3 attempts: %w", lastErr)
+	return nil, fmt.Errorf("all AI providers failed: %w", errors.Join(errs...))
 }
 
-func (c *AIClient) doRequest(reqBody chatRequest) (*AIResponse, error) {
-	body, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("marshal request: %w", err)
+// complete makes one call to p; on rate-limit it tries the provider's
+// fallback model once (Z.AI free tiers).
+func (c *AIClient) complete(p LLMProvider, req LLMRequest, raw bool, timeout time.Duration) (*AIResponse, error) {
+	resp, err := c.call(p, req, raw, timeout)
+	var rl *RateLimitError
+	if errors.As(err, &rl) && req.Model == "" {
+		if fb, ok := p.(modelFallback); ok && fb.FallbackModel() != "" {
+			fmt.Printf("[AI] Rate limited on %s, single attempt with %s\n", p.Name(), fb.FallbackModel())
+			req.Model = fb.FallbackModel()
+			resp, err = c.call(p, req, raw, timeout)
+		}
 	}
+	return resp, err
+}
 
-	req, err := http.NewRequest("POST", c.baseURL, bytes.NewReader(body))
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+func (c *AIClient) call(p LLMProvider, req LLMRequest, raw bool, timeout time.Duration) (out *AIResponse, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
-	}
-	defer resp.Body.Close()
+	start := time.Now()
+	defer func() { observeAICall(p.Name(), req.Model, start, out, err) }()
 
-	respBody, err := io.ReadAll(resp.Body)
+	llmResp, err := p.Complete(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(respBody))
-	}
-
-	var chatResp chatResponse
-	if err := json.Unmarshal(respBody, &chatResp); err != nil {
-		return nil, fmt.Errorf("unmarshal response: %w", err)
-	}
-
-	if chatResp.Error != nil {
-		return nil, fmt.Errorf("API error: %s - %s", chatResp.Error.Code, chatResp.Error.Message)
+		return nil, err
 	}
 
-	if len(chatResp.Choices) == 0 {
-		return nil, fmt.Errorf("empty response from API")
-	}
-
-	// GLM models may return text in reasoning_content instead of content
-	text := chatResp.Choices[0].Message.Content
-	if text == "" {
-		text = chatResp.Choices[0].Message.ReasoningContent
+	var text string
+	if raw {
+		text = pickRawText(llmResp.Content, llmResp.Reasoning)
+	} else {
+		// GLM models may return text in reasoning_content instead of content
+		text = llmResp.Content
+		if text == "" {
+			text = llmResp.Reasoning
+		}
+		// GLM flash models include chain-of-thought in reasoning_content.
+		// Extract only the final Markdown report (starts with "## ").
+		if text != "" {
+			text = extractMarkdownReport(text)
+		}
 	}
 	if text == "" {
 		return nil, fmt.Errorf("empty response from API")
 	}
 
-	// GLM flash models include chain-of-thought in reasoning_content.
-	// Extract only the final Markdown report (starts with "## ").
-	text = extractMarkdownReport(text)
-
 	return &AIResponse{
 		Text:         text,
-		InputTokens:  chatResp.Usage.PromptTokens,
-		OutputTokens: chatResp.Usage.CompletionTokens,
-		Model:        reqBody.Model,
+		InputTokens:  llmResp.InputTokens,
+		OutputTokens: llmResp.OutputTokens,
+		Model:        llmResp.Model,
+		Provider:     p.Name(),
 	}, nil
 }
 
-// doRequestRaw is identical to doRequest but skips extractMarkdownReport.
-// Returns content + reasoning_content concatenated so callers can search for
-// code blocks (e.g. ```sql) anywhere in the full response.
-func (c *AIClient) doRequestRaw(reqBody chatRequest) (*AIResponse, error) {
-	body, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("marshal request: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", c.baseURL, bytes.NewReader(body))
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(respBody))
-	}
-
-	var chatResp chatResponse
-	if err := json.Unmarshal(respBody, &chatResp); err != nil {
-		return nil, fmt.Errorf("unmarshal response: %w", err)
-	}
-
-	if chatResp.Error != nil {
-		return nil, fmt.Errorf("API error: %s - %s", chatResp.Error.Code, chatResp.Error.Message)
-	}
-
-	if len(chatResp.Choices) == 0 {
-		return nil, fmt.Errorf("empty response from API")
-	}
-
-	content := strings.TrimSpace(chatResp.Choices[0].Message.Content)
-	reasoning := strings.TrimSpace(chatResp.Choices[0].Message.ReasoningContent)
-
-	// GLM flash models vary in where they put the final SQL:
-	// - Sometimes in content (with a ```sql block)
-	// - Sometimes in reasoning_content (with a ```sql block), with content having prose
-	// Priority: whichever field has a ```sql code block wins.
-	// Never mix the two — reasoning prose contains backtick-quoted identifiers
-	// and numbered lists that corrupt SQL extraction.
-	var text string
+// pickRawText returns content or reasoning for callers that search for code
+// blocks (e.g. ```sql) in the full response.
+// GLM flash models vary in where they put the final SQL:
+// - Sometimes in content (with a ```sql block)
+// - Sometimes in reasoning_content (with a ```sql block), with content having prose
+// Priority: whichever field has a ```sql code block wins.
+// Never mix the two — reasoning prose contains backtick-quoted identifiers
+// and numbered lists that corrupt SQL extraction.
+func pickRawText(content, reasoning string) string {
 	switch {
 	case strings.Contains(content, "```sql"):
-		text = content
+		return content
 	case strings.Contains(reasoning, "```sql"):
-		text = reasoning
+		return reasoning
 	case strings.Contains(content, "```"):
-		text = content
+		return content
 	case strings.Contains(reasoning, "```"):
-		text = reasoning
+		return reasoning
 	case content != "":
-		text = content
-	case reasoning != "":
-		text = reasoning
+		return content
 	default:
-		return nil, fmt.Errorf("empty response from API")
+		return reasoning
 	}
+}
 
-	return &AIResponse{
-		Text:         text,
-		InputTokens:  chatResp.Usage.PromptTokens,
-		OutputTokens: chatResp.Usage.CompletionTokens,
-		Model:        reqBody.Model,
-	}, nil
+var (
+	aiRequestDuration = metrics.NewHistogramVec("ai_request_duration_seconds",
+		"Latency of LLM calls by provider, model and outcome.", metrics.DefBuckets, "provider", "model", "outcome")
+	aiTokens = metrics.NewCounterVec("ai_tokens_total",
+		"Tokens reported by the LLM provider, by model and direction (input/output).", "provider", "model", "direction")
+)
+
+// observeAICall records one round-trip to a provider (retries count as
+// separate calls, which is what rate-limit and latency alerts need).
+func observeAICall(provider, model string, start time.Time, resp *AIResponse, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	if resp != nil {
+		model = resp.Model
+	}
+	if model == "" {
+		model = "default"
+	}
+	aiRequestDuration.Observe(time.Since(start).Seconds(), provider, model, outcome)
+	if resp != nil {
+		aiTokens.Add(float64(resp.InputTokens), provider, model, "input")
+		aiTokens.Add(float64(resp.OutputTokens), provider, model, "output")
+	}
 }
 
 // extractMarkdownReport extracts the final Markdown report from GLM reasoning output.
@@ -465,7 +352,7 @@ func isTransientNetworkError(errStr string) bool {
 	return false
 }
 
-// IsAvailable checks if the AI client is configured.
+// IsAvailable checks if the AI client has at least one provider.
 func (c *AIClient) IsAvailable() bool {
-	return c != nil && c.apiKey != ""
+	return c != nil && len(c.providers) > 0
 }
@@ -0,0 +1,478 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The executive summary data, shared by the on-demand summary (handlers) and
+// the reports emailed by the worker, so both show the same numbers: the month,
+// the previous month and the same month last year, with trends and anomalies.
+
+// ApuracaoPeriodo is one month aggregated from mv_mercadorias_agregada.
+type ApuracaoPeriodo struct {
+	Periodo          string  `json:"periodo"`
+	FaturamentoBruto float64 `json:"faturamento_bruto"`
+	TotalEntradas    float64 `json:"total_entradas"`
+	TotalSaidas      float64 `json:"total_saidas"`
+	IcmsEntrada      float64 `json:"icms_entrada"`
+	IcmsSaida        float64 `json:"icms_saida"`
+	IcmsAPagar       float64 `json:"icms_a_pagar"`
+	IbsProjetado     float64 `json:"ibs_projetado"`
+	CbsProjetado     float64 `json:"cbs_projetado"`
+	TotalNFes        int     `json:"total_nfes"`
+	// Breakdown by operation type
+	Operacoes []OperacaoResumo `json:"operacoes"`
+	// Alíquotas efetivas (% sobre faturamento bruto)
+	AliquotaEfetivaICMS         float64 `json:"aliquota_efetiva_icms"`
+	AliquotaEfetivaIBS          float64 `json:"aliquota_efetiva_ibs"`
+	AliquotaEfetivaCBS          float64 `json:"aliquota_efetiva_cbs"`
+	AliquotaEfetivaTotalReforma float64 `json:"aliquota_efetiva_total_reforma"`
+}
+
+// SemDados reports whether the month has no movement at all.
+func (p *ApuracaoPeriodo) SemDados() bool {
+	return p.FaturamentoBruto == 0 && p.TotalEntradas == 0
+}
+
+type OperacaoResumo struct {
+	TipoOperacao string  `json:"tipo_operacao"`
+	Tipo         string  `json:"tipo"` // ENTRADA or SAIDA
+	Valor        float64 `json:"valor"`
+	Icms         float64 `json:"icms"`
+}
+
+// ApuracaoResumo is the month with its comparisons.
+type ApuracaoResumo struct {
+	CompanyName string `json:"company_name"`
+	CNPJ        string `json:"cnpj"`
+	ApuracaoPeriodo
+	// Previous month
+	PeriodoAnterior             string  `json:"periodo_anterior"`
+	FaturamentoAnterior         float64 `json:"faturamento_anterior"`
+	IcmsAPagarAnterior          float64 `json:"icms_a_pagar_anterior"`
+	TotalNFesAnterior           int     `json:"total_nfes_anterior"`
+	AliquotaEfetivaICMSAnterior float64 `json:"aliquota_efetiva_icms_anterior"`
+	// Same month last year
+	PeriodoAnoAnterior             string  `json:"periodo_ano_anterior"`
+	FaturamentoAnoAnterior         float64 `json:"faturamento_ano_anterior"`
+	IcmsAPagarAnoAnterior          float64 `json:"icms_a_pagar_ano_anterior"`
+	TotalNFesAnoAnterior           int     `json:"total_nfes_ano_anterior"`
+	AliquotaEfetivaICMSAnoAnterior float64 `json:"aliquota_efetiva_icms_ano_anterior"`
+	// Trends of the main indicators and the variations beyond the limits
+	Tendencias []Tendencia `json:"tendencias"`
+	Anomalias  []Anomalia  `json:"anomalias"`
+	// Import jobs info
+	UltimaImportacao string `json:"ultima_importacao"`
+	TotalJobs        int    `json:"total_jobs"`
+}
+
+// Tendencia compares an indicator with the previous month (Mes) and with the
+// same month last year (Ano); either is nil when that month has no data.
+type Tendencia struct {
+	Indicador string    `json:"indicador"`
+	Descricao string    `json:"descricao"`
+	Taxa      bool      `json:"taxa"` // effective rate (%), varies in p.p.
+	Atual     float64   `json:"atual"`
+	Mes       *Variacao `json:"mes"`
+	Ano       *Variacao `json:"ano"`
+}
+
+// Variacao is the change against one base month: percent for amounts,
+// percentage points for rates.
+type Variacao struct {
+	Periodo   string  `json:"periodo"`
+	Base      float64 `json:"base"`
+	Variacao  float64 `json:"variacao"`
+	Tendencia string  `json:"tendencia"` // alta, queda or estavel
+}
+
+// Anomalia is a variation beyond the configured limit.
+type Anomalia struct {
+	Indicador string  `json:"indicador"`
+	Periodo   string  `json:"periodo"` // base month of the comparison
+	Variacao  float64 `json:"variacao"`
+	Limite    float64 `json:"limite"`
+	Mensagem  string  `json:"mensagem"`
+}
+
+// Variations smaller than these are reported as "estavel".
+const (
+	tendenciaEstavelPct = 2.0
+	tendenciaEstavelPP  = 0.1
+)
+
+// anomaliaLimites returns the variations that flag an anomaly: effective rate
+// moving more than ANOMALIA_ALIQUOTA_PP points (default 1) and amounts moving
+// more than ANOMALIA_VARIACAO_PCT percent (default 30).
+func anomaliaLimites() (pontos, percentual float64) {
+	return envFloat("ANOMALIA_ALIQUOTA_PP", 1), envFloat("ANOMALIA_VARIACAO_PCT", 30)
+}
+
+func envFloat(key string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(envOr(key, ""), 64); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// indicadoresResumo are the indicators followed by Tendencias.
+var indicadoresResumo = []struct {
+	id, descricao string
+	taxa          bool
+	valor         func(p *ApuracaoPeriodo) float64
+}{
+	{"faturamento", "Faturamento bruto", false, func(p *ApuracaoPeriodo) float64 { return p.FaturamentoBruto }},
+	{"icms_a_pagar", "ICMS a recolher", false, func(p *ApuracaoPeriodo) float64 { return p.IcmsAPagar }},
+	{"aliquota_efetiva_icms", "Alíquota efetiva de ICMS", true, func(p *ApuracaoPeriodo) float64 { return p.AliquotaEfetivaICMS }},
+	{"ibs_cbs_projetado", "IBS + CBS projetado", false, func(p *ApuracaoPeriodo) float64 { return p.IbsProjetado + p.CbsProjetado }},
+}
+
+// GetApuracaoResumo aggregates periodo (MM/YYYY) and the months it is compared
+// with. filiais restricts results to specific filial CNPJs (nil/empty = all filiais).
+func GetApuracaoResumo(db dbQuerier, companyID, periodo string, filiais []string) (*ApuracaoResumo, error) {
+	resumo := &ApuracaoResumo{}
+
+	// Get company info (cnpj may not exist in all schemas)
+	err := db.QueryRow(`
+		SELECT COALESCE(c.name, ''), COALESCE(c.trade_name, '')
+		FROM companies c WHERE c.id = $1
+	`, companyID).Scan(&resumo.CompanyName, &resumo.CNPJ)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("query company: %w", err)
+	}
+
+	rates := loadReformaRates(db)
+	atual, err := loadApuracaoPeriodo(db, companyID, periodo, filiais, rates)
+	if err != nil {
+		return nil, fmt.Errorf("query current period: %w", err)
+	}
+	resumo.ApuracaoPeriodo = *atual
+
+	anterior, err := loadApuracaoPeriodo(db, companyID, shiftPeriodo(periodo, -1), filiais, rates)
+	if err != nil {
+		return nil, fmt.Errorf("query previous period: %w", err)
+	}
+	resumo.PeriodoAnterior = anterior.Periodo
+	resumo.FaturamentoAnterior = anterior.FaturamentoBruto
+	resumo.IcmsAPagarAnterior = anterior.IcmsAPagar
+	resumo.TotalNFesAnterior = anterior.TotalNFes
+	resumo.AliquotaEfetivaICMSAnterior = anterior.AliquotaEfetivaICMS
+
+	anoAnterior, err := loadApuracaoPeriodo(db, companyID, shiftPeriodo(periodo, -12), filiais, rates)
+	if err != nil {
+		return nil, fmt.Errorf("query same period last year: %w", err)
+	}
+	resumo.PeriodoAnoAnterior = anoAnterior.Periodo
+	resumo.FaturamentoAnoAnterior = anoAnterior.FaturamentoBruto
+	resumo.IcmsAPagarAnoAnterior = anoAnterior.IcmsAPagar
+	resumo.TotalNFesAnoAnterior = anoAnterior.TotalNFes
+	resumo.AliquotaEfetivaICMSAnoAnterior = anoAnterior.AliquotaEfetivaICMS
+
+	resumo.Tendencias, resumo.Anomalias = compararPeriodos(atual, anterior, anoAnterior)
+
+	// Last import info
+	db.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(created_at)::text, 'nunca')
+		FROM import_jobs WHERE company_id = $1 AND status = 'completed'
+	`, companyID).Scan(&resumo.TotalJobs, &resumo.UltimaImportacao)
+
+	return resumo, nil
+}
+
+// shiftPeriodo moves a MM/YYYY period by months ("" if it doesn't parse).
+func shiftPeriodo(periodo string, months int) string {
+	t, err := time.Parse("01/2006", periodo)
+	if err != nil {
+		return ""
+	}
+	return t.AddDate(0, months, 0).Format("01/2006")
+}
+
+// reformaRates are the 2033 (full reform) rates, in fractions.
+type reformaRates struct {
+	ibs, cbs, reducICMS float64
+}
+
+func loadReformaRates(db dbQuerier) reformaRates {
+	var percIBSUF, percIBSMun, percCBS, percReducICMS float64
+	err := db.QueryRow(`SELECT perc_ibs_uf, perc_ibs_mun, perc_cbs, perc_reduc_icms FROM tabela_aliquotas WHERE ano = 2033`).
+		Scan(&percIBSUF, &percIBSMun, &percCBS, &percReducICMS)
+	if err != nil {
+		// Default 2033 rates
+		percIBSUF = 26.0
+		percIBSMun = 5.0
+		percCBS = 8.80
+		percReducICMS = 100.0
+	}
+	return reformaRates{
+		ibs:       (percIBSUF + percIBSMun) / 100.0,
+		cbs:       percCBS / 100.0,
+		reducICMS: percReducICMS / 100.0,
+	}
+}
+
+// buildFilialClause builds " AND filial_cnpj IN ($N, ...)" for optional filtering.
+// nextIdx is the 1-based index of the next query parameter.
+func buildFilialClause(filiais []string, nextIdx int) (string, []interface{}) {
+	if len(filiais) == 0 {
+		return "", nil
+	}
+	placeholders := make([]string, len(filiais))
+	args := make([]interface{}, len(filiais))
+	for i, c := range filiais {
+		placeholders[i] = fmt.Sprintf("$%d", nextIdx+i)
+		args[i] = c
+	}
+	return " AND filial_cnpj IN (" + strings.Join(placeholders, ", ") + ")", args
+}
+
+// loadApuracaoPeriodo aggregates one month. An empty periodo yields an empty month.
+func loadApuracaoPeriodo(db dbQuerier, companyID, periodo string, filiais []string, rates reformaRates) (*ApuracaoPeriodo, error) {
+	p := &ApuracaoPeriodo{Periodo: periodo}
+	if periodo == "" {
+		return p, nil
+	}
+	filialClause, filialArgs := buildFilialClause(filiais, 3)
+	args := append([]interface{}{companyID, periodo}, filialArgs...)
+
+	rows, err := db.Query(`
+		SELECT
+			mv.tipo,
+			mv.tipo_operacao,
+			COALESCE(SUM(mv.valor_contabil), 0) as valor,
+			COALESCE(SUM(mv.vl_icms_origem), 0) as icms
+		FROM mv_mercadorias_agregada mv
+		WHERE mv.company_id = $1 AND mv.mes_ano = $2`+filialClause+`
+		GROUP BY mv.tipo, mv.tipo_operacao
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var op OperacaoResumo
+		if err := rows.Scan(&op.Tipo, &op.TipoOperacao, &op.Valor, &op.Icms); err != nil {
+			return nil, fmt.Errorf("scan operation: %w", err)
+		}
+		p.Operacoes = append(p.Operacoes, op)
+		if op.Tipo == "ENTRADA" {
+			p.TotalEntradas += op.Valor
+			p.IcmsEntrada += op.Icms
+		} else {
+			p.TotalSaidas += op.Valor
+			p.IcmsSaida += op.Icms
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	p.FaturamentoBruto = p.TotalSaidas
+	p.IcmsAPagar = math.Max(p.IcmsSaida-p.IcmsEntrada, 0)
+
+	db.QueryRow(`
+		SELECT COUNT(DISTINCT mv.filial_cnpj || mv.mes_ano || mv.tipo_operacao)
+		FROM mv_mercadorias_agregada mv
+		WHERE mv.company_id = $1 AND mv.mes_ano = $2`+filialClause, args...).Scan(&p.TotalNFes)
+
+	// IBS/CBS projections using same logic as Dashboard (year 2033 = full reform):
+	// NET calculation (Debit - Credit), excludes CFOP T and O
+	ibsCbsRows, err := db.Query(`
+		SELECT
+			tipo,
+			COALESCE(SUM(CASE WHEN tipo_cfop NOT IN ('T', 'O') THEN valor_contabil ELSE 0 END), 0) as taxable_valor,
+			COALESCE(SUM(CASE WHEN tipo_cfop NOT IN ('T', 'O') THEN vl_icms_origem ELSE 0 END), 0) as taxable_icms
+		FROM mv_mercadorias_agregada
+		WHERE company_id = $1 AND mes_ano = $2`+filialClause+`
+		GROUP BY tipo
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer ibsCbsRows.Close()
+	var ibsDebit, ibsCredit, cbsDebit, cbsCredit float64
+	for ibsCbsRows.Next() {
+		var tipo string
+		var valTax, icmsTax float64
+		if err := ibsCbsRows.Scan(&tipo, &valTax, &icmsTax); err != nil {
+			continue
+		}
+		base := valTax - icmsTax*(1.0-rates.reducICMS)
+		if tipo == "SAIDA" {
+			ibsDebit = base * rates.ibs
+			cbsDebit = base * rates.cbs
+		} else {
+			ibsCredit = base * rates.ibs
+			cbsCredit = base * rates.cbs
+		}
+	}
+	p.IbsProjetado = math.Max(ibsDebit-ibsCredit, 0)
+	p.CbsProjetado = math.Max(cbsDebit-cbsCredit, 0)
+
+	// Alíquotas efetivas (% sobre faturamento bruto)
+	if p.FaturamentoBruto > 0 {
+		p.AliquotaEfetivaICMS = math.Round((p.IcmsAPagar/p.FaturamentoBruto)*10000) / 100
+		p.AliquotaEfetivaIBS = math.Round((p.IbsProjetado/p.FaturamentoBruto)*10000) / 100
+		p.AliquotaEfetivaCBS = math.Round((p.CbsProjetado/p.FaturamentoBruto)*10000) / 100
+		p.AliquotaEfetivaTotalReforma = math.Round(((p.IbsProjetado+p.CbsProjetado)/p.FaturamentoBruto)*10000) / 100
+	}
+	return p, nil
+}
+
+// compararPeriodos builds the trend of each indicator and flags the
+// variations beyond anomaliaLimites.
+func compararPeriodos(atual, anterior, anoAnterior *ApuracaoPeriodo) ([]Tendencia, []Anomalia) {
+	limitePP, limitePct := anomaliaLimites()
+	var tendencias []Tendencia
+	var anomalias []Anomalia
+	for _, ind := range indicadoresResumo {
+		t := Tendencia{Indicador: ind.id, Descricao: ind.descricao, Taxa: ind.taxa, Atual: ind.valor(atual)}
+		variacao := func(base *ApuracaoPeriodo) *Variacao {
+			if base.SemDados() || (ind.taxa && (atual.FaturamentoBruto == 0 || base.FaturamentoBruto == 0)) {
+				return nil
+			}
+			v := &Variacao{Periodo: base.Periodo, Base: ind.valor(base)}
+			estavel := tendenciaEstavelPP
+			if ind.taxa {
+				v.Variacao = t.Atual - v.Base
+			} else {
+				if v.Base <= 0 {
+					return nil
+				}
+				v.Variacao = VariacaoPercentual(t.Atual, v.Base)
+				estavel = tendenciaEstavelPct
+			}
+			switch {
+			case v.Variacao >= estavel:
+				v.Tendencia = "alta"
+			case v.Variacao <= -estavel:
+				v.Tendencia = "queda"
+			default:
+				v.Tendencia = "estavel"
+			}
+			return v
+		}
+		t.Mes = variacao(anterior)
+		t.Ano = variacao(anoAnterior)
+		tendencias = append(tendencias, t)
+
+		limite := limitePct
+		if ind.taxa {
+			limite = limitePP
+		}
+		for _, v := range []*Variacao{t.Mes, t.Ano} {
+			if v != nil && math.Abs(v.Variacao) > limite {
+				anomalias = append(anomalias, Anomalia{
+					Indicador: ind.id,
+					Periodo:   v.Periodo,
+					Variacao:  v.Variacao,
+					Limite:    limite,
+					Mensagem:  t.descreverVariacao(v),
+				})
+			}
+		}
+	}
+	return tendencias, anomalias
+}
+
+// VariacaoPercentual is the change from base to atual, in percent.
+func VariacaoPercentual(atual, base float64) float64 {
+	if base == 0 {
+		return 0
+	}
+	return (atual - base) / base * 100
+}
+
+// descreverVariacao writes v in words, e.g. "Alíquota efetiva de ICMS subiu
+// 1.35 p.p. em relação a 02/2026 (7.53% → 8.88%)".
+func (t Tendencia) descreverVariacao(v *Variacao) string {
+	verbo := "subiu"
+	if v.Variacao < 0 {
+		verbo = "caiu"
+	}
+	if t.Taxa {
+		return fmt.Sprintf("%s %s %.2f p.p. em relação a %s (%.2f%% → %.2f%%)",
+			t.Descricao, verbo, math.Abs(v.Variacao), v.Periodo, v.Base, t.Atual)
+	}
+	return fmt.Sprintf("%s %s %.1f%% em relação a %s (R$ %s → R$ %s)",
+		t.Descricao, verbo, math.Abs(v.Variacao), v.Periodo, formatEmailBRL(v.Base), formatEmailBRL(t.Atual))
+}
+
+// TaxComparison fills the email/PDF data of the executive summary; the
+// créditos em risco are left to the caller.
+func (r *ApuracaoResumo) TaxComparison() TaxComparisonData {
+	return TaxComparisonData{
+		IcmsAPagar:                     r.IcmsAPagar,
+		IbsProjetado:                   r.IbsProjetado,
+		CbsProjetado:                   r.CbsProjetado,
+		FaturamentoBruto:               r.FaturamentoBruto,
+		TotalEntradas:                  r.TotalEntradas,
+		IcmsSaida:                      r.IcmsSaida,
+		IcmsEntrada:                    r.IcmsEntrada,
+		AliquotaEfetivaICMS:            r.AliquotaEfetivaICMS,
+		AliquotaEfetivaIBS:             r.AliquotaEfetivaIBS,
+		AliquotaEfetivaCBS:             r.AliquotaEfetivaCBS,
+		AliquotaEfetivaTotalReforma:    r.AliquotaEfetivaTotalReforma,
+		PeriodoAnterior:                r.PeriodoAnterior,
+		FaturamentoAnterior:            r.FaturamentoAnterior,
+		IcmsAPagarAnterior:             r.IcmsAPagarAnterior,
+		AliquotaEfetivaICMSAnterior:    r.AliquotaEfetivaICMSAnterior,
+		PeriodoAnoAnterior:             r.PeriodoAnoAnterior,
+		FaturamentoAnoAnterior:         r.FaturamentoAnoAnterior,
+		IcmsAPagarAnoAnterior:          r.IcmsAPagarAnoAnterior,
+		AliquotaEfetivaICMSAnoAnterior: r.AliquotaEfetivaICMSAnoAnterior,
+		Anomalias:                      r.Anomalias,
+	}
+}
+
+// ComparativoPrompt is the comparison part of the AI prompt: each indicator
+// against the previous month and the same month last year, and the anomalies.
+func (r *ApuracaoResumo) ComparativoPrompt() string {
+	var sb strings.Builder
+	secao := func(titulo string, variacao func(t Tendencia) *Variacao) {
+		var linhas []string
+		for _, t := range r.Tendencias {
+			v := variacao(t)
+			if v == nil {
+				continue
+			}
+			if t.Taxa {
+				linhas = append(linhas, fmt.Sprintf("- %s: %.2f%% (variação: %+.2f p.p., %s)\n", t.Descricao, v.Base, v.Variacao, v.Tendencia))
+			} else {
+				linhas = append(linhas, fmt.Sprintf("- %s: R$ %.2f (variação: %+.1f%%, %s)\n", t.Descricao, v.Base, v.Variacao, v.Tendencia))
+			}
+		}
+		if len(linhas) > 0 {
+			sb.WriteString(titulo)
+			sb.WriteString(strings.Join(linhas, ""))
+		}
+	}
+	secao(fmt.Sprintf("\nCOMPARATIVO COM O MÊS ANTERIOR (%s):\n", r.PeriodoAnterior), func(t Tendencia) *Variacao { return t.Mes })
+	secao(fmt.Sprintf("\nCOMPARATIVO COM O MESMO MÊS DO ANO ANTERIOR (%s):\n", r.PeriodoAnoAnterior), func(t Tendencia) *Variacao { return t.Ano })
+
+	if len(r.Anomalias) > 0 {
+		sb.WriteString("\nALERTAS DE VARIAÇÃO (fora do padrão — comente cada um):\n")
+		for _, a := range r.Anomalias {
+			sb.WriteString("- " + a.Mensagem + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// AnomaliasMarkdown lists the anomalies for the fallback narratives ("" if none).
+func (r *ApuracaoResumo) AnomaliasMarkdown() string {
+	if len(r.Anomalias) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("### Pontos de Atenção\n\n")
+	for _, a := range r.Anomalias {
+		sb.WriteString("- " + a.Mensagem + "\n")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
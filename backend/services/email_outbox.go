@@ -0,0 +1,60 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"net/textproto"
+)
+
+// Emails are not sent inline: the Send* functions render the message and
+// insert it into email_outbox, and the worker's email sender delivers it with
+// retries (see worker.StartEmailSender). An SMTP outage delays the email
+// instead of losing it or failing the caller.
+
+// emailQueued wakes the sender of this instance as soon as something is
+// queued; other instances pick it up on their next poll.
+var emailQueued = make(chan struct{}, 1)
+
+// EmailQueued fires after an email is added to the outbox.
+func EmailQueued() <-chan struct{} { return emailQueued }
+
+// queueEmail stores the complete MIME message for to.
+func queueEmail(db *sql.DB, config *EmailConfig, template string, to ReportRecipient, rendered *RenderedEmail, attachments []Attachment) error {
+	msg := buildReportMessage(config, to, rendered, attachments)
+	_, err := db.Exec(`
+		INSERT INTO email_outbox (template, to_email, subject, message, delivery_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid)
+	`, template, to.Email, rendered.Subject, msg, to.DeliveryID)
+	if err != nil {
+		return err
+	}
+	select {
+	case emailQueued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// DeliverEmail sends an already assembled message (an email_outbox row).
+func DeliverEmail(config *EmailConfig, to string, msg []byte) error {
+	return sendMail(config, []string{to}, msg)
+}
+
+// EmailRejectedError is a permanent (5xx) refusal of the recipient or of the
+// message. Retrying won't help, so the outbox records it as a bounce.
+type EmailRejectedError struct {
+	Code int
+	err  error
+}
+
+func (e *EmailRejectedError) Error() string { return e.err.Error() }
+func (e *EmailRejectedError) Unwrap() error { return e.err }
+
+// rejection wraps err in *EmailRejectedError when the server answered 5xx.
+func rejection(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return &EmailRejectedError{Code: reply.Code, err: err}
+	}
+	return err
+}
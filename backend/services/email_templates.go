@@ -0,0 +1,295 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Email templates, one pair of files per template under
+// templates/email/<locale>/: <name>.html (html/template, may use layout.html)
+// and <name>.txt (text/template, defines "subject" and renders the plain-text
+// part). Files are read on every render, so wording can be changed on disk
+// without a rebuild.
+const (
+	EmailTemplateResumoExecutivo  = "resumo_executivo"
+	EmailTemplateRelatorio        = "relatorio"
+	EmailTemplateRedefinicaoSenha = "redefinicao_senha"
+)
+
+// EmailTemplates lists the templates, as accepted by the preview endpoint.
+var EmailTemplates = []string{EmailTemplateResumoExecutivo, EmailTemplateRelatorio, EmailTemplateRedefinicaoSenha}
+
+// DefaultEmailLocale is used when no locale is asked for (EMAIL_LOCALE
+// overrides it) and for any file missing from a locale's directory.
+const DefaultEmailLocale = "pt-BR"
+
+// RenderedEmail is a template rendered for one recipient.
+type RenderedEmail struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// emailTemplatesDir resolves the templates directory (EMAIL_TEMPLATES_DIR)
+// whether the binary runs from backend/ or from the repository root.
+func emailTemplatesDir() string {
+	if dir := os.Getenv("EMAIL_TEMPLATES_DIR"); dir != "" {
+		return dir
+	}
+	dir := filepath.Join("templates", "email")
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join("backend", dir)); err == nil {
+			dir = filepath.Join("backend", dir)
+		}
+	}
+	return dir
+}
+
+// emailTemplateFile returns the path of file for locale, falling back to the
+// default locale when that locale has no such file.
+func emailTemplateFile(locale, file string) (string, error) {
+	dir := emailTemplatesDir()
+	if locale == "" {
+		locale = os.Getenv("EMAIL_LOCALE")
+	}
+	for _, l := range []string{locale, DefaultEmailLocale} {
+		if l == "" || strings.ContainsAny(l, `/\.`) {
+			continue
+		}
+		path := filepath.Join(dir, l, file)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("template de e-mail %s não encontrado em %s", file, dir)
+}
+
+var emailTextFuncs = texttemplate.FuncMap{
+	"brl":   formatEmailBRL,
+	"upper": strings.ToUpper,
+}
+
+var emailHTMLFuncs = htmltemplate.FuncMap{
+	"brl":      formatEmailBRL,
+	"variacao": emailVariacaoHTML,
+}
+
+// renderEmail renders the subject, text and HTML of template name.
+func renderEmail(name, locale string, data interface{}) (*RenderedEmail, error) {
+	txtPath, err := emailTemplateFile(locale, name+".txt")
+	if err != nil {
+		return nil, err
+	}
+	htmlPath, err := emailTemplateFile(locale, name+".html")
+	if err != nil {
+		return nil, err
+	}
+	layoutPath, err := emailTemplateFile(locale, "layout.html")
+	if err != nil {
+		return nil, err
+	}
+
+	txt, err := texttemplate.New(filepath.Base(txtPath)).Funcs(emailTextFuncs).ParseFiles(txtPath)
+	if err != nil {
+		return nil, err
+	}
+	page, err := htmltemplate.New(filepath.Base(htmlPath)).Funcs(emailHTMLFuncs).ParseFiles(htmlPath, layoutPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var subject, text, body bytes.Buffer
+	if err := txt.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("assunto do e-mail %s: %w", name, err)
+	}
+	if err := txt.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("texto do e-mail %s: %w", name, err)
+	}
+	if err := page.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("HTML do e-mail %s: %w", name, err)
+	}
+	return &RenderedEmail{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    body.String(),
+	}, nil
+}
+
+// emailVariacaoHTML renders a percent change with a colored arrow.
+func emailVariacaoHTML(v float64) htmltemplate.HTML {
+	switch {
+	case v > 0:
+		return htmltemplate.HTML(fmt.Sprintf(`<span style="color:#10b981">&#8593; +%.1f%%</span>`, v))
+	case v < 0:
+		return htmltemplate.HTML(fmt.Sprintf(`<span style="color:#e53e3e">&#8595; %.1f%%</span>`, v))
+	}
+	return "0,0%"
+}
+
+// emailPage is what layout.html needs: the header, the info box, the button
+// to the app and the unsubscribe footer.
+type emailPage struct {
+	Titulo         string
+	Empresa        string
+	Periodo        string
+	GeradoEm       string
+	AppURL         string
+	PainelPath     string
+	UnsubscribeURL string
+}
+
+func newEmailPage(to ReportRecipient, titulo, companyName, periodo, painelPath string) emailPage {
+	return emailPage{
+		Titulo:         titulo,
+		Empresa:        companyName,
+		Periodo:        periodo,
+		GeradoEm:       getTimeBrasil(),
+		AppURL:         emailAppURL(),
+		PainelPath:     painelPath,
+		UnsubscribeURL: to.UnsubscribeURL,
+	}
+}
+
+func emailAppURL() string {
+	if appURL := os.Getenv("APP_URL"); appURL != "" {
+		return appURL
+	}
+	return "http://localhost:3000"
+}
+
+// resumoExecutivoEmail is the data of resumo_executivo.html/.txt.
+type resumoExecutivoEmail struct {
+	emailPage
+	Dados          TaxComparisonData
+	NarrativaHTML  htmltemplate.HTML
+	NarrativaTexto string
+}
+
+func (e resumoExecutivoEmail) TotalIbsCbs() float64 {
+	return e.Dados.IbsProjetado + e.Dados.CbsProjetado
+}
+
+// Comparativo reports whether there is a previous period to compare with.
+func (e resumoExecutivoEmail) Comparativo() bool {
+	return e.Dados.PeriodoAnterior != "" && e.Dados.FaturamentoAnterior != 0
+}
+
+func (e resumoExecutivoEmail) VariacaoFaturamento() float64 {
+	return VariacaoPercentual(e.Dados.FaturamentoBruto, e.Dados.FaturamentoAnterior)
+}
+
+func (e resumoExecutivoEmail) VariacaoIcms() float64 {
+	if e.Dados.IcmsAPagarAnterior <= 0 {
+		return 0
+	}
+	return VariacaoPercentual(e.Dados.IcmsAPagar, e.Dados.IcmsAPagarAnterior)
+}
+
+// VariacaoAliquota is the change of the effective ICMS rate, in points.
+func (e resumoExecutivoEmail) VariacaoAliquota() float64 {
+	return e.Dados.AliquotaEfetivaICMS - e.Dados.AliquotaEfetivaICMSAnterior
+}
+
+// ComparativoAnual reports whether the same month last year has data.
+func (e resumoExecutivoEmail) ComparativoAnual() bool {
+	return e.Dados.PeriodoAnoAnterior != "" && e.Dados.FaturamentoAnoAnterior != 0
+}
+
+func (e resumoExecutivoEmail) VariacaoFaturamentoAnual() float64 {
+	return VariacaoPercentual(e.Dados.FaturamentoBruto, e.Dados.FaturamentoAnoAnterior)
+}
+
+func (e resumoExecutivoEmail) VariacaoIcmsAnual() float64 {
+	if e.Dados.IcmsAPagarAnoAnterior <= 0 {
+		return 0
+	}
+	return VariacaoPercentual(e.Dados.IcmsAPagar, e.Dados.IcmsAPagarAnoAnterior)
+}
+
+func (e resumoExecutivoEmail) VariacaoAliquotaAnual() float64 {
+	return e.Dados.AliquotaEfetivaICMS - e.Dados.AliquotaEfetivaICMSAnoAnterior
+}
+
+// emailBarra is one row of the table-based bar chart (SVG is not supported by
+// most email clients).
+type emailBarra struct {
+	Label, Cor, Nota string
+	Valor            float64
+	Pct              int
+}
+
+// Barra sizes a bar relative to the largest of ICMS, IBS, CBS and IBS+CBS.
+func (e resumoExecutivoEmail) Barra(label, cor, nota string, valor float64) emailBarra {
+	maxVal := e.TotalIbsCbs()
+	for _, v := range []float64{e.Dados.IcmsAPagar, e.Dados.IbsProjetado, e.Dados.CbsProjetado} {
+		if v > maxVal {
+			maxVal = v
+		}
+	}
+	if maxVal == 0 {
+		maxVal = 1
+	}
+	pct := int(valor / maxVal * 100)
+	if valor > 0 && pct < 3 {
+		pct = 3
+	}
+	return emailBarra{Label: label, Cor: cor, Nota: nota, Valor: valor, Pct: pct}
+}
+
+// relatorioEmail is the data of relatorio.html/.txt.
+type relatorioEmail struct {
+	emailPage
+	Sections []ReportSection
+}
+
+// redefinicaoSenhaEmail is the data of redefinicao_senha.html/.txt.
+type redefinicaoSenhaEmail struct {
+	ResetLink string
+}
+
+// RenderEmailPreview renders template name with sample data, for checking
+// wording and layout without sending anything.
+func RenderEmailPreview(name, locale string) (*RenderedEmail, error) {
+	to := ReportRecipient{Email: "gestor@exemplo.com.br", UnsubscribeURL: ReportUnsubscribeURL("exemplo")}
+	switch name {
+	case EmailTemplateResumoExecutivo:
+		narrativa := convertMarkdownToHTML("## Destaques\n\n- O faturamento cresceu **8,5%** em relação ao mês anterior.\n- Revise os fornecedores sem IBS/CBS destacados nas NF-e.")
+		return renderEmail(name, locale, resumoExecutivoEmail{
+			emailPage: newEmailPage(to, "Resumo Executivo", "Empresa Exemplo Ltda", "03/2026", "/relatorios/resumo-executivo"),
+			Dados: TaxComparisonData{
+				IcmsAPagar: 182350.40, IbsProjetado: 231870.15, CbsProjetado: 115280.90,
+				FaturamentoBruto: 2450000, TotalEntradas: 1620000, IcmsSaida: 441000, IcmsEntrada: 258649.60,
+				AliquotaEfetivaICMS: 7.44, AliquotaEfetivaIBS: 9.46, AliquotaEfetivaCBS: 4.71, AliquotaEfetivaTotalReforma: 14.17,
+				PeriodoAnterior: "02/2026", FaturamentoAnterior: 2258000, IcmsAPagarAnterior: 170120.00, AliquotaEfetivaICMSAnterior: 7.53,
+				PeriodoAnoAnterior: "03/2025", FaturamentoAnoAnterior: 2105000, IcmsAPagarAnoAnterior: 132460.00, AliquotaEfetivaICMSAnoAnterior: 6.29,
+				Anomalias: []Anomalia{{
+					Indicador: "aliquota_efetiva_icms", Periodo: "03/2025", Variacao: 1.15, Limite: 1,
+					Mensagem: "Alíquota efetiva de ICMS subiu 1.15 p.p. em relação a 03/2025 (6.29% → 7.44%)",
+				}},
+				CreditosEmRiscoTotal: 38420.75, CreditosNFeSemIBS: 25110.30, CreditosSimplesNacional: 13310.45,
+			},
+			NarrativaHTML:  htmltemplate.HTML(narrativa),
+			NarrativaTexto: stripHTMLTags(narrativa),
+		})
+	case EmailTemplateRelatorio:
+		return renderEmail(name, locale, relatorioEmail{
+			emailPage: newEmailPage(to, ReportNames[ReportCreditosRisco], "Empresa Exemplo Ltda", "03/2026", "/apuracao/creditos-perdidos"),
+			Sections: []ReportSection{{
+				Title: "Créditos IBS/CBS em risco",
+				Rows: []ReportRow{
+					{Label: "NF-e sem IBS/CBS (42 notas)", Value: "R$ 25.110,30"},
+					{Label: "Fornecedores do Simples Nacional (7)", Value: "R$ 13.310,45"},
+					{Label: "Total em risco", Value: "R$ 38.420,75", Destaque: true},
+				},
+			}},
+		})
+	case EmailTemplateRedefinicaoSenha:
+		return renderEmail(name, locale, redefinicaoSenhaEmail{ResetLink: emailAppURL() + "/reset-senha?token=exemplo"})
+	}
+	return nil, fmt.Errorf("template de e-mail desconhecido: %s", name)
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LLMProvider is one chat-completion backend. AIClient chains several of them
+// (LLM_PROVIDERS) and falls through to the next when one fails, so the AI
+// features keep working when a hosted API is rate-limited or offline.
+type LLMProvider interface {
+	// Name identifies the provider in logs, metrics and AIResponse.Provider.
+	Name() string
+	// Complete runs a single request — no retries, those belong to AIClient.
+	Complete(ctx context.Context, req LLMRequest) (*LLMResponse, error)
+}
+
+// LLMMessage is one conversation turn ("user" or "assistant").
+type LLMMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// LLMRequest is the provider-neutral request. An empty Model selects the
+// provider's configured default.
+type LLMRequest struct {
+	System    string
+	Messages  []LLMMessage
+	Model     string
+	MaxTokens int
+}
+
+// LLMResponse keeps the visible answer and any separate reasoning channel
+// apart; AIClient decides which one to use (see pickRawText).
+type LLMResponse struct {
+	Content      string
+	Reasoning    string
+	InputTokens  int
+	OutputTokens int
+	Model        string
+}
+
+// RateLimitError is returned by providers on HTTP 429 so AIClient can try the
+// provider's fallback model before moving to the next provider.
+type RateLimitError struct {
+	Provider string
+	Body     string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: API returned status 429: %s", e.Provider, e.Body)
+}
+
+// modelFallback is implemented by providers that have a cheaper model to use
+// when the default one is rate-limited (Z.AI flash tiers).
+type modelFallback interface {
+	FallbackModel() string
+}
+
+// LoadLLMProviders builds the provider chain from LLM_PROVIDERS, a comma
+// separated list tried in order:
+//
+//	zai        Z.AI GLM (ZAI_API_KEY, ZAI_MODEL)
+//	openai     any OpenAI-compatible endpoint, e.g. Ollama or llama.cpp
+//	           (LLM_OPENAI_URL, LLM_OPENAI_API_KEY, LLM_OPENAI_MODEL)
+//	anthropic  Anthropic messages API (ANTHROPIC_API_KEY, ANTHROPIC_MODEL, ANTHROPIC_URL)
+//	stub       deterministic offline responses (LLM_STUB_RESPONSE)
+//
+// Entries missing their required settings are skipped. The default is "zai",
+// matching the behaviour before providers were configurable.
+func LoadLLMProviders() []LLMProvider {
+	spec := os.Getenv("LLM_PROVIDERS")
+	if strings.TrimSpace(spec) == "" {
+		spec = "zai"
+	}
+
+	var providers []LLMProvider
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "":
+			continue
+		case "zai":
+			if p := newZAIProvider(); p != nil {
+				providers = append(providers, p)
+			}
+		case "openai", "local", "ollama":
+			if p := newOpenAICompatFromEnv(); p != nil {
+				providers = append(providers, p)
+			}
+		case "anthropic":
+			if p := newAnthropicFromEnv(); p != nil {
+				providers = append(providers, p)
+			}
+		case "stub":
+			providers = append(providers, NewStubProvider(os.Getenv("LLM_STUB_RESPONSE")))
+		default:
+			fmt.Printf("[AI] Unknown LLM provider %q in LLM_PROVIDERS — ignored\n", name)
+		}
+	}
+	return providers
+}
+
+func envOr(key, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return fallback
+}
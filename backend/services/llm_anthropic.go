@@ -0,0 +1,127 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const anthropicVersion = "2023-06-01"
+
+// AnthropicProvider talks to an Anthropic-style /v1/messages endpoint.
+type AnthropicProvider struct {
+	url        string
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+// NewAnthropicProvider creates a provider for the messages API at url.
+func NewAnthropicProvider(url, apiKey, model string) *AnthropicProvider {
+	return &AnthropicProvider{url: url, apiKey: apiKey, model: model, httpClient: &http.Client{}}
+}
+
+func newAnthropicFromEnv() *AnthropicProvider {
+	apiKey := os.Getenv("ANTHROPIC_API_KEY")
+	if apiKey == "" {
+		fmt.Println("[AI] anthropic provider needs ANTHROPIC_API_KEY — skipped")
+		return nil
+	}
+	return NewAnthropicProvider(
+		envOr("ANTHROPIC_URL", "https://api.anthropic.com/v1/messages"),
+		apiKey,
+		envOr("ANTHROPIC_MODEL", "claude-3-5-haiku-latest"),
+	)
+}
+
+func (p *AnthropicProvider) Name() string { return "anthropic" }
+
+type anthropicRequest struct {
+	Model     string       `json:"model"`
+	MaxTokens int          `json:"max_tokens"`
+	System    string       `json:"system,omitempty"`
+	Messages  []LLMMessage `json:"messages"`
+}
+
+type anthropicResponse struct {
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *AnthropicProvider) Complete(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	model := req.Model
+	if model == "" {
+		model = p.model
+	}
+
+	body, err := json.Marshal(anthropicRequest{Model: model, MaxTokens: req.MaxTokens, System: req.System, Messages: req.Messages})
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", p.apiKey)
+	httpReq.Header.Set("anthropic-version", anthropicVersion)
+
+	resp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &RateLimitError{Provider: p.Name(), Body: string(respBody)}
+	}
+
+	var msgResp anthropicResponse
+	if err := json.Unmarshal(respBody, &msgResp); err != nil {
+		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+	if msgResp.Error != nil {
+		return nil, fmt.Errorf("API error: %s - %s", msgResp.Error.Type, msgResp.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var sb strings.Builder
+	for _, block := range msgResp.Content {
+		if block.Type == "text" {
+			sb.WriteString(block.Text)
+		}
+	}
+	if msgResp.Model != "" {
+		model = msgResp.Model
+	}
+	return &LLMResponse{
+		Content:      strings.TrimSpace(sb.String()),
+		InputTokens:  msgResp.Usage.InputTokens,
+		OutputTokens: msgResp.Usage.OutputTokens,
+		Model:        model,
+	}, nil
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Z.AI GLM Models
+const (
+	ModelFlash         = "glm-4.7-flash" // Free tier - primary
+	ModelFlashFallback = "glm-4.5-flash" // Free tier - fallback for rate limits
+)
+
+const zaiChatURL = "https://api.z.ai/api/paas/v4/chat/completions"
+
+// OpenAICompatProvider talks to any /chat/completions endpoint: Z.AI, OpenAI,
+// or a local Ollama / llama.cpp server (no API key needed).
+type OpenAICompatProvider struct {
+	name          string
+	url           string
+	apiKey        string
+	model         string
+	fallbackModel string
+	httpClient    *http.Client
+}
+
+// NewOpenAICompatProvider creates a provider for an OpenAI-compatible URL
+// (the full .../chat/completions path).
+func NewOpenAICompatProvider(name, url, apiKey, model string) *OpenAICompatProvider {
+	return &OpenAICompatProvider{
+		name:       name,
+		url:        url,
+		apiKey:     apiKey,
+		model:      model,
+		httpClient: &http.Client{}, // deadlines come from the request context
+	}
+}
+
+func newZAIProvider() *OpenAICompatProvider {
+	apiKey := os.Getenv("ZAI_API_KEY")
+	if apiKey == "" {
+		return nil
+	}
+	p := NewOpenAICompatProvider("zai", zaiChatURL, apiKey, envOr("ZAI_MODEL", ModelFlash))
+	if p.model == ModelFlash {
+		p.fallbackModel = ModelFlashFallback
+	}
+	return p
+}
+
+func newOpenAICompatFromEnv() *OpenAICompatProvider {
+	url := os.Getenv("LLM_OPENAI_URL")
+	model := os.Getenv("LLM_OPENAI_MODEL")
+	if url == "" || model == "" {
+		fmt.Println("[AI] openai provider needs LLM_OPENAI_URL and LLM_OPENAI_MODEL — skipped")
+		return nil
+	}
+	return NewOpenAICompatProvider("openai", url, os.Getenv("LLM_OPENAI_API_KEY"), model)
+}
+
+func (p *OpenAICompatProvider) Name() string          { return p.name }
+func (p *OpenAICompatProvider) FallbackModel() string { return p.fallbackModel }
+
+// OpenAI-compatible request/response types
+type chatRequest struct {
+	Model     string        `json:"model"`
+	MaxTokens int           `json:"max_tokens"`
+	Messages  []chatMessage `json:"messages"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content          string `json:"content"`
+			ReasoningContent string `json:"reasoning_content"`
+		} `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *OpenAICompatProvider) Complete(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	model := req.Model
+	if model == "" {
+		model = p.model
+	}
+
+	// OpenAI-compatible format: system prompt goes as a message with role "system"
+	messages := make([]chatMessage, 0, len(req.Messages)+1)
+	if req.System != "" {
+		messages = append(messages, chatMessage{Role: "system", Content: req.System})
+	}
+	for _, m := range req.Messages {
+		messages = append(messages, chatMessage{Role: m.Role, Content: m.Content})
+	}
+
+	body, err := json.Marshal(chatRequest{Model: model, MaxTokens: req.MaxTokens, Messages: messages})
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &RateLimitError{Provider: p.name, Body: string(respBody)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var chatResp chatResponse
+	if err := json.Unmarshal(respBody, &chatResp); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	if chatResp.Error != nil {
+		return nil, fmt.Errorf("API error: %s - %s", chatResp.Error.Code, chatResp.Error.Message)
+	}
+
+	if len(chatResp.Choices) == 0 {
+		return nil, fmt.Errorf("empty response from API")
+	}
+
+	// GLM models may return text in reasoning_content instead of content
+	return &LLMResponse{
+		Content:      strings.TrimSpace(chatResp.Choices[0].Message.Content),
+		Reasoning:    strings.TrimSpace(chatResp.Choices[0].Message.ReasoningContent),
+		InputTokens:  chatResp.Usage.PromptTokens,
+		OutputTokens: chatResp.Usage.CompletionTokens,
+		Model:        model,
+	}, nil
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// StubProvider answers offline with deterministic text: the configured
+// response if set, otherwise a short Markdown report derived from a hash of
+// the prompt. It never fails, so it also works as the last link of a chain
+// in environments without network access.
+type StubProvider struct {
+	response string
+}
+
+// NewStubProvider creates a stub that always returns response (when non-empty).
+func NewStubProvider(response string) *StubProvider {
+	return &StubProvider{response: response}
+}
+
+func (p *StubProvider) Name() string { return "stub" }
+
+func (p *StubProvider) Complete(ctx context.Context, req LLMRequest) (*LLMResponse, error) {
+	var prompt strings.Builder
+	prompt.WriteString(req.System)
+	for _, m := range req.Messages {
+		prompt.WriteString(m.Content)
+	}
+
+	text := p.response
+	if text == "" {
+		h := fnv.New32a()
+		h.Write([]byte(prompt.String()))
+		text = fmt.Sprintf("## Resumo\n\nResposta simulada (stub %08x) — nenhum modelo de linguagem foi consultado.", h.Sum32())
+	}
+	return &LLMResponse{
+		Content:      text,
+		InputTokens:  len(strings.Fields(prompt.String())),
+		OutputTokens: len(strings.Fields(text)),
+		Model:        "stub",
+	}, nil
+}
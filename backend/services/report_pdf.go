@@ -0,0 +1,273 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"fb_apu01/pdf"
+)
+
+// Attachment is a file attached to a report email.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// PDFAttachment wraps a rendered report as an email attachment.
+func PDFAttachment(filename string, data []byte) Attachment {
+	return Attachment{Filename: filename, ContentType: "application/pdf", Data: data}
+}
+
+var filenameUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// ReportPDFFilename builds a download name like "resumo-executivo-03-2026.pdf".
+func ReportPDFFilename(titulo, periodo string) string {
+	name := strings.ToLower(foldAccents(titulo + " " + periodo))
+	return strings.Trim(filenameUnsafe.ReplaceAllString(name, "-"), "-") + ".pdf"
+}
+
+func foldAccents(s string) string {
+	return strings.NewReplacer(
+		"á", "a", "à", "a", "â", "a", "ã", "a", "é", "e", "ê", "e", "í", "i",
+		"ó", "o", "ô", "o", "õ", "o", "ú", "u", "ç", "c",
+		"Á", "A", "À", "A", "Â", "A", "Ã", "A", "É", "E", "Ê", "E", "Í", "I",
+		"Ó", "O", "Ô", "O", "Õ", "O", "Ú", "U", "Ç", "C",
+	).Replace(s)
+}
+
+// pdfFooter is printed at the bottom of every page of a report PDF.
+func pdfFooter() string {
+	return "© 2026 FBTax Cloud — Gerado em " + getTimeBrasil()
+}
+
+// TaxComparisonFromDadosBrutos rebuilds the email/PDF figures from the
+// dados_brutos JSON saved with an ai_reports row. Effective rates are only
+// stored by the worker, so they are recomputed from faturamento when absent.
+// Previous-period and créditos em risco figures are not stored and stay zero.
+func TaxComparisonFromDadosBrutos(raw []byte) (TaxComparisonData, error) {
+	var b struct {
+		Faturamento         float64 `json:"faturamento"`
+		TotalEntradas       float64 `json:"total_entradas"`
+		IcmsEntrada         float64 `json:"icms_entrada"`
+		IcmsSaida           float64 `json:"icms_saida"`
+		IcmsAPagar          float64 `json:"icms_a_pagar"`
+		IbsProjetado        float64 `json:"ibs_projetado"`
+		CbsProjetado        float64 `json:"cbs_projetado"`
+		AliquotaICMS        float64 `json:"aliquota_efetiva_icms"`
+		AliquotaIBS         float64 `json:"aliquota_efetiva_ibs"`
+		AliquotaCBS         float64 `json:"aliquota_efetiva_cbs"`
+		AliquotaTotalReform float64 `json:"aliquota_efetiva_total_reforma"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return TaxComparisonData{}, err
+		}
+	}
+	d := TaxComparisonData{
+		IcmsAPagar:                  b.IcmsAPagar,
+		IbsProjetado:                b.IbsProjetado,
+		CbsProjetado:                b.CbsProjetado,
+		FaturamentoBruto:            b.Faturamento,
+		TotalEntradas:               b.TotalEntradas,
+		IcmsSaida:                   b.IcmsSaida,
+		IcmsEntrada:                 b.IcmsEntrada,
+		AliquotaEfetivaICMS:         b.AliquotaICMS,
+		AliquotaEfetivaIBS:          b.AliquotaIBS,
+		AliquotaEfetivaCBS:          b.AliquotaCBS,
+		AliquotaEfetivaTotalReforma: b.AliquotaTotalReform,
+	}
+	if d.FaturamentoBruto > 0 && d.AliquotaEfetivaTotalReforma == 0 {
+		d.AliquotaEfetivaICMS = d.IcmsAPagar / d.FaturamentoBruto * 100
+		d.AliquotaEfetivaIBS = d.IbsProjetado / d.FaturamentoBruto * 100
+		d.AliquotaEfetivaCBS = d.CbsProjetado / d.FaturamentoBruto * 100
+		d.AliquotaEfetivaTotalReforma = d.AliquotaEfetivaIBS + d.AliquotaEfetivaCBS
+	}
+	return d, nil
+}
+
+// TaxComparisonBars is the ICMS x IBS x CBS chart of the executive summary,
+// with the same colors as the email.
+func TaxComparisonBars(d TaxComparisonData) []pdf.Bar {
+	ibsCbsTotal := d.IbsProjetado + d.CbsProjetado
+	return []pdf.Bar{
+		{Label: "ICMS (atual)", Note: "Regime atual", Value: d.IcmsAPagar, Text: "R$ " + formatEmailBRL(d.IcmsAPagar), Color: pdf.Hex("#3B82F6")},
+		{Label: "IBS Projetado", Note: "Novo imposto (2033)", Value: d.IbsProjetado, Text: "R$ " + formatEmailBRL(d.IbsProjetado), Color: pdf.Hex("#10B981")},
+		{Label: "CBS Projetado", Note: "Novo imposto (2033)", Value: d.CbsProjetado, Text: "R$ " + formatEmailBRL(d.CbsProjetado), Color: pdf.Hex("#F59E0B")},
+		{Label: "IBS + CBS", Note: "Substituirá ICMS+PIS/COFINS", Value: ibsCbsTotal, Text: "R$ " + formatEmailBRL(ibsCbsTotal), Color: pdf.Hex("#8B5CF6")},
+	}
+}
+
+// RenderExecutiveSummaryPDF renders the executive summary the way the email
+// shows it: period figures, the reform projection chart, effective rates,
+// comparison and créditos em risco when available, then the AI narrative.
+func RenderExecutiveSummaryPDF(companyName, periodo, narrativaMarkdown string, d TaxComparisonData) ([]byte, error) {
+	rep := pdf.NewReport("Resumo Executivo", companyName, pdfFooter())
+	rep.InfoBox(fmt.Sprintf("Empresa: %s  |  Período: %s  |  Gerado em: %s", companyName, periodo, getTimeBrasil()))
+
+	right := []pdf.Align{pdf.AlignLeft, pdf.AlignRight}
+	rep.Heading("Dados do Período")
+	rep.Table(pdf.Table{
+		Header: []string{"Indicador", "Valor"},
+		Widths: []float64{3, 2},
+		Align:  right,
+		Rows: []pdf.TableRow{
+			{Cells: []string{"Faturamento Bruto", "R$ " + formatEmailBRL(d.FaturamentoBruto)}},
+			{Cells: []string{"Total de Entradas", "R$ " + formatEmailBRL(d.TotalEntradas)}},
+			{Cells: []string{"ICMS Débito", "R$ " + formatEmailBRL(d.IcmsSaida)}},
+			{Cells: []string{"ICMS Crédito", "R$ " + formatEmailBRL(d.IcmsEntrada)}},
+			{Cells: []string{"ICMS a Recolher", "R$ " + formatEmailBRL(d.IcmsAPagar)}, Bold: true},
+		},
+	})
+
+	rep.Heading("Reforma Tributária — Projeção 2033")
+	rep.BarChart(TaxComparisonBars(d))
+
+	if d.FaturamentoBruto > 0 {
+		rep.Heading("Carga Tributária Efetiva (sobre faturamento)")
+		rep.Table(pdf.Table{
+			Header: []string{"Imposto", "Alíquota Efetiva", "Regime"},
+			Widths: []float64{3, 2, 2},
+			Align:  right,
+			Rows: []pdf.TableRow{
+				{Cells: []string{"ICMS a Recolher", fmt.Sprintf("%.2f%%", d.AliquotaEfetivaICMS), "Atual"}},
+				{Cells: []string{"IBS Projetado", fmt.Sprintf("%.2f%%", d.AliquotaEfetivaIBS), "Projeção 2033"}},
+				{Cells: []string{"CBS Projetado", fmt.Sprintf("%.2f%%", d.AliquotaEfetivaCBS), "Projeção 2033"}},
+				{Cells: []string{"Total IBS + CBS", fmt.Sprintf("%.2f%%", d.AliquotaEfetivaTotalReforma), "Projeção 2033"}, Bold: true},
+			},
+		})
+	}
+
+	comparativo := func(titulo, base string, faturamento, icms, aliquota float64) {
+		variacao := func(atual, anterior float64) string {
+			if anterior == 0 {
+				return "-"
+			}
+			return fmt.Sprintf("%+.1f%%", VariacaoPercentual(atual, anterior))
+		}
+		rows := []pdf.TableRow{
+			{Cells: []string{"Faturamento Bruto", "R$ " + formatEmailBRL(faturamento), "R$ " + formatEmailBRL(d.FaturamentoBruto), variacao(d.FaturamentoBruto, faturamento)}},
+			{Cells: []string{"ICMS a Recolher", "R$ " + formatEmailBRL(icms), "R$ " + formatEmailBRL(d.IcmsAPagar), variacao(d.IcmsAPagar, icms)}},
+		}
+		if aliquota > 0 {
+			rows = append(rows, pdf.TableRow{Cells: []string{"Alíquota Efetiva ICMS", fmt.Sprintf("%.2f%%", aliquota), fmt.Sprintf("%.2f%%", d.AliquotaEfetivaICMS), fmt.Sprintf("%+.2f p.p.", d.AliquotaEfetivaICMS-aliquota)}})
+		}
+		rep.Heading(titulo)
+		rep.Table(pdf.Table{
+			Header: []string{"Indicador", base, periodo, "Variação"},
+			Widths: []float64{3, 2, 2, 1.5},
+			Align:  []pdf.Align{pdf.AlignLeft, pdf.AlignRight, pdf.AlignRight, pdf.AlignRight},
+			Rows:   rows,
+		})
+	}
+	if d.PeriodoAnterior != "" && d.FaturamentoAnterior > 0 {
+		comparativo("Comparativo com Período Anterior", d.PeriodoAnterior, d.FaturamentoAnterior, d.IcmsAPagarAnterior, d.AliquotaEfetivaICMSAnterior)
+	}
+	if d.PeriodoAnoAnterior != "" && d.FaturamentoAnoAnterior > 0 {
+		comparativo("Comparativo com o Mesmo Mês do Ano Anterior", d.PeriodoAnoAnterior, d.FaturamentoAnoAnterior, d.IcmsAPagarAnoAnterior, d.AliquotaEfetivaICMSAnoAnterior)
+	}
+
+	if len(d.Anomalias) > 0 {
+		rep.Heading("Variações Fora do Padrão")
+		for _, a := range d.Anomalias {
+			rep.Bullet(a.Mensagem)
+		}
+	}
+
+	if d.CreditosEmRiscoTotal > 0 {
+		rep.Heading("Atenção: Créditos IBS+CBS em Risco")
+		rep.Table(pdf.Table{
+			Header: []string{"Origem", "Crédito estimado"},
+			Widths: []float64{3, 2},
+			Align:  right,
+			Rows: []pdf.TableRow{
+				{Cells: []string{"NF-e sem crédito IBS/CBS", "R$ " + formatEmailBRL(d.CreditosNFeSemIBS)}},
+				{Cells: []string{"Fornecedores do Simples Nacional", "R$ " + formatEmailBRL(d.CreditosSimplesNacional)}},
+				{Cells: []string{"Total em risco", "R$ " + formatEmailBRL(d.CreditosEmRiscoTotal)}, Bold: true},
+			},
+		})
+	}
+
+	if strings.TrimSpace(narrativaMarkdown) != "" {
+		rep.Heading("Análise da Inteligência Artificial")
+		renderMarkdownPDF(rep, narrativaMarkdown)
+	}
+	return rep.Bytes()
+}
+
+// ReportChart is an optional bar chart drawn above the sections of a report PDF.
+type ReportChart struct {
+	Title string
+	Bars  []pdf.Bar
+}
+
+// RenderReportPDF renders a sectioned report (the content of SendReportEmail)
+// as a PDF, with an optional chart before the tables.
+func RenderReportPDF(titulo, companyName, periodo string, sections []ReportSection, chart *ReportChart) ([]byte, error) {
+	rep := pdf.NewReport(titulo, companyName, pdfFooter())
+	rep.InfoBox(fmt.Sprintf("Empresa: %s  |  Período: %s  |  Gerado em: %s", companyName, periodo, getTimeBrasil()))
+
+	if chart != nil && len(chart.Bars) > 0 {
+		rep.Heading(chart.Title)
+		rep.BarChart(chart.Bars)
+	}
+	for _, sec := range sections {
+		rep.Heading(sec.Title)
+		rows := make([]pdf.TableRow, len(sec.Rows))
+		for i, row := range sec.Rows {
+			rows[i] = pdf.TableRow{Cells: []string{row.Label, row.Value}, Bold: row.Destaque}
+		}
+		rep.Table(pdf.Table{
+			Widths: []float64{3, 2},
+			Align:  []pdf.Align{pdf.AlignLeft, pdf.AlignRight},
+			Rows:   rows,
+		})
+	}
+	return rep.Bytes()
+}
+
+// renderMarkdownPDF lays out the subset of markdown the AI narrative uses:
+// headings, bullet lists, pipe tables and **bold** (printed as plain text).
+func renderMarkdownPDF(rep *pdf.Report, markdown string) {
+	var table [][]string
+	flushTable := func() {
+		if len(table) == 0 {
+			return
+		}
+		t := pdf.Table{Header: table[0]}
+		for _, cells := range table[1:] {
+			t.Rows = append(t.Rows, pdf.TableRow{Cells: cells})
+		}
+		rep.Table(t)
+		table = nil
+	}
+
+	for _, line := range strings.Split(markdown, "\n") {
+		line = strings.TrimSpace(strings.ReplaceAll(line, "**", ""))
+		if strings.HasPrefix(line, "|") {
+			cells := parseTableRow(line)
+			if len(cells) > 0 && isTableSeparator(cells[0]) {
+				continue
+			}
+			table = append(table, cells)
+			continue
+		}
+		flushTable()
+
+		switch {
+		case line == "", line == "---":
+			rep.Space(4)
+		case strings.HasPrefix(line, "###"):
+			rep.Subheading(strings.TrimSpace(strings.TrimLeft(line, "#")))
+		case strings.HasPrefix(line, "#"):
+			rep.Heading(strings.TrimSpace(strings.TrimLeft(line, "#")))
+		case strings.HasPrefix(line, "- "), strings.HasPrefix(line, "* "), strings.HasPrefix(line, "• "):
+			rep.Bullet(strings.TrimSpace(line[strings.Index(line, " "):]))
+		default:
+			rep.Paragraph(line)
+		}
+	}
+	flushTable()
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"fmt"
+	"time"
+)
+
+// Reports a manager can subscribe to (report_subscriptions.relatorio).
+const (
+	ReportResumoExecutivo = "resumo_executivo"
+	ReportCreditosRisco   = "creditos_risco"
+	ReportRFBCBS          = "rfb_cbs"
+	ReportApuracaoPainel  = "apuracao_painel"
+)
+
+// ReportNames maps each subscribable report to its title in emails and the UI.
+var ReportNames = map[string]string{
+	ReportResumoExecutivo: "Resumo Executivo",
+	ReportCreditosRisco:   "Créditos IBS/CBS em Risco",
+	ReportRFBCBS:          "Apuração CBS da Receita Federal",
+	ReportApuracaoPainel:  "Painel de Apuração IBS/CBS",
+}
+
+// Subscription frequencies (report_subscriptions.frequencia).
+const (
+	FrequencyOnImport = "importacao" // after each SPED import, no schedule
+	FrequencyMonthly  = "mensal"     // dia = day of month, 1..28
+	FrequencyWeekly   = "semanal"    // dia = weekday, 0 (Sunday)..6
+)
+
+// brasilia is the schedule timezone. Brazil has had no DST since 2019, so a
+// fixed offset matches America/Sao_Paulo without needing tzdata.
+var brasilia = time.FixedZone("BRT", -3*3600)
+
+// ValidateReportSchedule checks a subscription's report, frequency, day and hour.
+func ValidateReportSchedule(relatorio, frequencia string, dia, hora int) error {
+	if _, ok := ReportNames[relatorio]; !ok {
+		return fmt.Errorf("relatório inválido: %q", relatorio)
+	}
+	if frequencia == FrequencyOnImport {
+		if relatorio != ReportResumoExecutivo {
+			return fmt.Errorf("envio após importação só está disponível para o resumo executivo")
+		}
+		return nil
+	}
+	return ValidateSchedule(frequencia, dia, hora)
+}
+
+// ValidateSchedule checks a monthly or weekly calendar (day and hour in
+// Brasília time), as used by report subscriptions and rfb_agendamentos.
+func ValidateSchedule(frequencia string, dia, hora int) error {
+	switch frequencia {
+	case FrequencyMonthly:
+		if dia < 1 || dia > 28 {
+			return fmt.Errorf("dia do mês deve estar entre 1 e 28")
+		}
+	case FrequencyWeekly:
+		if dia < 0 || dia > 6 {
+			return fmt.Errorf("dia da semana deve estar entre 0 (domingo) e 6 (sábado)")
+		}
+	default:
+		return fmt.Errorf("frequência inválida: %q", frequencia)
+	}
+	if hora < 0 || hora > 23 {
+		return fmt.Errorf("hora deve estar entre 0 e 23")
+	}
+	return nil
+}
+
+// NextReportRun returns the first scheduled time strictly after `after`, or
+// the zero time for FrequencyOnImport. dia and hora are in Brasília time.
+func NextReportRun(frequencia string, dia, hora int, after time.Time) time.Time {
+	t := after.In(brasilia)
+	switch frequencia {
+	case FrequencyMonthly:
+		next := time.Date(t.Year(), t.Month(), dia, hora, 0, 0, 0, brasilia)
+		if !next.After(t) {
+			next = next.AddDate(0, 1, 0)
+		}
+		return next
+	case FrequencyWeekly:
+		next := time.Date(t.Year(), t.Month(), t.Day(), hora, 0, 0, 0, brasilia)
+		next = next.AddDate(0, 0, (dia-int(next.Weekday())+7)%7)
+		if !next.After(t) {
+			next = next.AddDate(0, 0, 7)
+		}
+		return next
+	}
+	return time.Time{}
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,8 +9,11 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"fb_apu01/metrics"
 )
 
 // RFBClient wraps communication with the Receita Federal CBS API.
@@ -34,6 +38,29 @@ type RFBApuracaoResponse struct {
 	MensagemErro  string `json:"mensagemErro"`
 }
 
+var (
+	rfbRequests = metrics.NewCounterVec("rfb_api_requests_total",
+		"RFB API calls by operation, HTTP status (\"error\" = no response) and codigoErro.",
+		"operation", "status", "codigo_erro")
+	rfbDuration = metrics.NewHistogramVec("rfb_api_request_duration_seconds",
+		"RFB API call latency by operation.", metrics.DefBuckets, "operation")
+)
+
+// observeRFB records the outcome of one RFB API call. codigoErro is taken
+// from the response body when the API returns its standard error envelope.
+func observeRFB(operation string, start time.Time, resp *http.Response, body []byte) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	var envelope RFBApuracaoResponse
+	if len(body) > 0 {
+		json.Unmarshal(body, &envelope)
+	}
+	rfbRequests.Inc(operation, status, envelope.CodigoErro)
+	rfbDuration.Observe(time.Since(start).Seconds(), operation)
+}
+
 // NewRFBClient creates a new RFB API client from environment variables.
 func NewRFBClient() *RFBClient {
 	baseURL := os.Getenv("RFB_API_URL")
@@ -71,31 +98,53 @@ func (c *RFBClient) SetAmbiente(ambiente string) {
 	}
 }
 
+// SetCertificado presents cert (an e-CNPJ A1) in the TLS handshake of every
+// call, for credentials that authenticate by certificate.
+func (c *RFBClient) SetCertificado(cert tls.Certificate) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	c.httpClient.Transport = transport
+}
+
 // GetToken obtains an OAuth2 access token using client_credentials grant.
+// With an empty clientSecret (certificate credentials) the client is
+// authenticated by the mTLS certificate and client_id goes in the form.
 func (c *RFBClient) GetToken(clientID, clientSecret string) (string, error) {
 	log.Printf("[RFB] Requesting OAuth2 token from %s", c.tokenURL)
 
 	data := url.Values{}
 	data.Set("grant_type", "client_credentials")
+	if clientSecret == "" {
+		data.Set("client_id", clientID)
+	}
 
 	req, err := http.NewRequest("POST", c.tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return "", fmt.Errorf("failed to create token request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(clientID, clientSecret)
+	if clientSecret != "" {
+		req.SetBasicAuth(clientID, clientSecret)
+	}
 
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		observeRFB("token", start, nil, nil)
 		return "", fmt.Errorf("token request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
+	observeRFB("token", start, resp, body)
 
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("[RFB] Token error (HTTP %d): %s", resp.StatusCode, string(body))
-		return "", fmt.Errorf("token request returned HTTP %d: %s", resp.StatusCode, string(body))
+		return "", &RFBAPIError{Operation: "token", StatusCode: resp.StatusCode,
+			msg: fmt.Sprintf("token request returned HTTP %d: %s", resp.StatusCode, string(body))}
 	}
 
 	var tokenResp RFBTokenResponse
@@ -121,14 +170,15 @@ func (c *RFBClient) GetToken(clientID, clientSecret string) (string, error) {
 }
 
 // SolicitarApuracao sends a CBS assessment request to the RFB API.
-// cnpjBase must be 8 digits (company root CNPJ).
+// cnpjBase must be 8 digits (company root CNPJ). webhookToken goes in the
+// urlRetorno so the callback can be verified (see NewRFBWebhookToken).
 // Returns the tiquete (ticket) for later download.
-func (c *RFBClient) SolicitarApuracao(token, cnpjBase string) (string, error) {
+func (c *RFBClient) SolicitarApuracao(token, cnpjBase, webhookToken string) (string, error) {
 	endpoint := fmt.Sprintf("%s/%s/apuracao-cbs/v1/%s", c.baseURL, c.pathPrefix, cnpjBase)
 	log.Printf("[RFB] Requesting CBS assessment: POST %s (webhook: %s, prefix: %s)", endpoint, c.webhookURL, c.pathPrefix)
 
 	payload := map[string]string{
-		"urlRetorno": c.webhookURL,
+		"urlRetorno": c.callbackURL(webhookToken),
 	}
 	payloadJSON, _ := json.Marshal(payload)
 
@@ -139,26 +189,31 @@ func (c *RFBClient) SolicitarApuracao(token, cnpjBase string) (string, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+token)
 
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		observeRFB("apuracao", start, nil, nil)
 		return "", fmt.Errorf("assessment request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
+	observeRFB("apuracao", start, resp, body)
 	log.Printf("[RFB] Assessment response (HTTP %d): %s", resp.StatusCode, string(body))
 
 	var apuracaoResp RFBApuracaoResponse
-	if err := json.Unmarshal(body, &apuracaoResp); err != nil {
-		return "", fmt.Errorf("failed to parse assessment response: %w", err)
-	}
+	parseErr := json.Unmarshal(body, &apuracaoResp)
 
 	if resp.StatusCode != http.StatusCreated {
 		errMsg := apuracaoResp.MensagemErro
 		if errMsg == "" {
 			errMsg = string(body)
 		}
-		return "", fmt.Errorf("assessment returned HTTP %d: [%s] %s", resp.StatusCode, apuracaoResp.CodigoErro, errMsg)
+		return "", &RFBAPIError{Operation: "apuracao", StatusCode: resp.StatusCode, CodigoErro: apuracaoResp.CodigoErro,
+			msg: fmt.Sprintf("assessment returned HTTP %d: [%s] %s", resp.StatusCode, apuracaoResp.CodigoErro, errMsg)}
+	}
+	if parseErr != nil {
+		return "", fmt.Errorf("failed to parse assessment response: %w", parseErr)
 	}
 
 	if apuracaoResp.Tiquete == "" {
@@ -169,31 +224,31 @@ func (c *RFBClient) SolicitarApuracao(token, cnpjBase string) (string, error) {
 	return apuracaoResp.Tiquete, nil
 }
 
-// DownloadArquivo downloads the CBS assessment JSON file using the ticket.
-// Returns the raw JSON bytes. Note: each ticket can only be downloaded ONCE.
-func (c *RFBClient) DownloadArquivo(token, tiquete string) ([]byte, error) {
+// DownloadArquivo downloads the CBS assessment JSON file using the ticket,
+// copying it to dst as it arrives (files reach hundreds of MB), and returns
+// its size. Note: each ticket can only be downloaded ONCE.
+func (c *RFBClient) DownloadArquivo(token, tiquete string, dst io.Writer) (int64, error) {
 	endpoint := fmt.Sprintf("%s/%s/download/v1/%s", c.baseURL, c.pathPrefix, tiquete)
 	log.Printf("[RFB] Downloading assessment file: GET %s (prefix: %s)", endpoint, c.pathPrefix)
 
 	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create download request: %w", err)
+		return 0, fmt.Errorf("failed to create download request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+token)
 
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("download request failed: %w", err)
+		observeRFB("download", start, nil, nil)
+		return 0, fmt.Errorf("download request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read download response: %w", err)
-	}
-
 	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		observeRFB("download", start, resp, body)
 		// Log the full response to diagnose gateway vs application errors.
 		// Note: documented responses are 200/400/403/404 — HTTP 401 indicates
 		// gateway-level authentication failure, NOT an application error.
@@ -206,18 +261,31 @@ func (c *RFBClient) DownloadArquivo(token, tiquete string) ([]byte, error) {
 				return token
 			}(),
 		)
+		apiErr := &RFBAPIError{Operation: "download", StatusCode: resp.StatusCode}
+		var envelope RFBApuracaoResponse
+		if json.Unmarshal(body, &envelope) == nil {
+			apiErr.CodigoErro = envelope.CodigoErro
+		}
 		switch resp.StatusCode {
 		case http.StatusUnauthorized:
-			return nil, fmt.Errorf("HTTP 401 (gateway auth) — token inválido ou expirado: %s", string(body))
+			apiErr.msg = fmt.Sprintf("HTTP 401 (gateway auth) — token inválido ou expirado: %s", string(body))
 		case http.StatusForbidden:
-			return nil, fmt.Errorf("HTTP 403 — CNPJ do consumidor não corresponde ao CNPJ da solicitação: %s", string(body))
+			apiErr.msg = fmt.Sprintf("HTTP 403 — CNPJ do consumidor não corresponde ao CNPJ da solicitação: %s", string(body))
 		case http.StatusNotFound:
-			return nil, fmt.Errorf("HTTP 404 — arquivo não encontrado ou tíquete inválido: %s", string(body))
+			apiErr.msg = fmt.Sprintf("HTTP 404 — arquivo não encontrado ou tíquete inválido: %s", string(body))
 		default:
-			return nil, fmt.Errorf("HTTP %d — %s", resp.StatusCode, string(body))
+			apiErr.msg = fmt.Sprintf("HTTP %d — %s", resp.StatusCode, string(body))
 		}
+		return 0, apiErr
+	}
+
+	// The 200 payload carries no codigoErro
+	n, err := io.Copy(dst, resp.Body)
+	observeRFB("download", start, resp, nil)
+	if err != nil {
+		return n, fmt.Errorf("failed to read download response: %w", err)
 	}
 
-	log.Printf("[RFB] Download completed successfully (%d bytes)", len(body))
-	return body, nil
+	log.Printf("[RFB] Download completed successfully (%d bytes)", n)
+	return n, nil
 }
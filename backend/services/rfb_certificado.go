@@ -0,0 +1,138 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// CertificadoA1 is an e-CNPJ A1 certificate (.pfx) ready for mTLS.
+type CertificadoA1 struct {
+	TLS      tls.Certificate
+	Titular  string // subject CN, usually "RAZAO SOCIAL:CNPJ"
+	CNPJ     string // from the CN, "" when it has none
+	Emissor  string
+	NotAfter time.Time
+	SHA256   string // fingerprint of the leaf, hex
+}
+
+// ErrRFBCertificadoVencido is returned when a credential's certificate has expired.
+var ErrRFBCertificadoVencido = errors.New("Certificado A1 vencido. Envie um certificado válido em Conectar Receita Federal > Credenciais API.")
+
+var cnpjCN = regexp.MustCompile(`(\d{14})\s*$`)
+
+// ParseCertificadoA1 opens a .pfx with its password. ICP-Brasil files usually
+// carry the CA chain too; the leaf is the certificate of the private key and
+// the rest is sent as its chain.
+func ParseCertificadoA1(pfx []byte, senha string) (*CertificadoA1, error) {
+	blocks, err := pkcs12.ToPEM(pfx, senha)
+	if err != nil {
+		if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+			return nil, errors.New("senha do certificado incorreta")
+		}
+		return nil, fmt.Errorf("arquivo .pfx inválido ou com cifra não suportada (exporte com cifra 3DES, ex.: openssl pkcs12 -legacy): %w", err)
+	}
+
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	for _, b := range blocks {
+		switch {
+		case b.Type == "CERTIFICATE":
+			c, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("certificado inválido no .pfx: %w", err)
+			}
+			certs = append(certs, c)
+		case strings.HasSuffix(b.Type, "PRIVATE KEY") && key == nil:
+			if key, err = parseChavePrivada(b.Bytes); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if key == nil {
+		return nil, errors.New("o .pfx não contém a chave privada")
+	}
+
+	leaf := -1
+	for i, c := range certs {
+		if pub, ok := c.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(key.Public()) {
+			leaf = i
+			break
+		}
+	}
+	if leaf < 0 {
+		return nil, errors.New("nenhum certificado do .pfx corresponde à chave privada")
+	}
+
+	cert := &CertificadoA1{
+		TLS:      tls.Certificate{PrivateKey: key, Leaf: certs[leaf]},
+		Titular:  certs[leaf].Subject.CommonName,
+		Emissor:  certs[leaf].Issuer.CommonName,
+		NotAfter: certs[leaf].NotAfter,
+	}
+	cert.TLS.Certificate = append(cert.TLS.Certificate, certs[leaf].Raw)
+	for i, c := range certs {
+		if i != leaf && !bytes.Equal(c.RawSubject, c.RawIssuer) { // self-signed roots are not sent
+			cert.TLS.Certificate = append(cert.TLS.Certificate, c.Raw)
+		}
+	}
+	if m := cnpjCN.FindStringSubmatch(cert.Titular); m != nil {
+		cert.CNPJ = m[1]
+	}
+	sum := sha256.Sum256(certs[leaf].Raw)
+	cert.SHA256 = hex.EncodeToString(sum[:])
+	return cert, nil
+}
+
+func parseChavePrivada(der []byte) (crypto.Signer, error) {
+	if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(der); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("chave privada do .pfx não suportada: %w", err)
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("chave privada do .pfx não suportada")
+	}
+	return signer, nil
+}
+
+// Certificate expiry states, as returned by RFBCertificadoAlerta.
+const (
+	RFBCertificadoOK           = "ok"
+	RFBCertificadoVenceEmBreve = "vence_em_breve"
+	RFBCertificadoVencido      = "vencido"
+)
+
+// RFBCertificadoAlertaDias is how many days before expiry a certificate is
+// flagged, from RFB_CERT_ALERTA_DIAS (default 30).
+func RFBCertificadoAlertaDias() int {
+	return envInt("RFB_CERT_ALERTA_DIAS", 30)
+}
+
+// RFBCertificadoAlerta classifies a certificate by its expiry date.
+func RFBCertificadoAlerta(validade, now time.Time) string {
+	switch {
+	case !now.Before(validade):
+		return RFBCertificadoVencido
+	case validade.Sub(now) <= time.Duration(RFBCertificadoAlertaDias())*24*time.Hour:
+		return RFBCertificadoVenceEmBreve
+	default:
+		return RFBCertificadoOK
+	}
+}
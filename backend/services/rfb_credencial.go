@@ -0,0 +1,144 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"fb_apu01/secrets"
+)
+
+// RFB credential authentication types (rfb_credentials.auth_tipo).
+const (
+	RFBAuthClientSecret = "client_secret"
+	RFBAuthCertificado  = "certificado"
+)
+
+// RFBCredencial is one of a company's RFB API credentials, decrypted. A
+// company has one per CNPJ base and ambiente.
+type RFBCredencial struct {
+	ID           string
+	CompanyID    string
+	CNPJMatriz   string
+	CNPJBase     string
+	Ambiente     string
+	AuthTipo     string
+	ClientID     string
+	ClientSecret string
+
+	certificadoPFX, certificadoSenha string
+	CertificadoValidade              *time.Time
+}
+
+// CarregarCredencialRFB returns an active credential of the company: the one
+// with credentialID, else the one of cnpjBase, else the oldest. Empty
+// arguments do not filter. ErrRFBSemCredenciais when there is none.
+func CarregarCredencialRFB(db *sql.DB, companyID, credentialID, cnpjBase string) (*RFBCredencial, error) {
+	var c RFBCredencial
+	var pfx, senha sql.NullString
+	var validade sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, company_id, cnpj_matriz, cnpj_base, COALESCE(ambiente, 'producao'), auth_tipo,
+			client_id, COALESCE(client_secret, ''), certificado_pfx, certificado_senha, certificado_validade
+		FROM rfb_credentials
+		WHERE company_id = $1 AND ativo = true
+		  AND ($2 = '' OR id::text = $2)
+		  AND ($3 = '' OR cnpj_base = $3)
+		ORDER BY created_at, id
+		LIMIT 1
+	`, companyID, credentialID, cnpjBase).Scan(&c.ID, &c.CompanyID, &c.CNPJMatriz, &c.CNPJBase, &c.Ambiente, &c.AuthTipo,
+		&c.ClientID, &c.ClientSecret, &pfx, &senha, &validade)
+	if err == sql.ErrNoRows {
+		return nil, ErrRFBSemCredenciais
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao buscar credenciais: %w", err)
+	}
+	if c.ClientSecret != "" {
+		if c.ClientSecret, err = secrets.Decrypt(c.ClientSecret); err != nil {
+			return nil, fmt.Errorf("client secret da credencial %s ilegível: %w", c.ID, err)
+		}
+	}
+	c.certificadoPFX = pfx.String
+	c.certificadoSenha = senha.String
+	if validade.Valid {
+		c.CertificadoValidade = &validade.Time
+	}
+	return &c, nil
+}
+
+// ListarCredenciaisRFB returns the ids of the company's active credentials,
+// oldest first.
+func ListarCredenciaisRFB(db *sql.DB, companyID string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT id FROM rfb_credentials WHERE company_id = $1 AND ativo = true ORDER BY created_at, id
+	`, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Certificado decrypts and opens the credential's A1 certificate.
+func (c *RFBCredencial) Certificado() (*CertificadoA1, error) {
+	if c.certificadoPFX == "" {
+		return nil, errors.New("credencial sem certificado A1")
+	}
+	encoded, err := secrets.Decrypt(c.certificadoPFX)
+	if err != nil {
+		return nil, fmt.Errorf("certificado A1 armazenado ilegível: %w", err)
+	}
+	pfx, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("certificado A1 armazenado ilegível: %w", err)
+	}
+	senha, err := secrets.Decrypt(c.certificadoSenha)
+	if err != nil {
+		return nil, fmt.Errorf("senha do certificado A1 armazenada ilegível: %w", err)
+	}
+	return ParseCertificadoA1(pfx, senha)
+}
+
+// Client returns an RFBClient set up for the credential (see Configurar).
+func (c *RFBCredencial) Client() (*RFBClient, error) {
+	client := NewRFBClient()
+	if err := c.Configurar(client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Configurar points client at the credential's ambiente and, when it
+// authenticates by certificate, makes it present the certificate (mTLS).
+// An expired certificate is refused with ErrRFBCertificadoVencido.
+func (c *RFBCredencial) Configurar(client *RFBClient) error {
+	client.SetAmbiente(c.Ambiente)
+	if c.AuthTipo != RFBAuthCertificado {
+		return nil
+	}
+	cert, err := c.Certificado()
+	if err != nil {
+		return err
+	}
+	switch RFBCertificadoAlerta(cert.NotAfter, time.Now()) {
+	case RFBCertificadoVencido:
+		return ErrRFBCertificadoVencido
+	case RFBCertificadoVenceEmBreve:
+		log.Printf("[RFB] WARNING: A1 certificate of credential %s (%s) expires on %s",
+			c.ID, cert.Titular, cert.NotAfter.Format("2006-01-02"))
+	}
+	client.SetCertificado(cert.TLS)
+	return nil
+}
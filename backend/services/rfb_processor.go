@@ -4,16 +4,25 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"strings"
 	"time"
 )
 
-// dbExecutor abstracts *sql.DB and *sql.Tx so insertDebito works in both contexts.
+// dbExecutor abstracts *sql.DB and *sql.Tx so debitoBatch works in both contexts.
 type dbExecutor interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
+// dbQuerier abstracts *sql.DB and *sql.Tx for read paths that also run inside
+// a handler's tenant transaction.
+type dbQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 // FlexString unmarshals both JSON strings and JSON numbers into a Go string.
 // Needed because the RFB API returns some fields (e.g. modeloDfe=55) as numbers.
 type FlexString string
@@ -51,17 +60,7 @@ func (rt *RFBTime) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// RFB JSON structures matching the API response layout
-type RFBApuracaoJSON struct {
-	ApuracaoCorrente     *RFBGrupoDebitos `json:"apuracaoCorrente"`
-	ApuracaoAjuste       *RFBGrupoDebitos `json:"apuracaoAjuste"`
-	DebitosExtemporaneos *RFBGrupoDebitos `json:"debitosExtemporaneos"`
-}
-
-type RFBGrupoDebitos struct {
-	Debitos []RFBDebito `json:"debitos"`
-}
-
+// RFBDebito is one debit of the apuração file (see streamDebitosRFB for the layout).
 type RFBDebito struct {
 	ModeloDfe          FlexString      `json:"modeloDfe"`
 	NumeroDfe          FlexString      `json:"numeroDfe"`
@@ -80,41 +79,53 @@ type RFBDebito struct {
 	Eventos            json.RawMessage `json:"eventos"`
 }
 
+// rfbSaveAttempts is how many times the downloaded file is saved before the
+// request is failed.
+const rfbSaveAttempts = 3
+
 // ProcessarDownloadRFB downloads and processes the RFB CBS assessment JSON.
-// It saves the raw JSON, normalizes debits into rfb_debitos, and creates a summary in rfb_resumo.
+// The file is streamed to a temp file and kept gzip-compressed in rfb_arquivos; debits are
+// decoded one at a time into rfb_debitos, and a summary is created in rfb_resumo.
 // All DB writes (debits + summary) are wrapped in a single transaction to prevent partial imports.
 // An atomic status update prevents two goroutines from processing the same request concurrently.
+// Temporary token/download failures are left for the RFB scheduler to retry (see
+// RFBErrorRetryable); a request polled before its webhook whose file is not ready
+// goes back to 'requested' and ErrRFBArquivoNaoPronto is returned.
 func ProcessarDownloadRFB(db *sql.DB, rfbClient *RFBClient, requestID string) error {
 	log.Printf("[RFB Processor] Starting download processing for request %s", requestID)
 
 	// 1. Fetch request details and company credentials
-	var companyID, tiquete, cnpjBase string
+	var companyID, tiquete, cnpjBase, credentialID string
 	var tiqueteDownload *string
 	err := db.QueryRow(`
-		SELECT r.company_id, r.tiquete, r.cnpj_base, r.tiquete_download
+		SELECT r.company_id, r.tiquete, r.cnpj_base, r.tiquete_download, COALESCE(r.credential_id::text, '')
 		FROM rfb_requests r
 		WHERE r.id = $1
-	`, requestID).Scan(&companyID, &tiquete, &cnpjBase, &tiqueteDownload)
+	`, requestID).Scan(&companyID, &tiquete, &cnpjBase, &tiqueteDownload, &credentialID)
 	if err != nil {
 		return fmt.Errorf("failed to fetch request: %w", err)
 	}
 
-	var clientID, clientSecret, ambiente string
-	err = db.QueryRow(`
-		SELECT client_id, client_secret, COALESCE(ambiente, 'producao') FROM rfb_credentials
-		WHERE company_id = $1 AND ativo = true
-	`, companyID).Scan(&clientID, &clientSecret, &ambiente)
+	// The credential that solicited it or, when that one is gone (or the
+	// request predates credential_id), another of the same CNPJ base
+	cred, err := CarregarCredencialRFB(db, companyID, credentialID, cnpjBase)
+	if err == ErrRFBSemCredenciais && credentialID != "" {
+		cred, err = CarregarCredencialRFB(db, companyID, "", cnpjBase)
+	}
 	if err != nil {
 		updateRequestError(db, requestID, "CRED_NOT_FOUND", "Credenciais RFB não encontradas ou inativas")
 		return fmt.Errorf("failed to fetch credentials: %w", err)
 	}
-	clientSecret = DecryptFieldWithFallback(clientSecret)
-
-	rfbClient.SetAmbiente(ambiente)
+	if err := cred.Configurar(rfbClient); err != nil {
+		updateRequestError(db, requestID, "CERT_ERROR", "Certificado A1: "+err.Error())
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	clientID, clientSecret := cred.ClientID, cred.ClientSecret
 
 	// Use tiqueteDownload if provided by the webhook
 	tiqueteParaDownload := tiquete
-	if tiqueteDownload != nil && *tiqueteDownload != "" {
+	polling := tiqueteDownload == nil || *tiqueteDownload == ""
+	if !polling {
 		tiqueteParaDownload = *tiqueteDownload
 		log.Printf("[RFB Processor] Using tiqueteDownload '%s' (solicitacao: '%s')", tiqueteParaDownload, tiquete)
 	} else {
@@ -124,7 +135,7 @@ func ProcessarDownloadRFB(db *sql.DB, rfbClient *RFBClient, requestID string) er
 	// 2. Atomic status claim — prevents concurrent webhook + manual download races.
 	// Only proceeds if status is not already 'downloading', 'completed', or 'reprocessing'.
 	res, err := db.Exec(`
-		UPDATE rfb_requests SET status = 'downloading', updated_at = CURRENT_TIMESTAMP
+		UPDATE rfb_requests SET status = 'downloading', error_retryable = false, updated_at = CURRENT_TIMESTAMP
 		WHERE id = $1 AND status NOT IN ('downloading', 'completed', 'reprocessing')
 	`, requestID)
 	if err != nil {
@@ -138,184 +149,242 @@ func ProcessarDownloadRFB(db *sql.DB, rfbClient *RFBClient, requestID string) er
 	// 3. Get fresh OAuth2 token
 	token, err := rfbClient.GetToken(clientID, clientSecret)
 	if err != nil {
-		updateRequestError(db, requestID, "TOKEN_ERROR", err.Error())
+		recordDownloadFailure(db, requestID, "TOKEN_ERROR", err)
 		return fmt.Errorf("failed to get token: %w", err)
 	}
 
-	// 4. Download the JSON file (single-use ticket!)
-	rawJSON, err := rfbClient.DownloadArquivo(token, tiqueteParaDownload)
+	// 4. Download the JSON file (single-use ticket!) to a temp file, so its
+	// size never has to fit in memory
+	tmp, err := os.CreateTemp("", "rfb-apuracao-*.json")
 	if err != nil {
-		updateRequestError(db, requestID, "DOWNLOAD_ERROR", err.Error())
+		updateRequestError(db, requestID, "DOWNLOAD_ERROR", "Falha ao criar arquivo temporário: "+err.Error())
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := rfbClient.DownloadArquivo(token, tiqueteParaDownload, tmp)
+	if err != nil && polling && rfbErrorStatus(err) == 404 {
+		// No webhook yet, so nothing was downloaded: the file is just not ready.
+		// A webhook that arrived meanwhile left its tíquete; use it right away.
+		log.Printf("[RFB Processor] Request %s: file not ready yet, polling again later", requestID)
+		db.Exec(`
+			UPDATE rfb_requests
+			SET status = CASE WHEN tiquete_download IS NULL THEN 'requested' ELSE 'webhook_received' END,
+			    next_attempt_at = CASE WHEN tiquete_download IS NULL
+			                           THEN NOW() + make_interval(secs => $2) ELSE NOW() END,
+			    updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, requestID, LoadRFBRetryPolicy().PollInterval.Seconds())
+		return ErrRFBArquivoNaoPronto
+	}
+	if err != nil {
+		recordDownloadFailure(db, requestID, "DOWNLOAD_ERROR", err)
 		return fmt.Errorf("failed to download: %w", err)
 	}
 
-	// 5. Save raw JSON as TEXT immediately — data is preserved even if parse/insert fails.
-	// Column is TEXT (not JSONB, migration 064), so no 268 MB size limit applies.
-	log.Printf("[RFB Processor] Saving raw JSON (%d MB) for request %s", len(rawJSON)/1024/1024, requestID)
-	_, saveErr := db.Exec(`
-		UPDATE rfb_requests SET raw_json = $1, updated_at = CURRENT_TIMESTAMP
-		WHERE id = $2
-	`, string(rawJSON), requestID)
+	// 5. Save the file (gzip, in parts) before parsing: the ticket is spent, so
+	// the data must survive a parse or insert failure for a later reprocess.
+	// The save is one transaction, so it is retried a few times; if it still
+	// fails the request errors out instead of parsing a file nobody can replay.
+	log.Printf("[RFB Processor] Saving downloaded file (%d MB) for request %s", size/1024/1024, requestID)
+	var saveErr error
+	for attempt := 1; attempt <= rfbSaveAttempts; attempt++ {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			updateRequestError(db, requestID, "DOWNLOAD_ERROR", "Falha ao ler arquivo temporário: "+err.Error())
+			return fmt.Errorf("failed to rewind temp file: %w", err)
+		}
+		if saveErr = salvarArquivoRFB(db, requestID, companyID, tmp, size); saveErr == nil {
+			break
+		}
+		log.Printf("[RFB Processor] Failed to save file for request %s (attempt %d/%d): %v", requestID, attempt, rfbSaveAttempts, saveErr)
+		if attempt < rfbSaveAttempts {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+	}
 	if saveErr != nil {
-		// Non-fatal: log but continue — if parse succeeds, debits are still loaded
-		log.Printf("[RFB Processor] WARNING: Failed to save raw JSON for request %s: %v (processing continues)", requestID, saveErr)
-	} else {
-		log.Printf("[RFB Processor] Raw JSON saved successfully for request %s", requestID)
+		updateRequestError(db, requestID, "DB_ERROR", "Falha ao salvar o arquivo da RFB: "+saveErr.Error())
+		return fmt.Errorf("failed to save file: %w", saveErr)
 	}
+	log.Printf("[RFB Processor] File saved successfully for request %s", requestID)
 
-	// 6. Parse JSON
-	var apuracao RFBApuracaoJSON
-	if err := json.Unmarshal(rawJSON, &apuracao); err != nil {
-		updateRequestError(db, requestID, "PARSE_ERROR", "Falha ao interpretar JSON da RFB: "+err.Error())
-		return fmt.Errorf("failed to parse JSON: %w", err)
+	// 6. Parse and insert debits and summary inside a single transaction
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		updateRequestError(db, requestID, "DOWNLOAD_ERROR", "Falha ao ler arquivo temporário: "+err.Error())
+		return fmt.Errorf("failed to rewind temp file: %w", err)
 	}
+	resumo, err := importarDebitosRFB(db, requestID, companyID, tmp, false)
+	if err != nil {
+		return err
+	}
+
+	// 7. Mark request as completed
+	updateRequestStatus(db, requestID, "completed")
+	log.Printf("[RFB Processor] Request %s completed: %s", requestID, resumo)
+	return nil
+}
+
+// resumoImportacao totals one import, as stored in rfb_resumo.
+type resumoImportacao struct {
+	dataApuracao                              string
+	totalCorrente, totalAjuste, totalExtempor int
+	valorTotal, valorExtinto, valorNaoExtinto float64
+}
 
-	// 7. Insert debits and summary inside a single transaction.
-	// If any step fails the whole import is rolled back — no partial data.
+func (r resumoImportacao) totalDebitos() int {
+	return r.totalCorrente + r.totalAjuste + r.totalExtempor
+}
+
+func (r resumoImportacao) String() string {
+	return fmt.Sprintf("%d debits (%d corrente, %d ajuste, %d extemporaneo), CBS total: %.2f",
+		r.totalDebitos(), r.totalCorrente, r.totalAjuste, r.totalExtempor, r.valorTotal)
+}
+
+// importarDebitosRFB streams the apuração file into rfb_debitos, in batches,
+// and upserts the request's rfb_resumo (marking it the period's current
+// version), all in one transaction: a malformed file or a
+// failed insert rolls everything back (with replace, the request's previous
+// debits are kept). Failures are recorded on the request.
+func importarDebitosRFB(db *sql.DB, requestID, companyID string, src io.Reader, replace bool) (resumoImportacao, error) {
+	var resumo resumoImportacao
 	tx, err := db.Begin()
 	if err != nil {
 		updateRequestError(db, requestID, "DB_ERROR", "Falha ao iniciar transação: "+err.Error())
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-
-	var totalCorrente, totalAjuste, totalExtemporaneo, insertErrors int
-	var valorTotal, valorExtinto, valorNaoExtinto float64
-	var dataApuracao string
-
-	if apuracao.ApuracaoCorrente != nil {
-		for _, d := range apuracao.ApuracaoCorrente.Debitos {
-			if err := insertDebito(tx, requestID, companyID, "corrente", d); err != nil {
-				log.Printf("[RFB Processor] Error inserting corrente debit (chave=%s): %v", d.ChaveDfe, err)
-				insertErrors++
-			} else {
-				totalCorrente++
-				valorTotal += d.ValorCBSTotal
-				valorExtinto += d.ValorCBSExtinto
-				valorNaoExtinto += d.ValorCBSNaoExtinto
-				if dataApuracao == "" && d.DataApuracao != "" {
-					dataApuracao = d.DataApuracao
-				}
-			}
-		}
+		return resumo, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	if apuracao.ApuracaoAjuste != nil {
-		for _, d := range apuracao.ApuracaoAjuste.Debitos {
-			if err := insertDebito(tx, requestID, companyID, "ajuste", d); err != nil {
-				log.Printf("[RFB Processor] Error inserting ajuste debit (chave=%s): %v", d.ChaveDfe, err)
-				insertErrors++
-			} else {
-				totalAjuste++
-				valorTotal += d.ValorCBSTotal
-				valorExtinto += d.ValorCBSExtinto
-				valorNaoExtinto += d.ValorCBSNaoExtinto
-			}
+	if replace {
+		if _, err = tx.Exec(`DELETE FROM rfb_debitos WHERE request_id = $1`, requestID); err != nil {
+			updateRequestError(db, requestID, "DB_ERROR", "Falha ao limpar débitos anteriores: "+err.Error())
+			return resumo, fmt.Errorf("failed to delete existing debits: %w", err)
 		}
 	}
 
-	if apuracao.DebitosExtemporaneos != nil {
-		for _, d := range apuracao.DebitosExtemporaneos.Debitos {
-			if err := insertDebito(tx, requestID, companyID, "extemporaneo", d); err != nil {
-				log.Printf("[RFB Processor] Error inserting extemporaneo debit (chave=%s): %v", d.ChaveDfe, err)
-				insertErrors++
-			} else {
-				totalExtemporaneo++
-				valorTotal += d.ValorCBSTotal
-				valorExtinto += d.ValorCBSExtinto
-				valorNaoExtinto += d.ValorCBSNaoExtinto
+	batch := newDebitoBatch(tx, requestID, companyID)
+	var insertErr error
+	parseErr := streamDebitosRFB(src, func(tipo string, d RFBDebito) error {
+		if err := batch.add(tipo, d); err != nil {
+			insertErr = err
+			return err
+		}
+		switch tipo {
+		case "corrente":
+			resumo.totalCorrente++
+			if resumo.dataApuracao == "" && d.DataApuracao != "" {
+				resumo.dataApuracao = d.DataApuracao
 			}
+		case "ajuste":
+			resumo.totalAjuste++
+		case "extemporaneo":
+			resumo.totalExtempor++
 		}
+		resumo.valorTotal += d.ValorCBSTotal
+		resumo.valorExtinto += d.ValorCBSExtinto
+		resumo.valorNaoExtinto += d.ValorCBSNaoExtinto
+		return nil
+	})
+	if parseErr == nil {
+		insertErr = batch.flush()
+	}
+	if insertErr != nil {
+		updateRequestError(db, requestID, "DB_ERROR", "Falha ao inserir débitos: "+insertErr.Error())
+		return resumo, fmt.Errorf("failed to insert debits: %w", insertErr)
+	}
+	if parseErr != nil {
+		updateRequestError(db, requestID, "PARSE_ERROR", "Falha ao interpretar JSON da RFB: "+parseErr.Error())
+		return resumo, fmt.Errorf("failed to parse JSON: %w", parseErr)
 	}
 
-	totalDebitos := totalCorrente + totalAjuste + totalExtemporaneo
-
-	// Upsert summary in the same transaction
+	// One summary per request: earlier assessments of the period are kept as history
 	_, err = tx.Exec(`
-		INSERT INTO rfb_resumo (request_id, company_id, data_apuracao, total_debitos,
+		INSERT INTO rfb_resumo (request_id, company_id, cnpj_base, data_apuracao, total_debitos,
 			valor_cbs_total, valor_cbs_extinto, valor_cbs_nao_extinto,
 			total_corrente, total_ajuste, total_extemporaneo)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		ON CONFLICT (company_id, data_apuracao)
-		DO UPDATE SET request_id = $1, total_debitos = $4,
+		VALUES ($1, $2, (SELECT cnpj_base FROM rfb_requests WHERE id = $1), NULLIF($3, ''), $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (request_id)
+		DO UPDATE SET data_apuracao = EXCLUDED.data_apuracao, total_debitos = $4,
 			valor_cbs_total = $5, valor_cbs_extinto = $6, valor_cbs_nao_extinto = $7,
 			total_corrente = $8, total_ajuste = $9, total_extemporaneo = $10
-	`, requestID, companyID, dataApuracao, totalDebitos,
-		valorTotal, valorExtinto, valorNaoExtinto,
-		totalCorrente, totalAjuste, totalExtemporaneo)
+	`, requestID, companyID, resumo.dataApuracao, resumo.totalDebitos(),
+		resumo.valorTotal, resumo.valorExtinto, resumo.valorNaoExtinto,
+		resumo.totalCorrente, resumo.totalAjuste, resumo.totalExtempor)
+	if err == nil {
+		err = marcarResumoAtual(tx, requestID)
+	}
 	if err != nil {
-		tx.Rollback()
 		updateRequestError(db, requestID, "DB_ERROR", "Falha ao salvar resumo: "+err.Error())
-		return fmt.Errorf("failed to upsert summary: %w", err)
+		return resumo, fmt.Errorf("failed to upsert summary: %w", err)
 	}
 
 	if err := tx.Commit(); err != nil {
 		updateRequestError(db, requestID, "DB_ERROR", "Falha no commit da transação: "+err.Error())
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return resumo, fmt.Errorf("failed to commit transaction: %w", err)
 	}
-
-	// 8. Mark request as completed
-	finalStatus := "completed"
-	if insertErrors > 0 {
-		log.Printf("[RFB Processor] WARN: %d debits failed to insert (raw_json preserved — use reprocess to retry)", insertErrors)
+	if batch.ignorados > 0 {
+		log.Printf("[RFB Processor] Request %s: %d formasExtincao/eventos list(s) kept only as JSON", requestID, batch.ignorados)
 	}
-	updateRequestStatus(db, requestID, finalStatus)
-	log.Printf("[RFB Processor] Request %s %s: %d debits (%d corrente, %d ajuste, %d extemporaneo, %d errors), CBS total: %.2f",
-		requestID, finalStatus, totalDebitos, totalCorrente, totalAjuste, totalExtemporaneo, insertErrors, valorTotal)
-
-	return nil
+	return resumo, nil
 }
 
-func insertDebito(exec dbExecutor, requestID, companyID, tipoApuracao string, d RFBDebito) error {
-	formasExtincao := sql.NullString{}
-	if len(d.FormasExtincao) > 0 && string(d.FormasExtincao) != "null" {
-		formasExtincao = sql.NullString{String: string(d.FormasExtincao), Valid: true}
+// marcarResumoAtual flags, among the summaries of the request's company, CNPJ
+// base and period, the one of the most recently created request as atual.
+// Concurrent imports of the same period are serialised by an advisory lock.
+func marcarResumoAtual(tx *sql.Tx, requestID string) error {
+	var companyID, cnpjBase, periodo sql.NullString
+	err := tx.QueryRow(`
+		SELECT company_id::text, cnpj_base, data_apuracao FROM rfb_resumo WHERE request_id = $1
+	`, requestID).Scan(&companyID, &cnpjBase, &periodo)
+	if err != nil {
+		return err
 	}
-	eventos := sql.NullString{}
-	if len(d.Eventos) > 0 && string(d.Eventos) != "null" {
-		eventos = sql.NullString{String: string(d.Eventos), Valid: true}
+	if !periodo.Valid {
+		return nil
 	}
-
-	var dataEmissao *time.Time
-	if d.DataDfeEmissao != nil {
-		dataEmissao = d.DataDfeEmissao.T
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('rfb_resumo:' || $1 || ':' || $2 || ':' || $3))`,
+		companyID.String, cnpjBase.String, periodo.String); err != nil {
+		return err
 	}
-
-	_, err := exec.Exec(`
-		INSERT INTO rfb_debitos (request_id, company_id, tipo_apuracao,
-			modelo_dfe, numero_dfe, chave_dfe, data_dfe_emissao, data_apuracao,
-			ni_emitente, ni_adquirente,
-			valor_cbs_total, valor_cbs_extinto, valor_cbs_nao_extinto,
-			situacao_debito, formas_extincao, eventos)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
-	`, requestID, companyID, tipoApuracao,
-		string(d.ModeloDfe), string(d.NumeroDfe), string(d.ChaveDfe), dataEmissao, d.DataApuracao,
-		string(d.NiEmitente), string(d.NiAdquirente),
-		d.ValorCBSTotal, d.ValorCBSExtinto, d.ValorCBSNaoExtinto,
-		string(d.SituacaoDebito), formasExtincao, eventos)
+	if _, err := tx.Exec(`
+		UPDATE rfb_resumo SET atual = false
+		WHERE company_id = $1 AND cnpj_base IS NOT DISTINCT FROM $2 AND data_apuracao = $3 AND atual
+	`, companyID.String, cnpjBase, periodo.String); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE rfb_resumo SET atual = true
+		WHERE id = (
+			SELECT rs.id FROM rfb_resumo rs
+			JOIN rfb_requests r ON r.id = rs.request_id
+			WHERE rs.company_id = $1 AND rs.cnpj_base IS NOT DISTINCT FROM $2 AND rs.data_apuracao = $3
+			ORDER BY r.created_at DESC, rs.id DESC
+			LIMIT 1
+		)
+	`, companyID.String, cnpjBase, periodo.String)
 	return err
 }
 
-// ReprocessarRawJSON re-parses the raw JSON already stored in the DB without calling the RFB API.
-// Safe pattern: parse JSON FIRST, then atomically delete old debits and insert new ones in a transaction.
-// If parse or any insert fails, old data is never deleted — no data loss.
+// ReprocessarRawJSON re-parses the file already stored in the DB without calling the RFB API.
+// Old debits are replaced inside the import transaction, so a parse or insert failure
+// leaves them intact — no data loss.
 func ReprocessarRawJSON(db *sql.DB, requestID string) error {
 	log.Printf("[RFB Reprocess] Starting reprocess for request %s", requestID)
 
 	var companyID string
-	var rawJSON *string
-	err := db.QueryRow(`
-		SELECT company_id, raw_json FROM rfb_requests WHERE id = $1
-	`, requestID).Scan(&companyID, &rawJSON)
+	err := db.QueryRow(`SELECT company_id FROM rfb_requests WHERE id = $1`, requestID).Scan(&companyID)
 	if err != nil {
 		return fmt.Errorf("failed to fetch request: %w", err)
 	}
-	if rawJSON == nil || *rawJSON == "" {
+	src, ok, err := abrirArquivoRFB(db, requestID)
+	if err != nil {
+		return fmt.Errorf("failed to open stored file: %w", err)
+	}
+	if !ok {
 		return fmt.Errorf("no raw_json stored for request %s — cannot reprocess without raw data", requestID)
 	}
+	defer src.Close()
 
-	log.Printf("[RFB Reprocess] Raw JSON found (%d MB), parsing...", len(*rawJSON)/1024/1024)
-
-	// 1. Atomic status claim — prevent concurrent reprocess runs
+	// Atomic status claim — prevent concurrent reprocess runs
 	res, err := db.Exec(`
 		UPDATE rfb_requests SET status = 'reprocessing', updated_at = CURRENT_TIMESTAMP
 		WHERE id = $1 AND status NOT IN ('downloading', 'reprocessing')
@@ -328,108 +397,13 @@ func ReprocessarRawJSON(db *sql.DB, requestID string) error {
 		return nil
 	}
 
-	// 2. Parse JSON FIRST — before touching any existing data.
-	// If parse fails, old debits remain intact.
-	var apuracao RFBApuracaoJSON
-	if err := json.Unmarshal([]byte(*rawJSON), &apuracao); err != nil {
-		updateRequestError(db, requestID, "PARSE_ERROR", "Falha ao reprocessar JSON: "+err.Error())
-		return fmt.Errorf("failed to parse JSON: %w", err)
-	}
-
-	// 3. Transaction: delete old debits then insert new ones atomically.
-	// Rollback keeps old data if anything goes wrong.
-	tx, err := db.Begin()
-	if err != nil {
-		updateRequestError(db, requestID, "DB_ERROR", "Falha ao iniciar transação: "+err.Error())
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-
-	if _, err = tx.Exec(`DELETE FROM rfb_debitos WHERE request_id = $1`, requestID); err != nil {
-		tx.Rollback()
-		updateRequestError(db, requestID, "DB_ERROR", "Falha ao limpar débitos anteriores: "+err.Error())
-		return fmt.Errorf("failed to delete existing debits: %w", err)
-	}
-
-	var totalCorrente, totalAjuste, totalExtemporaneo, insertErrors int
-	var valorTotal, valorExtinto, valorNaoExtinto float64
-	var dataApuracao string
-
-	if apuracao.ApuracaoCorrente != nil {
-		for _, d := range apuracao.ApuracaoCorrente.Debitos {
-			if err := insertDebito(tx, requestID, companyID, "corrente", d); err != nil {
-				log.Printf("[RFB Reprocess] Error inserting corrente debit (chave=%s): %v", d.ChaveDfe, err)
-				insertErrors++
-			} else {
-				totalCorrente++
-				valorTotal += d.ValorCBSTotal
-				valorExtinto += d.ValorCBSExtinto
-				valorNaoExtinto += d.ValorCBSNaoExtinto
-				if dataApuracao == "" && d.DataApuracao != "" {
-					dataApuracao = d.DataApuracao
-				}
-			}
-		}
-	}
-
-	if apuracao.ApuracaoAjuste != nil {
-		for _, d := range apuracao.ApuracaoAjuste.Debitos {
-			if err := insertDebito(tx, requestID, companyID, "ajuste", d); err != nil {
-				log.Printf("[RFB Reprocess] Error inserting ajuste debit (chave=%s): %v", d.ChaveDfe, err)
-				insertErrors++
-			} else {
-				totalAjuste++
-				valorTotal += d.ValorCBSTotal
-				valorExtinto += d.ValorCBSExtinto
-				valorNaoExtinto += d.ValorCBSNaoExtinto
-			}
-		}
-	}
-
-	if apuracao.DebitosExtemporaneos != nil {
-		for _, d := range apuracao.DebitosExtemporaneos.Debitos {
-			if err := insertDebito(tx, requestID, companyID, "extemporaneo", d); err != nil {
-				log.Printf("[RFB Reprocess] Error inserting extemporaneo debit (chave=%s): %v", d.ChaveDfe, err)
-				insertErrors++
-			} else {
-				totalExtemporaneo++
-				valorTotal += d.ValorCBSTotal
-				valorExtinto += d.ValorCBSExtinto
-				valorNaoExtinto += d.ValorCBSNaoExtinto
-			}
-		}
-	}
-
-	totalDebitos := totalCorrente + totalAjuste + totalExtemporaneo
-
-	_, err = tx.Exec(`
-		INSERT INTO rfb_resumo (request_id, company_id, data_apuracao, total_debitos,
-			valor_cbs_total, valor_cbs_extinto, valor_cbs_nao_extinto,
-			total_corrente, total_ajuste, total_extemporaneo)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		ON CONFLICT (company_id, data_apuracao)
-		DO UPDATE SET request_id = $1, total_debitos = $4,
-			valor_cbs_total = $5, valor_cbs_extinto = $6, valor_cbs_nao_extinto = $7,
-			total_corrente = $8, total_ajuste = $9, total_extemporaneo = $10
-	`, requestID, companyID, dataApuracao, totalDebitos,
-		valorTotal, valorExtinto, valorNaoExtinto,
-		totalCorrente, totalAjuste, totalExtemporaneo)
+	resumo, err := importarDebitosRFB(db, requestID, companyID, src, true)
 	if err != nil {
-		tx.Rollback()
-		updateRequestError(db, requestID, "DB_ERROR", "Falha ao salvar resumo: "+err.Error())
-		return fmt.Errorf("failed to upsert summary: %w", err)
-	}
-
-	if err := tx.Commit(); err != nil {
-		updateRequestError(db, requestID, "DB_ERROR", "Falha no commit: "+err.Error())
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return err
 	}
 
 	updateRequestStatus(db, requestID, "completed")
-	if insertErrors > 0 {
-		log.Printf("[RFB Reprocess] WARN: %d debits failed to insert out of total attempted", insertErrors)
-	}
-	log.Printf("[RFB Reprocess] Request %s completed: %d debits (%d corrente, %d ajuste, %d extemporaneo, %d errors), CBS total: %.2f",
-		requestID, totalDebitos, totalCorrente, totalAjuste, totalExtemporaneo, insertErrors, valorTotal)
+	log.Printf("[RFB Reprocess] Request %s completed: %s", requestID, resumo)
 	return nil
 }
 
@@ -444,7 +418,8 @@ func updateRequestStatus(db *sql.DB, requestID, status string) {
 
 func updateRequestError(db *sql.DB, requestID, code, message string) {
 	_, err := db.Exec(`
-		UPDATE rfb_requests SET status = 'error', error_code = $1, error_message = $2, updated_at = CURRENT_TIMESTAMP
+		UPDATE rfb_requests SET status = 'error', error_code = $1, error_message = $2,
+			error_retryable = false, updated_at = CURRENT_TIMESTAMP
 		WHERE id = $3
 	`, code, message, requestID)
 	if err != nil {
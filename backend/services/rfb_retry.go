@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RFBAPIError is an error answer (non-2xx) from the RFB API.
+type RFBAPIError struct {
+	Operation  string // "token", "apuracao" or "download"
+	StatusCode int
+	CodigoErro string
+	msg        string
+}
+
+func (e *RFBAPIError) Error() string { return e.msg }
+
+// ErrRFBArquivoNaoPronto is returned by ProcessarDownloadRFB when a request
+// polled before its webhook has no file yet; it stays 'requested'.
+var ErrRFBArquivoNaoPronto = errors.New("arquivo da RFB ainda não disponível")
+
+// RFBErrorRetryable tells temporary failures, worth trying again later, from
+// final ones. Retried are calls that got no (complete) answer — network
+// errors, timeouts, a body cut short — and API answers 408, 429 and 5xx, plus
+// the gateway 401 (expired token) outside the token call. Everything else is
+// final: 400, 403 (the CNPJ of the credential differs from the request's),
+// 404 (unknown tíquete or file already downloaded — the download tíquete is
+// single-use), rejected credentials, unreadable certificates, parse errors.
+func RFBErrorRetryable(err error) bool {
+	var apiErr *RFBAPIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case 401:
+			// On the token call it means the client id/secret were refused
+			return apiErr.Operation != "token"
+		case 408, 429:
+			return true
+		}
+		return apiErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// rfbErrorStatus is the HTTP status of an RFB API error, 0 for other errors.
+func rfbErrorStatus(err error) int {
+	var apiErr *RFBAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// RFBRetryPolicy is how long a request may wait for its webhook and how its
+// temporary failures are retried:
+//
+//	RFB_POLL_AFTER_MINUTES     wait for the webhook before polling (default 30)
+//	RFB_POLL_INTERVAL_MINUTES  between polls while the file is not ready (default 30)
+//	RFB_RETRY_BASE_MINUTES     first retry delay, doubled each failure (default 5)
+//	RFB_MAX_ATTEMPTS           temporary failures before giving up (default 6)
+//	RFB_REQUEST_TTL_HOURS      age at which an unfinished request expires (default 72)
+type RFBRetryPolicy struct {
+	PollAfter    time.Duration
+	PollInterval time.Duration
+	BackoffBase  time.Duration
+	BackoffMax   time.Duration
+	MaxAttempts  int
+	TTL          time.Duration
+}
+
+// LoadRFBRetryPolicy reads the policy from the environment.
+func LoadRFBRetryPolicy() RFBRetryPolicy {
+	return RFBRetryPolicy{
+		PollAfter:    time.Duration(envInt("RFB_POLL_AFTER_MINUTES", 30)) * time.Minute,
+		PollInterval: time.Duration(envInt("RFB_POLL_INTERVAL_MINUTES", 30)) * time.Minute,
+		BackoffBase:  time.Duration(envInt("RFB_RETRY_BASE_MINUTES", 5)) * time.Minute,
+		BackoffMax:   6 * time.Hour,
+		MaxAttempts:  envInt("RFB_MAX_ATTEMPTS", 6),
+		TTL:          time.Duration(envInt("RFB_REQUEST_TTL_HOURS", 72)) * time.Hour,
+	}
+}
+
+// Backoff returns the delay before retry number `attempts` (1-based).
+func (p RFBRetryPolicy) Backoff(attempts int) time.Duration {
+	d := p.BackoffBase
+	for i := 1; i < attempts && d < p.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > p.BackoffMax {
+		d = p.BackoffMax
+	}
+	return d
+}
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(envOr(key, "")); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// recordDownloadFailure marks the request as failed. A temporary failure is
+// scheduled for another try (error_retryable, next_attempt_at) until the
+// policy's attempts run out; a final one is recorded like any other error.
+func recordDownloadFailure(db *sql.DB, requestID, code string, err error) {
+	if !RFBErrorRetryable(err) {
+		updateRequestError(db, requestID, code, err.Error())
+		return
+	}
+
+	policy := LoadRFBRetryPolicy()
+	var attempts int
+	if e := db.QueryRow(`
+		UPDATE rfb_requests SET download_attempts = download_attempts + 1
+		WHERE id = $1
+		RETURNING download_attempts
+	`, requestID).Scan(&attempts); e != nil {
+		log.Printf("[RFB Processor] Error counting attempts of request %s: %v", requestID, e)
+	}
+	if attempts >= policy.MaxAttempts {
+		updateRequestError(db, requestID, code, fmt.Sprintf("Falhou após %d tentativas: %v", attempts, err))
+		return
+	}
+
+	delay := policy.Backoff(attempts)
+	log.Printf("[RFB Processor] Request %s: %s (attempt %d/%d), retrying in %v: %v",
+		requestID, code, attempts, policy.MaxAttempts, delay, err)
+	_, e := db.Exec(`
+		UPDATE rfb_requests
+		SET status = 'error', error_code = $2, error_message = $3,
+		    error_retryable = true, next_attempt_at = NOW() + make_interval(secs => $4),
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, requestID, code, err.Error(), delay.Seconds())
+	if e != nil {
+		log.Printf("[RFB Processor] Error scheduling retry of request %s: %v", requestID, e)
+	}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Origins of an rfb_requests row.
+const (
+	RFBOrigemManual   = "manual"
+	RFBOrigemAgendada = "agendada"
+)
+
+// RFBLimiteDiario is how many solicitations a company may make per day.
+const RFBLimiteDiario = 2
+
+var (
+	ErrRFBSemCredenciais = errors.New("Credenciais RFB não configuradas. Configure em Conectar Receita Federal > Credenciais API.")
+	ErrRFBLimiteDiario   = fmt.Errorf("Limite diário atingido (máximo %d solicitações por dia)", RFBLimiteDiario)
+)
+
+// RFBSolicitacaoError is a failed token or solicitation call to the RFB. It
+// has already been recorded as an 'error' row of rfb_requests.
+type RFBSolicitacaoError struct {
+	Code string // TOKEN_ERROR or REQUEST_ERROR
+	Err  error
+}
+
+func (e *RFBSolicitacaoError) Error() string {
+	if e.Code == "TOKEN_ERROR" {
+		return "Erro ao obter token da RFB: " + e.Err.Error()
+	}
+	return "Erro ao solicitar apuração: " + e.Err.Error()
+}
+
+func (e *RFBSolicitacaoError) Unwrap() error { return e.Err }
+
+// SolicitarApuracaoRFB requests a new CBS assessment with one of the
+// company's active credentials (credentialID, or the oldest when empty) and
+// records it in rfb_requests, returning the request id and tíquete. The
+// download starts with the webhook or, failing that, with the RFB
+// scheduler's polling once RFBRetryPolicy.PollAfter has passed.
+func SolicitarApuracaoRFB(db *sql.DB, companyID, credentialID, origem string) (requestID, tiquete string, err error) {
+	cred, err := CarregarCredencialRFB(db, companyID, credentialID, "")
+	if err != nil {
+		return "", "", err
+	}
+	cnpjBase := cred.CNPJBase
+
+	// The daily limit is per CNPJ base
+	var todayCount int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM rfb_requests
+		WHERE company_id = $1 AND cnpj_base = $2 AND status != 'error'
+		AND created_at >= CURRENT_DATE
+	`, companyID, cnpjBase).Scan(&todayCount)
+	if err == nil && todayCount >= RFBLimiteDiario {
+		return "", "", ErrRFBLimiteDiario
+	}
+
+	rfbClient, err := cred.Client()
+	if err != nil {
+		return "", "", fmt.Errorf("Erro no certificado A1 da credencial %s: %w", cnpjBase, err)
+	}
+
+	failed := func(code string, err error) (string, string, error) {
+		db.Exec(`
+			INSERT INTO rfb_requests (company_id, cnpj_base, status, error_code, error_message, origem, credential_id)
+			VALUES ($1, $2, 'error', $3, $4, $5, $6)
+		`, companyID, cnpjBase, code, err.Error(), origem, cred.ID)
+		return "", "", &RFBSolicitacaoError{Code: code, Err: err}
+	}
+
+	// 1. Get OAuth2 token
+	token, err := rfbClient.GetToken(cred.ClientID, cred.ClientSecret)
+	if err != nil {
+		return failed("TOKEN_ERROR", err)
+	}
+
+	// 2. Request CBS assessment, with this request's callback secret
+	webhookToken, webhookTokenHash, err := NewRFBWebhookToken()
+	if err != nil {
+		return "", "", fmt.Errorf("Erro ao gerar token do webhook: %w", err)
+	}
+	tiquete, err = rfbClient.SolicitarApuracao(token, cnpjBase, webhookToken)
+	if err != nil {
+		return failed("REQUEST_ERROR", err)
+	}
+
+	// 3. Save request with ticket; polling starts if the webhook takes too long
+	pollAt := time.Now().Add(LoadRFBRetryPolicy().PollAfter)
+	err = db.QueryRow(`
+		INSERT INTO rfb_requests (company_id, cnpj_base, tiquete, status, webhook_token_hash, origem, next_attempt_at, credential_id)
+		VALUES ($1, $2, $3, 'requested', $4, $5, $6, $7)
+		RETURNING id
+	`, companyID, cnpjBase, tiquete, webhookTokenHash, origem, pollAt, cred.ID).Scan(&requestID)
+	if err != nil {
+		return "", "", fmt.Errorf("Erro ao salvar solicitação: %w", err)
+	}
+	return requestID, tiquete, nil
+}
@@ -0,0 +1,454 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// The apuração file is one object with a group of debits per kind of
+// apuração; each group is {"debitos": [...]}:
+//
+//	{"apuracaoCorrente": {"debitos": [...]}, "apuracaoAjuste": {...}, "debitosExtemporaneos": {...}}
+//
+// gruposRFB maps each group to rfb_debitos.tipo_apuracao.
+var gruposRFB = map[string]string{
+	"apuracaoCorrente":     "corrente",
+	"apuracaoAjuste":       "ajuste",
+	"debitosExtemporaneos": "extemporaneo",
+}
+
+// grupoRFB looks key up in gruposRFB ignoring case, as json.Unmarshal matched
+// the group fields before the file was streamed.
+func grupoRFB(key string) (string, bool) {
+	for grupo, tipo := range gruposRFB {
+		if strings.EqualFold(key, grupo) {
+			return tipo, true
+		}
+	}
+	return "", false
+}
+
+// streamDebitosRFB decodes the apuração file one debit at a time, calling fn
+// with the debit's tipo_apuracao, so memory does not grow with the file.
+// Unknown keys are skipped.
+func streamDebitosRFB(r io.Reader, fn func(tipo string, d RFBDebito) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := objectKey(dec)
+		if err != nil {
+			return err
+		}
+		tipo, ok := grupoRFB(key)
+		if !ok {
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := streamGrupo(dec, key, tipo, fn); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// streamGrupo reads one group: null or {"debitos": null | [...]}.
+func streamGrupo(dec *json.Decoder, grupo, tipo string, fn func(string, RFBDebito) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("%s: esperado objeto, encontrado %v", grupo, tok)
+	}
+	for dec.More() {
+		key, err := objectKey(dec)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(key, "debitos") {
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok == nil {
+			continue
+		}
+		if d, ok := tok.(json.Delim); !ok || d != '[' {
+			return fmt.Errorf("%s.debitos: esperado lista, encontrado %v", grupo, tok)
+		}
+		for i := 0; dec.More(); i++ {
+			var d RFBDebito
+			if err := dec.Decode(&d); err != nil {
+				return fmt.Errorf("%s.debitos[%d]: %w", grupo, i, err)
+			}
+			if err := fn(tipo, d); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("JSON inesperado: esperado %q, encontrado %v", want, tok)
+	}
+	return nil
+}
+
+func objectKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("JSON inesperado: esperado nome de campo, encontrado %v", tok)
+	}
+	return key, nil
+}
+
+// skipValue consumes the next value without keeping it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// batchSize rows per INSERT (at most 17 parameters each, well under the
+// 65535-parameter limit of the protocol).
+const batchSize = 500
+
+// batchInsert accumulates rows for one multi-row INSERT.
+type batchInsert struct {
+	insert  string // "INSERT INTO t (cols) VALUES "
+	columns int
+	args    []interface{}
+	rows    int
+}
+
+func (b *batchInsert) add(values ...interface{}) {
+	b.args = append(b.args, values...)
+	b.rows++
+}
+
+func (b *batchInsert) flush(exec dbExecutor) error {
+	if b.rows == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString(b.insert)
+	for i := 0; i < b.rows; i++ {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('(')
+		for c := 0; c < b.columns; c++ {
+			if c > 0 {
+				sb.WriteString(", ")
+			}
+			fmt.Fprintf(&sb, "$%d", i*b.columns+c+1)
+		}
+		sb.WriteByte(')')
+	}
+	_, err := exec.Exec(sb.String(), b.args...)
+	b.args = b.args[:0]
+	b.rows = 0
+	return err
+}
+
+// RFBFormaExtincao is one item of a debit's formasExtincao: how (and when)
+// part of the debit was extinguished — payment, split payment, credit offset...
+type RFBFormaExtincao struct {
+	CodigoFormaExtincao    FlexString `json:"codigoFormaExtincao"`
+	DescricaoFormaExtincao FlexString `json:"descricaoFormaExtincao"`
+	ValorExtinto           *float64   `json:"valorExtinto"`
+	DataExtincao           *RFBTime   `json:"dataExtincao"`
+}
+
+// RFBEvento is one item of a debit's eventos (cancellation, correction...)
+// and the document it refers to, when the RFB sends one.
+type RFBEvento struct {
+	CodigoEvento    FlexString `json:"codigoEvento"`
+	DescricaoEvento FlexString `json:"descricaoEvento"`
+	DataEvento      *RFBTime   `json:"dataEvento"`
+	ValorCBS        *float64   `json:"valorCBS"`
+	ChaveDfe        FlexString `json:"chaveDfe"`
+	NumeroProtocolo FlexString `json:"numeroProtocolo"`
+}
+
+// debitoBatch accumulates rfb_debitos rows, with their extinction forms and
+// events, and inserts them a batch at a time. Debit ids are generated here so
+// the child rows can reference them in the same flush.
+type debitoBatch struct {
+	exec      dbExecutor
+	requestID string
+	companyID string
+
+	debitos, extincoes, eventos batchInsert
+	// ignorados counts formasExtincao/eventos lists that could not be
+	// decoded; they are kept only in the debit's JSON columns.
+	ignorados int
+}
+
+func newDebitoBatch(exec dbExecutor, requestID, companyID string) *debitoBatch {
+	return &debitoBatch{
+		exec: exec, requestID: requestID, companyID: companyID,
+		debitos: batchInsert{columns: 17, insert: `INSERT INTO rfb_debitos (id, request_id, company_id, tipo_apuracao,
+			modelo_dfe, numero_dfe, chave_dfe, data_dfe_emissao, data_apuracao,
+			ni_emitente, ni_adquirente,
+			valor_cbs_total, valor_cbs_extinto, valor_cbs_nao_extinto,
+			situacao_debito, formas_extincao, eventos) VALUES `},
+		extincoes: batchInsert{columns: 7, insert: `INSERT INTO rfb_debito_extincoes (debito_id, request_id, company_id,
+			codigo_forma, descricao_forma, valor_extinto, data_extincao) VALUES `},
+		eventos: batchInsert{columns: 9, insert: `INSERT INTO rfb_debito_eventos (debito_id, request_id, company_id,
+			codigo_evento, descricao_evento, data_evento, valor_cbs, chave_dfe, protocolo) VALUES `},
+	}
+}
+
+func (b *debitoBatch) add(tipo string, d RFBDebito) error {
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	b.debitos.add(id, b.requestID, b.companyID, tipo,
+		string(d.ModeloDfe), string(d.NumeroDfe), string(d.ChaveDfe), d.DataDfeEmissao.Time(), d.DataApuracao,
+		string(d.NiEmitente), string(d.NiAdquirente),
+		d.ValorCBSTotal, d.ValorCBSExtinto, d.ValorCBSNaoExtinto,
+		string(d.SituacaoDebito), rawJSONColumn(d.FormasExtincao), rawJSONColumn(d.Eventos))
+
+	var formas []RFBFormaExtincao
+	if b.decodeLista(d.FormasExtincao, &formas, "formasExtincao", d.ChaveDfe) {
+		for _, f := range formas {
+			b.extincoes.add(id, b.requestID, b.companyID,
+				textColumn(f.CodigoFormaExtincao, 20), textColumn(f.DescricaoFormaExtincao, 200),
+				f.ValorExtinto, f.DataExtincao.Time())
+		}
+	}
+	var eventos []RFBEvento
+	if b.decodeLista(d.Eventos, &eventos, "eventos", d.ChaveDfe) {
+		for _, e := range eventos {
+			b.eventos.add(id, b.requestID, b.companyID,
+				textColumn(e.CodigoEvento, 20), textColumn(e.DescricaoEvento, 200),
+				e.DataEvento.Time(), e.ValorCBS,
+				textColumn(e.ChaveDfe, 50), textColumn(e.NumeroProtocolo, 50))
+		}
+	}
+
+	if b.debitos.rows >= batchSize || b.extincoes.rows >= batchSize || b.eventos.rows >= batchSize {
+		return b.flush()
+	}
+	return nil
+}
+
+// decodeLista decodes a formasExtincao or eventos list. A list in an
+// unexpected shape is logged and skipped instead of failing the import.
+func (b *debitoBatch) decodeLista(raw json.RawMessage, dst interface{}, campo string, chave FlexString) bool {
+	if !rawJSONColumn(raw).Valid {
+		return false
+	}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		log.Printf("[RFB Processor] WARNING: %s of debit %s not decoded, kept only as JSON: %v", campo, chave, err)
+		b.ignorados++
+		return false
+	}
+	return true
+}
+
+// flush inserts the debits before their children (the foreign keys are
+// checked per statement).
+func (b *debitoBatch) flush() error {
+	for _, batch := range []*batchInsert{&b.debitos, &b.extincoes, &b.eventos} {
+		if err := batch.flush(b.exec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Time returns the parsed time, nil when absent or unparseable.
+func (rt *RFBTime) Time() *time.Time {
+	if rt == nil {
+		return nil
+	}
+	return rt.T
+}
+
+// textColumn stores a text field cut to the column size, NULL when absent.
+func textColumn(s FlexString, max int) sql.NullString {
+	v := strings.TrimSpace(string(s))
+	if v == "" || v == "null" {
+		return sql.NullString{}
+	}
+	if r := []rune(v); len(r) > max {
+		v = string(r[:max])
+	}
+	return sql.NullString{String: v, Valid: true}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
+
+// rawJSONColumn stores a JSON fragment as-is, NULL when absent.
+func rawJSONColumn(raw json.RawMessage) sql.NullString {
+	if len(raw) == 0 || string(raw) == "null" {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(raw), Valid: true}
+}
+
+// rfbArquivoParte is the size of each rfb_arquivos part (compressed bytes).
+const rfbArquivoParte = 1 << 20
+
+// salvarArquivoRFB stores the downloaded file gzip-compressed in rfb_arquivos,
+// replacing any earlier copy, one part at a time.
+func salvarArquivoRFB(db *sql.DB, requestID, companyID string, src io.Reader, size int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM rfb_arquivos WHERE request_id = $1`, requestID); err != nil {
+		return err
+	}
+	pw := &parteWriter{tx: tx, requestID: requestID, companyID: companyID}
+	buf := bufio.NewWriterSize(pw, rfbArquivoParte)
+	gz := gzip.NewWriter(buf)
+	if _, err := io.Copy(gz, src); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE rfb_requests SET raw_json = NULL, raw_json_bytes = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, requestID, size); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// parteWriter inserts each write as the next part; behind a bufio.Writer of
+// rfbArquivoParte bytes the parts stay around that size.
+type parteWriter struct {
+	tx                   *sql.Tx
+	requestID, companyID string
+	parte                int
+}
+
+func (w *parteWriter) Write(p []byte) (int, error) {
+	_, err := w.tx.Exec(`
+		INSERT INTO rfb_arquivos (request_id, parte, company_id, dados) VALUES ($1, $2, $3, $4)
+	`, w.requestID, w.parte, w.companyID, p)
+	if err != nil {
+		return 0, err
+	}
+	w.parte++
+	return len(p), nil
+}
+
+// abrirArquivoRFB returns the stored file of a request: the rfb_arquivos parts
+// or, for requests downloaded before them, the raw_json column (which is read
+// whole). ok is false when nothing is stored.
+func abrirArquivoRFB(db *sql.DB, requestID string) (r io.ReadCloser, ok bool, err error) {
+	var partes int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM rfb_arquivos WHERE request_id = $1`, requestID).Scan(&partes); err != nil {
+		return nil, false, err
+	}
+	if partes > 0 {
+		gz, err := gzip.NewReader(&parteReader{db: db, requestID: requestID, total: partes})
+		if err != nil {
+			return nil, false, fmt.Errorf("arquivo da RFB corrompido: %w", err)
+		}
+		return gz, true, nil
+	}
+
+	var rawJSON sql.NullString
+	if err := db.QueryRow(`SELECT raw_json FROM rfb_requests WHERE id = $1`, requestID).Scan(&rawJSON); err != nil {
+		return nil, false, err
+	}
+	if !rawJSON.Valid || rawJSON.String == "" {
+		return nil, false, nil
+	}
+	return io.NopCloser(strings.NewReader(rawJSON.String)), true, nil
+}
+
+// parteReader reads the rfb_arquivos parts in order, one at a time.
+type parteReader struct {
+	db        *sql.DB
+	requestID string
+	total     int
+	parte     int
+	buf       []byte
+}
+
+func (r *parteReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.parte >= r.total {
+			return 0, io.EOF
+		}
+		if err := r.db.QueryRow(`
+			SELECT dados FROM rfb_arquivos WHERE request_id = $1 AND parte = $2
+		`, r.requestID, r.parte).Scan(&r.buf); err != nil {
+			return 0, fmt.Errorf("parte %d do arquivo da RFB: %w", r.parte, err)
+		}
+		r.parte++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+)
+
+// Each solicitation sends its own callback secret in urlRetorno (?token=...),
+// so the webhook can tell a callback from the RFB for that request from any
+// other POST. Only the SHA-256 of the token is stored
+// (rfb_requests.webhook_token_hash).
+
+// NewRFBWebhookToken returns a random callback token and its hash.
+func NewRFBWebhookToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, RFBWebhookTokenHash(token), nil
+}
+
+// RFBWebhookTokenHash is the stored form of a callback token.
+func RFBWebhookTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// callbackURL is the webhook URL with the request's token.
+func (c *RFBClient) callbackURL(webhookToken string) string {
+	u, err := url.Parse(c.webhookURL)
+	if err != nil || webhookToken == "" {
+		return c.webhookURL
+	}
+	q := u.Query()
+	q.Set("token", webhookToken)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// schemaContext holds the schema section of the text-to-SQL prompt as read
+// from the catalog by LoadSchemaContext. Empty until then.
+var schemaContext atomic.Value
+
+// SchemaContext returns the schema section of the text-to-SQL prompt: the one
+// generated from the catalog when available, dbSchemaContext otherwise.
+func SchemaContext() string {
+	if s, ok := schemaContext.Load().(string); ok && s != "" {
+		return s
+	}
+	return dbSchemaContext
+}
+
+// schemaColumn is one column of an allow-listed relation.
+type schemaColumn struct {
+	rel, kind, relComment string
+	name, typ, comment    string
+}
+
+// LoadSchemaContext builds the schema section of the text-to-SQL prompt from
+// the live catalog. The allow-list is the set of views in ai_sandbox (the only
+// relations the generated SQL can reach); types come from those views and
+// comments from the underlying relations in public, so documenting a column
+// is a COMMENT ON away. Call it after migrations; on failure the hand-written
+// dbSchemaContext stays in use.
+func LoadSchemaContext(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT v.relname,
+		       COALESCE(src.relkind::text, 'v'),
+		       COALESCE(obj_description(src.oid, 'pg_class'), ''),
+		       a.attname,
+		       format_type(a.atttypid, a.atttypmod),
+		       COALESCE(col_description(src.oid, sa.attnum), '')
+		FROM pg_class v
+		JOIN pg_namespace vn ON vn.oid = v.relnamespace AND vn.nspname = 'ai_sandbox'
+		JOIN pg_attribute a ON a.attrelid = v.oid AND a.attnum > 0 AND NOT a.attisdropped
+		LEFT JOIN pg_namespace pn ON pn.nspname = 'public'
+		LEFT JOIN pg_class src ON src.relname = v.relname AND src.relnamespace = pn.oid
+		LEFT JOIN pg_attribute sa ON sa.attrelid = src.oid AND sa.attname = a.attname AND NOT sa.attisdropped
+		WHERE v.relkind = 'v'
+		ORDER BY v.relname, a.attnum
+	`)
+	if err != nil {
+		return fmt.Errorf("read catalog: %w", err)
+	}
+	defer rows.Close()
+
+	var cols []schemaColumn
+	for rows.Next() {
+		var c schemaColumn
+		if err := rows.Scan(&c.rel, &c.kind, &c.relComment, &c.name, &c.typ, &c.comment); err != nil {
+			return fmt.Errorf("scan catalog: %w", err)
+		}
+		cols = append(cols, c)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read catalog: %w", err)
+	}
+	if len(cols) == 0 {
+		return fmt.Errorf("no relations in schema ai_sandbox")
+	}
+
+	ctx := renderSchemaContext(cols)
+	schemaContext.Store(ctx)
+	fmt.Printf("[AI Query] Schema context loaded from catalog (%d columns, %d bytes)\n", len(cols), len(ctx))
+	return nil
+}
+
+// renderSchemaContext writes the columns (ordered by relation) in the
+// CREATE ... ( col TYPE, -- comment ) layout the prompt has always used.
+func renderSchemaContext(cols []schemaColumn) string {
+	var sb strings.Builder
+	sb.WriteString("\n-- Schema PostgreSQL do FBTax Cloud (multi-empresa), gerado do catálogo\n")
+	sb.WriteString("-- IMPORTANTE: todas as tabelas de dados da empresa têm company_id — sempre filtre por ele.\n")
+
+	for i, c := range cols {
+		if i == 0 || cols[i-1].rel != c.rel {
+			sb.WriteString("\n")
+			if c.relComment != "" {
+				sb.WriteString("-- " + strings.ReplaceAll(c.relComment, "\n", "\n-- ") + "\n")
+			}
+			kind := "TABLE"
+			switch c.kind {
+			case "m":
+				kind = "MATERIALIZED VIEW"
+			case "v":
+				kind = "VIEW"
+			}
+			fmt.Fprintf(&sb, "CREATE %s %s (\n", kind, c.rel)
+		}
+
+		last := i == len(cols)-1 || cols[i+1].rel != c.rel
+		line := "    " + c.name + " " + strings.ToUpper(c.typ)
+		if !last {
+			line += ","
+		}
+		if c.comment != "" {
+			line += " -- " + strings.ReplaceAll(c.comment, "\n", " ")
+		}
+		sb.WriteString(line + "\n")
+		if last {
+			sb.WriteString(");\n")
+		}
+	}
+	return sb.String()
+}
@@ -13,8 +13,8 @@ NÃO escreva análise, raciocínio ou explicação. Vá direto ao bloco SQL.
 
 REGRAS OBRIGATÓRIAS:
 1. Responda SOMENTE com o bloco SQL dentro de ` + "```sql\n...\n```" + `. Zero texto fora do bloco.
-2. mv_mercadorias_agregada, mv_operacoes_simples e mv_compras_fornecedores têm company_id — filtre diretamente: WHERE company_id = '__COMPANY_ID__'.
-3. operacoes_comerciais e participants NÃO têm company_id. Sempre JOIN com import_jobs: JOIN import_jobs j ON j.id = oc.job_id WHERE j.company_id = '__COMPANY_ID__'.
+2. Todas as tabelas e views de dados da empresa (exceto tabela_aliquotas) têm company_id — filtre diretamente: WHERE company_id = '__COMPANY_ID__'.
+3. Em JOINs, filtre company_id na tabela principal (ex: WHERE oc.company_id = '__COMPANY_ID__').
 4. participants requer JOIN duplo: JOIN participants p ON p.job_id = oc.job_id AND p.cod_part = oc.cod_part.
 5. Use APENAS SELECT. Jamais use INSERT, UPDATE, DELETE, DROP, ALTER, CREATE, TRUNCATE.
 6. Inclua LIMIT 100 no final.
@@ -28,13 +28,14 @@ REGRAS OBRIGATÓRIAS:
     Use ano=2033 da tabela_aliquotas. total_icms é sempre 0 para fornecedores do Simples — ignore-o.
 11. Faturamento/vendas = tipo = 'SAIDA'. Compras = tipo = 'ENTRADA' (mv_mercadorias_agregada).
 12. Ordene por valor DESC quando relevante.
-13. Para perguntas sobre "maiores fornecedores por compra", "top fornecedores", "fornecedores por valor de compra" use mv_compras_fornecedores — ela contém TODOS os fornecedores (CFOP < 5000, todas as filiais). mv_operacoes_simples contém APENAS fornecedores do Simples Nacional — use-a somente quando a pergunta mencionar explicitamente Simples Nacional.`
+13. Para perguntas sobre "maiores fornecedores por compra", "top fornecedores", "fornecedores por valor de compra" use mv_compras_fornecedores — ela contém TODOS os fornecedores (CFOP < 5000, todas as filiais). mv_operacoes_simples contém APENAS fornecedores do Simples Nacional — use-a somente quando a pergunta mencionar explicitamente Simples Nacional.
+14. Só existem as tabelas e views listadas no schema abaixo. Não use prefixo de schema (public., pg_catalog.) nem funções administrativas.`
 
-// dbSchemaContext describes the key tables/views the AI can query.
+// dbSchemaContext is the hand-written schema used until LoadSchemaContext has
+// read the catalog (or when it fails).
 const dbSchemaContext = `
 -- Schema PostgreSQL do FBTax Cloud (multi-empresa)
--- IMPORTANTE: operacoes_comerciais e participants NÃO têm company_id diretamente.
--- Para filtrar por empresa, sempre JOIN com import_jobs usando job_id.
+-- IMPORTANTE: todas as tabelas de dados da empresa têm company_id — sempre filtre por ele.
 
 -- View principal agregada: operações fiscais por filial/período (TEM company_id direto)
 CREATE MATERIALIZED VIEW mv_mercadorias_agregada (
@@ -77,11 +78,12 @@ CREATE MATERIALIZED VIEW mv_operacoes_simples (
     total_icms DECIMAL       -- crédito ICMS perdido = prejuízo do Simples (antigo vl_icms_origem)
 );
 
--- Operações por parceiro (NÃO tem company_id — filtrar via import_jobs)
+-- Operações por parceiro (TEM company_id direto)
 -- vl_ibs_projetado e vl_cbs_projetado são valores projetados da Reforma Tributária
 -- calculados sobre os dados reais importados (mes_ano refere-se ao período real, ex: '01/2024')
 CREATE TABLE operacoes_comerciais (
-    job_id UUID,             -- JOIN com import_jobs para obter company_id
+    company_id UUID,         -- filtrar aqui diretamente
+    job_id UUID,             -- importação de origem (import_jobs)
     filial_cnpj VARCHAR,
     cod_part VARCHAR,        -- código do parceiro
     mes_ano VARCHAR,         -- período real 'MM/YYYY' dos dados importados
@@ -92,16 +94,17 @@ CREATE TABLE operacoes_comerciais (
     vl_cbs_projetado DECIMAL
 );
 
--- Parceiros/fornecedores (NÃO tem company_id — filtrar via import_jobs)
+-- Parceiros/fornecedores (TEM company_id direto)
 -- JOIN obrigatório em DOIS campos: job_id AND cod_part
 CREATE TABLE participants (
-    job_id UUID,             -- JOIN com import_jobs para obter company_id
+    company_id UUID,         -- filtrar aqui diretamente
+    job_id UUID,
     cod_part VARCHAR,
     nome VARCHAR,
     cnpj VARCHAR
 );
 
--- Importações de SPED (bridge para company_id)
+-- Importações de SPED
 CREATE TABLE import_jobs (
     id UUID PRIMARY KEY,
     company_id UUID,         -- chave de empresa
@@ -119,14 +122,16 @@ CREATE TABLE tabela_aliquotas (
     perc_cbs      DECIMAL,   -- alíquota CBS federal
     perc_reduc_icms DECIMAL  -- percentual de redução do ICMS
     -- IBS total = perc_ibs_uf + perc_ibs_mun
-);
+);`
 
+// sqlExamplesContext is appended to the schema: join and query patterns the
+// model must follow. Unlike the schema it is not derivable from the catalog.
+const sqlExamplesContext = `
 -- EXEMPLOS DE JOIN CORRETO:
 -- Para consultar operacoes_comerciais com filtro de empresa:
 --   FROM operacoes_comerciais oc
---   JOIN import_jobs j ON j.id = oc.job_id
 --   JOIN participants p ON p.job_id = oc.job_id AND p.cod_part = oc.cod_part
---   WHERE j.company_id = '__COMPANY_ID__'
+--   WHERE oc.company_id = '__COMPANY_ID__'
 --
 -- Para consultar mv_mercadorias_agregada:
 --   FROM mv_mercadorias_agregada WHERE company_id = '__COMPANY_ID__'
@@ -172,7 +177,62 @@ var (
 
 // BuildTextToSQLPrompt builds the full user prompt for the AI.
 func BuildTextToSQLPrompt(pergunta string) string {
-	return fmt.Sprintf("%s\n\nPergunta: %s", dbSchemaContext, pergunta)
+	return fmt.Sprintf("%s\n%s\n\nPergunta: %s", SchemaContext(), sqlExamplesContext, pergunta)
+}
+
+// SQLTurn is an earlier question of the same conversation, replayed to the
+// model so follow-ups like "e por filial?" can refer to it.
+type SQLTurn struct {
+	Pergunta string
+	SQL      string
+	Resumo   string // short description of the result (row count, columns)
+}
+
+// BuildTextToSQLMessages builds the conversation for a follow-up question:
+// the schema goes with the first question, each earlier SQL is replayed as the
+// assistant's answer and its result summary prefixes the next question.
+// Without history it is equivalent to BuildTextToSQLPrompt.
+func BuildTextToSQLMessages(history []SQLTurn, pergunta string) []LLMMessage {
+	if len(history) == 0 {
+		return []LLMMessage{{Role: "user", Content: BuildTextToSQLPrompt(pergunta)}}
+	}
+
+	messages := make([]LLMMessage, 0, len(history)*2+1)
+	var pendingResumo string
+	for i, t := range history {
+		content := "Pergunta: " + t.Pergunta
+		if i == 0 {
+			content = BuildTextToSQLPrompt(t.Pergunta)
+		} else if pendingResumo != "" {
+			content = fmt.Sprintf("Resultado da consulta anterior: %s\n\n%s", pendingResumo, content)
+		}
+		messages = append(messages,
+			LLMMessage{Role: "user", Content: content},
+			LLMMessage{Role: "assistant", Content: "```sql\n" + t.SQL + "\n```"},
+		)
+		pendingResumo = t.Resumo
+	}
+
+	final := "Pergunta de seguimento (refine ou complemente as consultas anteriores quando fizer sentido): " + pergunta
+	if pendingResumo != "" {
+		final = fmt.Sprintf("Resultado da consulta anterior: %s\n\n%s", pendingResumo, final)
+	}
+	return append(messages, LLMMessage{Role: "user", Content: final})
+}
+
+// BuildSQLRepairPrompt asks the model to fix its previous query, given the
+// error PostgreSQL (or our validation) returned for it.
+func BuildSQLRepairPrompt(failedSQL, errMsg string) string {
+	var sb strings.Builder
+	sb.WriteString("A consulta anterior falhou.\nErro: ")
+	sb.WriteString(errMsg)
+	if failedSQL != "" {
+		sb.WriteString("\n\nSQL executado:\n```sql\n")
+		sb.WriteString(failedSQL)
+		sb.WriteString("\n```")
+	}
+	sb.WriteString("\n\nCorrija a consulta respeitando as REGRAS OBRIGATÓRIAS e usando apenas as tabelas e colunas do schema. Responda SOMENTE com o bloco SQL corrigido.")
+	return sb.String()
 }
 
 // ExtractSQL extracts and validates SQL from an AI response.
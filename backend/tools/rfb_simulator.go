@@ -0,0 +1,39 @@
+//go:build scripts
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"fb_apu01/rfbsim"
+)
+
+// Simulador local da API CBS da Receita Federal (ver pacote rfbsim).
+//
+//	go run -tags scripts ./tools/rfb_simulator.go -addr :8099
+//
+// Backend: RFB_API_URL=http://localhost:8099 e
+// RFB_WEBHOOK_URL=http://localhost:8081/api/rfb/webhook.
+func main() {
+	addr := flag.String("addr", ":8099", "endereço de escuta")
+	fixtures := flag.String("fixtures", os.Getenv("RFB_SIM_FIXTURES"), "diretório com clientes.json e apuracoes/ (vazio = fixtures embutidas)")
+	webhookURL := flag.String("webhook-url", os.Getenv("RFB_SIM_WEBHOOK_URL"), "substitui a urlRetorno enviada pelo backend")
+	delay := flag.Duration("webhook-delay", 2*time.Second, "espera antes de chamar o webhook")
+	flag.Parse()
+
+	sim, err := rfbsim.New(rfbsim.Options{
+		Fixtures:     *fixtures,
+		WebhookDelay: *delay,
+		WebhookURL:   *webhookURL,
+	})
+	if err != nil {
+		log.Fatalf("Erro ao carregar fixtures: %v", err)
+	}
+
+	log.Printf("Simulador RFB escutando em %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, sim))
+}
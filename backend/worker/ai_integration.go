@@ -12,78 +12,89 @@ import (
 	"fb_apu01/services"
 )
 
-// AIResumo holds aggregated fiscal data for AI report generation (simplified for worker)
-type AIResumo struct {
-	CompanyName       string   `json:"company_name"`
-	CNPJ             string   `json:"cnpj"`
-	Periodo          string   `json:"periodo"`
-	FaturamentoBruto  float64  `json:"faturamento_bruto"`
-	TotalEntradas    float64  `json:"total_entradas"`
-	TotalSaidas      float64  `json:"total_saidas"`
-	IcmsEntrada      float64  `json:"icms_entrada"`
-	IcmsSaida        float64  `json:"icms_saida"`
-	IcmsAPagar       float64  `json:"icms_a_pagar"`
-	IbsProjetado     float64  `json:"ibs_projetado"`
-	CbsProjetado     float64  `json:"cbs_projetado"`
-	TotalNFes        int       `json:"total_nfs"`
-	Operacoes        []AIOperacaoResumo `json:"operacoes"`
-	// Alíquotas efetivas (% sobre faturamento bruto)
-	AliquotaEfetivaICMS         float64 `json:"aliquota_efetiva_icms"`
-	AliquotaEfetivaIBS          float64 `json:"aliquota_efetiva_ibs"`
-	AliquotaEfetivaCBS          float64 `json:"aliquota_efetiva_cbs"`
-	AliquotaEfetivaTotalReforma float64 `json:"aliquota_efetiva_total_reforma"`
-}
+// TriggerAIReportGeneration generates the executive summary after an import
+// and emails it to the managers subscribed to it with frequency "importacao".
+func TriggerAIReportGeneration(db *sql.DB, companyID, periodo, jobID string) error {
+	//1. Check if there are subscribers for this company
+	subscribers, err := getImportSubscribers(db, companyID)
+	if err != nil {
+		return fmt.Errorf("error getting subscribers: %w", err)
+	}
+	if len(subscribers) == 0 {
+		fmt.Printf("[AI Report] No managers subscribed to the post-import summary for company %s, skipping email\n", companyID)
+		return nil // Not an error, just no one to email
+	}
+
+	//2. Generate and save the report
+	report, err := buildExecutiveReport(db, companyID, periodo, jobID)
+	if err != nil {
+		return err
+	}
+	if report == nil {
+		fmt.Printf("[AI Report] No fiscal data for company %s period %s, skipping AI report\n", companyID, periodo)
+		return nil
+	}
 
-// AIOperacaoResumo represents an operation for AI report
-type AIOperacaoResumo struct {
-	TipoOperacao string  `json:"tipo_operacao"`
-	Tipo         string  `json:"tipo"`
-	Valor        float64 `json:"valor"`
-	Icms         float64 `json:"icms"`
+	//3. Queue one email per subscriber (each with its own unsubscribe link);
+	// SMTP failures are retried by the email sender, not reported here
+	scheduled := report.scheduled(periodo)
+	var sendErr error
+	for _, sub := range subscribers {
+		if err := scheduled.deliver(db, sub, time.Time{}); err != nil {
+			sendErr = err
+		}
+	}
+	if sendErr != nil {
+		return fmt.Errorf("error queueing AI report email: %w", sendErr)
+	}
+	return nil
 }
 
-// AIManager represents a manager for AI report emailing
-type AIManager struct {
-	ID           string    `json:"id"`
-	CompanyID     string    `json:"company_id"`
-	NomeCompleto  string    `json:"nome_completo"`
-	Cargo         string    `json:"cargo"`
-	Email         string    `json:"email"`
-	Ativo         bool      `json:"ativo"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+// executiveReport is a generated executive summary, ready to be emailed.
+type executiveReport struct {
+	resumo      *services.ApuracaoResumo
+	narrative   string
+	dadosBrutos string
+	taxData     services.TaxComparisonData
 }
 
-// TriggerAIReportGeneration generates AI-powered executive summary and sends email to managers
-func TriggerAIReportGeneration(db *sql.DB, companyID, periodo, jobID string) error {
-	//1. Check if there are active managers for this company
-	var managerCount int
-	err := db.QueryRow("SELECT COUNT(*) FROM managers WHERE company_id = $1 AND ativo = true", companyID).Scan(&managerCount)
-	if err != nil || managerCount == 0 {
-		fmt.Printf("[AI Report] No active managers for company %s, skipping email\n", companyID)
-		return nil // Not an error, just no one to email
+// scheduled wraps the summary for sending, with its PDF edition.
+func (e *executiveReport) scheduled(periodo string) *scheduledReport {
+	return &scheduledReport{
+		periodo: periodo,
+		send: func(db *sql.DB, to services.ReportRecipient, attachments ...services.Attachment) error {
+			return services.SendAIReportEmail(db, []services.ReportRecipient{to}, e.resumo.CompanyName, periodo, e.narrative, e.dadosBrutos, e.taxData, attachments...)
+		},
+		renderPDF: func() ([]byte, error) {
+			return services.RenderExecutiveSummaryPDF(e.resumo.CompanyName, periodo, e.narrative, e.taxData)
+		},
+		filename: services.ReportPDFFilename(services.ReportNames[services.ReportResumoExecutivo], periodo),
 	}
+}
 
-	//2. Aggregate fiscal data
-	resumo, err := getApuracaoResumoForAI(db, companyID, periodo)
+// buildExecutiveReport aggregates the period, generates the narrative (AI or
+// fallback), saves it to ai_reports and gathers the email data. It returns
+// nil when the period has no fiscal data. jobID may be empty (scheduled runs).
+func buildExecutiveReport(db *sql.DB, companyID, periodo, jobID string) (*executiveReport, error) {
+	//1. Aggregate fiscal data
+	resumo, err := services.GetApuracaoResumo(db, companyID, periodo, nil)
 	if err != nil {
-		return fmt.Errorf("error aggregating data: %w", err)
+		return nil, fmt.Errorf("error aggregating data: %w", err)
 	}
 
 	// Check if there's data to analyze
-	if resumo.FaturamentoBruto == 0 && resumo.TotalEntradas == 0 {
-		fmt.Printf("[AI Report] No fiscal data for company %s period %s, skipping AI report\n", companyID, periodo)
-		return nil
+	if resumo.SemDados() {
+		return nil, nil
 	}
 
-	//3. Generate AI narrative (with fallback if AI unavailable)
+	//2. Generate AI narrative (with fallback if AI unavailable)
 	var narrative string
 	var modelUsed string
 
 	aiClient := services.NewAIClient()
 	if aiClient != nil && aiClient.IsAvailable() {
 		dataPrompt := buildExecutiveSummaryPromptForAI(resumo)
-		aiResp, err := aiClient.Generate(executiveSummarySystem, dataPrompt, services.ModelFlash, 4096)
+		aiResp, err := aiClient.Generate(executiveSummarySystem, dataPrompt, "", 4096)
 		if err != nil {
 			fmt.Printf("[AI Report] AI generation failed, using fallback: %v\n", err)
 			narrative = buildFallbackNarrative(resumo)
@@ -98,34 +109,22 @@ func TriggerAIReportGeneration(db *sql.DB, companyID, periodo, jobID string) err
 		modelUsed = "fallback"
 	}
 
-	//4. Save report to database
+	//3. Save report to database
 	titulo := fmt.Sprintf("%s | %s", resumo.CompanyName, formatoPeriodoBR(periodo))
 	dadosBrutosJSON := buildDadosBrutosJSON(resumo)
 
 	var reportID string
 	err = db.QueryRow(`
 		INSERT INTO ai_reports (company_id, job_id, periodo, titulo, resumo, dados_brutos, gerado_automaticamente)
-		VALUES ($1, $2, $3, $4, $5, $6, true)
+		VALUES ($1, NULLIF($2, '')::uuid, $3, $4, $5, $6, true)
 		RETURNING id
 	`, companyID, jobID, periodo, titulo, narrative, dadosBrutosJSON).Scan(&reportID)
 	if err != nil {
-		return fmt.Errorf("error saving AI report: %w", err)
+		return nil, fmt.Errorf("error saving AI report: %w", err)
 	}
 	fmt.Printf("[AI Report] Report saved to database: %s (model: %s)\n", reportID, modelUsed)
 
-	//5. Get all active managers
-	managers, err := getActiveManagersForAIReport(db, companyID)
-	if err != nil {
-		return fmt.Errorf("error getting managers: %w", err)
-	}
-
-	//6. Extract emails
-	recipients := make([]string, 0, len(managers))
-	for _, m := range managers {
-		recipients = append(recipients, m.Email)
-	}
-
-	//7. Busca créditos em risco (NF-e sem IBS/CBS + Simples Nacional)
+	//4. Busca créditos em risco (NF-e sem IBS/CBS + Simples Nacional)
 	var ibsRate, cbsRate float64
 	db.QueryRow(`SELECT perc_ibs_uf + perc_ibs_mun, perc_cbs FROM tabela_aliquotas WHERE ano = 2033 LIMIT 1`).Scan(&ibsRate, &cbsRate)
 	if ibsRate == 0 { ibsRate = 17.7 }
@@ -141,30 +140,13 @@ func TriggerAIReportGeneration(db *sql.DB, companyID, periodo, jobID string) err
 	nfeCredLost := nfeValorSemCredito * totalRate
 	simplesCredLost := simplesTotalValor * totalRate
 
-	//8. Send email with full structured data (mirrors the screen)
-	taxData := services.TaxComparisonData{
-		IcmsAPagar:                  resumo.IcmsAPagar,
-		IbsProjetado:                resumo.IbsProjetado,
-		CbsProjetado:                resumo.CbsProjetado,
-		FaturamentoBruto:            resumo.FaturamentoBruto,
-		TotalEntradas:               resumo.TotalEntradas,
-		IcmsSaida:                   resumo.IcmsSaida,
-		IcmsEntrada:                 resumo.IcmsEntrada,
-		AliquotaEfetivaICMS:         resumo.AliquotaEfetivaICMS,
-		AliquotaEfetivaIBS:          resumo.AliquotaEfetivaIBS,
-		AliquotaEfetivaCBS:          resumo.AliquotaEfetivaCBS,
-		AliquotaEfetivaTotalReforma: resumo.AliquotaEfetivaTotalReforma,
-		CreditosEmRiscoTotal:        nfeCredLost + simplesCredLost,
-		CreditosNFeSemIBS:           nfeCredLost,
-		CreditosSimplesNacional:     simplesCredLost,
-		// Previous period not available in worker context; fields remain zero
-	}
-	err = services.SendAIReportEmail(recipients, resumo.CompanyName, periodo, narrative, dadosBrutosJSON, taxData)
-	if err != nil {
-		return fmt.Errorf("error sending AI report email: %w", err)
-	}
+	//5. Structured data for the email (mirrors the screen)
+	taxData := resumo.TaxComparison()
+	taxData.CreditosEmRiscoTotal = nfeCredLost + simplesCredLost
+	taxData.CreditosNFeSemIBS = nfeCredLost
+	taxData.CreditosSimplesNacional = simplesCredLost
 
-	return nil
+	return &executiveReport{resumo: resumo, narrative: narrative, dadosBrutos: dadosBrutosJSON, taxData: taxData}, nil
 }
 
 // formatoPeriodoBR converts MM/YYYY to Portuguese month name YYYY
@@ -183,7 +165,7 @@ func formatoPeriodoBR(periodo string) string {
 }
 
 // buildDadosBrutosJSON converts summary to JSON for storage
-func buildDadosBrutosJSON(resumo *AIResumo) string {
+func buildDadosBrutosJSON(resumo *services.ApuracaoResumo) string {
 	data := map[string]interface{}{
 		"empresa":          resumo.CompanyName,
 		"cnpj":             resumo.CNPJ,
@@ -203,125 +185,15 @@ func buildDadosBrutosJSON(resumo *AIResumo) string {
 		"aliquota_efetiva_total_reforma": resumo.AliquotaEfetivaTotalReforma,
 		"total_nfs":                    resumo.TotalNFes,
 		"operacoes":                    resumo.Operacoes,
+		"tendencias":                   resumo.Tendencias,
+		"anomalias":                    resumo.Anomalias,
 	}
 	jsonBytes, _ := json.Marshal(data)
 	return string(jsonBytes)
 }
 
-// getApuracaoResumoForAI aggregates fiscal data (simplified version for worker)
-func getApuracaoResumoForAI(db *sql.DB, companyID, periodo string) (*AIResumo, error) {
-	resumo := &AIResumo{Periodo: periodo}
-
-	// Get company info
-	err := db.QueryRow(`
-		SELECT COALESCE(c.name, ''), COALESCE(c.trade_name, '')
-		FROM companies c WHERE c.id = $1
-	`, companyID).Scan(&resumo.CompanyName, &resumo.CNPJ)
-	if err != nil && err != sql.ErrNoRows {
-		return nil, fmt.Errorf("query company: %w", err)
-	}
-
-	// Aggregate current period from MV
-	rows, err := db.Query(`
-		SELECT
-			mv.tipo,
-			mv.tipo_operacao,
-			COALESCE(SUM(mv.valor_contabil), 0) as valor,
-			COALESCE(SUM(mv.vl_icms_origem), 0) as icms
-		FROM mv_mercadorias_agregada mv
-		WHERE mv.company_id = $1 AND mv.mes_ano = $2
-		GROUP BY mv.tipo, mv.tipo_operacao
-	`, companyID, periodo)
-	if err != nil {
-		return nil, fmt.Errorf("query current period: %w", err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var op AIOperacaoResumo
-		if err := rows.Scan(&op.Tipo, &op.TipoOperacao, &op.Valor, &op.Icms); err != nil {
-			return nil, fmt.Errorf("scan operation: %w", err)
-		}
-		resumo.Operacoes = append(resumo.Operacoes, op)
-		if op.Tipo == "ENTRADA" {
-			resumo.TotalEntradas += op.Valor
-			resumo.IcmsEntrada += op.Icms
-		} else {
-			resumo.TotalSaidas += op.Valor
-			resumo.IcmsSaida += op.Icms
-		}
-	}
-	resumo.FaturamentoBruto = resumo.TotalSaidas
-	resumo.IcmsAPagar = resumo.IcmsSaida - resumo.IcmsEntrada
-	if resumo.IcmsAPagar < 0 {
-		resumo.IcmsAPagar = 0
-	}
-
-	// Count NFs for current period
-	db.QueryRow(`
-		SELECT COUNT(DISTINCT mv.filial_cnpj || mv.mes_ano || mv.tipo_operacao)
-		FROM mv_mercadorias_agregada mv
-		WHERE mv.company_id = $1 AND mv.mes_ano = $2
-	`, companyID, periodo).Scan(&resumo.TotalNFes)
-
-	// Calculate IBS/CBS projections using same logic as Dashboard (year 2033 = full reform)
-	// Uses mv_mercadorias_agregada with NET calculation (Debit - Credit), excludes CFOP T and O
-	var rates TaxRates
-	rates, _ = getTaxRates(db, 2033)
-
-	ibsCbsRows, err := db.Query(`
-		SELECT
-			tipo,
-			COALESCE(SUM(CASE WHEN tipo_cfop NOT IN ('T', 'O') THEN valor_contabil ELSE 0 END), 0) as taxable_valor,
-			COALESCE(SUM(CASE WHEN tipo_cfop NOT IN ('T', 'O') THEN vl_icms_origem ELSE 0 END), 0) as taxable_icms
-		FROM mv_mercadorias_agregada
-		WHERE company_id = $1 AND mes_ano = $2
-		GROUP BY tipo
-	`, companyID, periodo)
-	if err == nil {
-		defer ibsCbsRows.Close()
-		var ibsDebit, ibsCredit, cbsDebit, cbsCredit float64
-		ibsRate := (rates.PercIBS_UF + rates.PercIBS_Mun) / 100.0
-		cbsRate := rates.PercCBS / 100.0
-		for ibsCbsRows.Next() {
-			var tipo string
-			var valTax, icmsTax float64
-			if err := ibsCbsRows.Scan(&tipo, &valTax, &icmsTax); err != nil {
-				continue
-			}
-			icmsProj := icmsTax * (1.0 - (rates.PercReducICMS / 100.0))
-			base := valTax - icmsProj
-			if tipo == "SAIDA" {
-				ibsDebit = base * ibsRate
-				cbsDebit = base * cbsRate
-			} else {
-				ibsCredit = base * ibsRate
-				cbsCredit = base * cbsRate
-			}
-		}
-		resumo.IbsProjetado = ibsDebit - ibsCredit
-		resumo.CbsProjetado = cbsDebit - cbsCredit
-		if resumo.IbsProjetado < 0 {
-			resumo.IbsProjetado = 0
-		}
-		if resumo.CbsProjetado < 0 {
-			resumo.CbsProjetado = 0
-		}
-	}
-
-	// Calcular alíquotas efetivas (% sobre faturamento bruto)
-	if resumo.FaturamentoBruto > 0 {
-		resumo.AliquotaEfetivaICMS = math.Round((resumo.IcmsAPagar/resumo.FaturamentoBruto)*10000) / 100
-		resumo.AliquotaEfetivaIBS = math.Round((resumo.IbsProjetado/resumo.FaturamentoBruto)*10000) / 100
-		resumo.AliquotaEfetivaCBS = math.Round((resumo.CbsProjetado/resumo.FaturamentoBruto)*10000) / 100
-		resumo.AliquotaEfetivaTotalReforma = math.Round(((resumo.IbsProjetado+resumo.CbsProjetado)/resumo.FaturamentoBruto)*10000) / 100
-	}
-
-	return resumo, nil
-}
-
 // buildExecutiveSummaryPromptForAI builds prompt for AI generation
-func buildExecutiveSummaryPromptForAI(resumo *AIResumo) string {
+func buildExecutiveSummaryPromptForAI(resumo *services.ApuracaoResumo) string {
 	var sb strings.Builder
 	sb.WriteString("IMPORTANTE: Responda EXCLUSIVAMENTE em português brasileiro (pt-BR). NÃO escreva em inglês.\n\n")
 	sb.WriteString(fmt.Sprintf("Empresa: %s (CNPJ: %s)\n", resumo.CompanyName, resumo.CNPJ))
@@ -347,6 +219,8 @@ func buildExecutiveSummaryPromptForAI(resumo *AIResumo) string {
 		sb.WriteString(fmt.Sprintf("- Total IBS+CBS efetivo (2033): %.2f%%\n", resumo.AliquotaEfetivaTotalReforma))
 	}
 
+	sb.WriteString(resumo.ComparativoPrompt())
+
 	if len(resumo.Operacoes) > 0 {
 		sb.WriteString("\nDETALHAMENTO POR TIPO DE OPERAÇÃO:\n")
 		for _, op := range resumo.Operacoes {
@@ -383,7 +257,7 @@ REGRAS:
      | CBS Projetado a Pagar | R$ X | X,XX% | Novo imposto - projeção 2033 |
      | Total IBS + CBS a Pagar | R$ X | X,XX% | Substituirá ICMS + PIS/COFINS |
   4. Comentário sobre alíquota efetiva: compare ICMS efetivo atual vs total IBS+CBS efetivo, explique o impacto prático para o negócio
-  5. Comparativo com período anterior (se disponível) com variação percentual e variação em pontos percentuais da alíquota efetiva
+  5. Comparativo com o mês anterior e com o mesmo mês do ano anterior (se disponíveis) com variação percentual e variação em pontos percentuais da alíquota efetiva; comente os alertas de variação
   6. Destaques relevantes
   7. Recomendações práticas (2-3 itens)
 - NÃO invente dados. Use APENAS os números fornecidos.
@@ -418,7 +292,7 @@ func fmtBRL(v float64) string {
 }
 
 // buildFallbackNarrative generates a basic report when AI is unavailable
-func buildFallbackNarrative(r *AIResumo) string {
+func buildFallbackNarrative(r *services.ApuracaoResumo) string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("## Resumo Executivo — %s | %s\n\n", r.CompanyName, r.Periodo))
 
@@ -439,6 +313,16 @@ func buildFallbackNarrative(r *AIResumo) string {
 	sb.WriteString(fmt.Sprintf("| CBS Projetado | R$ %s | %.2f%% |\n", fmtBRL(r.CbsProjetado), r.AliquotaEfetivaCBS))
 	sb.WriteString(fmt.Sprintf("| **Total IBS + CBS** | **R$ %s** | **%.2f%%** |\n\n", fmtBRL(r.IbsProjetado+r.CbsProjetado), r.AliquotaEfetivaTotalReforma))
 
+	if r.FaturamentoAnterior > 0 {
+		varFat := services.VariacaoPercentual(r.FaturamentoBruto, r.FaturamentoAnterior)
+		direcao := "aumento"
+		if varFat < 0 {
+			direcao = "redução"
+		}
+		sb.WriteString(fmt.Sprintf("**Comparativo com %s:** %s de %.1f%% no faturamento.\n\n", r.PeriodoAnterior, direcao, math.Abs(varFat)))
+	}
+	sb.WriteString(r.AnomaliasMarkdown())
+
 	if len(r.Operacoes) > 0 {
 		sb.WriteString("### Detalhamento por Tipo de Operação\n\n")
 		for _, op := range r.Operacoes {
@@ -451,28 +335,3 @@ func buildFallbackNarrative(r *AIResumo) string {
 	sb.WriteString(fmt.Sprintf("*%d registros processados. Narrativa com IA será incluída automaticamente quando disponível.*", r.TotalNFes))
 	return sb.String()
 }
-
-// getActiveManagersForAIReport returns active managers for AI report emailing
-func getActiveManagersForAIReport(db *sql.DB, companyID string) ([]AIManager, error) {
-	rows, err := db.Query(`
-		SELECT id, company_id, nome_completo, cargo, email, ativo, created_at, updated_at
-		FROM managers
-		WHERE company_id = $1 AND ativo = true
-		ORDER BY nome_completo ASC
-	`, companyID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var managers []AIManager
-	for rows.Next() {
-		var m AIManager
-		if err := rows.Scan(&m.ID, &m.CompanyID, &m.NomeCompleto, &m.Cargo, &m.Email, &m.Ativo, &m.CreatedAt, &m.UpdatedAt); err != nil {
-			return nil, err
-		}
-		managers = append(managers, m)
-	}
-
-	return managers, nil
-}
@@ -0,0 +1,187 @@
+package worker
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"fb_apu01/services"
+)
+
+// emailSenderConfig controls delivery of email_outbox.
+type emailSenderConfig struct {
+	PollInterval time.Duration // EMAIL_SENDER_SECONDS — wait between polls when idle
+	Lease        time.Duration // a claimed email not finished by then is retried
+	BackoffBase  time.Duration // EMAIL_BACKOFF_SECONDS — first retry delay, doubled each attempt
+	BackoffMax   time.Duration
+	BatchSize    int
+}
+
+func loadEmailSenderConfig() emailSenderConfig {
+	return emailSenderConfig{
+		PollInterval: time.Duration(envInt("EMAIL_SENDER_SECONDS", 15)) * time.Second,
+		Lease:        5 * time.Minute,
+		BackoffBase:  time.Duration(envInt("EMAIL_BACKOFF_SECONDS", 60)) * time.Second,
+		BackoffMax:   6 * time.Hour,
+		BatchSize:    20,
+	}
+}
+
+// backoff returns the delay before retry number `attempts` (1-based).
+func (c emailSenderConfig) backoff(attempts int) time.Duration {
+	d := c.BackoffBase
+	for i := 1; i < attempts && d < c.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > c.BackoffMax {
+		d = c.BackoffMax
+	}
+	return d
+}
+
+// StartEmailSender delivers email_outbox. It wakes up as soon as this
+// instance queues an email and otherwise polls, which picks up retries and
+// emails queued by other instances. While SMTP is not configured the queue
+// just waits.
+func StartEmailSender(db *sql.DB) {
+	cfg := loadEmailSenderConfig()
+	fmt.Printf("Starting email sender (poll every %v)...\n", cfg.PollInterval)
+	go func() {
+		for {
+			sendQueuedEmails(db, cfg)
+			select {
+			case <-services.EmailQueued():
+			case <-time.After(cfg.PollInterval):
+			}
+		}
+	}()
+}
+
+// queuedEmail is an email_outbox row this instance holds a lease on.
+type queuedEmail struct {
+	ID          string
+	To          string
+	Message     []byte
+	Attempts    int
+	MaxAttempts int
+	DeliveryID  string
+}
+
+// sendQueuedEmails drains the emails that are due, a batch at a time.
+func sendQueuedEmails(db *sql.DB, cfg emailSenderConfig) {
+	config := services.GetEmailConfig()
+	if !config.Configured() {
+		return
+	}
+	for {
+		batch, err := claimQueuedEmails(db, cfg)
+		if err != nil {
+			fmt.Printf("[Email Sender] Error claiming emails: %v\n", err)
+			return
+		}
+		for _, e := range batch {
+			finishEmail(db, cfg, e, services.DeliverEmail(config, e.To, e.Message))
+		}
+		if len(batch) < cfg.BatchSize {
+			return
+		}
+	}
+}
+
+// claimQueuedEmails leases the next due emails (SKIP LOCKED, so several
+// instances can send). Emails left in 'sending' by an instance that died are
+// due again once their lease expires; such a retry may duplicate an email the
+// server had already accepted, which beats losing it.
+func claimQueuedEmails(db *sql.DB, cfg emailSenderConfig) ([]queuedEmail, error) {
+	rows, err := db.Query(`
+		UPDATE email_outbox
+		SET status = 'sending',
+		    attempts = attempts + 1,
+		    lease_expires_at = NOW() + make_interval(secs => $2),
+		    updated_at = NOW()
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE (status = 'pending' AND run_after <= NOW())
+			   OR (status = 'sending' AND lease_expires_at < NOW())
+			ORDER BY run_after
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, to_email, message, attempts, max_attempts, COALESCE(delivery_id::text, '')
+	`, cfg.BatchSize, cfg.Lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []queuedEmail
+	for rows.Next() {
+		var e queuedEmail
+		if err := rows.Scan(&e.ID, &e.To, &e.Message, &e.Attempts, &e.MaxAttempts, &e.DeliveryID); err != nil {
+			return nil, err
+		}
+		batch = append(batch, e)
+	}
+	return batch, rows.Err()
+}
+
+// finishEmail records the outcome of one attempt: sent, bounced (the server
+// refused it for good), dead (out of attempts) or back to pending after the
+// backoff. Final outcomes are copied to the linked report_deliveries row.
+func finishEmail(db *sql.DB, cfg emailSenderConfig, e queuedEmail, sendErr error) {
+	var rejected *services.EmailRejectedError
+	switch {
+	case sendErr == nil:
+		db.Exec(`
+			UPDATE email_outbox
+			SET status = 'sent', sent_at = NOW(), last_error = NULL,
+			    lease_expires_at = NULL, updated_at = NOW()
+			WHERE id = $1`, e.ID)
+		finishDelivery(db, e.DeliveryID, "enviado", "")
+		emailOutcomes.Inc("sent")
+
+	case errors.As(sendErr, &rejected):
+		fmt.Printf("[Email Sender] Email %s to %s bounced: %v\n", e.ID, e.To, sendErr)
+		db.Exec(`
+			UPDATE email_outbox
+			SET status = 'bounced', bounce_reason = $2, bounced_at = NOW(), last_error = $2,
+			    lease_expires_at = NULL, updated_at = NOW()
+			WHERE id = $1`, e.ID, sendErr.Error())
+		finishDelivery(db, e.DeliveryID, "devolvido", sendErr.Error())
+		emailOutcomes.Inc("bounced")
+
+	case e.Attempts >= e.MaxAttempts:
+		msg := fmt.Sprintf("Falhou após %d tentativas: %v", e.Attempts, sendErr)
+		fmt.Printf("[Email Sender] Email %s to %s: %s\n", e.ID, e.To, msg)
+		db.Exec(`
+			UPDATE email_outbox
+			SET status = 'dead', last_error = $2,
+			    lease_expires_at = NULL, updated_at = NOW()
+			WHERE id = $1`, e.ID, sendErr.Error())
+		finishDelivery(db, e.DeliveryID, "erro", msg)
+		emailOutcomes.Inc("dead")
+
+	default:
+		delay := cfg.backoff(e.Attempts)
+		fmt.Printf("[Email Sender] Email %s to %s: attempt %d/%d failed, retrying in %v: %v\n",
+			e.ID, e.To, e.Attempts, e.MaxAttempts, delay, sendErr)
+		db.Exec(`
+			UPDATE email_outbox
+			SET status = 'pending', last_error = $2,
+			    run_after = NOW() + make_interval(secs => $3),
+			    lease_expires_at = NULL, updated_at = NOW()
+			WHERE id = $1`, e.ID, sendErr.Error(), delay.Seconds())
+		emailOutcomes.Inc("retry")
+	}
+}
+
+// finishDelivery moves a queued report delivery to its final status.
+func finishDelivery(db *sql.DB, deliveryID, status, errMsg string) {
+	if deliveryID == "" {
+		return
+	}
+	db.Exec(`
+		UPDATE report_deliveries SET status = $2, erro = NULLIF($3, '')
+		WHERE id = $1`, deliveryID, status, errMsg)
+}
@@ -0,0 +1,123 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"fb_apu01/metrics"
+	"fb_apu01/services"
+)
+
+var (
+	jobDuration = metrics.NewHistogramVec("sped_job_duration_seconds",
+		"Time spent in processFile per job, by file size class (lines).",
+		[]float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}, "size")
+	jobOutcomes = metrics.NewCounterVec("sped_jobs_finished_total",
+		"Job attempts by outcome (completed, retry, dead, error, cancelled, lease_lost).", "outcome")
+	emailOutcomes = metrics.NewCounterVec("email_outbox_sends_total",
+		"Email delivery attempts by outcome (sent, retry, dead, bounced).", "outcome")
+	rfbSchedulerOutcomes = metrics.NewCounterVec("rfb_scheduler_runs_total",
+		"RFB scheduler actions by outcome (completed, not_ready, failed, expired, scheduled, schedule_failed).", "outcome")
+	linesProcessed = metrics.NewCounterVec("sped_lines_processed_total",
+		"SPED lines parsed and committed by the workers.")
+	linesPerSecond = metrics.NewHistogramVec("sped_lines_per_second",
+		"Parsing throughput of each processFile run.",
+		[]float64{100, 500, 1000, 2500, 5000, 10000, 25000, 50000, 100000})
+)
+
+// sizeClass buckets a file by line count so duration histograms compare
+// like with like (a 5M-line EFD is not a slow 50k-line one).
+func sizeClass(lines int) string {
+	switch {
+	case lines < 10_000:
+		return "lt_10k"
+	case lines < 100_000:
+		return "10k_100k"
+	case lines < 1_000_000:
+		return "100k_1m"
+	default:
+		return "gte_1m"
+	}
+}
+
+// registerQueueMetrics exports queue depth and age at scrape time, which is
+// what the stuck-import alerts key on: a processing job whose updated_at stops
+// moving, or pending work that nobody claims.
+func registerQueueMetrics(db *sql.DB) {
+	metrics.NewGaugeFunc("sped_jobs",
+		"Import jobs by status.", []string{"status"},
+		func(emit func(float64, ...string)) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			rows, err := db.QueryContext(ctx, "SELECT status, COUNT(*) FROM import_jobs GROUP BY status")
+			if err != nil {
+				fmt.Printf("Worker Metrics: queue depth query failed: %v\n", err)
+				return
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var status string
+				var n float64
+				if rows.Scan(&status, &n) == nil {
+					emit(n, status)
+				}
+			}
+		})
+
+	metrics.NewGaugeFunc("sped_jobs_oldest_seconds",
+		"Age of the oldest runnable pending job (pending) and the longest time a processing job has gone without progress (stalled).",
+		[]string{"kind"},
+		func(emit func(float64, ...string)) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var pending, stalled float64
+			err := db.QueryRowContext(ctx, `
+				SELECT
+					COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(created_at) FILTER (WHERE status = 'pending' AND run_after <= NOW())), 0),
+					COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(updated_at) FILTER (WHERE status = 'processing')), 0)
+				FROM import_jobs`).Scan(&pending, &stalled)
+			if err != nil {
+				fmt.Printf("Worker Metrics: queue age query failed: %v\n", err)
+				return
+			}
+			emit(pending, "pending")
+			emit(stalled, "stalled")
+		})
+}
+
+// registerRFBCertificadoMetrics exports the active A1 certificates by expiry
+// state at scrape time, so an alert can fire before RFB calls start failing.
+func registerRFBCertificadoMetrics(db *sql.DB) {
+	metrics.NewGaugeFunc("rfb_certificados",
+		"Active RFB credentials authenticated by A1 certificate, by expiry state (ok, vence_em_breve, vencido).",
+		[]string{"alerta"},
+		func(emit func(float64, ...string)) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			counts := map[string]float64{
+				services.RFBCertificadoOK:           0,
+				services.RFBCertificadoVenceEmBreve: 0,
+				services.RFBCertificadoVencido:      0,
+			}
+			rows, err := db.QueryContext(ctx, `
+				SELECT certificado_validade FROM rfb_credentials
+				WHERE ativo AND auth_tipo = 'certificado' AND certificado_validade IS NOT NULL`)
+			if err != nil {
+				fmt.Printf("Worker Metrics: RFB certificate query failed: %v\n", err)
+				return
+			}
+			defer rows.Close()
+			now := time.Now()
+			for rows.Next() {
+				var validade time.Time
+				if rows.Scan(&validade) == nil {
+					counts[services.RFBCertificadoAlerta(validade, now)]++
+				}
+			}
+			for alerta, n := range counts {
+				emit(n, alerta)
+			}
+		})
+}
@@ -0,0 +1,301 @@
+package worker
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"fb_apu01/jobevents"
+)
+
+// QueueConfig controls the SPED import queue. Values come from the environment
+// (see LoadQueueConfig) so each deployment can size the pool to its hardware.
+type QueueConfig struct {
+	PoolSize     int           // WORKER_POOL_SIZE — concurrent workers in this instance
+	Lease        time.Duration // JOB_LEASE_SECONDS — how long a claim survives without heartbeat
+	PollInterval time.Duration // JOB_POLL_SECONDS — idle wait between claims
+	BackoffBase  time.Duration // JOB_BACKOFF_SECONDS — first retry delay, doubled each attempt
+	BackoffMax   time.Duration
+}
+
+// LoadQueueConfig reads the queue settings, falling back to the historical
+// defaults (3 workers, 2s polling).
+func LoadQueueConfig() QueueConfig {
+	return QueueConfig{
+		PoolSize:     envInt("WORKER_POOL_SIZE", 3),
+		Lease:        time.Duration(envInt("JOB_LEASE_SECONDS", 120)) * time.Second,
+		PollInterval: time.Duration(envInt("JOB_POLL_SECONDS", 2)) * time.Second,
+		BackoffBase:  time.Duration(envInt("JOB_BACKOFF_SECONDS", 30)) * time.Second,
+		BackoffMax:   30 * time.Minute,
+	}
+}
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// backoff returns the delay before retry number `attempts` (1-based).
+func (c QueueConfig) backoff(attempts int) time.Duration {
+	d := c.BackoffBase
+	for i := 1; i < attempts && d < c.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > c.BackoffMax {
+		d = c.BackoffMax
+	}
+	return d
+}
+
+// ─── Errors ──────────────────────────────────────────────────────────────────
+
+// errLeaseLost aborts processing when another instance reclaimed the job.
+var errLeaseLost = errors.New("job lease lost")
+
+// permanentError marks failures that retrying cannot fix (corrupt or missing
+// file); the job goes straight to 'error' instead of being retried.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error { return permanentError{err} }
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// ─── Claim / lease ───────────────────────────────────────────────────────────
+
+// claimedJob is a job this worker holds a lease on.
+type claimedJob struct {
+	ID          string
+	Filename    string
+	Attempts    int
+	MaxAttempts int
+	lease       *lease
+}
+
+type lease struct {
+	lost atomic.Bool
+	stop chan struct{}
+}
+
+// Lost reports whether the heartbeat failed to renew the lease.
+func (l *lease) Lost() bool { return l != nil && l.lost.Load() }
+
+// claimNextJob picks the next runnable job with round-robin fairness across
+// companies: companies with fewer jobs in flight go first, then the company
+// that was served least recently, then priority and age inside a company.
+// FOR UPDATE SKIP LOCKED lets several workers (and instances) claim in parallel.
+func claimNextJob(db *sql.DB, cfg QueueConfig, workerName string) (*claimedJob, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var job claimedJob
+	err = tx.QueryRow(`
+		WITH running AS (
+			SELECT company_id, COUNT(*) AS n
+			FROM import_jobs
+			WHERE status = 'processing'
+			GROUP BY company_id
+		), served AS (
+			-- Only companies with runnable jobs; each lookup is one probe of
+			-- idx_import_jobs_company_started instead of aggregating all history
+			SELECT p.company_id, last.started_at AS last_started
+			FROM (
+				SELECT DISTINCT company_id
+				FROM import_jobs
+				WHERE status = 'pending' AND run_after <= NOW()
+			) p
+			LEFT JOIN LATERAL (
+				SELECT i.started_at
+				FROM import_jobs i
+				WHERE i.company_id = p.company_id AND i.started_at IS NOT NULL
+				ORDER BY i.started_at DESC
+				LIMIT 1
+			) last ON true
+		)
+		SELECT j.id, j.filename
+		FROM import_jobs j
+		LEFT JOIN running r ON r.company_id IS NOT DISTINCT FROM j.company_id
+		LEFT JOIN served s ON s.company_id IS NOT DISTINCT FROM j.company_id
+		WHERE j.status = 'pending' AND j.run_after <= NOW()
+		ORDER BY COALESCE(r.n, 0) ASC,
+		         s.last_started ASC NULLS FIRST,
+		         j.priority DESC,
+		         j.created_at ASC
+		LIMIT 1
+		FOR UPDATE OF j SKIP LOCKED
+	`).Scan(&job.ID, &job.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`
+		UPDATE import_jobs
+		SET status = 'processing',
+		    attempts = attempts + 1,
+		    locked_by = $2,
+		    lease_expires_at = NOW() + make_interval(secs => $3),
+		    started_at = NOW(),
+		    updated_at = NOW()
+		WHERE id = $1
+		RETURNING attempts, max_attempts
+	`, job.ID, workerName, cfg.Lease.Seconds()).Scan(&job.Attempts, &job.MaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	job.lease = &lease{stop: make(chan struct{})}
+	go heartbeat(db, cfg, job.ID, workerName, job.lease)
+	return &job, nil
+}
+
+// heartbeat renews the lease every Lease/3 until released. If the row is no
+// longer ours (reaped after a long DB outage) the lease is flagged as lost and
+// processFile aborts at its next batch boundary.
+func heartbeat(db *sql.DB, cfg QueueConfig, jobID, workerName string, l *lease) {
+	ticker := time.NewTicker(cfg.Lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			res, err := db.Exec(`
+				UPDATE import_jobs
+				SET lease_expires_at = NOW() + make_interval(secs => $3)
+				WHERE id = $1 AND locked_by = $2 AND status IN ('processing', 'cancelling')
+			`, jobID, workerName, cfg.Lease.Seconds())
+			if err != nil {
+				fmt.Printf("Worker %s: heartbeat error for job %s: %v\n", workerName, jobID, err)
+				continue
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				fmt.Printf("Worker %s: lease lost for job %s\n", workerName, jobID)
+				l.lost.Store(true)
+				return
+			}
+		}
+	}
+}
+
+func (j *claimedJob) release() {
+	if j.lease != nil {
+		close(j.lease.stop)
+	}
+}
+
+// ─── Outcomes ────────────────────────────────────────────────────────────────
+
+func completeJob(db *sql.DB, jobID, summary string) {
+	db.Exec(`
+		UPDATE import_jobs
+		SET status = 'completed', message = $1, last_error = NULL,
+		    locked_by = NULL, lease_expires_at = NULL, finished_at = NOW(), updated_at = NOW()
+		WHERE id = $2`, summary, jobID)
+}
+
+func cancelJob(db *sql.DB, jobID, message string) {
+	db.Exec(`
+		UPDATE import_jobs
+		SET status = 'cancelled', message = $1,
+		    locked_by = NULL, lease_expires_at = NULL, finished_at = NOW(), updated_at = NOW()
+		WHERE id = $2`, message, jobID)
+	jobevents.Publish(db, jobID, jobevents.Event{Type: jobevents.TypeCancelled, Status: "cancelled", Message: message})
+}
+
+// failJob records a failed attempt and reports whether the upload file can be
+// dropped. Retries keep the file so they resume from last_line_processed, and
+// dead-lettered jobs keep it so an operator can re-queue them; only permanent
+// errors (the file itself is bad) release it.
+func failJob(db *sql.DB, cfg QueueConfig, job *claimedJob, cause error) (dropFile bool) {
+	switch {
+	case isPermanent(cause):
+		db.Exec(`
+			UPDATE import_jobs
+			SET status = 'error', message = $1, last_error = $1,
+			    locked_by = NULL, lease_expires_at = NULL, finished_at = NOW(), updated_at = NOW()
+			WHERE id = $2`, cause.Error(), job.ID)
+		jobevents.Publish(db, job.ID, jobevents.Event{Type: jobevents.TypeFailed, Status: "error", Message: cause.Error()})
+		jobOutcomes.Inc("error")
+		return true
+
+	case job.Attempts >= job.MaxAttempts:
+		msg := fmt.Sprintf("Falhou após %d tentativas: %v", job.Attempts, cause)
+		db.Exec(`
+			UPDATE import_jobs
+			SET status = 'dead', message = $1, last_error = $2,
+			    locked_by = NULL, lease_expires_at = NULL, finished_at = NOW(), updated_at = NOW()
+			WHERE id = $3`, msg, cause.Error(), job.ID)
+		jobevents.Publish(db, job.ID, jobevents.Event{Type: jobevents.TypeFailed, Status: "dead", Message: msg})
+		jobOutcomes.Inc("dead")
+		return false
+
+	default:
+		delay := cfg.backoff(job.Attempts)
+		msg := fmt.Sprintf("Tentativa %d/%d falhou, nova tentativa em %v: %v", job.Attempts, job.MaxAttempts, delay, cause)
+		db.Exec(`
+			UPDATE import_jobs
+			SET status = 'pending', message = $1, last_error = $2,
+			    run_after = NOW() + make_interval(secs => $3),
+			    locked_by = NULL, lease_expires_at = NULL, updated_at = NOW()
+			WHERE id = $4`, msg, cause.Error(), delay.Seconds(), job.ID)
+		jobevents.Publish(db, job.ID, jobevents.Event{Type: jobevents.TypeRetry, Status: "pending", Message: msg})
+		jobOutcomes.Inc("retry")
+		return false
+	}
+}
+
+// ─── Reaper ──────────────────────────────────────────────────────────────────
+
+// reapExpiredLeases returns jobs whose worker died (lease expired) to the
+// queue, dead-letters those out of attempts and finalizes cancellations that
+// no live worker will pick up. Safe to run from every instance.
+func reapExpiredLeases(db *sql.DB, cfg QueueConfig) {
+	res, err := db.Exec(`
+		UPDATE import_jobs
+		SET status = CASE WHEN attempts >= max_attempts THEN 'dead' ELSE 'pending' END,
+		    message = CASE WHEN attempts >= max_attempts
+		                   THEN 'Worker interrompido e tentativas esgotadas'
+		                   ELSE COALESCE(message, '') || ' [Recovered]' END,
+		    run_after = NOW() + make_interval(secs => $1),
+		    finished_at = CASE WHEN attempts >= max_attempts THEN NOW() ELSE NULL END,
+		    locked_by = NULL, lease_expires_at = NULL, updated_at = NOW()
+		WHERE status = 'processing'
+		  AND (lease_expires_at IS NULL OR lease_expires_at < NOW())
+	`, cfg.BackoffBase.Seconds())
+	if err != nil {
+		fmt.Printf("Worker Reaper: error reclaiming expired leases: %v\n", err)
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		fmt.Printf("Worker Reaper: %d job(s) with expired lease returned to the queue\n", n)
+	}
+
+	db.Exec(`
+		UPDATE import_jobs
+		SET status = 'cancelled', message = 'Cancelado pelo usuário',
+		    locked_by = NULL, lease_expires_at = NULL, finished_at = NOW(), updated_at = NOW()
+		WHERE status = 'cancelling'
+		  AND (lease_expires_at IS NULL OR lease_expires_at < NOW())`)
+}
+
+func reaperLoop(db *sql.DB, cfg QueueConfig) {
+	for {
+		reapExpiredLeases(db, cfg)
+		time.Sleep(cfg.Lease / 2)
+	}
+}
@@ -0,0 +1,198 @@
+package worker
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"fb_apu01/services"
+)
+
+// errNoReportData marks a run skipped because the company has nothing to
+// report yet; it is recorded as 'sem_dados' rather than as a failure.
+var errNoReportData = errors.New("sem dados para o relatório")
+
+// reportSubscriber is an active subscription of an active manager.
+type reportSubscriber struct {
+	id          string
+	companyID   string
+	relatorio   string
+	frequencia  string
+	dia, hora   int
+	email       string
+	token       string
+	anexarPDF   bool
+	scheduledAt time.Time // next_run_at when claimed; zero for post-import sends
+}
+
+func (s reportSubscriber) recipient(deliveryID string) services.ReportRecipient {
+	return services.ReportRecipient{Email: s.email, UnsubscribeURL: services.ReportUnsubscribeURL(s.token), DeliveryID: deliveryID}
+}
+
+// StartReportScheduler polls report_subscriptions for due monthly/weekly
+// subscriptions (REPORT_SCHEDULER_SECONDS, default 60). The schedule lives in
+// next_run_at, so restarts lose nothing: a run missed while the backend was
+// down goes out on the first poll after it comes back.
+func StartReportScheduler(db *sql.DB) {
+	interval := time.Duration(envInt("REPORT_SCHEDULER_SECONDS", 60)) * time.Second
+	fmt.Printf("Starting report scheduler (every %v)...\n", interval)
+	go func() {
+		for {
+			runDueReports(db)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// runDueReports claims the due subscriptions, moves their next_run_at forward
+// and only then builds and sends the reports. A crash between the two loses
+// that run instead of emailing it twice.
+func runDueReports(db *sql.DB) {
+	due, err := claimDueSubscriptions(db, time.Now())
+	if err != nil {
+		fmt.Printf("[Report Scheduler] Error claiming subscriptions: %v\n", err)
+		return
+	}
+
+	// Managers of the same company subscribed to the same report share one build
+	type reportKey struct{ companyID, relatorio string }
+	built := map[reportKey]*scheduledReport{}
+	for _, sub := range due {
+		key := reportKey{sub.companyID, sub.relatorio}
+		report, ok := built[key]
+		if !ok {
+			report, err = buildScheduledReport(db, sub.companyID, sub.relatorio)
+			if err != nil {
+				report = &scheduledReport{err: err}
+			}
+			built[key] = report
+		}
+		if report.err != nil {
+			fmt.Printf("[Report Scheduler] %s for company %s: %v\n", sub.relatorio, sub.companyID, report.err)
+			recordDelivery(db, sub, report.periodo, report.err, sub.scheduledAt)
+			continue
+		}
+		report.deliver(db, sub, sub.scheduledAt)
+	}
+}
+
+// claimDueSubscriptions locks the subscriptions whose next_run_at has passed
+// (SKIP LOCKED, so several instances can poll) and reschedules them.
+func claimDueSubscriptions(db *sql.DB, now time.Time) ([]reportSubscriber, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT s.id, s.company_id, s.relatorio, s.frequencia, s.dia, s.hora,
+		       m.email, s.unsubscribe_token, s.anexar_pdf, s.next_run_at
+		FROM report_subscriptions s
+		JOIN managers m ON m.id = s.manager_id
+		WHERE s.ativo AND m.ativo
+		  AND s.frequencia <> 'importacao'
+		  AND s.next_run_at <= $1
+		ORDER BY s.next_run_at
+		LIMIT 50
+		FOR UPDATE OF s SKIP LOCKED
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	var due []reportSubscriber
+	for rows.Next() {
+		var s reportSubscriber
+		if err := rows.Scan(&s.id, &s.companyID, &s.relatorio, &s.frequencia, &s.dia, &s.hora,
+			&s.email, &s.token, &s.anexarPDF, &s.scheduledAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range due {
+		// Scheduled from now, not from the missed slot: one catch-up run, not a burst
+		next := services.NextReportRun(s.frequencia, s.dia, s.hora, now)
+		if _, err := tx.Exec(`
+			UPDATE report_subscriptions
+			SET next_run_at = $2, last_run_at = $3
+			WHERE id = $1
+		`, s.id, next, now); err != nil {
+			return nil, err
+		}
+	}
+	return due, tx.Commit()
+}
+
+// getImportSubscribers returns the company's post-import executive summary subscribers.
+func getImportSubscribers(db *sql.DB, companyID string) ([]reportSubscriber, error) {
+	rows, err := db.Query(`
+		SELECT s.id, s.company_id, s.relatorio, s.frequencia, s.dia, s.hora, m.email, s.unsubscribe_token, s.anexar_pdf
+		FROM report_subscriptions s
+		JOIN managers m ON m.id = s.manager_id
+		WHERE s.company_id = $1 AND s.ativo AND m.ativo
+		  AND s.relatorio = $2 AND s.frequencia = $3
+		ORDER BY m.nome_completo
+	`, companyID, services.ReportResumoExecutivo, services.FrequencyOnImport)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []reportSubscriber
+	for rows.Next() {
+		var s reportSubscriber
+		if err := rows.Scan(&s.id, &s.companyID, &s.relatorio, &s.frequencia, &s.dia, &s.hora, &s.email, &s.token, &s.anexarPDF); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// recordDelivery writes one row of report_deliveries and returns its id ("" if
+// the insert failed). A nil sendErr means the email was queued: the row stays
+// 'enfileirado' until the email sender records 'enviado', 'devolvido' or 'erro'.
+func recordDelivery(db *sql.DB, sub reportSubscriber, periodo string, sendErr error, scheduledFor time.Time) string {
+	status := "enfileirado"
+	var errMsg sql.NullString
+	switch {
+	case errors.Is(sendErr, errNoReportData):
+		status = "sem_dados"
+	case sendErr != nil:
+		status = "erro"
+		errMsg = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+	var scheduled sql.NullTime
+	if !scheduledFor.IsZero() {
+		scheduled = sql.NullTime{Time: scheduledFor, Valid: true}
+	}
+	var id string
+	err := db.QueryRow(`
+		INSERT INTO report_deliveries
+			(subscription_id, company_id, relatorio, periodo, email, status, erro, scheduled_for)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8)
+		RETURNING id
+	`, sub.id, sub.companyID, sub.relatorio, periodo, sub.email, status, errMsg, scheduled).Scan(&id)
+	if err != nil {
+		fmt.Printf("[Report Scheduler] Failed to record delivery for subscription %s: %v\n", sub.id, err)
+	}
+	return id
+}
+
+// deliver queues the report for sub, recording the delivery first so the
+// queued email carries its id. A failure to queue marks the delivery 'erro'.
+func (r *scheduledReport) deliver(db *sql.DB, sub reportSubscriber, scheduledFor time.Time) error {
+	deliveryID := recordDelivery(db, sub, r.periodo, nil, scheduledFor)
+	err := r.send(db, sub.recipient(deliveryID), r.attachmentsFor(sub)...)
+	if err != nil && deliveryID != "" {
+		db.Exec(`UPDATE report_deliveries SET status = 'erro', erro = $2 WHERE id = $1`, deliveryID, err.Error())
+	}
+	return err
+}
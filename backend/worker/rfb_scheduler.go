@@ -0,0 +1,284 @@
+package worker
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"fb_apu01/services"
+)
+
+// rfbAttemptLease keeps a request claimed by one instance while it downloads:
+// next_attempt_at is pushed this far ahead, and a request left in
+// 'downloading' longer than this is taken as abandoned by a dead instance.
+const rfbAttemptLease = 30 * time.Minute
+
+// StartRFBScheduler looks after RFB requests every RFB_SCHEDULER_SECONDS
+// (default 60): expires the ones that never finished, recovers downloads
+// abandoned by a dead instance, solicits the apurações due in
+// rfb_agendamentos and retries or polls the requests whose next_attempt_at
+// has passed, and exports the A1 certificates' expiry (rfb_certificados).
+// All state is in the database, so it survives restarts and several
+// instances share the work (SKIP LOCKED).
+func StartRFBScheduler(db *sql.DB) {
+	interval := time.Duration(envInt("RFB_SCHEDULER_SECONDS", 60)) * time.Second
+	fmt.Printf("Starting RFB scheduler (every %v)...\n", interval)
+	registerRFBCertificadoMetrics(db)
+	go func() {
+		for {
+			runRFBScheduler(db, services.LoadRFBRetryPolicy())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func runRFBScheduler(db *sql.DB, policy services.RFBRetryPolicy) {
+	expireRFBRequests(db, policy)
+	recoverRFBDownloads(db)
+	runDueRFBAgendamentos(db, policy)
+	attemptDueRFBRequests(db)
+}
+
+// expireRFBRequests gives up on requests older than the policy's TTL that
+// are still waiting for the RFB or for a retry.
+func expireRFBRequests(db *sql.DB, policy services.RFBRetryPolicy) {
+	res, err := db.Exec(`
+		UPDATE rfb_requests
+		SET status = 'error', error_code = 'EXPIRED',
+		    error_message = $2 || COALESCE(' Último erro: ' || error_message, ''),
+		    error_retryable = false, next_attempt_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE created_at < NOW() - make_interval(secs => $1)
+		  AND (status IN ('requested', 'webhook_received') OR (status = 'error' AND error_retryable))
+	`, policy.TTL.Seconds(), fmt.Sprintf("Arquivo não obtido em %.0f horas; solicite uma nova apuração.", policy.TTL.Hours()))
+	if err != nil {
+		fmt.Printf("[RFB Scheduler] Error expiring requests: %v\n", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		fmt.Printf("[RFB Scheduler] %d request(s) expired\n", n)
+		rfbSchedulerOutcomes.Add(float64(n), "expired")
+	}
+}
+
+// recoverRFBDownloads hands downloads stuck in 'downloading' back to the
+// retry loop. The tíquete may already have been consumed; if the file was
+// saved the retry reprocesses it instead of downloading again.
+func recoverRFBDownloads(db *sql.DB) {
+	res, err := db.Exec(`
+		UPDATE rfb_requests
+		SET status = CASE WHEN tiquete_download IS NULL THEN 'requested' ELSE 'webhook_received' END,
+		    next_attempt_at = NOW(), updated_at = CURRENT_TIMESTAMP
+		WHERE status = 'downloading' AND updated_at < NOW() - make_interval(secs => $1)
+	`, rfbAttemptLease.Seconds())
+	if err != nil {
+		fmt.Printf("[RFB Scheduler] Error recovering stalled downloads: %v\n", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		fmt.Printf("[RFB Scheduler] %d stalled download(s) returned to the queue\n", n)
+	}
+}
+
+// dueRFBRequest is a request claimed for one attempt.
+type dueRFBRequest struct {
+	id     string
+	status string
+	hasRaw bool
+}
+
+// attemptDueRFBRequests polls the requests whose webhook is late and retries
+// the temporary failures, a batch at a time.
+func attemptDueRFBRequests(db *sql.DB) {
+	due, err := claimDueRFBRequests(db, 10)
+	if err != nil {
+		fmt.Printf("[RFB Scheduler] Error claiming requests: %v\n", err)
+		return
+	}
+	for _, req := range due {
+		var err error
+		if req.hasRaw {
+			err = services.ReprocessarRawJSON(db, req.id)
+		} else {
+			err = services.ProcessarDownloadRFB(db, services.NewRFBClient(), req.id)
+		}
+		switch {
+		case err == nil:
+			rfbSchedulerOutcomes.Inc("completed")
+		case errors.Is(err, services.ErrRFBArquivoNaoPronto):
+			rfbSchedulerOutcomes.Inc("not_ready")
+		default:
+			fmt.Printf("[RFB Scheduler] Request %s (%s): %v\n", req.id, req.status, err)
+			rfbSchedulerOutcomes.Inc("failed")
+		}
+	}
+}
+
+// claimDueRFBRequests leases the due requests by moving next_attempt_at past
+// the attempt; the attempt itself sets the next one (or finishes the request).
+func claimDueRFBRequests(db *sql.DB, limit int) ([]dueRFBRequest, error) {
+	rows, err := db.Query(`
+		UPDATE rfb_requests
+		SET next_attempt_at = NOW() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id FROM rfb_requests
+			WHERE next_attempt_at <= NOW()
+			  AND (status IN ('requested', 'webhook_received') OR (status = 'error' AND error_retryable))
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, status,
+		          raw_json IS NOT NULL OR EXISTS (SELECT 1 FROM rfb_arquivos a WHERE a.request_id = rfb_requests.id)
+	`, limit, rfbAttemptLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []dueRFBRequest
+	for rows.Next() {
+		var req dueRFBRequest
+		if err := rows.Scan(&req.id, &req.status, &req.hasRaw); err != nil {
+			return nil, err
+		}
+		due = append(due, req)
+	}
+	return due, rows.Err()
+}
+
+// rfbAgendamento is a company's calendar claimed for a run.
+type rfbAgendamento struct {
+	id, companyID string
+	frequencia    string
+	dia, hora     int
+	falhas        int
+}
+
+// runDueRFBAgendamentos solicits a new apuração for each company whose
+// calendar is due, once per active credential (CNPJ base). Temporary RFB
+// failures are retried with backoff; anything else (no credential, daily
+// limit reached, expired certificate) waits for the next date.
+func runDueRFBAgendamentos(db *sql.DB, policy services.RFBRetryPolicy) {
+	due, err := claimDueRFBAgendamentos(db, time.Now())
+	if err != nil {
+		fmt.Printf("[RFB Scheduler] Error claiming schedules: %v\n", err)
+		return
+	}
+	for _, a := range due {
+		requestID, err := solicitarAgendamento(db, a)
+		if err == nil {
+			db.Exec(`
+				UPDATE rfb_agendamentos
+				SET last_request_id = COALESCE($2, last_request_id), last_error = NULL, falhas = 0, updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1`, a.id, nullIfEmpty(requestID))
+			continue
+		}
+
+		fmt.Printf("[RFB Scheduler] Scheduled apuração for company %s failed: %v\n", a.companyID, err)
+		var solErr *services.RFBSolicitacaoError
+		if errors.As(err, &solErr) && services.RFBErrorRetryable(solErr.Err) && a.falhas+1 < policy.MaxAttempts {
+			db.Exec(`
+				UPDATE rfb_agendamentos
+				SET last_request_id = COALESCE($4, last_request_id), last_error = $2, falhas = falhas + 1,
+				    next_run_at = NOW() + make_interval(secs => $3), updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1`, a.id, err.Error(), policy.Backoff(a.falhas+1).Seconds(), nullIfEmpty(requestID))
+			continue
+		}
+		db.Exec(`
+			UPDATE rfb_agendamentos
+			SET last_request_id = COALESCE($3, last_request_id), last_error = $2, falhas = 0, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1`, a.id, err.Error(), nullIfEmpty(requestID))
+		rfbSchedulerOutcomes.Inc("schedule_failed")
+	}
+}
+
+// solicitarAgendamento solicits with each of the company's active
+// credentials, skipping those that already got a scheduled request today (a
+// retry after a partial failure). It returns the last request id and the
+// first retryable error, else the first error.
+func solicitarAgendamento(db *sql.DB, a rfbAgendamento) (lastRequestID string, err error) {
+	credenciais, err := services.ListarCredenciaisRFB(db, a.companyID)
+	if err != nil {
+		return "", err
+	}
+	if len(credenciais) == 0 {
+		return "", services.ErrRFBSemCredenciais
+	}
+	var firstErr error
+	for _, credentialID := range credenciais {
+		var feita bool
+		db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM rfb_requests
+			               WHERE credential_id = $1 AND origem = $2 AND status != 'error' AND created_at >= CURRENT_DATE)
+		`, credentialID, services.RFBOrigemAgendada).Scan(&feita)
+		if feita {
+			continue
+		}
+		requestID, _, err := services.SolicitarApuracaoRFB(db, a.companyID, credentialID, services.RFBOrigemAgendada)
+		if err != nil {
+			var solErr *services.RFBSolicitacaoError
+			if firstErr == nil || (errors.As(err, &solErr) && services.RFBErrorRetryable(solErr.Err)) {
+				firstErr = err
+			}
+			continue
+		}
+		fmt.Printf("[RFB Scheduler] Scheduled apuração requested for company %s (request %s)\n", a.companyID, requestID)
+		rfbSchedulerOutcomes.Inc("scheduled")
+		lastRequestID = requestID
+	}
+	return lastRequestID, firstErr
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// claimDueRFBAgendamentos locks the due calendars (SKIP LOCKED) and moves
+// them to their next date, as claimDueSubscriptions does for reports.
+func claimDueRFBAgendamentos(db *sql.DB, now time.Time) ([]rfbAgendamento, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, company_id, frequencia, dia, hora, falhas
+		FROM rfb_agendamentos
+		WHERE ativo AND next_run_at <= $1
+		ORDER BY next_run_at
+		LIMIT 20
+		FOR UPDATE SKIP LOCKED
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	var due []rfbAgendamento
+	for rows.Next() {
+		var a rfbAgendamento
+		if err := rows.Scan(&a.id, &a.companyID, &a.frequencia, &a.dia, &a.hora, &a.falhas); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, a := range due {
+		next := services.NextReportRun(a.frequencia, a.dia, a.hora, now)
+		if _, err := tx.Exec(`
+			UPDATE rfb_agendamentos SET next_run_at = $2, last_run_at = $3
+			WHERE id = $1
+		`, a.id, next, now); err != nil {
+			return nil, err
+		}
+	}
+	return due, tx.Commit()
+}
@@ -0,0 +1,284 @@
+package worker
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"fb_apu01/services"
+)
+
+// scheduledReport is a report built once per company for a scheduler run and
+// sent to each of its subscribers.
+type scheduledReport struct {
+	periodo string
+	err     error
+	send    func(db *sql.DB, to services.ReportRecipient, attachments ...services.Attachment) error
+	// renderPDF builds the PDF edition; it runs at most once, for the first
+	// subscriber with anexar_pdf.
+	renderPDF func() ([]byte, error)
+	filename  string
+	pdf       []byte
+	pdfErr    error
+}
+
+// attachmentsFor returns the PDF edition when the subscriber asked for it. If
+// rendering fails the email still goes out, without the attachment.
+func (r *scheduledReport) attachmentsFor(sub reportSubscriber) []services.Attachment {
+	if !sub.anexarPDF || r.renderPDF == nil {
+		return nil
+	}
+	if r.pdf == nil && r.pdfErr == nil {
+		r.pdf, r.pdfErr = r.renderPDF()
+		if r.pdfErr != nil {
+			fmt.Printf("[Report Scheduler] PDF for %s (company %s) failed, sending without it: %v\n", sub.relatorio, sub.companyID, r.pdfErr)
+		}
+	}
+	if r.pdfErr != nil {
+		return nil
+	}
+	return []services.Attachment{services.PDFAttachment(r.filename, r.pdf)}
+}
+
+// sectionsReport is a scheduledReport made of label/value sections, sent with
+// SendReportEmail and rendered with RenderReportPDF.
+func sectionsReport(relatorio, companyName, periodo string, sections []services.ReportSection, painelPath string) *scheduledReport {
+	titulo := services.ReportNames[relatorio]
+	return &scheduledReport{
+		periodo: periodo,
+		send: func(db *sql.DB, to services.ReportRecipient, attachments ...services.Attachment) error {
+			return services.SendReportEmail(db, to, titulo, companyName, periodo, sections, painelPath, attachments...)
+		},
+		renderPDF: func() ([]byte, error) {
+			return services.RenderReportPDF(titulo, companyName, periodo, sections, nil)
+		},
+		filename: services.ReportPDFFilename(titulo, periodo),
+	}
+}
+
+// buildScheduledReport builds the latest edition of a subscribable report.
+// When the company has nothing to report yet the report's err is errNoReportData.
+func buildScheduledReport(db *sql.DB, companyID, relatorio string) (*scheduledReport, error) {
+	var companyName string
+	db.QueryRow(`SELECT COALESCE(name, '') FROM companies WHERE id = $1`, companyID).Scan(&companyName)
+
+	switch relatorio {
+	case services.ReportResumoExecutivo:
+		return buildExecutiveScheduledReport(db, companyID)
+	case services.ReportCreditosRisco:
+		return buildCreditosRiscoReport(db, companyID, companyName)
+	case services.ReportRFBCBS:
+		return buildRFBCBSReport(db, companyID, companyName)
+	case services.ReportApuracaoPainel:
+		return buildApuracaoPainelReport(db, companyID, companyName)
+	}
+	return nil, fmt.Errorf("relatório desconhecido: %s", relatorio)
+}
+
+// buildExecutiveScheduledReport generates the executive summary for the most
+// recent imported period, same as the post-import send.
+func buildExecutiveScheduledReport(db *sql.DB, companyID string) (*scheduledReport, error) {
+	var periodo string
+	err := db.QueryRow(`
+		SELECT mes_ano FROM mv_mercadorias_agregada
+		WHERE company_id = $1
+		GROUP BY mes_ano
+		ORDER BY TO_DATE(mes_ano, 'MM/YYYY') DESC
+		LIMIT 1
+	`, companyID).Scan(&periodo)
+	if err == sql.ErrNoRows {
+		return &scheduledReport{err: errNoReportData}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query latest period: %w", err)
+	}
+
+	report, err := buildExecutiveReport(db, companyID, periodo, "")
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return &scheduledReport{periodo: periodo, err: errNoReportData}, nil
+	}
+	return report.scheduled(periodo), nil
+}
+
+// buildCreditosRiscoReport summarizes the IBS/CBS credits at risk (same rules
+// as GET /api/apuracao/creditos-perdidos): NF-e and CT-e from third parties
+// without IBS/CBS, and purchases from Simples Nacional suppliers.
+func buildCreditosRiscoReport(db *sql.DB, companyID, companyName string) (*scheduledReport, error) {
+	var ibsRate, cbsRate float64
+	if err := db.QueryRow(`
+		SELECT perc_ibs_uf + perc_ibs_mun, perc_cbs
+		FROM tabela_aliquotas WHERE ano = 2033 LIMIT 1
+	`).Scan(&ibsRate, &cbsRate); err != nil {
+		ibsRate, cbsRate = 17.7, 8.8
+	}
+	rate := (ibsRate + cbsRate) / 100.0
+
+	var nfeQtd, cteQtd int
+	var nfeValor, simplesValor, cteValor float64
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(v_nf), 0)
+		FROM nfe_entradas
+		WHERE company_id = $1 AND v_ibs = 0 AND v_cbs = 0
+		  AND LEFT(forn_cnpj, 8) != LEFT(dest_cnpj_cpf, 8)
+	`, companyID).Scan(&nfeQtd, &nfeValor)
+	if err != nil {
+		return nil, fmt.Errorf("query nfe_entradas: %w", err)
+	}
+	db.QueryRow(`SELECT COALESCE(SUM(total_valor), 0) FROM mv_operacoes_simples WHERE company_id = $1`, companyID).Scan(&simplesValor)
+	db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(v_prest), 0)
+		FROM cte_entradas
+		WHERE company_id = $1 AND COALESCE(v_ibs, 0) = 0 AND COALESCE(v_cbs, 0) = 0
+	`, companyID).Scan(&cteQtd, &cteValor)
+
+	if nfeValor == 0 && simplesValor == 0 && cteValor == 0 {
+		return &scheduledReport{periodo: "Acumulado", err: errNoReportData}, nil
+	}
+
+	sections := []services.ReportSection{{
+		Title: "Créditos IBS/CBS em Risco",
+		Rows: []services.ReportRow{
+			{Label: fmt.Sprintf("NF-e sem IBS/CBS (%d notas)", nfeQtd), Value: "R$ " + fmtBRL(nfeValor*rate)},
+			{Label: "Fornecedores do Simples Nacional", Value: "R$ " + fmtBRL(simplesValor*rate)},
+			{Label: fmt.Sprintf("CT-e sem IBS/CBS (%d conhecimentos)", cteQtd), Value: "R$ " + fmtBRL(cteValor*rate)},
+			{Label: "Total em risco", Value: "R$ " + fmtBRL((nfeValor+simplesValor+cteValor)*rate), Destaque: true},
+		},
+	}}
+
+	// Maiores fornecedores de NF-e sem crédito
+	rows, err := db.Query(`
+		SELECT COALESCE(forn_nome, forn_cnpj), SUM(v_nf)
+		FROM nfe_entradas
+		WHERE company_id = $1 AND v_ibs = 0 AND v_cbs = 0
+		  AND LEFT(forn_cnpj, 8) != LEFT(dest_cnpj_cpf, 8)
+		GROUP BY forn_cnpj, forn_nome
+		ORDER BY SUM(v_nf) DESC
+		LIMIT 5
+	`, companyID)
+	if err == nil {
+		defer rows.Close()
+		top := services.ReportSection{Title: "Maiores fornecedores sem crédito (NF-e)"}
+		for rows.Next() {
+			var nome string
+			var valor float64
+			if rows.Scan(&nome, &valor) == nil {
+				top.Rows = append(top.Rows, services.ReportRow{Label: nome, Value: "R$ " + fmtBRL(valor*rate)})
+			}
+		}
+		if len(top.Rows) > 0 {
+			sections = append(sections, top)
+		}
+	}
+
+	return sectionsReport(services.ReportCreditosRisco, companyName, "Acumulado", sections, "/apuracao/creditos-perdidos"), nil
+}
+
+// buildRFBCBSReport summarizes the latest CBS assessment downloaded from the
+// Receita Federal (rfb_resumo), adding up the current version of each CNPJ base.
+func buildRFBCBSReport(db *sql.DB, companyID, companyName string) (*scheduledReport, error) {
+	var dataApuracao string
+	var totalDebitos, corrente, ajuste, extemporaneo int
+	var total, extinto, naoExtinto float64
+	err := db.QueryRow(`
+		SELECT data_apuracao, SUM(total_debitos), SUM(valor_cbs_total), SUM(valor_cbs_extinto), SUM(valor_cbs_nao_extinto),
+		       SUM(total_corrente), SUM(total_ajuste), SUM(total_extemporaneo)
+		FROM rfb_resumo
+		WHERE company_id = $1 AND data_apuracao IS NOT NULL AND atual
+		GROUP BY data_apuracao
+		ORDER BY data_apuracao DESC
+		LIMIT 1
+	`, companyID).Scan(&dataApuracao, &totalDebitos, &total, &extinto, &naoExtinto, &corrente, &ajuste, &extemporaneo)
+	if err == sql.ErrNoRows {
+		return &scheduledReport{err: errNoReportData}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query rfb_resumo: %w", err)
+	}
+
+	// data_apuracao is YYYYMM
+	periodo := dataApuracao
+	if len(dataApuracao) == 6 {
+		periodo = dataApuracao[4:] + "/" + dataApuracao[:4]
+	}
+
+	sections := []services.ReportSection{
+		{
+			Title: "CBS apurada pela Receita Federal",
+			Rows: []services.ReportRow{
+				{Label: "Débitos de CBS", Value: "R$ " + fmtBRL(total)},
+				{Label: "Extinto (pago/compensado)", Value: "R$ " + fmtBRL(extinto)},
+				{Label: "Saldo não extinto", Value: "R$ " + fmtBRL(naoExtinto), Destaque: true},
+			},
+		},
+		{
+			Title: "Documentos",
+			Rows: []services.ReportRow{
+				{Label: "Corrente", Value: strconv.Itoa(corrente)},
+				{Label: "Ajuste", Value: strconv.Itoa(ajuste)},
+				{Label: "Extemporâneo", Value: strconv.Itoa(extemporaneo)},
+				{Label: "Total de débitos", Value: strconv.Itoa(totalDebitos), Destaque: true},
+			},
+		},
+	}
+
+	return sectionsReport(services.ReportRFBCBS, companyName, periodo, sections, "/rfb/apuracao"), nil
+}
+
+// buildApuracaoPainelReport mirrors GET /api/apuracao/painel for the most
+// recent month with NF-e/CT-e: IBS and CBS debits, credits and balance.
+func buildApuracaoPainelReport(db *sql.DB, companyID, companyName string) (*scheduledReport, error) {
+	var mesAno string
+	err := db.QueryRow(`
+		SELECT mes_ano FROM (
+			SELECT mes_ano FROM nfe_saidas   WHERE company_id = $1
+			UNION
+			SELECT mes_ano FROM nfe_entradas WHERE company_id = $1
+			UNION
+			SELECT mes_ano FROM cte_entradas WHERE company_id = $1
+		) t
+		ORDER BY TO_DATE(mes_ano, 'MM/YYYY') DESC
+		LIMIT 1
+	`, companyID).Scan(&mesAno)
+	if err == sql.ErrNoRows {
+		return &scheduledReport{err: errNoReportData}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query latest month: %w", err)
+	}
+
+	var debIBS, debCBS, credNfeIBS, credNfeCBS, credCteIBS, credCteCBS float64
+	var qtdSaidas, qtdEntradas, qtdCtes int
+	db.QueryRow(`
+		SELECT COALESCE(SUM(v_ibs), 0), COALESCE(SUM(v_cbs), 0), COUNT(*)
+		FROM nfe_saidas WHERE company_id = $1 AND mes_ano = $2
+	`, companyID, mesAno).Scan(&debIBS, &debCBS, &qtdSaidas)
+	db.QueryRow(`
+		SELECT COALESCE(SUM(v_ibs), 0), COALESCE(SUM(v_cbs), 0), COUNT(*)
+		FROM nfe_entradas WHERE company_id = $1 AND mes_ano = $2
+	`, companyID, mesAno).Scan(&credNfeIBS, &credNfeCBS, &qtdEntradas)
+	db.QueryRow(`
+		SELECT COALESCE(SUM(v_ibs), 0), COALESCE(SUM(v_cbs), 0), COUNT(*)
+		FROM cte_entradas WHERE company_id = $1 AND mes_ano = $2
+	`, companyID, mesAno).Scan(&credCteIBS, &credCteCBS, &qtdCtes)
+
+	painel := func(imposto string, debito, credNfe, credCte float64) services.ReportSection {
+		return services.ReportSection{
+			Title: imposto,
+			Rows: []services.ReportRow{
+				{Label: fmt.Sprintf("Débito — NF-e de saída (%d)", qtdSaidas), Value: "R$ " + fmtBRL(debito)},
+				{Label: fmt.Sprintf("Crédito — NF-e de entrada (%d)", qtdEntradas), Value: "- R$ " + fmtBRL(credNfe)},
+				{Label: fmt.Sprintf("Crédito — CT-e (%d)", qtdCtes), Value: "- R$ " + fmtBRL(credCte)},
+				{Label: "Saldo " + imposto, Value: "R$ " + fmtBRL(debito-credNfe-credCte), Destaque: true},
+			},
+		}
+	}
+	sections := []services.ReportSection{
+		painel("IBS", debIBS, credNfeIBS, credCteIBS),
+		painel("CBS", debCBS, credNfeCBS, credCteCBS),
+	}
+
+	return sectionsReport(services.ReportApuracaoPainel, companyName, mesAno, sections, "/rfb/apuracao-ibs"), nil
+}
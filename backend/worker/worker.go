@@ -8,36 +8,25 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"fb_apu01/jobevents"
+
 	"golang.org/x/text/encoding/charmap"
 	"golang.org/x/text/transform"
 )
 
 func StartWorker(db *sql.DB) {
-	// Worker Pool Size: 3 concurrent workers
+	// Pool size defaults to 3 concurrent workers (WORKER_POOL_SIZE overrides).
 	// I/O-bound (DB writes), safe for 2 vCPU since workers spend ~70% waiting on PostgreSQL
-	const WorkerPoolSize = 3
-
-	fmt.Printf("Starting Background Worker Pool (%d workers)...\n", WorkerPoolSize)
+	cfg := LoadQueueConfig()
 
-	// AUTO-MIGRATE: Ensure last_line_processed column exists
-	// Check first to avoid ALTER TABLE lock contention with active transactions
-	var colExists bool
-	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM information_schema.columns WHERE table_name='import_jobs' AND column_name='last_line_processed')`).Scan(&colExists)
-	if err == nil && !colExists {
-		_, err = db.Exec(`ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS last_line_processed INT DEFAULT 0`)
-		if err != nil {
-			fmt.Printf("Worker: Warning adding checkpoint column: %v\n", err)
-		}
-	}
-
-	// STARTUP CLEANUP: Finalize any jobs that were being cancelled
-	db.Exec("UPDATE import_jobs SET status = 'cancelled', message = 'Cancelado (servidor reiniciado)', updated_at = NOW() WHERE status = 'cancelling'")
+	fmt.Printf("Starting Background Worker Pool (%d workers, lease %v)...\n", cfg.PoolSize, cfg.Lease)
 
 	// ORPHAN FILE CLEANUP: Delete any files in uploads/ that have no active job (pending/processing).
 	// This handles files left by: pre-fix versions, DB resets, crashes, or manual admin actions.
@@ -56,10 +45,10 @@ func StartWorker(db *sql.DB) {
 				continue
 			}
 			fname := entry.Name()
-			// Keep file only if there is a pending or processing job for it
+			// Keep file only if there is a job that may still read it (incl. dead-letter, re-queueable)
 			var count int
 			db.QueryRow(
-				"SELECT COUNT(*) FROM import_jobs WHERE filename = $1 AND status IN ('pending', 'processing')",
+				"SELECT COUNT(*) FROM import_jobs WHERE filename = $1 AND status IN ('pending', 'processing', 'cancelling', 'dead')",
 				fname,
 			).Scan(&count)
 			if count == 0 {
@@ -75,85 +64,57 @@ func StartWorker(db *sql.DB) {
 		}
 	}()
 
-	// CRASH RECOVERY: Reset any 'processing' jobs to 'pending' on startup
-	// This ensures that if the server crashed, interrupted jobs are resumed automatically
-	res, err := db.Exec("UPDATE import_jobs SET status = 'pending', message = message || ' [Recovered]' WHERE status = 'processing'")
-	if err == nil {
-		count, _ := res.RowsAffected()
-		if count > 0 {
-			fmt.Printf("Worker Recovery: Reset %d stuck jobs from 'processing' to 'pending'\n", count)
-		}
-	} else {
-		fmt.Printf("Worker Recovery Error: %v\n", err)
-	}
+	// CRASH RECOVERY: jobs whose worker died keep an expired lease; the reaper
+	// returns them to the queue (or dead-letters them). Leases held by other
+	// live instances are left alone, so replicas can restart independently.
+	go reaperLoop(db, cfg)
+
+	registerQueueMetrics(db)
 
-	for i := 0; i < WorkerPoolSize; i++ {
+	hostname, _ := os.Hostname()
+	for i := 0; i < cfg.PoolSize; i++ {
 		workerID := i + 1
-		go workerLoop(db, workerID)
+		name := fmt.Sprintf("%s:%d#%d", hostname, os.Getpid(), workerID)
+		go workerLoop(db, cfg, workerID, name)
 	}
 }
 
 // workerLoop runs the worker loop with auto-restart on panic.
 // If the worker panics or dies, it waits 5 seconds and restarts itself.
-func workerLoop(db *sql.DB, id int) {
+func workerLoop(db *sql.DB, cfg QueueConfig, id int, name string) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Printf("Worker #%d PANIC: %v — restarting in 5s...\n", id, r)
 			time.Sleep(5 * time.Second)
-			go workerLoop(db, id) // Auto-restart
+			go workerLoop(db, cfg, id, name) // Auto-restart
 		}
 	}()
-	fmt.Printf("Worker #%d started\n", id)
+	fmt.Printf("Worker #%d started (%s)\n", id, name)
 	for {
-		processNextJob(db, id)
-		time.Sleep(2 * time.Second)
+		if !processNextJob(db, cfg, id, name) {
+			time.Sleep(cfg.PollInterval)
+		}
 	}
 }
 
-func processNextJob(db *sql.DB, workerID int) {
-	var id, filename string
-
-	// Select pending job with SKIP LOCKED to avoid race conditions
-	// This allows multiple workers to pick different jobs concurrently
-	query := `
-		SELECT id, filename 
-		FROM import_jobs 
-		WHERE status = 'pending' 
-		ORDER BY created_at ASC 
-		LIMIT 1
-		FOR UPDATE SKIP LOCKED
-	`
-
-	// We must use a transaction for FOR UPDATE SKIP LOCKED to hold the lock until update
-	tx, err := db.Begin()
-	if err != nil {
-		fmt.Printf("Worker #%d: Error starting transaction: %v\n", workerID, err)
-		return
-	}
-	defer tx.Rollback() // Rollback if not committed
-
-	err = tx.QueryRow(query).Scan(&id, &filename)
+// processNextJob claims and runs one job. It returns false when the queue had
+// nothing runnable, so the caller can sleep before polling again.
+func processNextJob(db *sql.DB, cfg QueueConfig, workerID int, workerName string) bool {
+	job, err := claimNextJob(db, cfg, workerName)
 	if err == sql.ErrNoRows {
-		return // No jobs
+		return false // No jobs
 	} else if err != nil {
-		fmt.Printf("Worker #%d: Error scanning job: %v\n", workerID, err)
-		return
-	}
-
-	fmt.Printf("Worker #%d: Processing Job %s (File: %s)\n", workerID, id, filename)
-
-	// Update status to processing within the same transaction
-	_, err = tx.Exec("UPDATE import_jobs SET status = 'processing', updated_at = NOW() WHERE id = $1", id)
-	if err != nil {
-		fmt.Printf("Worker #%d: Error updating status to processing: %v\n", workerID, err)
-		return
+		fmt.Printf("Worker #%d: Error claiming job: %v\n", workerID, err)
+		return false
 	}
+	defer job.release()
+	id, filename := job.ID, job.Filename
 
-	// Commit the transaction to release the lock and save the status change
-	if err := tx.Commit(); err != nil {
-		fmt.Printf("Worker #%d: Error committing job pickup: %v\n", workerID, err)
-		return
-	}
+	fmt.Printf("Worker #%d: Processing Job %s (File: %s, attempt %d/%d)\n", workerID, id, filename, job.Attempts, job.MaxAttempts)
+	jobevents.Publish(db, id, jobevents.Event{
+		Type: jobevents.TypePhase, Phase: jobevents.PhaseParsing, Status: "processing",
+		Message: fmt.Sprintf("Tentativa %d/%d", job.Attempts, job.MaxAttempts),
+	})
 
 	// Simulate Processing
 	if err := db.Ping(); err != nil {
@@ -161,11 +122,11 @@ func processNextJob(db *sql.DB, workerID int) {
 		time.Sleep(1 * time.Second)
 		if err := db.Ping(); err != nil {
 			fmt.Printf("Worker #%d: Database unreachable: %v\n", workerID, err)
-			return // Retry next loop
+			return false // Lease expires and the reaper re-queues the job
 		}
 	}
 
-	summary, err := processFile(db, id, filename)
+	summary, err := processFile(db, id, filename, job.lease)
 
 	// Helper: delete file from storage (best-effort, always executed)
 	deleteUploadFile := func() {
@@ -178,20 +139,30 @@ func processNextJob(db *sql.DB, workerID int) {
 	}
 
 	if err != nil {
+		if errors.Is(err, errLeaseLost) {
+			// Another instance owns the job now — leave its row and file alone
+			fmt.Printf("Worker #%d: Job %s abandoned (lease lost)\n", workerID, id)
+			jobOutcomes.Inc("lease_lost")
+			return true
+		}
 		// Check if it was a cancellation
 		if strings.Contains(err.Error(), "cancelled by user") {
 			fmt.Printf("Worker #%d: Job %s cancelled by user\n", workerID, id)
-			db.Exec("UPDATE import_jobs SET status = 'cancelled', message = 'Cancelado pelo usuário', updated_at = NOW() WHERE id = $1", id)
-		} else {
-			fmt.Printf("Worker #%d: Job %s failed: %v\n", workerID, id, err)
-			db.Exec("UPDATE import_jobs SET status = 'error', message = $1, updated_at = NOW() WHERE id = $2", err.Error(), id)
+			cancelJob(db, id, "Cancelado pelo usuário")
+			jobOutcomes.Inc("cancelled")
+			deleteUploadFile()
+			return true
+		}
+		fmt.Printf("Worker #%d: Job %s failed (attempt %d/%d): %v\n", workerID, id, job.Attempts, job.MaxAttempts, err)
+		// Segurança: deletar arquivo quando não há como reprocessá-lo
+		if dropFile := failJob(db, cfg, job, err); dropFile {
+			deleteUploadFile()
 		}
-		// Segurança: deletar arquivo mesmo em caso de falha/cancelamento
-		deleteUploadFile()
 	} else {
 		// Report Success
 		fmt.Printf("Worker #%d: Job %s completed: %s\n", workerID, id, summary)
-		db.Exec("UPDATE import_jobs SET status = 'completed', message = $1, updated_at = NOW() WHERE id = $2", summary, id)
+		completeJob(db, id, summary)
+		jobOutcomes.Inc("completed")
 
 		// DELETE FILE FROM STORAGE (Cleanup)
 		deleteUploadFile()
@@ -203,12 +174,14 @@ func processNextJob(db *sql.DB, workerID int) {
 		
 		var pendingCount int
 		// Check for any jobs that are 'pending' or 'processing' (excluding current which is already 'completed')
-		err := db.QueryRow("SELECT COUNT(*) FROM import_jobs WHERE status IN ('pending', 'processing')").Scan(&pendingCount)
+		// (retries waiting for their backoff don't count — they may be hours away)
+		err := db.QueryRow("SELECT COUNT(*) FROM import_jobs WHERE status = 'processing' OR (status = 'pending' AND run_after <= NOW())").Scan(&pendingCount)
 		
 		if err == nil && pendingCount > 0 {
 			fmt.Printf("Worker #%d: Skipping view refresh (Queue has %d jobs pending/processing)...\n", workerID, pendingCount)
 		} else {
 			fmt.Printf("Worker #%d: Queue empty (Last Job). Refreshing Materialized Views...\n", workerID)
+			jobevents.Publish(db, id, jobevents.Event{Type: jobevents.TypePhase, Phase: jobevents.PhaseViewRefresh})
 
 			// Use CONCURRENTLY to avoid locking reads
 			// We can run this in background OR blocking.
@@ -259,6 +232,7 @@ func processNextJob(db *sql.DB, workerID int) {
 			err = db.QueryRow("SELECT company_id, mes_ano FROM import_jobs WHERE id = $1", id).Scan(&companyID, &mesAno)
 			if err == nil && companyID != "" && mesAno != "" {
 				fmt.Printf("Worker #%d: Triggering AI report generation for company %s, period %s\n", workerID, companyID, mesAno)
+				jobevents.Publish(db, id, jobevents.Event{Type: jobevents.TypePhase, Phase: jobevents.PhaseAIReport})
 				if err := TriggerAIReportGeneration(db, companyID, mesAno, id); err != nil {
 					fmt.Printf("Worker #%d: AI report generation warning: %v\n", workerID, err)
 				}
@@ -266,7 +240,11 @@ func processNextJob(db *sql.DB, workerID int) {
 				fmt.Printf("Worker #%d: Could not get job metadata for AI report: %v\n", workerID, err)
 			}
 		}
+
+		// Completion goes out after the view refresh so clients reload fresh data
+		jobevents.Publish(db, id, jobevents.Event{Type: jobevents.TypeCompleted, Status: "completed", Message: summary, Progress: 100})
 	}
+	return true
 }
 
 // validateFileIntegrity checks if the file has a valid SPED header and footer
@@ -356,7 +334,7 @@ func parseDecimal(s string) float64 {
 	return f
 }
 
-func processFile(db *sql.DB, jobID, filename string) (string, error) {
+func processFile(db *sql.DB, jobID, filename string, l *lease) (string, error) {
 	// Verify DB connection before starting
 	if err := db.Ping(); err != nil {
 		return "", fmt.Errorf("database connection lost before start: %v", err)
@@ -371,6 +349,10 @@ func processFile(db *sql.DB, jobID, filename string) (string, error) {
 		lastLineProcessed = 0
 	}
 
+	// Throughput metrics only count lines parsed in this run (not the resumed prefix)
+	parseStart := time.Now()
+	linesCounted := lastLineProcessed
+
 	// Security: Ensure we only read from allowed directory
 	uploadDir := "uploads"
 	path := filepath.Join(uploadDir, filename)
@@ -378,14 +360,13 @@ func processFile(db *sql.DB, jobID, filename string) (string, error) {
 	// 1. PRE-VALIDATION: Check if file is truncated (must end with |9999|)
 	if err := validateFileIntegrity(path); err != nil {
 		fmt.Printf("Worker: File integrity check failed: %v\n", err)
-		db.Exec("UPDATE import_jobs SET status='error', message=$1, updated_at=NOW() WHERE id=$2", "File Corrupted/Truncated: "+err.Error(), jobID)
-		return "File Integrity Failed", err
+		return "File Integrity Failed", permanent(fmt.Errorf("File Corrupted/Truncated: %v", err))
 	}
 
 	// Open file
 	file, err := os.Open(path)
 	if err != nil {
-		return "", fmt.Errorf("file not found: %v", err)
+		return "", permanent(fmt.Errorf("file not found: %v", err))
 	}
 	defer file.Close()
 
@@ -633,6 +614,11 @@ func processFile(db *sql.DB, jobID, filename string) (string, error) {
 		}
 
 		if lineCount%BatchSize == 0 {
+			if l.Lost() {
+				tx.Rollback()
+				return "", errLeaseLost
+			}
+
 			// Check for cancellation
 			var currentStatus string
 			if err := db.QueryRow("SELECT status FROM import_jobs WHERE id=$1", jobID).Scan(&currentStatus); err == nil {
@@ -653,12 +639,20 @@ func processFile(db *sql.DB, jobID, filename string) (string, error) {
 			}
 			fmt.Printf("Worker: %s\n", msg)
 			db.Exec("UPDATE import_jobs SET message=$1, updated_at=NOW() WHERE id=$2", msg, jobID)
+			ev := jobevents.Event{Type: jobevents.TypeProgress, Phase: jobevents.PhaseParsing, Message: msg, Line: lineCount}
+			if totalLines > 0 {
+				ev.Progress = math.Min(float64(lineCount)/float64(totalLines)*100, 99)
+			}
+			jobevents.Publish(db, jobID, ev)
 
 			// COMMIT BATCH AND RESTART
 			if err := commitBatch(); err != nil {
 				return "", fmt.Errorf("batch commit failed at line %d: %v", lineCount, err)
 			}
 
+			linesProcessed.Add(float64(lineCount - linesCounted))
+			linesCounted = lineCount
+
 			// Update Checkpoint in DB
 			_, err = db.Exec("UPDATE import_jobs SET last_line_processed = $1, updated_at = NOW() WHERE id = $2", lineCount, jobID)
 			if err != nil {
@@ -882,10 +876,15 @@ func processFile(db *sql.DB, jobID, filename string) (string, error) {
 	if err := commitBatch(); err != nil {
 		return "", fmt.Errorf("final batch commit failed: %v", err)
 	}
+	linesProcessed.Add(float64(lineCount - linesCounted))
+	if elapsed := time.Since(parseStart).Seconds(); elapsed > 0 {
+		linesPerSecond.Observe(float64(lineCount-lastLineProcessed) / elapsed)
+	}
 
 	// Run Aggregations (New Transaction)
 	fmt.Println("Worker: Running aggregations (Database intensive)...")
 	db.Exec("UPDATE import_jobs SET message='Running Aggregations (Database intensive)...' WHERE id=$1", jobID)
+	jobevents.Publish(db, jobID, jobevents.Event{Type: jobevents.TypePhase, Phase: jobevents.PhaseAggregations, Line: lineCount})
 
 	// Aggregation Transaction
 	aggTx, err := db.Begin()
@@ -909,6 +908,8 @@ func processFile(db *sql.DB, jobID, filename string) (string, error) {
 	db.QueryRow("SELECT COUNT(*) FROM reg_d100 WHERE job_id=$1", jobID).Scan(&dbCountD100)
 	db.QueryRow("SELECT COUNT(*) FROM reg_d500 WHERE job_id=$1", jobID).Scan(&dbCountD500)
 
+	jobDuration.Observe(time.Since(parseStart).Seconds(), sizeClass(lineCount))
+
 	return fmt.Sprintf("Imported: 0000=%d, 0150=%d, C100=%d(DB:%d), C190=%d, C500=%d(DB:%d), C600=%d, D100=%d(DB:%d), D500=%d(DB:%d)%s",
 		count0000, count0150, countC100, dbCountC100, countC190, countC500, dbCountC500, countC600, countD100, dbCountD100, countD500, dbCountD500, debugLog.String()), nil
 }